@@ -0,0 +1,138 @@
+// Package anonymize hides the IP and MAC addresses of flows before they are exported
+package anonymize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/flow"
+	lru "github.com/hashicorp/golang-lru"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const (
+	ModeCryptoPAn = "cryptopan"
+	ModeTruncate  = "truncate"
+	MACKeep       = "keep"
+	MACZero       = "zero"
+	MACHash       = "hash"
+)
+
+// Options selects how addresses are anonymized
+type Options struct {
+	Mode             string       // cryptopan or truncate
+	Key              []byte       // Crypto-PAn and MAC hashing key
+	IPv4PrefixLength int          // Bits kept by truncation
+	IPv6PrefixLength int          // Bits kept by truncation
+	Scope            []*net.IPNet // Only anonymize addresses in these networks, every address when empty
+	MAC              string       // keep, zero or hash
+	CacheSize        int          // Anonymized addresses kept in memory with Crypto-PAn
+}
+
+// Anonymizer replaces the addresses of the flows it enriches
+type Anonymizer struct {
+	options   Options
+	cryptoPAn *cryptoPAn
+	cache     *lru.Cache
+}
+
+func NewAnonymizer(options Options) (*Anonymizer, error) {
+	a := &Anonymizer{options: options}
+	switch options.Mode {
+	case ModeCryptoPAn:
+		var err error
+		if a.cryptoPAn, err = newCryptoPAn(options.Key); err != nil {
+			return nil, err
+		}
+		if a.cache, err = lru.New(options.CacheSize); err != nil {
+			return nil, err
+		}
+	case ModeTruncate:
+		if options.IPv4PrefixLength < 0 || options.IPv4PrefixLength > 8*net.IPv4len ||
+			options.IPv6PrefixLength < 0 || options.IPv6PrefixLength > 8*net.IPv6len {
+			return nil, fmt.Errorf("invalid truncation prefix length")
+		}
+	default:
+		return nil, fmt.Errorf("unknown anonymization mode %s", options.Mode)
+	}
+	switch options.MAC {
+	case MACKeep, MACZero:
+	case MACHash:
+		if len(options.Key) == 0 {
+			return nil, fmt.Errorf("MAC address hashing requires a key")
+		}
+	default:
+		return nil, fmt.Errorf("unknown MAC address anonymization %s", options.MAC)
+	}
+	return a, nil
+}
+
+// ReadKey reads a key file holding the key in hexadecimal or raw bytes
+func ReadKey(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(content))); err == nil {
+		return key, nil
+	}
+	return content, nil
+}
+
+func (a *Anonymizer) inScope(ip net.IP) bool {
+	if len(a.options.Scope) == 0 {
+		return true
+	}
+	for _, network := range a.options.Scope {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address returns the anonymized address, or ip itself when it is out of scope
+func (a *Anonymizer) Address(ip net.IP) net.IP {
+	if ip == nil || !a.inScope(ip) {
+		return ip
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if a.options.Mode == ModeTruncate {
+		length := a.options.IPv6PrefixLength
+		if len(ip) == net.IPv4len {
+			length = a.options.IPv4PrefixLength
+		}
+		return ip.Mask(net.CIDRMask(length, 8*len(ip)))
+	}
+	if cached, found := a.cache.Get(string(ip)); found {
+		return cached.(net.IP)
+	}
+	anonymized := net.IP(a.cryptoPAn.anonymize(ip))
+	a.cache.Add(string(ip), anonymized)
+	return anonymized
+}
+
+// HardwareAddress returns the zeroed or hashed MAC address
+func (a *Anonymizer) HardwareAddress(mac net.HardwareAddr) net.HardwareAddr {
+	switch a.options.MAC {
+	case MACKeep:
+		return mac
+	case MACHash:
+		hash := hmac.New(sha256.New, a.options.Key)
+		_, _ = hash.Write(mac)
+		hashed := net.HardwareAddr(hash.Sum(nil)[:len(mac)])
+		// Locally administered unicast address
+		hashed[0] = hashed[0]&0xfc | 0x02
+		return hashed
+	}
+	return make(net.HardwareAddr, len(mac))
+}
+
+func (a *Anonymizer) Enrich(f *flow.Flow) {
+	f.Anonymize(a.Address, a.HardwareAddress)
+}
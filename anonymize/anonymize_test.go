@@ -0,0 +1,103 @@
+package anonymize
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	a, err := NewAnonymizer(Options{Mode: ModeTruncate, IPv4PrefixLength: 24, IPv6PrefixLength: 48, MAC: MACZero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		address   string
+		truncated string
+	}{
+		{"192.0.2.123", "192.0.2.0"},
+		{"::ffff:198.51.100.7", "198.51.100.0"},
+		{"2001:db8:1234:5678:9abc::1", "2001:db8:1234::"},
+		{"2001:db8:ffff:ffff::", "2001:db8:ffff::"},
+	} {
+		if truncated := a.Address(net.ParseIP(c.address)); truncated.String() != c.truncated {
+			t.Errorf("%s truncated to %s, expected %s", c.address, truncated, c.truncated)
+		}
+	}
+	if a.Address(nil) != nil {
+		t.Error("missing address anonymized")
+	}
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	if zeroed := a.HardwareAddress(mac); !bytes.Equal(zeroed, make([]byte, 6)) {
+		t.Errorf("MAC address zeroed to %s", zeroed)
+	}
+}
+
+func TestCryptoPAnAnonymizer(t *testing.T) {
+	_, scope, _ := net.ParseCIDR("192.0.2.0/24")
+	a, err := NewAnonymizer(Options{Mode: ModeCryptoPAn, Key: referenceKey, Scope: []*net.IPNet{scope}, MAC: MACHash, CacheSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside, outside := net.ParseIP("192.0.2.10"), net.ParseIP("198.51.100.10")
+	anonymized := a.Address(inside)
+	if anonymized.Equal(inside) || len(anonymized) != net.IPv4len {
+		t.Errorf("%s anonymized to %s", inside, anonymized)
+	}
+	if cached := a.Address(inside); !cached.Equal(anonymized) {
+		t.Errorf("%s anonymized to %s then %s", inside, anonymized, cached)
+	}
+	if !a.Address(outside).Equal(outside) {
+		t.Errorf("%s outside of the scope anonymized", outside)
+	}
+	mac := net.HardwareAddr{0x00, 0x1b, 0x21, 0, 0, 1}
+	hashed := a.HardwareAddress(mac)
+	if len(hashed) != len(mac) || bytes.Equal(hashed, mac) || hashed[0]&0x03 != 0x02 {
+		t.Errorf("MAC address hashed to %s, expected a locally administered unicast address", hashed)
+	}
+	if again := a.HardwareAddress(mac); !bytes.Equal(again, hashed) {
+		t.Errorf("MAC address hashed to %s then %s", hashed, again)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		options Options
+	}{
+		{"unknown mode", Options{Mode: "hide", MAC: MACKeep}},
+		{"short Crypto-PAn key", Options{Mode: ModeCryptoPAn, Key: referenceKey[:16], CacheSize: 16, MAC: MACKeep}},
+		{"IPv4 prefix length", Options{Mode: ModeTruncate, IPv4PrefixLength: 33, MAC: MACKeep}},
+		{"IPv6 prefix length", Options{Mode: ModeTruncate, IPv6PrefixLength: 129, MAC: MACKeep}},
+		{"unknown MAC mode", Options{Mode: ModeTruncate, MAC: "drop"}},
+		{"MAC hash without key", Options{Mode: ModeTruncate, MAC: MACHash}},
+	} {
+		if _, err := NewAnonymizer(c.options); err == nil {
+			t.Errorf("%s accepted", c.name)
+		}
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	file, err := ioutil.TempFile("", "ripflow-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(file.Name()) })
+	_ = file.Close()
+	for _, content := range [][]byte{[]byte(hex.EncodeToString(referenceKey) + "\n"), referenceKey} {
+		if err := ioutil.WriteFile(file.Name(), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := ReadKey(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, referenceKey) {
+			t.Errorf("key read as %x from %q", key, content)
+		}
+	}
+}
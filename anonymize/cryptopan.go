@@ -0,0 +1,51 @@
+package anonymize
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// KeySize is the size of a Crypto-PAn key: an AES-128 key followed by the secret used as padding
+const KeySize = 32
+
+// cryptoPAn is the prefix-preserving anonymization of Xu, Fan, Ammar and Moon:
+// addresses sharing a prefix of n bits are anonymized to addresses sharing a prefix of n bits.
+type cryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+func newCryptoPAn(key []byte) (*cryptoPAn, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Crypto-PAn key must be %d bytes long", KeySize)
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	c := &cryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+// anonymize works on IPv4 and IPv6 addresses, each bit is flipped by a function of the bits before it
+func (c *cryptoPAn) anonymize(address []byte) []byte {
+	var input, output [aes.BlockSize]byte
+	flips := make([]byte, len(address))
+	for position := 0; position < len(address)*8; position++ {
+		copy(input[:], c.pad[:])
+		full := position / 8
+		copy(input[:full], address[:full])
+		if partial := uint(position % 8); partial > 0 {
+			mask := byte(0xff << (8 - partial))
+			input[full] = address[full]&mask | c.pad[full]&^mask
+		}
+		c.block.Encrypt(output[:], input[:])
+		flips[full] |= (output[0] >> 7) << (7 - uint(position%8))
+	}
+	for i := range flips {
+		flips[i] ^= address[i]
+	}
+	return flips
+}
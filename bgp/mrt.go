@@ -0,0 +1,161 @@
+package bgp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// https://tools.ietf.org/html/rfc6396
+const (
+	mrtHeaderSize              = 12
+	mrtTypeTableDumpV2         = 13
+	mrtRIBIPv4Unicast          = 2
+	mrtRIBIPv6Unicast          = 4
+	mrtRIBIPv4UnicastAddPath   = 8
+	mrtRIBIPv6UnicastAddPath   = 10
+	bgpAttributeExtendedLength = 0x10
+	bgpAttributeASPath         = 2
+	bgpASSet                   = 1
+	bgpASSequence              = 2
+)
+
+var errTruncated = errors.New("truncated MRT record")
+
+// readMRT adds the origin AS of every prefix of a TABLE_DUMP_V2 RIB dump
+func readMRT(r io.Reader, add func(prefix *net.IPNet, as uint32)) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, mrtHeaderSize)
+	var message []byte
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		recordType := binary.BigEndian.Uint16(header[4:])
+		subtype := binary.BigEndian.Uint16(header[6:])
+		length := int(binary.BigEndian.Uint32(header[8:]))
+		if cap(message) < length {
+			message = make([]byte, length)
+		}
+		message = message[:length]
+		if _, err := io.ReadFull(reader, message); err != nil {
+			return err
+		}
+		if recordType != mrtTypeTableDumpV2 {
+			continue
+		}
+		var err error
+		switch subtype {
+		case mrtRIBIPv4Unicast:
+			err = readRIBEntries(message, net.IPv4len, false, add)
+		case mrtRIBIPv6Unicast:
+			err = readRIBEntries(message, net.IPv6len, false, add)
+		case mrtRIBIPv4UnicastAddPath:
+			err = readRIBEntries(message, net.IPv4len, true, add)
+		case mrtRIBIPv6UnicastAddPath:
+			err = readRIBEntries(message, net.IPv6len, true, add)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readRIBEntries reads the prefix of a RIB record and the origin AS of its first entry
+func readRIBEntries(message []byte, addressLength int, addPath bool, add func(prefix *net.IPNet, as uint32)) error {
+	if len(message) < 5 {
+		return errTruncated
+	}
+	prefixLength := int(message[4])
+	if prefixLength > addressLength*8 {
+		return fmt.Errorf("invalid prefix length %d", prefixLength)
+	}
+	prefixBytes := (prefixLength + 7) / 8
+	offset := 5 + prefixBytes
+	if len(message) < offset+2 {
+		return errTruncated
+	}
+	ip := make(net.IP, addressLength)
+	copy(ip, message[5:offset])
+	prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLength, addressLength*8)}
+	entries := int(binary.BigEndian.Uint16(message[offset:]))
+	offset += 2
+	for i := 0; i < entries; i++ {
+		// Peer index and originated time
+		offset += 6
+		if addPath {
+			offset += 4
+		}
+		if len(message) < offset+2 {
+			return errTruncated
+		}
+		attributesLength := int(binary.BigEndian.Uint16(message[offset:]))
+		offset += 2
+		if len(message) < offset+attributesLength {
+			return errTruncated
+		}
+		if as, found := originAS(message[offset : offset+attributesLength]); found {
+			add(prefix, as)
+			return nil
+		}
+		offset += attributesLength
+	}
+	return nil
+}
+
+// originAS returns the last AS of the AS_PATH attribute, AS numbers are 4 bytes long in TABLE_DUMP_V2
+func originAS(attributes []byte) (uint32, bool) {
+	for offset := 0; offset+3 <= len(attributes); {
+		flags := attributes[offset]
+		attributeType := attributes[offset+1]
+		var length int
+		if flags&bgpAttributeExtendedLength != 0 {
+			if offset+4 > len(attributes) {
+				return 0, false
+			}
+			length = int(binary.BigEndian.Uint16(attributes[offset+2:]))
+			offset += 4
+		} else {
+			length = int(attributes[offset+2])
+			offset += 3
+		}
+		if offset+length > len(attributes) {
+			return 0, false
+		}
+		if attributeType == bgpAttributeASPath {
+			return lastAS(attributes[offset : offset+length])
+		}
+		offset += length
+	}
+	return 0, false
+}
+
+func lastAS(path []byte) (uint32, bool) {
+	var origin uint32
+	found := false
+	for offset := 0; offset+2 <= len(path); {
+		segmentType := path[offset]
+		count := int(path[offset+1])
+		offset += 2
+		if offset+4*count > len(path) || count == 0 {
+			return origin, found
+		}
+		switch segmentType {
+		case bgpASSequence:
+			origin = binary.BigEndian.Uint32(path[offset+4*(count-1):])
+			found = true
+		case bgpASSet:
+			// An aggregate has several origins, keep the first one
+			origin = binary.BigEndian.Uint32(path[offset:])
+			found = true
+		}
+		offset += 4 * count
+	}
+	return origin, found
+}
@@ -0,0 +1,227 @@
+package bgp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	bgpAttributeOrigin     = 1
+	bgpAttributeNextHop    = 3
+	bgpAttributeTransitive = 0x40
+)
+
+// attribute encodes a BGP path attribute, with a 2 bytes length when extended
+func attribute(attributeType byte, extended bool, value []byte) []byte {
+	if extended {
+		header := []byte{bgpAttributeTransitive | bgpAttributeExtendedLength, attributeType, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+		return append(header, value...)
+	}
+	return append([]byte{bgpAttributeTransitive, attributeType, byte(len(value))}, value...)
+}
+
+// asPath encodes an AS_PATH segment of 4 bytes AS numbers
+func asPath(segmentType byte, path ...uint32) []byte {
+	segment := []byte{segmentType, byte(len(path))}
+	for _, as := range path {
+		segment = appendUint32(segment, as)
+	}
+	return segment
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], value)
+	return append(buf, b[:]...)
+}
+
+// ribRecord encodes a TABLE_DUMP_V2 RIB record holding one entry per attribute set
+func ribRecord(subtype uint16, prefix string, addPath bool, entries ...[]byte) []byte {
+	_, network, _ := net.ParseCIDR(prefix)
+	length, bits := network.Mask.Size()
+	ip := network.IP.To16()
+	if bits == 32 {
+		ip = network.IP.To4()
+	}
+	message := []byte{0, 0, 0, 1, byte(length)}
+	message = append(message, ip[:(length+7)/8]...)
+	message = append(message, byte(len(entries)>>8), byte(len(entries)))
+	for i, attributes := range entries {
+		message = append(message, 0, byte(i), 0x60, 0, 0, 0)
+		if addPath {
+			message = appendUint32(message, uint32(i+1))
+		}
+		message = append(message, byte(len(attributes)>>8), byte(len(attributes)))
+		message = append(message, attributes...)
+	}
+	return mrtRecord(mrtTypeTableDumpV2, subtype, message)
+}
+
+func mrtRecord(recordType uint16, subtype uint16, message []byte) []byte {
+	header := make([]byte, mrtHeaderSize)
+	binary.BigEndian.PutUint32(header, 1622548800)
+	binary.BigEndian.PutUint16(header[4:], recordType)
+	binary.BigEndian.PutUint16(header[6:], subtype)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(message)))
+	return append(header, message...)
+}
+
+// testDump is a RIB dump covering both address families, ADD-PATH, AS_SET and extended length attributes
+func testDump() []byte {
+	origin := attribute(bgpAttributeOrigin, false, []byte{0})
+	nextHop := attribute(bgpAttributeNextHop, false, []byte{192, 0, 2, 254})
+	var dump []byte
+	// PEER_INDEX_TABLE and a BGP4MP record are skipped
+	dump = append(dump, mrtRecord(mrtTypeTableDumpV2, 1, []byte{192, 0, 2, 1, 0, 0, 0, 0})...)
+	dump = append(dump, mrtRecord(16, 4, []byte{1, 2, 3})...)
+	dump = append(dump, ribRecord(mrtRIBIPv4Unicast, "192.0.2.0/24", false,
+		append(append(origin, attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 64500, 64501, 64502))...), nextHop...))...)
+	dump = append(dump, ribRecord(mrtRIBIPv4Unicast, "198.51.100.128/25", false,
+		append(origin, attribute(bgpAttributeASPath, true, asPath(bgpASSequence, 64510, 4200000000))...))...)
+	// The first entry lacks an AS_PATH
+	dump = append(dump, ribRecord(mrtRIBIPv6Unicast, "2001:db8::/32", false,
+		origin, attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 64520, 64521)))...)
+	// An aggregate ends with an AS_SET
+	dump = append(dump, ribRecord(mrtRIBIPv6Unicast, "2001:db8:1::/48", false,
+		attribute(bgpAttributeASPath, false, append(asPath(bgpASSequence, 64530), asPath(bgpASSet, 64531, 64532)...)))...)
+	dump = append(dump, ribRecord(mrtRIBIPv4UnicastAddPath, "203.0.113.0/24", true,
+		attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 64540)))...)
+	dump = append(dump, ribRecord(mrtRIBIPv6UnicastAddPath, "2001:db8:2::/48", true,
+		attribute(bgpAttributeASPath, true, asPath(bgpASSequence, 64550, 64551)))...)
+	// Default route, without any prefix byte
+	dump = append(dump, ribRecord(mrtRIBIPv4Unicast, "0.0.0.0/0", false,
+		attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 64560)))...)
+	return dump
+}
+
+var testDumpOrigins = map[string]uint32{
+	"192.0.2.0/24":      64502,
+	"198.51.100.128/25": 4200000000,
+	"2001:db8::/32":     64521,
+	"2001:db8:1::/48":   64531,
+	"203.0.113.0/24":    64540,
+	"2001:db8:2::/48":   64551,
+	"0.0.0.0/0":         64560,
+}
+
+func TestReadMRT(t *testing.T) {
+	origins := make(map[string]uint32)
+	err := readMRT(bytes.NewReader(testDump()), func(prefix *net.IPNet, as uint32) {
+		origins[prefix.String()] = as
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(origins) != len(testDumpOrigins) {
+		t.Errorf("%d prefixes read, expected %d: %v", len(origins), len(testDumpOrigins), origins)
+	}
+	for prefix, expected := range testDumpOrigins {
+		if as, found := origins[prefix]; !found || as != expected {
+			t.Errorf("%s originated by %d, expected %d", prefix, as, expected)
+		}
+	}
+}
+
+func TestReadTruncatedMRT(t *testing.T) {
+	path := attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 64500))
+	record := ribRecord(mrtRIBIPv4Unicast, "192.0.2.0/24", false, path)
+	// The MRT length covers the truncated message
+	for _, size := range []int{mrtHeaderSize + 3, mrtHeaderSize + 10, len(record) - 2} {
+		truncated := append([]byte(nil), record[:size]...)
+		binary.BigEndian.PutUint32(truncated[8:], uint32(size-mrtHeaderSize))
+		if err := readMRT(bytes.NewReader(truncated), func(*net.IPNet, uint32) {}); err == nil {
+			t.Errorf("RIB record truncated to %d bytes accepted", size)
+		}
+	}
+	if err := readMRT(bytes.NewReader(record[:len(record)-1]), func(*net.IPNet, uint32) {}); err == nil {
+		t.Error("file truncated in a record accepted")
+	}
+	invalid := ribRecord(mrtRIBIPv4Unicast, "192.0.2.0/24", false, path)
+	invalid[mrtHeaderSize+4] = 33
+	if err := readMRT(bytes.NewReader(invalid), func(*net.IPNet, uint32) {}); err == nil {
+		t.Error("prefix length 33 accepted")
+	}
+}
+
+func TestOriginAS(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		attributes []byte
+		as         uint32
+		found      bool
+	}{
+		{"sequence", attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 1, 2, 3)), 3, true},
+		{"extended length", attribute(bgpAttributeASPath, true, asPath(bgpASSequence, 1, 2)), 2, true},
+		{"set", attribute(bgpAttributeASPath, false, asPath(bgpASSet, 7, 8)), 7, true},
+		{"sequences", attribute(bgpAttributeASPath, false, append(asPath(bgpASSequence, 1), asPath(bgpASSequence, 2, 5)...)), 5, true},
+		{"empty path", attribute(bgpAttributeASPath, false, nil), 0, false},
+		{"no path", attribute(bgpAttributeOrigin, false, []byte{0}), 0, false},
+		{"truncated attribute", attribute(bgpAttributeASPath, false, asPath(bgpASSequence, 1))[:5], 0, false},
+		{"truncated extended length", []byte{bgpAttributeExtendedLength, bgpAttributeASPath, 0}, 0, false},
+		{"truncated segment", attribute(bgpAttributeASPath, false, []byte{bgpASSequence, 2, 0, 0, 0, 1}), 0, false},
+	} {
+		as, found := originAS(c.attributes)
+		if as != c.as || found != c.found {
+			t.Errorf("%s: origin %d (%t), expected %d (%t)", c.name, as, found, c.as, c.found)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ripflow-bgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write(testDump())
+	_ = writer.Close()
+	mrtPath := filepath.Join(dir, "rib.mrt.gz")
+	textPath := filepath.Join(dir, "prefixes.txt")
+	if err := ioutil.WriteFile(mrtPath, compressed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	text := "# prefix AS\n192.0.2.0/24 64502\n\n2001:db8:1::/48 AS64531\n"
+	if err := ioutil.WriteFile(textPath, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewEntry(log.New())
+	logger.Logger.SetOutput(ioutil.Discard)
+	for path, format := range map[string]string{mrtPath: FormatMRT, textPath: FormatText} {
+		table, err := NewTable(path, format, 0, logger)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		for address, expected := range map[string]uint32{"192.0.2.10": 64502, "2001:db8:1::1": 64531} {
+			if as, length, found := table.Lookup(net.ParseIP(address)); !found || as != expected || (length != 24 && length != 48) {
+				t.Errorf("%s: %s originated by %d/%d (%t), expected %d", format, address, as, length, found, expected)
+			}
+		}
+	}
+	table, _ := NewTable(mrtPath, FormatMRT, 0, logger)
+	if as, length, found := table.Lookup(net.ParseIP("::ffff:198.51.100.200")); !found || as != 4200000000 || length != 25 {
+		t.Errorf("IPv4-mapped address originated by %d/%d (%t)", as, length, found)
+	}
+	if _, _, found := table.Lookup(net.ParseIP("2001:db9::1")); found {
+		t.Error("address outside the dump found")
+	}
+	if _, err := NewTable(textPath, "json", 0, logger); err == nil {
+		t.Error("unknown format accepted")
+	}
+	if err := ioutil.WriteFile(textPath, []byte("192.0.2.0/24 ASX\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTable(textPath, FormatText, 0, logger); err == nil {
+		t.Error("invalid AS number accepted")
+	}
+}
@@ -0,0 +1,169 @@
+// Package bgp enriches flows with the origin AS numbers of their addresses
+package bgp
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/lpm"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatMRT  = "mrt"
+	FormatText = "text"
+)
+
+// Table maps prefixes to their origin AS, loaded from an MRT RIB dump or a text file
+type Table struct {
+	path           string
+	format         string
+	reloadInterval time.Duration
+	trie           *lpm.Trie
+	modified       time.Time
+	killSwitch     chan int
+	lock           sync.RWMutex
+	log            *log.Entry
+}
+
+func NewTable(path string, format string, reloadInterval time.Duration, logger *log.Entry) (*Table, error) {
+	if format != FormatMRT && format != FormatText {
+		return nil, fmt.Errorf("unknown AS table format %s", format)
+	}
+	table := &Table{
+		path:           path,
+		format:         format,
+		reloadInterval: reloadInterval,
+		killSwitch:     make(chan int, 0),
+		log: logger.WithFields(log.Fields{
+			"component": "bgp",
+			"file":      path,
+		}),
+	}
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// open returns a reader of the file, uncompressing gzip and bzip2 dumps
+func (t *Table) open(file *os.File) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(t.path, ".gz"):
+		return gzip.NewReader(file)
+	case strings.HasSuffix(t.path, ".bz2"):
+		return bzip2.NewReader(file), nil
+	}
+	return file, nil
+}
+
+func (t *Table) load() error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := t.open(file)
+	if err != nil {
+		return err
+	}
+	trie := lpm.NewTrie()
+	add := func(prefix *net.IPNet, as uint32) {
+		trie.Insert(prefix, as)
+	}
+	if t.format == FormatMRT {
+		err = readMRT(reader, add)
+	} else {
+		err = readText(reader, add)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", t.path, err)
+	}
+	t.lock.Lock()
+	t.trie = trie
+	t.modified = info.ModTime()
+	t.lock.Unlock()
+	t.log.Infof("Loaded %d prefixes", trie.Len())
+	return nil
+}
+
+// reloadIfChanged loads the file again when its modification time changed
+func (t *Table) reloadIfChanged() {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		t.log.Errorf("Cannot check AS table: %s", err)
+		return
+	}
+	t.lock.RLock()
+	modified := t.modified
+	t.lock.RUnlock()
+	if info.ModTime().Equal(modified) {
+		return
+	}
+	if err := t.load(); err != nil {
+		t.log.Errorf("Cannot reload AS table, keeping the previous one: %s", err)
+	}
+}
+
+// Lookup returns the origin AS of the longest prefix holding ip and its length
+func (t *Table) Lookup(ip net.IP) (uint32, uint8, bool) {
+	t.lock.RLock()
+	trie := t.trie
+	t.lock.RUnlock()
+	value, length, found := trie.Lookup(ip)
+	if !found {
+		return 0, 0, false
+	}
+	return value.(uint32), uint8(length), true
+}
+
+// Enrich sets the source and destination AS numbers and prefix lengths of the flow
+func (t *Table) Enrich(f *flow.Flow) {
+	if as, length, found := t.Lookup(f.SourceIP()); found {
+		f.SetSourceAS(as, length)
+	}
+	if as, length, found := t.Lookup(f.DestinationIP()); found {
+		f.SetDestinationAS(as, length)
+	}
+}
+
+func (t *Table) Listen() {
+	ticker := time.NewTicker(t.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.killSwitch:
+			t.log.Info("Received a listener kill switch")
+			return
+		case <-ticker.C:
+			t.reloadIfChanged()
+		}
+	}
+}
+
+func (t *Table) Start() error {
+	if t.reloadInterval > 0 {
+		go t.Listen()
+	}
+	return nil
+}
+
+func (t *Table) Stop() error {
+	if t.reloadInterval > 0 {
+		t.killSwitch <- 1
+	}
+	return nil
+}
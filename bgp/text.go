@@ -0,0 +1,37 @@
+package bgp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// readText adds the prefixes of a text file holding one "prefix AS" pair per line,
+// like "192.0.2.0/24 64500" or "2001:db8::/32 AS64501". Lines starting with # are ignored.
+func readText(r io.Reader, add func(prefix *net.IPNet, as uint32)) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: expected a prefix and an AS number", line)
+		}
+		_, prefix, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		as, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid AS number %s", line, fields[1])
+		}
+		add(prefix, uint32(as))
+	}
+	return scanner.Err()
+}
@@ -4,6 +4,6 @@ package configuration
 
 import "errors"
 
-func NewAlternateConfiguration(path string) (*MainConfiguration, error) {
+func NewAlternateConfiguration(path string, previous *MainConfiguration) (*MainConfiguration, error) {
 	return nil, errors.New("not implemented")
 }
@@ -15,9 +15,9 @@ import (
 
 const defaultPfSenseLogFile = "/var/log/ripflow/flow.log"
 
-func NewAlternateConfiguration(path string) (*MainConfiguration, error) {
+func NewAlternateConfiguration(path string, previous *MainConfiguration) (*MainConfiguration, error) {
 	if filepath.Ext(path) == ".xml" {
-		pfConfig, err := GetConfigurationFromPfSense(path)
+		pfConfig, err := GetConfigurationFromPfSense(path, previous)
 		if err == nil {
 			pfConfig.Log.Debug("Starting in pfSense mode")
 			return pfConfig, nil
@@ -37,7 +37,7 @@ type ripSenseConfiguration struct {
 	Packages proxyPackageConfiguration `xml:"installedpackages"`
 }
 
-func GetConfigurationFromPfSense(path string) (*MainConfiguration, error) {
+func GetConfigurationFromPfSense(path string, previous *MainConfiguration) (*MainConfiguration, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -65,7 +65,7 @@ func GetConfigurationFromPfSense(path string) (*MainConfiguration, error) {
 			Port: pfConf.Packages.Ripflow.CollectorPort,
 		},
 	}
-	conf.setUpLog()
+	conf.setUpLog(previous)
 	conf.Interfaces = map[string]InterfaceConfig{}
 
 	for _, ifaceConfig := range pfConf.Packages.RipflowCaptures {
@@ -1,30 +1,279 @@
 package configuration
 
 import (
+	"fmt"
 	"github.com/COSAE-FR/ripflow/utils"
 	"github.com/COSAE-FR/riputils/common/logging"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// DefaultControlSocket is the control socket of the daemon and of the ctl command
+const DefaultControlSocket = "/var/run/ripflow.sock"
+
 const (
-	defaultExporterPort  = 9999
-	defaultMaxFlows      = 65536
-	defaultActiveTimeout = 1800
-	defaultIdleTimeout   = 15
+	defaultExporterPort                    = 9999
+	defaultExporterVersion                 = 5
+	defaultExporterTransport               = "udp"
+	defaultExporterTemplateRefreshPackets  = 20
+	defaultExporterTemplateRefreshInterval = 60
+	defaultMaxFlows                        = 65536
+	defaultActiveTimeout                   = 1800
+	defaultIdleTimeout                     = 15
+	defaultReplayPacing                    = "fast"
+	defaultMetricsPath                     = "/metrics"
+	defaultSamplingMode                    = "deterministic"
+	defaultCaptureBackend                  = "pcap"
+	defaultSFlowPort                       = 6343
+	defaultSFlowHeaderSize                 = 128
+	maxSFlowHeaderSize                     = 512
+	defaultSFlowCounterInterval            = 20
+	defaultBGPFormat                       = "mrt"
+	defaultBGPReloadInterval               = 300
+	defaultRoutesRefreshInterval           = 60
+	defaultRoutesCacheSize                 = 65536
+	defaultGeoIPReloadInterval             = 300
+	defaultExporterFormat                  = "netflow"
+	defaultJSONOutput                      = "stdout"
+	defaultAnonymizeMAC                    = "zero"
+	defaultAnonymizeIPv4PrefixLength       = 24
+	defaultAnonymizeIPv6PrefixLength       = 48
+	defaultAnonymizeCacheSize              = 65536
+	reverseInformationElementPEN           = 29305
+	maxSamplingRate                        = 16383
 )
 
+// anyInterface is the Linux pseudo-interface capturing every interface
+const anyInterface = "any"
+
+// tunnelTypes are the tunnels that can be decapsulated
+var tunnelTypes = []string{"gre", "erspan", "vxlan", "geneve", "mpls"}
+
+func checkDecapsulation(tunnels []string) error {
+	for _, tunnel := range tunnels {
+		found := false
+		for _, tunnelType := range tunnelTypes {
+			found = found || tunnel == tunnelType
+		}
+		if !found {
+			return fmt.Errorf("unknown tunnel type %s in decapsulation, supported types: %s", tunnel, strings.Join(tunnelTypes, ", "))
+		}
+	}
+	return nil
+}
+
+type ExportFilterConfig struct {
+	Interfaces []string
+	IPVersion  uint8 `yaml:"ip_version"`
+	Protocols  []uint8
+}
+
+func (c *ExportFilterConfig) check(logger *log.Entry) error {
+	if c.IPVersion != 0 && c.IPVersion != 4 && c.IPVersion != 6 {
+		return fmt.Errorf("unknown IP version %d in filter", c.IPVersion)
+	}
+	return nil
+}
+
 type ExporterConfig struct {
-	Host string
-	Port uint16
+	Name                    string
+	Host                    string
+	Port                    uint16
+	Version                 uint16
+	Transport               string
+	SourceID                uint32 `yaml:"source_id"`
+	TemplateRefreshPackets  uint32 `yaml:"template_refresh_packets"`
+	TemplateRefreshInterval uint32 `yaml:"template_refresh_interval"`
+	Biflow                  bool
+	GeoEnterpriseNumber     uint32 `yaml:"geo_enterprise_number"`
+	TunnelEnterpriseNumber  uint32 `yaml:"tunnel_enterprise_number"`
+	SourceAddress           string `yaml:"source_address"`
+	Anonymize               AnonymizeConfig
+	Format                  string
+	Output                  string
+	MaxSize                 uint32 `yaml:"max_size"`
+	RotateInterval          uint32 `yaml:"rotate_interval"`
+	MaxFiles                uint32 `yaml:"max_files"`
+	Filter                  ExportFilterConfig
+	SamplingRate            uint32 `yaml:"sampling_rate"`
+	block                   []byte // Configuration block, decoded by the sinks registered by third-party code
+}
+
+func (c *ExporterConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ExporterConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	var block yaml.MapSlice
+	if err := unmarshal(&block); err != nil {
+		return err
+	}
+	var err error
+	c.block, err = yaml.Marshal(block)
+	return err
+}
+
+// Decode unmarshals the exporter block into the configuration of a sink.
+// An *ExporterConfig receives the checked configuration.
+func (c ExporterConfig) Decode(out interface{}) error {
+	if config, ok := out.(*ExporterConfig); ok {
+		*config = c
+		return nil
+	}
+	return yaml.Unmarshal(c.block, out)
 }
 
 func (c *ExporterConfig) check(logger *log.Entry) error {
+	if len(c.Format) == 0 {
+		c.Format = defaultExporterFormat
+	}
+	if c.Format == "json" {
+		return c.checkJSON(logger)
+	}
+	if c.Format != "netflow" {
+		return c.checkSink(logger)
+	}
 	if c.Port == 0 {
 		c.Port = defaultExporterPort
 	}
+	if len(c.Name) == 0 {
+		c.Name = net.JoinHostPort(c.Host, strconv.Itoa(int(c.Port)))
+	}
+	if c.SamplingRate > maxSamplingRate {
+		return fmt.Errorf("sampling rate cannot exceed %d", maxSamplingRate)
+	}
+	if err := c.Filter.check(logger); err != nil {
+		return err
+	}
+	if c.Version == 0 {
+		c.Version = defaultExporterVersion
+	}
+	if c.Version != 5 && c.Version != 9 && c.Version != 10 {
+		return fmt.Errorf("unsupported Netflow version %d", c.Version)
+	}
+	if len(c.Transport) == 0 {
+		c.Transport = defaultExporterTransport
+	}
+	if c.Transport != "udp" && c.Transport != "tcp" {
+		return fmt.Errorf("unsupported export transport %s", c.Transport)
+	}
+	if c.Transport == "tcp" && c.Version != 10 {
+		return fmt.Errorf("TCP transport requires IPFIX (version 10)")
+	}
+	if c.Biflow && c.Version != 10 {
+		return fmt.Errorf("biflow export requires IPFIX (version 10)")
+	}
+	if c.GeoEnterpriseNumber == reverseInformationElementPEN || c.TunnelEnterpriseNumber == reverseInformationElementPEN {
+		return fmt.Errorf("enterprise number %d is reserved for reverse elements", reverseInformationElementPEN)
+	}
+	if len(c.SourceAddress) > 0 && net.ParseIP(c.SourceAddress) == nil {
+		return fmt.Errorf("invalid exporter source address %s", c.SourceAddress)
+	}
+	if err := c.Anonymize.check(logger); err != nil {
+		return err
+	}
+	if c.GeoEnterpriseNumber != 0 && c.Version == 5 {
+		logger.Warnf("GeoIP fields cannot be exported with Netflow v5 on %s", c.Name)
+	}
+	if c.TunnelEnterpriseNumber != 0 && c.Version == 5 {
+		logger.Warnf("Tunnel fields cannot be exported with Netflow v5 on %s", c.Name)
+	}
+	if c.TemplateRefreshPackets == 0 {
+		c.TemplateRefreshPackets = defaultExporterTemplateRefreshPackets
+	}
+	if c.TemplateRefreshInterval == 0 {
+		c.TemplateRefreshInterval = defaultExporterTemplateRefreshInterval
+	}
+	return nil
+}
+
+func (c *ExporterConfig) checkJSON(logger *log.Entry) error {
+	if len(c.Output) == 0 {
+		c.Output = defaultJSONOutput
+	}
+	if len(c.Name) == 0 {
+		c.Name = c.Output
+	}
+	if c.SamplingRate > maxSamplingRate {
+		return fmt.Errorf("sampling rate cannot exceed %d", maxSamplingRate)
+	}
+	if err := c.Anonymize.check(logger); err != nil {
+		return err
+	}
+	if (c.MaxSize > 0 || c.RotateInterval > 0) &&
+		(c.Output == "stdout" || c.Output == "-" || strings.Contains(c.Output, "://")) {
+		logger.Warnf("Rotation settings only apply to files on %s", c.Name)
+	}
+	return c.Filter.check(logger)
+}
+
+// checkSink checks the settings common to every sink type, the sink checks its own settings
+func (c *ExporterConfig) checkSink(logger *log.Entry) error {
+	if len(c.Name) == 0 {
+		c.Name = c.Format
+	}
+	if c.SamplingRate > maxSamplingRate {
+		return fmt.Errorf("sampling rate cannot exceed %d", maxSamplingRate)
+	}
+	if err := c.Anonymize.check(logger); err != nil {
+		return err
+	}
+	return c.Filter.check(logger)
+}
+
+type AnonymizeConfig struct {
+	Mode             string
+	Key              string
+	KeyFile          string `yaml:"key_file"`
+	IPv4PrefixLength uint8  `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength uint8  `yaml:"ipv6_prefix_length"`
+	Scope            []string
+	MAC              string
+	CacheSize        uint32 `yaml:"cache_size"`
+}
+
+func (c *AnonymizeConfig) check(logger *log.Entry) error {
+	if len(c.Mode) == 0 {
+		return nil
+	}
+	if c.Mode != "cryptopan" && c.Mode != "truncate" {
+		return fmt.Errorf("unknown anonymization mode %s", c.Mode)
+	}
+	if len(c.Key) > 0 && len(c.KeyFile) > 0 {
+		return fmt.Errorf("anonymization key and key file are exclusive")
+	}
+	if len(c.MAC) == 0 {
+		c.MAC = defaultAnonymizeMAC
+	}
+	if c.MAC != "keep" && c.MAC != "zero" && c.MAC != "hash" {
+		return fmt.Errorf("unknown MAC address anonymization %s", c.MAC)
+	}
+	if (c.Mode == "cryptopan" || c.MAC == "hash") && len(c.Key) == 0 && len(c.KeyFile) == 0 {
+		return fmt.Errorf("%s anonymization requires a key or a key file", c.Mode)
+	}
+	if c.IPv4PrefixLength == 0 {
+		c.IPv4PrefixLength = defaultAnonymizeIPv4PrefixLength
+	}
+	if c.IPv6PrefixLength == 0 {
+		c.IPv6PrefixLength = defaultAnonymizeIPv6PrefixLength
+	}
+	if c.IPv4PrefixLength > 32 || c.IPv6PrefixLength > 128 {
+		return fmt.Errorf("invalid anonymization prefix length")
+	}
+	for _, network := range c.Scope {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("invalid anonymization scope %s", network)
+		}
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultAnonymizeCacheSize
+	}
 	return nil
 }
 
@@ -32,6 +281,7 @@ type FlowsConfig struct {
 	Max           uint32
 	IdleTimeout   uint32
 	ActiveTimeout uint32
+	Bidirectional bool
 }
 
 func (c *FlowsConfig) check(logger *log.Entry) error {
@@ -48,22 +298,229 @@ func (c *FlowsConfig) check(logger *log.Entry) error {
 }
 
 type InterfaceConfig struct {
-	Name   string `yaml:"-"`
-	Filter string
+	Name          string `yaml:"-"`
+	Filter        string
+	SamplingRate  uint32 `yaml:"sampling_rate"`
+	SamplingMode  string `yaml:"sampling_mode"`
+	Backend       string
+	Workers       uint8
+	EngineType    uint8    `yaml:"engine_type"`
+	EngineID      uint8    `yaml:"engine_id"`
+	Decapsulation []string // Tunnel types whose inner packets are accounted
 }
 
 func (i *InterfaceConfig) check(name string, logger *log.Entry) error {
 	i.Name = name
+	if len(i.SamplingMode) == 0 {
+		i.SamplingMode = defaultSamplingMode
+	}
+	if i.SamplingMode != "deterministic" && i.SamplingMode != "random" {
+		return fmt.Errorf("unknown sampling mode %s", i.SamplingMode)
+	}
+	if i.SamplingRate > maxSamplingRate {
+		return fmt.Errorf("sampling rate cannot exceed %d", maxSamplingRate)
+	}
+	if len(i.Backend) == 0 {
+		i.Backend = defaultCaptureBackend
+	}
+	if i.Backend != "pcap" && i.Backend != "afpacket" {
+		return fmt.Errorf("unknown capture backend %s", i.Backend)
+	}
+	if i.Workers == 0 {
+		i.Workers = 1
+	}
+	if i.Workers > 1 && i.Backend != "afpacket" {
+		return fmt.Errorf("several capture workers require the afpacket backend")
+	}
+	if name == anyInterface && i.Backend != "pcap" {
+		return fmt.Errorf("the %s interface requires the pcap backend", anyInterface)
+	}
+	return checkDecapsulation(i.Decapsulation)
+}
+
+type ReplayConfig struct {
+	Files         []string
+	Pacing        string
+	Filter        string
+	Decapsulation []string
+}
+
+func (c *ReplayConfig) check(logger *log.Entry) error {
+	if len(c.Pacing) == 0 {
+		c.Pacing = defaultReplayPacing
+	}
+	if c.Pacing != "fast" && c.Pacing != "realtime" {
+		return fmt.Errorf("unknown replay pacing %s", c.Pacing)
+	}
+	return checkDecapsulation(c.Decapsulation)
+}
+
+type SFlowConfig struct {
+	Host            string
+	Port            uint16
+	AgentAddress    string `yaml:"agent_address"`
+	SubAgentID      uint32 `yaml:"sub_agent_id"`
+	HeaderSize      uint32 `yaml:"header_size"`
+	CounterInterval uint32 `yaml:"counter_interval"`
+}
+
+func (c *SFlowConfig) check(logger *log.Entry) error {
+	if len(c.Host) == 0 {
+		return nil
+	}
+	if c.Port == 0 {
+		c.Port = defaultSFlowPort
+	}
+	if len(c.AgentAddress) > 0 && net.ParseIP(c.AgentAddress) == nil {
+		return fmt.Errorf("invalid sFlow agent address %s", c.AgentAddress)
+	}
+	if c.HeaderSize == 0 {
+		c.HeaderSize = defaultSFlowHeaderSize
+	}
+	if c.HeaderSize > maxSFlowHeaderSize {
+		return fmt.Errorf("sFlow header size cannot exceed %d", maxSFlowHeaderSize)
+	}
+	if c.CounterInterval == 0 {
+		c.CounterInterval = defaultSFlowCounterInterval
+	}
+	return nil
+}
+
+type CollectorConfig struct {
+	UDP                    string
+	TCP                    string
+	GeoEnterpriseNumber    uint32 `yaml:"geo_enterprise_number"`
+	TunnelEnterpriseNumber uint32 `yaml:"tunnel_enterprise_number"`
+}
+
+func (c *CollectorConfig) check(logger *log.Entry) error {
+	for _, address := range []string{c.UDP, c.TCP} {
+		if len(address) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid collector address %s: %s", address, err)
+		}
+	}
+	if c.GeoEnterpriseNumber == reverseInformationElementPEN || c.TunnelEnterpriseNumber == reverseInformationElementPEN {
+		return fmt.Errorf("enterprise number %d is reserved for reverse elements", reverseInformationElementPEN)
+	}
+	return nil
+}
+
+// Enabled tells if the collector listens on at least one transport
+func (c *CollectorConfig) Enabled() bool {
+	return len(c.UDP) > 0 || len(c.TCP) > 0
+}
+
+type BGPConfig struct {
+	File           string
+	Format         string
+	ReloadInterval uint32 `yaml:"reload_interval"`
+}
+
+func (c *BGPConfig) check(logger *log.Entry) error {
+	if len(c.File) == 0 {
+		return nil
+	}
+	if len(c.Format) == 0 {
+		c.Format = defaultBGPFormat
+	}
+	if c.Format != "mrt" && c.Format != "text" {
+		return fmt.Errorf("unknown AS table format %s", c.Format)
+	}
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultBGPReloadInterval
+	}
+	return nil
+}
+
+type RoutesConfig struct {
+	Source          string
+	File            string
+	RefreshInterval uint32 `yaml:"refresh_interval"`
+	CacheSize       uint32 `yaml:"cache_size"`
+}
+
+func (c *RoutesConfig) check(logger *log.Entry) error {
+	if len(c.Source) == 0 {
+		return nil
+	}
+	if c.Source != "netlink" && c.Source != "file" {
+		return fmt.Errorf("unknown route source %s", c.Source)
+	}
+	if c.Source == "file" && len(c.File) == 0 {
+		return fmt.Errorf("route file is required with the file source")
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = defaultRoutesRefreshInterval
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = defaultRoutesCacheSize
+	}
+	return nil
+}
+
+type GeoIPConfig struct {
+	Country        string
+	City           string
+	ASN            string
+	ReloadInterval uint32 `yaml:"reload_interval"`
+}
+
+func (c *GeoIPConfig) check(logger *log.Entry) error {
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultGeoIPReloadInterval
+	}
+	return nil
+}
+
+// Enabled tells if at least one GeoIP database is configured
+func (c *GeoIPConfig) Enabled() bool {
+	return len(c.Country) > 0 || len(c.City) > 0 || len(c.ASN) > 0
+}
+
+type ControlConfig struct {
+	Socket  string
+	Disable bool
+}
+
+func (c *ControlConfig) check(logger *log.Entry) error {
+	if len(c.Socket) == 0 {
+		c.Socket = DefaultControlSocket
+	}
+	return nil
+}
+
+type MetricsConfig struct {
+	Listen string
+	Path   string
+}
+
+func (c *MetricsConfig) check(logger *log.Entry) error {
+	if len(c.Path) == 0 {
+		c.Path = defaultMetricsPath
+	}
 	return nil
 }
 
 type MainConfiguration struct {
 	Logging       logging.Config             `yaml:"logging"`
 	Exporter      ExporterConfig             `yaml:"exporter"`
+	Exporters     []ExporterConfig           `yaml:"exporters"`
 	Cache         FlowsConfig                `yaml:"cache"`
 	Interfaces    map[string]InterfaceConfig `yaml:"interfaces"`
+	Replay        ReplayConfig               `yaml:"replay"`
+	SFlow         SFlowConfig                `yaml:"sflow"`
+	Collector     CollectorConfig            `yaml:"collector"`
+	Relay         CollectorConfig            `yaml:"relay"`
+	BGP           BGPConfig                  `yaml:"bgp"`
+	Routes        RoutesConfig               `yaml:"routes"`
+	GeoIP         GeoIPConfig                `yaml:"geoip"`
+	Metrics       MetricsConfig              `yaml:"metrics"`
+	Control       ControlConfig              `yaml:"control"`
 	Log           *log.Entry                 `yaml:"-"`
-	logFileWriter *os.File
+	logFileWriter io.Writer
 	path          string
 }
 
@@ -71,26 +528,99 @@ func (c *MainConfiguration) check() error {
 	for name, i := range c.Interfaces {
 		err := i.check(name, c.Log)
 		if err != nil {
-			c.Log.Errorf("error in %s configuration", name)
+			c.Log.Errorf("error in %s configuration: %s", name, err)
 		}
 		c.Interfaces[name] = i
 	}
-	if err := c.Exporter.check(c.Log); err != nil {
-		return err
+	// The single exporter section is kept for compatibility
+	if len(c.Exporter.Host) > 0 || (len(c.Exporter.Format) > 0 && c.Exporter.Format != defaultExporterFormat) || len(c.Exporters) == 0 {
+		c.Exporters = append([]ExporterConfig{c.Exporter}, c.Exporters...)
+		c.Exporter = ExporterConfig{}
+	}
+	names := make(map[string]bool)
+	for index := range c.Exporters {
+		if err := c.Exporters[index].check(c.Log); err != nil {
+			return err
+		}
+		if names[c.Exporters[index].Name] {
+			return fmt.Errorf("duplicate exporter name %s", c.Exporters[index].Name)
+		}
+		names[c.Exporters[index].Name] = true
 	}
 	if err := c.Cache.check(c.Log); err != nil {
 		return err
 	}
+	if err := c.Replay.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.Metrics.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.Control.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.SFlow.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.Collector.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.Relay.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.BGP.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.Routes.check(c.Log); err != nil {
+		return err
+	}
+	if err := c.GeoIP.check(c.Log); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (c *MainConfiguration) setUpLog() {
+// SetReplay switches the configuration to capture file replay
+func (c *MainConfiguration) SetReplay(files []string, pacing string) error {
+	c.Replay.Files = files
+	if len(pacing) > 0 {
+		c.Replay.Pacing = pacing
+	}
+	return c.Replay.check(c.Log)
+}
+
+// setUpLog keeps the log of the previous configuration when the logging section is unchanged,
+// the log file would be opened once more on each reload otherwise
+func (c *MainConfiguration) setUpLog(previous *MainConfiguration) {
 	c.Logging.App = utils.Name
 	c.Logging.Version = utils.Version
 	c.Logging.Component = "config_loader"
 	c.Logging.FileMaxSize = 10
 	c.Logging.FileMaxBackups = 5
+	if previous != nil && previous.Log != nil && previous.Logging == c.Logging {
+		c.Log = previous.Log
+		c.logFileWriter = previous.logFileWriter
+		return
+	}
 	c.Log = logging.SetupLog(c.Logging)
+	if len(c.Logging.File) > 0 {
+		c.logFileWriter = c.Log.Logger.Out
+	}
+}
+
+// CloseLog closes the log file of a configuration no longer used, unless the current configuration
+// still writes to it
+func (c *MainConfiguration) CloseLog(current *MainConfiguration) {
+	if c.logFileWriter == nil || c.logFileWriter == os.Stdout || c.logFileWriter == os.Stderr {
+		return
+	}
+	if current != nil && (current.logFileWriter == c.logFileWriter || (current.Log != nil && current.Log.Logger.Out == c.logFileWriter)) {
+		return
+	}
+	if closer, ok := c.logFileWriter.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	c.logFileWriter = nil
 }
 
 func (c *MainConfiguration) Read() error {
@@ -115,8 +645,19 @@ func (c *MainConfiguration) Read() error {
 }
 
 func New(path string) (*MainConfiguration, error) {
-	config, err := NewAlternateConfiguration(path)
+	return load(path, nil)
+}
+
+// Reload reads the configuration file again. The new configuration shares the log file of c
+// when the logging section is unchanged, see CloseLog.
+func (c *MainConfiguration) Reload() (*MainConfiguration, error) {
+	return load(c.path, c)
+}
+
+func load(path string, previous *MainConfiguration) (*MainConfiguration, error) {
+	config, err := NewAlternateConfiguration(path, previous)
 	if err == nil {
+		config.path = path
 		return config, err
 	}
 	config = &MainConfiguration{
@@ -126,7 +667,7 @@ func New(path string) (*MainConfiguration, error) {
 	if err != nil {
 		return config, err
 	}
-	config.setUpLog()
+	config.setUpLog(previous)
 	err = config.check()
 	return config, err
 }
@@ -0,0 +1,177 @@
+package configuration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfiguration writes a configuration file in a temporary directory removed by the test
+func writeConfiguration(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ripflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "ripflow.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadKeepsTheLog(t *testing.T) {
+	path := writeConfiguration(t, "logging:\n  level: info\nexporter:\n  host: 127.0.0.1\n")
+	config, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Log != config.Log {
+		t.Error("log set up again for an unchanged logging section")
+	}
+	if err := ioutil.WriteFile(path, []byte("logging:\n  level: debug\nexporter:\n  host: 127.0.0.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := reloaded.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Log == reloaded.Log || changed.Logging.Level != "debug" {
+		t.Error("changed logging section not applied")
+	}
+}
+
+func TestCloseLog(t *testing.T) {
+	file, err := ioutil.TempFile("", "ripflow-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(file.Name()) })
+	previous := &MainConfiguration{logFileWriter: file}
+	shared := &MainConfiguration{logFileWriter: file}
+	previous.CloseLog(shared)
+	if _, err := file.WriteString("still open\n"); err != nil {
+		t.Errorf("log file shared with the current configuration closed: %s", err)
+	}
+	previous.CloseLog(&MainConfiguration{})
+	if _, err := file.WriteString("closed\n"); err == nil {
+		t.Error("log file of the replaced configuration still open")
+	}
+	// Standard outputs are never closed
+	(&MainConfiguration{logFileWriter: os.Stderr}).CloseLog(nil)
+	if _, err := os.Stderr.Write(nil); err != nil {
+		t.Errorf("standard error closed: %s", err)
+	}
+}
+
+func TestExporters(t *testing.T) {
+	config, err := New(writeConfiguration(t, `
+exporter:
+  host: 192.0.2.1
+exporters:
+  - host: 192.0.2.2
+    port: 2055
+    version: 10
+    filter:
+      ip_version: 6
+      interfaces: [eth1]
+      protocols: [6, 17]
+    sampling_rate: 10
+    tunnel_enterprise_number: 64512
+  - format: json
+    output: /var/log/ripflow/flows.json
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Exporters) != 3 {
+		t.Fatalf("%d exporters, expected the single exporter section and 2 others", len(config.Exporters))
+	}
+	for i, name := range []string{"192.0.2.1:9999", "192.0.2.2:2055", "/var/log/ripflow/flows.json"} {
+		if config.Exporters[i].Name != name {
+			t.Errorf("exporter %d named %s, expected %s", i, config.Exporters[i].Name, name)
+		}
+	}
+	filtered := config.Exporters[1]
+	if filtered.Filter.IPVersion != 6 || len(filtered.Filter.Interfaces) != 1 || len(filtered.Filter.Protocols) != 2 || filtered.SamplingRate != 10 {
+		t.Errorf("exporter filter %+v, sampling rate %d", filtered.Filter, filtered.SamplingRate)
+	}
+	if filtered.TunnelEnterpriseNumber != 64512 || filtered.GeoEnterpriseNumber != 0 {
+		t.Errorf("tunnel enterprise number %d, GeoIP enterprise number %d", filtered.TunnelEnterpriseNumber, filtered.GeoEnterpriseNumber)
+	}
+
+	for _, invalid := range []string{
+		"exporters:\n  - host: 192.0.2.1\n  - host: 192.0.2.1\n",
+		"exporters:\n  - host: 192.0.2.1\n    filter:\n      ip_version: 5\n",
+		"exporters:\n  - host: 192.0.2.1\n    sampling_rate: 20000\n",
+		"exporters:\n  - host: 192.0.2.1\n    tunnel_enterprise_number: 29305\n",
+		"collector:\n  udp: 0.0.0.0:2055\n  tunnel_enterprise_number: 29305\n",
+	} {
+		if _, err := New(writeConfiguration(t, invalid)); err == nil {
+			t.Errorf("invalid configuration accepted:\n%s", invalid)
+		}
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	config, err := New(writeConfiguration(t, "exporters:\n  - format: json\n  - format: json\n    output: unix:///run/ripflow.sock\n    max_size: 1000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Exporters) != 2 {
+		t.Fatalf("%d exporters, expected 2", len(config.Exporters))
+	}
+	for i, name := range []string{"stdout", "unix:///run/ripflow.sock"} {
+		if exporter := config.Exporters[i]; exporter.Output != name || exporter.Name != name {
+			t.Errorf("exporter %d writes to %s and is named %s, expected %s", i, exporter.Output, exporter.Name, name)
+		}
+	}
+}
+
+func TestSinkBlock(t *testing.T) {
+	config, err := New(writeConfiguration(t, `
+exporters:
+  - format: kafka
+    brokers: [192.0.2.10:9092, 192.0.2.11:9092]
+    topic: flows
+    sampling_rate: 4
+  - host: 192.0.2.1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Exporters) != 2 {
+		t.Fatalf("%d exporters, expected 2", len(config.Exporters))
+	}
+	sink := config.Exporters[0]
+	if sink.Name != "kafka" || sink.SamplingRate != 4 {
+		t.Errorf("sink named %s with sampling rate %d", sink.Name, sink.SamplingRate)
+	}
+	var kafka struct {
+		Brokers []string
+		Topic   string
+	}
+	if err := sink.Decode(&kafka); err != nil {
+		t.Fatal(err)
+	}
+	if len(kafka.Brokers) != 2 || kafka.Brokers[1] != "192.0.2.11:9092" || kafka.Topic != "flows" {
+		t.Errorf("sink block decoded as %+v", kafka)
+	}
+	// The exporter configuration itself is the checked one
+	var exporter ExporterConfig
+	if err := config.Exporters[1].Decode(&exporter); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.Name != "192.0.2.1:9999" || exporter.Port != 9999 {
+		t.Errorf("exporter decoded as %s on port %d", exporter.Name, exporter.Port)
+	}
+	if _, err := New(writeConfiguration(t, "exporters:\n  - format: kafka\n    sampling_rate: 20000\n")); err == nil {
+		t.Error("sink with an invalid sampling rate accepted")
+	}
+}
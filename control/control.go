@@ -0,0 +1,181 @@
+// Package control serves administrative commands to a running daemon over a Unix socket.
+// Each connection carries one JSON request answered by one JSON response.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const ioTimeout = 30 * time.Second
+
+type Request struct {
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type Response struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// HandlerFunc runs a command with its raw JSON arguments and returns a result encoded in JSON
+type HandlerFunc func(arguments json.RawMessage) (interface{}, error)
+
+type Server struct {
+	path     string
+	handlers map[string]HandlerFunc
+	listener net.Listener
+	workers  sync.WaitGroup
+	closed   bool
+	lock     sync.Mutex
+	log      *log.Entry
+}
+
+func NewServer(path string, logger *log.Entry) *Server {
+	return &Server{
+		path:     path,
+		handlers: make(map[string]HandlerFunc),
+		log:      logger.WithField("component", "control"),
+	}
+}
+
+// Handle registers the handler of a command
+func (s *Server) Handle(command string, handler HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers[command] = handler
+}
+
+func (s *Server) handler(command string) (HandlerFunc, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	handler, found := s.handlers[command]
+	return handler, found
+}
+
+func (s *Server) serve(connection net.Conn) {
+	defer s.workers.Done()
+	defer func() {
+		_ = connection.Close()
+	}()
+	_ = connection.SetDeadline(time.Now().Add(ioTimeout))
+	var request Request
+	var response Response
+	if err := json.NewDecoder(connection).Decode(&request); err == io.EOF {
+		// Liveness probe of another daemon
+		return
+	} else if err != nil {
+		response.Error = fmt.Sprintf("invalid request: %s", err)
+	} else if handler, found := s.handler(request.Command); !found {
+		response.Error = fmt.Sprintf("unknown command %s", request.Command)
+	} else {
+		s.log.Debugf("Running %s", request.Command)
+		result, err := handler(request.Arguments)
+		if err == nil {
+			response.Result, err = json.Marshal(result)
+		}
+		if err != nil {
+			response.Error = err.Error()
+		}
+	}
+	if err := json.NewEncoder(connection).Encode(response); err != nil {
+		s.log.Warnf("Cannot answer %s: %s", request.Command, err)
+	}
+}
+
+func (s *Server) Listen() {
+	defer s.workers.Done()
+	for {
+		connection, err := s.listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return
+			}
+			s.log.Errorf("Cannot accept connection: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		s.workers.Add(1)
+		go s.serve(connection)
+	}
+}
+
+// Start listens on the socket, a stale socket left by a previous daemon is replaced
+func (s *Server) Start() error {
+	if connection, err := net.Dial("unix", s.path); err == nil {
+		_ = connection.Close()
+		return fmt.Errorf("control socket %s is used by another process", s.path)
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	// Only root and the daemon group may control the daemon
+	if err := os.Chmod(s.path, 0660); err != nil {
+		_ = listener.Close()
+		return err
+	}
+	s.listener = listener
+	s.workers.Add(1)
+	go s.Listen()
+	s.log.Infof("Control socket listening on %s", s.path)
+	return nil
+}
+
+func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	err := s.listener.Close()
+	s.workers.Wait()
+	return err
+}
+
+// Call runs a command on the daemon listening on path and decodes its result into result
+func Call(path string, command string, arguments interface{}, result interface{}) error {
+	connection, err := net.DialTimeout("unix", path, ioTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = connection.Close()
+	}()
+	_ = connection.SetDeadline(time.Now().Add(ioTimeout))
+	request := Request{Command: command}
+	if arguments != nil {
+		if request.Arguments, err = json.Marshal(arguments); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(connection).Encode(request); err != nil {
+		return err
+	}
+	var response Response
+	if err := json.NewDecoder(connection).Decode(&response); err != nil {
+		return err
+	}
+	if len(response.Error) > 0 {
+		return errors.New(response.Error)
+	}
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,129 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+// testServer starts a server on a socket of a temporary directory
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ripflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	server := NewServer(filepath.Join(dir, "control.sock"), testLogger())
+	server.Handle("sum", func(raw json.RawMessage) (interface{}, error) {
+		var terms []int
+		if err := json.Unmarshal(raw, &terms); err != nil {
+			return nil, err
+		}
+		sum := 0
+		for _, term := range terms {
+			sum += term
+		}
+		return sum, nil
+	})
+	server.Handle("fail", func(json.RawMessage) (interface{}, error) {
+		return nil, errors.New("command failed")
+	})
+	server.Handle("nothing", func(json.RawMessage) (interface{}, error) {
+		return nil, nil
+	})
+	if err := server.Start(); err != nil {
+		t.Skipf("cannot listen on %s: %s", server.path, err)
+	}
+	t.Cleanup(func() { _ = server.Stop() })
+	return server
+}
+
+func TestCall(t *testing.T) {
+	server := testServer(t)
+	var sum int
+	if err := Call(server.path, "sum", []int{1, 2, 39}, &sum); err != nil || sum != 42 {
+		t.Errorf("sum is %d, error %v, expected 42", sum, err)
+	}
+	if err := Call(server.path, "nothing", nil, nil); err != nil {
+		t.Errorf("command without arguments nor result: %s", err)
+	}
+	for command, message := range map[string]string{
+		"fail":    "command failed",
+		"unknown": "unknown command unknown",
+		"sum":     "cannot unmarshal",
+	} {
+		err := Call(server.path, command, "not a list", &sum)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s returned %v, expected %s", command, err, message)
+		}
+	}
+}
+
+func TestInvalidRequest(t *testing.T) {
+	server := testServer(t)
+	connection, err := net.Dial("unix", server.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	if _, err := connection.Write([]byte("{command\n")); err != nil {
+		t.Fatal(err)
+	}
+	var response Response
+	if err := json.NewDecoder(connection).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Error, "invalid request") {
+		t.Errorf("error %q, expected an invalid request", response.Error)
+	}
+}
+
+func TestSocket(t *testing.T) {
+	server := testServer(t)
+	info, err := os.Stat(server.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0660 {
+		t.Errorf("socket mode %o, expected 660", mode)
+	}
+	// A second daemon must not steal the socket of a running one
+	if err := NewServer(server.path, testLogger()).Start(); err == nil {
+		t.Error("socket of a running daemon replaced")
+	}
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// The socket left by a stopped daemon is stale
+	stale, err := net.Listen("unix", server.path+".stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unixListener, ok := stale.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+	_ = stale.Close()
+	restarted := NewServer(server.path+".stale", testLogger())
+	restarted.Handle("nothing", func(json.RawMessage) (interface{}, error) { return nil, nil })
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("stale socket not replaced: %s", err)
+	}
+	defer restarted.Stop()
+	if err := Call(restarted.path, "nothing", nil, nil); err != nil {
+		t.Error(err)
+	}
+}
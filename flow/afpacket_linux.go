@@ -0,0 +1,231 @@
+// +build linux
+
+package flow
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/ripflow/utils"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ARPHRD types of the interfaces captured with AF_PACKET, arphrdEthernet is shared with Linux SLL
+const (
+	arphrdPPP      = 512
+	arphrdRawIP    = 519
+	arphrdTunnel   = 768
+	arphrdTunnel6  = 769
+	arphrdLoopback = 772
+	arphrdSIT      = 776
+	arphrdNone     = 65534
+)
+
+const (
+	afpacketSnapLength  = 65536
+	afpacketPollTimeout = 100 * time.Millisecond // Workers check their kill switch between polls
+	afpacketErrorDelay  = time.Second
+)
+
+// afpacketRing captures an interface with TPACKET_V3 memory mapped rings,
+// one socket per worker in the same fanout group
+type afpacketRing struct {
+	sockets    []*afpacket.TPacket
+	linkType   layers.LinkType
+	killSwitch chan struct{}
+	workers    sync.WaitGroup
+	closed     bool
+	lock       sync.Mutex
+	log        *log.Entry
+}
+
+// NewAFPacketHandler captures the interface with AF_PACKET, packets are hashed by flow between workers
+func NewAFPacketHandler(iface *net.Interface, workers int, worker chan Flow, logger *log.Entry) (*PacketHandler, error) {
+	handler := &PacketHandler{
+		iface: iface,
+		log: logger.WithFields(log.Fields{
+			"component": "capture",
+			"interface": iface.Name,
+			"backend":   "afpacket",
+		}),
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if iface.Name == AnyInterface {
+		return handler, fmt.Errorf("the %s pseudo-interface requires the pcap backend", AnyInterface)
+	}
+	linkType, err := afpacketLinkType(iface)
+	if err != nil {
+		return handler, err
+	}
+	handler.bringUp()
+	ring := &afpacketRing{
+		linkType:   linkType,
+		killSwitch: make(chan struct{}),
+		log:        handler.log,
+	}
+	// The group ID must be unique to the interface among the processes of the host
+	fanoutID := uint16(os.Getpid()&0xff)<<8 | uint16(iface.Index&0xff)
+	for i := 0; i < workers; i++ {
+		socket, err := afpacket.NewTPacket(
+			afpacket.OptInterface(iface.Name),
+			afpacket.TPacketVersion3,
+			afpacket.OptPollTimeout(afpacketPollTimeout),
+			afpacket.OptAddVLANHeader(true),
+		)
+		if err != nil {
+			ring.closeSockets()
+			handler.log.Errorf("Unable to open AF_PACKET socket on interface %s", iface.Name)
+			return handler, err
+		}
+		ring.sockets = append(ring.sockets, socket)
+		if workers == 1 {
+			break
+		}
+		if err := socket.SetFanout(afpacket.FanoutHashWithDefrag, fanoutID); err != nil {
+			ring.closeSockets()
+			return handler, fmt.Errorf("cannot join fanout group on %s: %s", iface.Name, err)
+		}
+	}
+	handler.ring = ring
+	handler.linkType = linkType
+	handler.Worker = worker
+	handler.Done = make(chan struct{})
+	handler.killSwitch = make(chan int, 0)
+	return handler, nil
+}
+
+// afpacketLinkType returns the link type of the frames of an interface, from its ARPHRD type
+func afpacketLinkType(iface *net.Interface) (layers.LinkType, error) {
+	hardwareType, err := utils.InterfaceHardwareType(*iface)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read the hardware type of %s: %s", iface.Name, err)
+	}
+	linkType, supported := hardwareLinkType(hardwareType)
+	if !supported {
+		return 0, fmt.Errorf("unsupported hardware type %d on %s, use the pcap backend", hardwareType, iface.Name)
+	}
+	return linkType, nil
+}
+
+func hardwareLinkType(hardwareType uint64) (layers.LinkType, bool) {
+	switch hardwareType {
+	case arphrdEthernet, arphrdLoopback:
+		return layers.LinkTypeEthernet, true
+	case arphrdPPP, arphrdRawIP, arphrdTunnel, arphrdTunnel6, arphrdSIT, arphrdNone:
+		// The packets start with their IP header
+		return layers.LinkTypeRaw, true
+	}
+	return 0, false
+}
+
+func (r *afpacketRing) setFilter(filter string) error {
+	instructions, err := pcap.CompileBPFFilter(r.linkType, afpacketSnapLength, filter)
+	if err != nil {
+		return err
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	for _, socket := range r.sockets {
+		if err := socket.SetBPF(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *afpacketRing) start(handler *PacketHandler) {
+	for index, socket := range r.sockets {
+		r.workers.Add(1)
+		go r.listen(handler, index, socket)
+	}
+}
+
+func (r *afpacketRing) listen(handler *PacketHandler, index int, socket *afpacket.TPacket) {
+	defer r.workers.Done()
+	r.log.Debugf("Capture worker %d listening", index)
+	pp := newParserParameters(r.linkType)
+	// Each worker samples its share of the packets
+	var s *sampler
+	if handler.sampler != nil {
+		s, _ = newSampler(handler.sampler.algorithm, handler.sampler.interval)
+	}
+	for {
+		select {
+		case <-r.killSwitch:
+			r.log.Debugf("Capture worker %d stopped", index)
+			return
+		default:
+		}
+		data, info, err := socket.ZeroCopyReadPacketData()
+		if err == afpacket.ErrTimeout || err == afpacket.ErrPoll {
+			continue
+		}
+		if err != nil {
+			r.log.Errorf("Cannot read packet: %s", err)
+			time.Sleep(afpacketErrorDelay)
+			continue
+		}
+		handler.countPacket()
+		if s != nil && !s.sample() {
+			continue
+		}
+		handler.decode(&pp, data, info)
+	}
+}
+
+func (r *afpacketRing) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	close(r.killSwitch)
+	// Rings are unmapped on close, wait for the workers to leave them
+	r.workers.Wait()
+	r.closeSockets()
+	r.closed = true
+}
+
+func (r *afpacketRing) closeSockets() {
+	for _, socket := range r.sockets {
+		socket.Close()
+	}
+}
+
+// collectStats sums the kernel statistics of every socket of the fanout group
+func (r *afpacketRing) collectStats(iface string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	var packets, drops, freezes uint64
+	for _, socket := range r.sockets {
+		_, stats, err := socket.SocketStats()
+		if err != nil {
+			r.log.Debugf("Cannot read socket statistics: %s", err)
+			continue
+		}
+		packets += uint64(stats.Packets())
+		drops += uint64(stats.Drops())
+		freezes += uint64(stats.QueueFreezes())
+	}
+	capturePacketsMetric.With(iface).Set(packets)
+	captureDroppedMetric.With(iface).Set(drops)
+	captureQueueFreezesMetric.With(iface).Set(freezes)
+}
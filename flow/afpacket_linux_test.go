@@ -0,0 +1,76 @@
+// +build linux
+
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestHardwareLinkType(t *testing.T) {
+	for _, c := range []struct {
+		hardwareType uint64
+		linkType     layers.LinkType
+		supported    bool
+	}{
+		{arphrdEthernet, layers.LinkTypeEthernet, true},
+		{arphrdLoopback, layers.LinkTypeEthernet, true},
+		{arphrdPPP, layers.LinkTypeRaw, true},
+		{arphrdRawIP, layers.LinkTypeRaw, true},
+		{arphrdTunnel, layers.LinkTypeRaw, true},
+		{arphrdTunnel6, layers.LinkTypeRaw, true},
+		{arphrdSIT, layers.LinkTypeRaw, true},
+		{arphrdNone, layers.LinkTypeRaw, true},
+		{801, 0, false}, // IEEE 802.11
+	} {
+		linkType, supported := hardwareLinkType(c.hardwareType)
+		if linkType != c.linkType || supported != c.supported {
+			t.Errorf("hardware type %d: link type %s supported %t, expected %s %t",
+				c.hardwareType, linkType, supported, c.linkType, c.supported)
+		}
+	}
+}
+
+func TestAFPacketLoopback(t *testing.T) {
+	if _, err := NewAFPacketHandler(&net.Interface{Name: AnyInterface}, 1, nil, testLogger()); err == nil {
+		t.Error("any pseudo-interface accepted")
+	}
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %s", err)
+	}
+	if linkType, err := afpacketLinkType(iface); err != nil || linkType != layers.LinkTypeEthernet {
+		t.Fatalf("loopback link type %s: %v", linkType, err)
+	}
+	worker := make(chan Flow, 1024)
+	handler, err := NewAFPacketHandler(iface, 2, worker, testLogger())
+	if err != nil {
+		t.Skipf("cannot open AF_PACKET sockets: %s", err)
+	}
+	if err := handler.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = handler.Stop() }()
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	deadline := time.After(2 * time.Second)
+	for {
+		_, _ = conn.Write([]byte("ripflow"))
+		select {
+		case f := <-worker:
+			if f.key.protocolIdentifier == 17 && f.key.sourceTransportPort == port && f.key.destinationTransportPort == 9 {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("datagram not captured on the loopback interface")
+		}
+	}
+}
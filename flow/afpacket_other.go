@@ -0,0 +1,14 @@
+// +build !linux
+
+package flow
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// NewAFPacketHandler is only available on Linux
+func NewAFPacketHandler(iface *net.Interface, workers int, worker chan Flow, logger *log.Entry) (*PacketHandler, error) {
+	return nil, fmt.Errorf("AF_PACKET capture is not supported on this platform")
+}
@@ -1,23 +1,38 @@
 package flow
 
 import (
+	"github.com/COSAE-FR/ripflow/metrics"
 	lru "github.com/hashicorp/golang-lru"
 	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Deadlines are checked at this interval when following the wall clock
+const expiryInterval = time.Second
+
 type Cache struct {
-	Flows         *lru.Cache
-	Input         chan Flow
-	output        chan Flow
-	idleTimeout   uint32
-	activeTimeout uint32
-	killSwitch    chan int
-	killFlusher   chan int
-	flushTicker   time.Ticker
-	log           *log.Entry
-	lock          sync.Mutex
+	Flows             *lru.Cache
+	Input             chan Flow
+	output            chan Flow
+	idleTimeout       uint32
+	activeTimeout     uint32
+	killSwitch        chan int
+	killFlusher       chan int
+	restart           chan chan struct{} // Packet clock restarts, handled by Listen
+	unregisterMetrics func()
+	flushTicker       *time.Ticker
+	expiries          expiryQueue
+	evicted           []Flow // Sent to the output once c.lock is released
+	deadlines         map[uint64]*expiryEntry
+	evictReason       uint8
+	packetTime        bool
+	bidirectional     bool
+	lastPacket        time.Time
+	log               *log.Entry
+	lock              sync.Mutex
 }
 
 func NewCache(maxFlows uint32, idle uint32, active uint32, output chan Flow, logger *log.Entry) (*Cache, error) {
@@ -29,17 +44,97 @@ func NewCache(maxFlows uint32, idle uint32, active uint32, output chan Flow, log
 		activeTimeout: active,
 		killSwitch:    make(chan int, 1),
 		killFlusher:   make(chan int, 1),
-		flushTicker:   *time.NewTicker(time.Duration(idle) * time.Second * 2),
+		restart:       make(chan chan struct{}),
+		flushTicker:   time.NewTicker(expiryInterval),
+		deadlines:     make(map[uint64]*expiryEntry),
+		evictReason:   flowEndReasonLackOfResources,
 		log:           logger,
 	}
+	// Flows leave the cache through this callback, c.lock is always held.
+	// They are sent by unlock, a slow output must not block the packets and the queries.
 	lruCache, err := lru.NewWithEvict(int(maxFlows), func(key interface{}, value interface{}) {
 		flow := value.(Flow)
-		cache.output <- flow
+		if flow.flowEndReason == 0 {
+			flow.flowEndReason = cache.evictReason
+		}
+		cacheEvictionsMetric.With(flowEndReasonName(flow.flowEndReason)).Inc()
+		if realKey, casted := key.(uint64); casted {
+			cache.unschedule(realKey)
+		}
+		cache.evicted = append(cache.evicted, flow)
 	})
 	cache.Flows = lruCache
+	cache.unregisterMetrics = metrics.Default.OnCollect(func() {
+		cacheFlowsMetric.Set(float64(lruCache.Len()))
+	})
 	return &cache, err
 }
 
+// unlock releases c.lock and sends the flows evicted meanwhile to the output
+func (c *Cache) unlock() {
+	evicted, output := c.evicted, c.output
+	c.evicted = nil
+	c.lock.Unlock()
+	for _, flow := range evicted {
+		output <- flow
+	}
+}
+
+// UsePacketTime makes the cache follow packet timestamps instead of the wall clock.
+// Expiry is then driven by incoming packets, as when replaying capture files.
+func (c *Cache) UsePacketTime() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.packetTime = true
+}
+
+// UseBiflows keeps separate counters for each direction of a flow (RFC 5103).
+// The flow is oriented by its first packet.
+func (c *Cache) UseBiflows(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.bidirectional = enabled
+}
+
+// SetOutput sends the flows leaving the cache to a new channel
+func (c *Cache) SetOutput(output chan Flow) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.output = output
+}
+
+// SetTimeouts changes the idle and active timeouts of cached and future flows
+func (c *Cache) SetTimeouts(idle uint32, active uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.idleTimeout = idle
+	c.activeTimeout = active
+	for key := range c.deadlines {
+		if raw, found := c.Flows.Peek(key); found {
+			if flow, casted := raw.(Flow); casted {
+				c.schedule(key, flow)
+			}
+		}
+	}
+}
+
+// Resize changes the maximum number of cached flows, oldest flows are exported when shrinking
+func (c *Cache) Resize(maxFlows uint32) {
+	c.lock.Lock()
+	defer c.unlock()
+	evicted := c.Flows.Resize(int(maxFlows))
+	if evicted > 0 {
+		c.log.Infof("%d flows evicted while resizing the cache", evicted)
+	}
+}
+
+func (c *Cache) now() time.Time {
+	if c.packetTime {
+		return c.lastPacket
+	}
+	return time.Now()
+}
+
 func (c *Cache) Listen() {
 	for {
 		select {
@@ -47,16 +142,51 @@ func (c *Cache) Listen() {
 			c.log.Info("Received a listener kill switch")
 			return
 		case flow := <-c.Input:
-			func() {
-				c.lock.Lock()
-				defer c.lock.Unlock()
-				c.UpdateFlow(flow)
-			}()
+			c.handleFlow(flow)
+		case done := <-c.restart:
+			c.drainInput()
+			c.ExpireAll()
+			c.lock.Lock()
+			c.lastPacket = time.Time{}
+			c.lock.Unlock()
+			close(done)
+		}
+	}
+}
 
+// RestartPacketTime exports every cached flow and restarts the packet clock once a capture file is read.
+// The flows of the file still queued are accounted first. The next file may cover an earlier period,
+// its flows would expire on arrival otherwise.
+func (c *Cache) RestartPacketTime() {
+	done := make(chan struct{})
+	c.restart <- done
+	<-done
+}
+
+// drainInput accounts the flows waiting in the input queue
+func (c *Cache) drainInput() {
+	for {
+		select {
+		case flow := <-c.Input:
+			c.handleFlow(flow)
+		default:
+			return
 		}
 	}
 }
 
+func (c *Cache) handleFlow(flow Flow) {
+	c.lock.Lock()
+	defer c.unlock()
+	if c.packetTime && flow.end.After(c.lastPacket) {
+		c.lastPacket = flow.end
+	}
+	c.UpdateFlow(flow)
+	if c.packetTime {
+		c.expire(c.lastPacket)
+	}
+}
+
 func (c *Cache) Start() error {
 	go c.Listen()
 	go c.flushOldest()
@@ -64,76 +194,164 @@ func (c *Cache) Start() error {
 }
 
 func (c *Cache) Stop() error {
+	c.unregisterMetrics()
 	c.killSwitch <- 1
 	c.killFlusher <- 1
-	cacheLength := c.Flows.Len()
-	if cacheLength > 0 {
-		c.log.Debugf("Flushing %d entries in cache", c.Flows.Len())
-		func() {
-			c.lock.Lock()
-			defer c.lock.Unlock()
-			c.Flows.Purge()
-		}()
+	c.drainInput()
+	if flushed := c.ExpireAll(); flushed > 0 {
+		c.log.Debugf("Flushed %d entries in cache", flushed)
 	}
 	return nil
 }
 
+// ExpireAll exports every cached flow with the forced end reason and returns their number
+func (c *Cache) ExpireAll() int {
+	c.lock.Lock()
+	defer c.unlock()
+	count := c.Flows.Len()
+	c.evictReason = flowEndReasonForceEnd
+	c.Flows.Purge()
+	c.evictReason = flowEndReasonLackOfResources
+	return count
+}
+
+// FlowQuery selects and orders cached flows, empty criteria match every flow
+type FlowQuery struct {
+	Address   net.IP // Source or destination address
+	Port      uint16 // Source or destination port
+	Protocol  uint8
+	Interface uint16 // Input interface index
+	SortBy    string // octets, packets, start or end, the biggest or latest first
+	Limit     int
+}
+
+func (q FlowQuery) match(flow *Flow) bool {
+	if q.Address != nil && !q.Address.Equal(flow.key.sourceIPAddress) && !q.Address.Equal(flow.key.destinationIPAddress) {
+		return false
+	}
+	if q.Port > 0 && q.Port != flow.key.sourceTransportPort && q.Port != flow.key.destinationTransportPort {
+		return false
+	}
+	if q.Protocol > 0 && q.Protocol != flow.key.protocolIdentifier {
+		return false
+	}
+	return q.Interface == 0 || q.Interface == flow.ifIndex
+}
+
+// Query returns the cached flows matching the query, without touching their recency
+func (c *Cache) Query(query FlowQuery) []Flow {
+	c.lock.Lock()
+	var flows []Flow
+	for _, key := range c.Flows.Keys() {
+		if raw, found := c.Flows.Peek(key); found {
+			if flow, casted := raw.(Flow); casted && query.match(&flow) {
+				flows = append(flows, flow)
+			}
+		}
+	}
+	c.lock.Unlock()
+	var less func(a, b *Flow) bool
+	switch query.SortBy {
+	case "octets":
+		less = func(a, b *Flow) bool {
+			return a.octetDeltaCount+a.reverseOctetDeltaCount > b.octetDeltaCount+b.reverseOctetDeltaCount
+		}
+	case "packets":
+		less = func(a, b *Flow) bool {
+			return a.packetDeltaCount+a.reversePacketDeltaCount > b.packetDeltaCount+b.reversePacketDeltaCount
+		}
+	case "start":
+		less = func(a, b *Flow) bool { return a.start.After(b.start) }
+	case "end":
+		less = func(a, b *Flow) bool { return a.end.After(b.end) }
+	}
+	if less != nil {
+		sort.SliceStable(flows, func(i, j int) bool { return less(&flows[i], &flows[j]) })
+	}
+	if query.Limit > 0 && len(flows) > query.Limit {
+		flows = flows[:query.Limit]
+	}
+	return flows
+}
+
 func (c *Cache) flushOldest() {
 	for {
 		select {
 		case <-c.killFlusher:
+			c.flushTicker.Stop()
 			return
 		case <-c.flushTicker.C:
 			func() {
-				now := time.Now()
 				c.lock.Lock()
-				defer c.lock.Unlock()
-				for _, key := range c.Flows.Keys() {
-					realKey, casted := key.(uint64)
-					if !casted {
-						continue
-					}
-					rawFlow, found := c.Flows.Peek(realKey)
-					if found {
-						flow, casted := rawFlow.(Flow)
-						if casted {
-							if uint32(flow.end.Sub(now).Seconds()) > c.idleTimeout {
-								c.Flows.Remove(key)
-							}
-						}
-					}
+				defer c.unlock()
+				if c.packetTime {
+					return
 				}
+				c.expire(c.now())
 			}()
 		}
 	}
 }
 
+// remove exports the flow stored under key with the given end reason, c.lock must be held
+func (c *Cache) remove(key uint64, reason uint8) {
+	c.evictReason = reason
+	c.Flows.Remove(key)
+	c.evictReason = flowEndReasonLackOfResources
+}
+
+// UpdateFlow accounts a packet in the cache, c.lock must be held
 func (c *Cache) UpdateFlow(flow Flow) {
-	flowEndReason := uint8(0)
 	key := flow.key.Hash()
+	if c.bidirectional {
+		key = flow.key.biflowHash()
+	}
 	existing, ok := c.Flows.Get(key)
 	if ok {
 		existingFlow, casted := existing.(Flow)
 		if casted {
-			existingFlow.packetDeltaCount++
-			existingFlow.octetDeltaCount += flow.octetDeltaCount
-			existingFlow.end = flow.end
-			existingFlow.tcpControlBits |= flow.tcpControlBits
-			if uint32(flow.end.Sub(existingFlow.end).Seconds()) > c.idleTimeout {
-				flowEndReason = flowEndReasonIdleTimeout
+			if flow.end.After(c.idleDeadline(existingFlow)) {
+				// The packet starts a new flow
+				c.remove(key, flowEndReasonIdleTimeout)
+			} else if flow.end.After(c.activeDeadline(existingFlow)) {
+				c.remove(key, flowEndReasonActiveTimeout)
 			} else {
-				if existingFlow.tcpControlBits&tcpControlBitsFIN > 0 {
-					flowEndReason = flowEndReasonEndOfFlow
-				} else if uint32(existingFlow.end.Sub(existingFlow.start).Seconds()) > c.activeTimeout {
-					flowEndReason = flowEndReasonActiveTimeout
+				if c.bidirectional && !flow.key.SameDirection(existingFlow.key) {
+					if existingFlow.reversePacketDeltaCount == 0 {
+						existingFlow.reverseStart = flow.start
+					}
+					existingFlow.reversePacketDeltaCount += flow.packetDeltaCount
+					existingFlow.reverseOctetDeltaCount += flow.octetDeltaCount
+					existingFlow.reverseEnd = flow.end
+					existingFlow.reverseTcpControlBits |= flow.tcpControlBits
+				} else {
+					existingFlow.packetDeltaCount += flow.packetDeltaCount
+					existingFlow.octetDeltaCount += flow.octetDeltaCount
+					existingFlow.tcpControlBits |= flow.tcpControlBits
+				}
+				if flow.end.After(existingFlow.end) {
+					existingFlow.end = flow.end
 				}
+				flow = existingFlow
 			}
-			flow = existingFlow
 		}
 	}
-	if flowEndReason == 0 {
-		c.Flows.Add(key, flow)
-	} else {
-		c.Flows.Remove(key)
+	c.Flows.Add(key, flow)
+	if c.ended(flow) {
+		c.remove(key, flowEndReasonEndOfFlow)
+		return
+	}
+	c.schedule(key, flow)
+}
+
+// ended tells if the TCP connection of the flow is closed by a reset, or by a FIN.
+// Biflows are kept until both sides have sent their FIN, c.lock must be held.
+func (c *Cache) ended(flow Flow) bool {
+	if (flow.tcpControlBits|flow.reverseTcpControlBits)&tcpControlBitsRST != 0 {
+		return true
+	}
+	if c.bidirectional {
+		return flow.tcpControlBits&tcpControlBitsFIN != 0 && flow.reverseTcpControlBits&tcpControlBitsFIN != 0
 	}
+	return flow.tcpControlBits&tcpControlBitsFIN != 0
 }
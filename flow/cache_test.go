@@ -0,0 +1,297 @@
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testPacketFlow is the flow of a single captured packet
+func testPacketFlow(source string, destination string, sourcePort uint16, destinationPort uint16, flags uint16, at time.Time) Flow {
+	return Flow{
+		key: FlowKey{
+			sourceIPAddress:          net.ParseIP(source).To4(),
+			destinationIPAddress:     net.ParseIP(destination).To4(),
+			sourceTransportPort:      sourcePort,
+			destinationTransportPort: destinationPort,
+			protocolIdentifier:       6,
+			ipVersion:                4,
+		},
+		tcpControlBits:   flags,
+		packetDeltaCount: 1,
+		octetDeltaCount:  60,
+		start:            at,
+		end:              at,
+	}
+}
+
+func newTestCache(t *testing.T, bidirectional bool) (*Cache, chan Flow) {
+	t.Helper()
+	output := make(chan Flow, 64)
+	cache, err := NewCache(64, 15, 1800, output, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.UsePacketTime()
+	cache.UseBiflows(bidirectional)
+	return cache, output
+}
+
+// exported returns the flows that left the cache
+func exported(output chan Flow) []Flow {
+	var flows []Flow
+	for {
+		select {
+		case f := <-output:
+			flows = append(flows, f)
+		default:
+			return flows
+		}
+	}
+}
+
+func TestBiflowTCPClose(t *testing.T) {
+	cache, output := newTestCache(t, true)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	client, server := "192.0.2.1", "198.51.100.2"
+	packets := []Flow{
+		testPacketFlow(client, server, 40000, 80, tcpControlBitsSYN, start),
+		testPacketFlow(server, client, 80, 40000, tcpControlBitsSYN|tcpControlBitsACK, start.Add(time.Millisecond)),
+		testPacketFlow(client, server, 40000, 80, tcpControlBitsACK, start.Add(2*time.Millisecond)),
+		testPacketFlow(client, server, 40000, 80, tcpControlBitsFIN|tcpControlBitsACK, start.Add(3*time.Millisecond)),
+	}
+	for _, packet := range packets {
+		cache.handleFlow(packet)
+	}
+	if flows := exported(output); len(flows) != 0 {
+		t.Fatalf("biflow exported before the FIN of the server: %v", flows)
+	}
+	cache.handleFlow(testPacketFlow(server, client, 80, 40000, tcpControlBitsFIN|tcpControlBitsACK, start.Add(4*time.Millisecond)))
+	flows := exported(output)
+	if len(flows) != 1 {
+		t.Fatalf("%d flows exported after both FIN, expected 1", len(flows))
+	}
+	f := flows[0]
+	if !f.key.sourceIPAddress.Equal(net.ParseIP(client)) || f.key.sourceTransportPort != 40000 {
+		t.Errorf("biflow oriented from %s:%d, expected the client", f.key.sourceIPAddress, f.key.sourceTransportPort)
+	}
+	if f.packetDeltaCount != 3 || f.reversePacketDeltaCount != 2 {
+		t.Errorf("%d forward and %d reverse packets, expected 3 and 2", f.packetDeltaCount, f.reversePacketDeltaCount)
+	}
+	if f.flowEndReason != flowEndReasonEndOfFlow {
+		t.Errorf("end reason %d, expected end of flow", f.flowEndReason)
+	}
+}
+
+func TestBiflowTCPReset(t *testing.T) {
+	cache, output := newTestCache(t, true)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, tcpControlBitsSYN, start))
+	cache.handleFlow(testPacketFlow("198.51.100.2", "192.0.2.1", 80, 40000, tcpControlBitsRST|tcpControlBitsACK, start.Add(time.Millisecond)))
+	flows := exported(output)
+	if len(flows) != 1 || flows[0].reversePacketDeltaCount != 1 || flows[0].flowEndReason != flowEndReasonEndOfFlow {
+		t.Fatalf("reset biflow not ended: %v", flows)
+	}
+}
+
+func TestUnidirectionalFIN(t *testing.T) {
+	cache, output := newTestCache(t, false)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, tcpControlBitsACK, start))
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, tcpControlBitsFIN, start.Add(time.Millisecond)))
+	if flows := exported(output); len(flows) != 1 || flows[0].flowEndReason != flowEndReasonEndOfFlow {
+		t.Fatalf("flow not ended by its FIN: %v", flows)
+	}
+}
+
+func TestUnidirectionalFlows(t *testing.T) {
+	cache, _ := newTestCache(t, false)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, tcpControlBitsSYN, start))
+	cache.handleFlow(testPacketFlow("198.51.100.2", "192.0.2.1", 80, 40000, tcpControlBitsSYN|tcpControlBitsACK, start.Add(time.Millisecond)))
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, tcpControlBitsACK, start.Add(2*time.Millisecond)))
+	flows := cache.Query(FlowQuery{SortBy: "packets"})
+	if len(flows) != 2 {
+		t.Fatalf("directions cached in %d flows, expected 2", len(flows))
+	}
+	if flows[0].key.sourceTransportPort != 40000 || flows[0].packetDeltaCount != 2 || flows[0].tcpControlBits != tcpControlBitsSYN|tcpControlBitsACK {
+		t.Errorf("client flow from port %d: %d packets, flags %d", flows[0].key.sourceTransportPort, flows[0].packetDeltaCount, flows[0].tcpControlBits)
+	}
+	if flows[1].key.sourceTransportPort != 80 || flows[1].packetDeltaCount != 1 || flows[1].reversePacketDeltaCount != 0 {
+		t.Errorf("server flow from port %d: %d packets, %d reverse packets", flows[1].key.sourceTransportPort, flows[1].packetDeltaCount, flows[1].reversePacketDeltaCount)
+	}
+}
+
+func TestBiflowKeyFields(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	request := testPacketFlow("192.0.2.1", "198.51.100.2", 0, 0, 0, start)
+	request.key.protocolIdentifier, request.key.icmpTypeCode = 1, 8<<8
+	reply := testPacketFlow("198.51.100.2", "192.0.2.1", 0, 0, 0, start.Add(time.Millisecond))
+	reply.key.protocolIdentifier, reply.key.icmpTypeCode = 1, 0
+	query := testPacketFlow("192.0.2.1", "198.51.100.2", 5000, 53, 0, start)
+	query.key.protocolIdentifier, query.key.ipClassOfService = 17, 0x28
+	answer := testPacketFlow("198.51.100.2", "192.0.2.1", 53, 5000, 0, start.Add(time.Millisecond))
+	answer.key.protocolIdentifier = 17
+	for _, c := range []struct {
+		name    string
+		packets []Flow
+	}{
+		{"ICMP echo", []Flow{request, reply}},
+		{"class of service", []Flow{query, answer}},
+	} {
+		cache, _ := newTestCache(t, true)
+		for _, packet := range c.packets {
+			cache.handleFlow(packet)
+		}
+		flows := cache.Query(FlowQuery{})
+		if len(flows) != 1 || flows[0].packetDeltaCount != 1 || flows[0].reversePacketDeltaCount != 1 {
+			t.Errorf("%s: directions not merged in one biflow: %v", c.name, flows)
+		}
+	}
+	// Linux cooked headers only have the MAC address of the sender
+	sent, received := query, answer
+	sent.key.sourceMacAddress, sent.key.macAddresses = [6]byte{2, 0, 0, 0, 0, 1}, macSource
+	received.key.sourceMacAddress, received.key.macAddresses = [6]byte{2, 0, 0, 0, 0, 2}, macSource
+	cache, _ := newTestCache(t, true)
+	cache.handleFlow(sent)
+	cache.handleFlow(received)
+	if flows := cache.Query(FlowQuery{}); len(flows) != 1 || flows[0].reversePacketDeltaCount != 1 {
+		t.Errorf("directions of a cooked capture not merged in one biflow: %v", flows)
+	}
+	split := Flow{key: request.key, packetDeltaCount: 1, reversePacketDeltaCount: 1}.Split()
+	if len(split) != 2 || split[1].key.ICMPType() != 0 || split[0].key.ICMPType() != 8 {
+		t.Errorf("ICMP echo biflow split in types %d and %d, expected 8 and 0", split[0].key.ICMPType(), split[1].key.ICMPType())
+	}
+}
+
+func TestEvictionDoesNotHoldTheLock(t *testing.T) {
+	// Nobody reads the output until the cache answers a query
+	output := make(chan Flow)
+	cache, err := NewCache(64, 15, 1800, output, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.UsePacketTime()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, tcpControlBitsACK, start))
+	expired := make(chan int)
+	go func() { expired <- cache.ExpireAll() }()
+	queried := make(chan []Flow)
+	go func() {
+		// Leave time to ExpireAll to block on the output
+		time.Sleep(50 * time.Millisecond)
+		queried <- cache.Query(FlowQuery{})
+	}()
+	select {
+	case flows := <-queried:
+		if len(flows) != 0 {
+			t.Errorf("%d flows still in the cache after the expiry", len(flows))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("query blocked by the eviction of a flow")
+	}
+	if f := <-output; f.flowEndReason != flowEndReasonForceEnd {
+		t.Errorf("end reason %d, expected a forced end", f.flowEndReason)
+	}
+	if count := <-expired; count != 1 {
+		t.Errorf("%d flows expired, expected 1", count)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	cache, output := newTestCache(t, false)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// A flow idle for more than 15s, another one active for more than 1800s
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, 0, start))
+	for at := time.Duration(0); at <= 1810*time.Second; at += 10 * time.Second {
+		cache.handleFlow(testPacketFlow("192.0.2.3", "198.51.100.2", 40001, 80, 0, start.Add(at)))
+	}
+	flows := exported(output)
+	if len(flows) != 2 {
+		t.Fatalf("%d flows expired, expected 2", len(flows))
+	}
+	if flows[0].key.sourceTransportPort != 40000 || flows[0].flowEndReason != flowEndReasonIdleTimeout || flows[0].packetDeltaCount != 1 {
+		t.Errorf("idle flow: port %d, end reason %d, %d packets", flows[0].key.sourceTransportPort, flows[0].flowEndReason, flows[0].packetDeltaCount)
+	}
+	if flows[1].key.sourceTransportPort != 40001 || flows[1].flowEndReason != flowEndReasonActiveTimeout || flows[1].packetDeltaCount != 181 {
+		t.Errorf("active flow: port %d, end reason %d, %d packets", flows[1].key.sourceTransportPort, flows[1].flowEndReason, flows[1].packetDeltaCount)
+	}
+	// The packet after the active timeout starts a new flow
+	if remaining := cache.Query(FlowQuery{}); len(remaining) != 1 || remaining[0].packetDeltaCount != 1 {
+		t.Errorf("cached flows after the active timeout: %v", remaining)
+	}
+	// Shrinking the cache exports the least recent flows
+	cache.handleFlow(testPacketFlow("192.0.2.4", "198.51.100.2", 40002, 80, 0, start.Add(1811*time.Second)))
+	cache.Resize(1)
+	flows = exported(output)
+	if len(flows) != 1 || flows[0].key.sourceTransportPort != 40001 || flows[0].flowEndReason != flowEndReasonLackOfResources {
+		t.Errorf("flows evicted by the resize: %v", flows)
+	}
+	if len(cache.expiries) != 1 || len(cache.deadlines) != 1 {
+		t.Errorf("%d deadlines left for 1 flow", len(cache.expiries))
+	}
+}
+
+func TestSetTimeoutsKeepsCachedFlows(t *testing.T) {
+	cache, output := newTestCache(t, false)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cache.handleFlow(testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, 0, start))
+	cache.SetTimeouts(60, 1800)
+	cache.handleFlow(testPacketFlow("192.0.2.3", "198.51.100.2", 40001, 80, 0, start.Add(30*time.Second)))
+	if flows := exported(output); len(flows) != 0 {
+		t.Fatalf("flow expired with the previous idle timeout: %v", flows)
+	}
+	cache.handleFlow(testPacketFlow("192.0.2.3", "198.51.100.2", 40001, 80, 0, start.Add(61*time.Second)))
+	flows := exported(output)
+	if len(flows) != 1 || flows[0].key.sourceTransportPort != 40000 || flows[0].flowEndReason != flowEndReasonIdleTimeout {
+		t.Fatalf("flows expired with the new idle timeout: %v", flows)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	cache, _ := newTestCache(t, false)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	web := testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 443, 0, start)
+	web.octetDeltaCount, web.ifIndex = 9000, 2
+	dns := testPacketFlow("192.0.2.3", "198.51.100.53", 5353, 53, 0, start.Add(time.Second))
+	dns.key.protocolIdentifier, dns.packetDeltaCount, dns.ifIndex = 17, 3, 3
+	ssh := testPacketFlow("198.51.100.2", "192.0.2.9", 22, 50000, 0, start.Add(2*time.Second))
+	ssh.octetDeltaCount, ssh.ifIndex = 500, 2
+	for _, f := range []Flow{web, dns, ssh} {
+		cache.handleFlow(f)
+	}
+	for _, c := range []struct {
+		name  string
+		query FlowQuery
+		ports []uint16
+	}{
+		{"by octets", FlowQuery{SortBy: "octets"}, []uint16{40000, 22, 5353}},
+		{"by packets", FlowQuery{SortBy: "packets", Limit: 1}, []uint16{5353}},
+		{"latest first", FlowQuery{SortBy: "start"}, []uint16{22, 5353, 40000}},
+		{"address", FlowQuery{Address: net.ParseIP("198.51.100.2"), SortBy: "end"}, []uint16{22, 40000}},
+		{"port", FlowQuery{Port: 53}, []uint16{5353}},
+		{"protocol and interface", FlowQuery{Protocol: 6, Interface: 2, SortBy: "octets"}, []uint16{40000, 22}},
+		{"no match", FlowQuery{Interface: 4}, nil},
+	} {
+		flows := cache.Query(c.query)
+		var ports []uint16
+		for _, f := range flows {
+			ports = append(ports, f.key.sourceTransportPort)
+		}
+		if len(ports) != len(c.ports) {
+			t.Errorf("%s: flows from ports %v, expected %v", c.name, ports, c.ports)
+			continue
+		}
+		for i := range ports {
+			if ports[i] != c.ports[i] {
+				t.Errorf("%s: flows from ports %v, expected %v", c.name, ports, c.ports)
+				break
+			}
+		}
+	}
+	// Queries do not change which flow is evicted first
+	cache.Resize(2)
+	if remaining := cache.Query(FlowQuery{SortBy: "start"}); len(remaining) != 2 || remaining[1].key.sourceTransportPort != 5353 {
+		t.Errorf("flows left after the resize: %v", remaining)
+	}
+}
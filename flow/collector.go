@@ -0,0 +1,209 @@
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+)
+
+const maxDatagramSize = 65535
+
+// CollectorOptions selects the listening addresses of the collector, an empty address disables the transport
+type CollectorOptions struct {
+	UDPAddress             string // Netflow v5, v9 and IPFIX
+	TCPAddress             string // IPFIX only
+	GeoEnterpriseNumber    uint32 // Private Enterprise Number of the GeoIP fields sent by ripflow probes
+	TunnelEnterpriseNumber uint32 // Private Enterprise Number of the tunnel fields sent by ripflow probes
+	Relay                  bool   // Keep the flows of each exporter apart when they are aggregated in the cache
+}
+
+// Collector receives Netflow and IPFIX messages and sends the decoded flows to its output
+type Collector struct {
+	output      chan Flow
+	decoder     *messageDecoder
+	relay       bool
+	udp         net.PacketConn
+	tcp         net.Listener
+	connections map[net.Conn]bool
+	workers     sync.WaitGroup
+	closed      bool
+	lock        sync.Mutex
+	log         *log.Entry
+}
+
+func NewCollector(options CollectorOptions, output chan Flow, logger *log.Entry) (*Collector, error) {
+	collector := &Collector{
+		output:      output,
+		decoder:     newMessageDecoder(options.GeoEnterpriseNumber, options.TunnelEnterpriseNumber),
+		relay:       options.Relay,
+		connections: make(map[net.Conn]bool),
+		log:         logger.WithField("component", "collector"),
+	}
+	if len(options.UDPAddress) == 0 && len(options.TCPAddress) == 0 {
+		return nil, errors.New("no collector listening address")
+	}
+	var err error
+	if len(options.UDPAddress) > 0 {
+		if collector.udp, err = net.ListenPacket("udp", options.UDPAddress); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.TCPAddress) > 0 {
+		if collector.tcp, err = net.Listen("tcp", options.TCPAddress); err != nil {
+			if collector.udp != nil {
+				_ = collector.udp.Close()
+			}
+			return nil, err
+		}
+	}
+	return collector, nil
+}
+
+func (c *Collector) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// handle decodes a message and sends its flows to the output
+func (c *Collector) handle(source string, exporter string, message []byte) {
+	collectorMessagesMetric.With(exporter).Inc()
+	flows, skipped, err := c.decoder.decode(source, message)
+	if err != nil {
+		collectorErrorsMetric.With(exporter).Inc()
+		c.log.Debugf("Cannot decode message from %s: %s", source, err)
+	}
+	if skipped > 0 {
+		collectorUnknownTemplateMetric.With(exporter).Add(uint64(skipped))
+		c.log.Debugf("Skipped %d data sets of unknown templates from %s", skipped, source)
+	}
+	collectorFlowsMetric.With(exporter).Add(uint64(len(flows)))
+	if c.relay {
+		// Identical 5-tuples of two routers are different flows
+		address := net.ParseIP(exporter)
+		for i := range flows {
+			flows[i].key.exporterAddress = address
+		}
+	}
+	for _, flow := range flows {
+		c.output <- flow
+	}
+}
+
+func (c *Collector) listenUDP() {
+	defer c.workers.Done()
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, address, err := c.udp.ReadFrom(buffer)
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			c.log.Errorf("Cannot read datagram: %s", err)
+			continue
+		}
+		exporter := address.String()
+		if udpAddress, ok := address.(*net.UDPAddr); ok {
+			exporter = udpAddress.IP.String()
+		}
+		// Templates belong to the transport session, identified by the exporter address and port
+		c.handle(address.String(), exporter, buffer[:n])
+	}
+}
+
+func (c *Collector) listenTCP() {
+	defer c.workers.Done()
+	for {
+		connection, err := c.tcp.Accept()
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			c.log.Errorf("Cannot accept connection: %s", err)
+			continue
+		}
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			_ = connection.Close()
+			return
+		}
+		c.connections[connection] = true
+		c.workers.Add(1)
+		c.lock.Unlock()
+		go c.readStream(connection)
+	}
+}
+
+// readStream reads the IPFIX messages of a TCP connection
+func (c *Collector) readStream(connection net.Conn) {
+	defer c.workers.Done()
+	source := connection.RemoteAddr().String()
+	exporter := source
+	if tcpAddress, ok := connection.RemoteAddr().(*net.TCPAddr); ok {
+		exporter = tcpAddress.IP.String()
+	}
+	c.log.Infof("Exporter %s connected", source)
+	defer func() {
+		c.decoder.forget(source)
+		c.lock.Lock()
+		delete(c.connections, connection)
+		c.lock.Unlock()
+		_ = connection.Close()
+	}()
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		if _, err := io.ReadFull(connection, buffer[:ipfixHeaderSize]); err != nil {
+			if err != io.EOF && !c.isClosed() {
+				c.log.Warnf("Connection from %s lost: %s", source, err)
+			}
+			return
+		}
+		version := binary.BigEndian.Uint16(buffer)
+		length := int(binary.BigEndian.Uint16(buffer[2:]))
+		if version != ipfixVersionNumber || length < ipfixHeaderSize {
+			collectorErrorsMetric.With(exporter).Inc()
+			c.log.Errorf("Closing connection from %s: invalid IPFIX message header", source)
+			return
+		}
+		if _, err := io.ReadFull(connection, buffer[ipfixHeaderSize:length]); err != nil {
+			c.log.Warnf("Connection from %s lost: %s", source, err)
+			return
+		}
+		c.handle(source, exporter, buffer[:length])
+	}
+}
+
+func (c *Collector) Start() error {
+	if c.udp != nil {
+		c.workers.Add(1)
+		go c.listenUDP()
+		c.log.Infof("Listening on %s/udp", c.udp.LocalAddr())
+	}
+	if c.tcp != nil {
+		c.workers.Add(1)
+		go c.listenTCP()
+		c.log.Infof("Listening on %s/tcp", c.tcp.Addr())
+	}
+	return nil
+}
+
+func (c *Collector) Stop() error {
+	c.lock.Lock()
+	c.closed = true
+	if c.udp != nil {
+		_ = c.udp.Close()
+	}
+	if c.tcp != nil {
+		_ = c.tcp.Close()
+	}
+	for connection := range c.connections {
+		_ = connection.Close()
+	}
+	c.lock.Unlock()
+	c.workers.Wait()
+	return nil
+}
@@ -0,0 +1,329 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// exportMessages exports the flows and returns the messages received by the collector
+func exportMessages(t *testing.T, options ExportOptions, flows []Flow, messages int) [][]byte {
+	t.Helper()
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, options)
+	for _, f := range flows {
+		if err := exporter.Export(f); err != nil {
+			t.Fatalf("cannot export: %s", err)
+		}
+		if err := exporter.Flush(); err != nil {
+			t.Fatalf("cannot flush: %s", err)
+		}
+	}
+	received := make([][]byte, messages)
+	for i := range received {
+		received[i] = collector.receive()
+	}
+	return received
+}
+
+// netflow9Message returns a Netflow v9 header followed by the FlowSets
+func netflow9Message(sets ...[]byte) []byte {
+	message := make([]byte, netflow9HeaderSize)
+	binary.BigEndian.PutUint16(message, 9)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(sets)))
+	binary.BigEndian.PutUint32(message[8:], uint32(time.Now().Unix()))
+	for _, set := range sets {
+		message = append(message, set...)
+	}
+	return message
+}
+
+// flowSet returns a FlowSet of the given ID holding the 16 bit values
+func flowSet(id uint16, values ...uint16) []byte {
+	set := make([]byte, flowSetHeaderSize+2*len(values))
+	binary.BigEndian.PutUint16(set, id)
+	binary.BigEndian.PutUint16(set[2:], uint16(len(set)))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(set[flowSetHeaderSize+2*i:], value)
+	}
+	return set
+}
+
+// compareFlows checks the decoded flows against the exported ones, times are compared within precision
+func compareFlows(t *testing.T, expected []Flow, decoded []Flow, precision time.Duration) {
+	t.Helper()
+	if len(decoded) != len(expected) {
+		t.Fatalf("decoded %d flows, expected %d", len(decoded), len(expected))
+	}
+	for i := range expected {
+		want, got := expected[i], decoded[i]
+		if !reflect.DeepEqual(got.key, want.key) {
+			t.Errorf("flow %d: key %+v, expected %+v", i, got.key, want.key)
+		}
+		if got.octetDeltaCount != want.octetDeltaCount || got.packetDeltaCount != want.packetDeltaCount {
+			t.Errorf("flow %d: counters %d/%d, expected %d/%d", i,
+				got.octetDeltaCount, got.packetDeltaCount, want.octetDeltaCount, want.packetDeltaCount)
+		}
+		if got.tcpControlBits != want.tcpControlBits || got.ifIndex != want.ifIndex || got.outputInterface != want.outputInterface {
+			t.Errorf("flow %d: flags %d, interfaces %d/%d, expected %d, %d/%d", i,
+				got.tcpControlBits, got.ifIndex, got.outputInterface, want.tcpControlBits, want.ifIndex, want.outputInterface)
+		}
+		if got.samplingInterval != want.samplingInterval || got.samplingAlgorithm != want.samplingAlgorithm {
+			t.Errorf("flow %d: sampling %d/%d, expected %d/%d", i,
+				got.samplingAlgorithm, got.samplingInterval, want.samplingAlgorithm, want.samplingInterval)
+		}
+		if got.sourceAS != want.sourceAS || got.destinationAS != want.destinationAS ||
+			got.sourcePrefixLength != want.sourcePrefixLength || got.destinationPrefixLength != want.destinationPrefixLength {
+			t.Errorf("flow %d: AS %d/%d prefixes %d/%d, expected %d/%d %d/%d", i,
+				got.sourceAS, got.destinationAS, got.sourcePrefixLength, got.destinationPrefixLength,
+				want.sourceAS, want.destinationAS, want.sourcePrefixLength, want.destinationPrefixLength)
+		}
+		if !got.nextHop.Equal(want.nextHop) {
+			t.Errorf("flow %d: next hop %s, expected %s", i, got.nextHop, want.nextHop)
+		}
+		if d := got.start.Sub(want.start); d < -precision || d > precision {
+			t.Errorf("flow %d: start %s, expected %s", i, got.start, want.start)
+		}
+		if d := got.end.Sub(want.end); d < -precision || d > precision {
+			t.Errorf("flow %d: end %s, expected %s", i, got.end, want.end)
+		}
+	}
+}
+
+// checkTemplateElements checks that the templates only use the elements of their IP version
+func checkTemplateElements(t *testing.T, decoder *messageDecoder, domain uint32) {
+	t.Helper()
+	ipv4Only := map[uint16]bool{fieldSourceIPv4Address: true, fieldDestinationIPv4Address: true,
+		fieldSourceIPv4PrefixLength: true, fieldDestinationIPv4PrefixLength: true,
+		fieldIPNextHopIPv4Address: true, fieldIcmpTypeCodeIPv4: true, fieldFragmentIdentification: true}
+	ipv6Only := map[uint16]bool{fieldSourceIPv6Address: true, fieldDestinationIPv6Address: true,
+		fieldSourceIPv6PrefixLength: true, fieldDestinationIPv6PrefixLength: true,
+		fieldIPNextHopIPv6Address: true, fieldIcmpTypeCodeIPv6: true, fieldFlowLabelIPv6: true}
+	for _, c := range []struct {
+		id        uint16
+		forbidden map[uint16]bool
+		required  map[uint16]bool
+	}{
+		{templateIDIPv4, ipv6Only, ipv4Only},
+		{templateIDIPv6, ipv4Only, ipv6Only},
+	} {
+		received, found := decoder.templates[templateKey{"test", domain, c.id}]
+		if !found {
+			t.Fatalf("template %d not received", c.id)
+		}
+		used := make(map[uint16]bool)
+		for _, field := range received.fields {
+			if field.enterprise != 0 {
+				continue
+			}
+			used[field.id] = true
+			if c.forbidden[field.id] {
+				t.Errorf("template %d uses element %d of the other IP version", c.id, field.id)
+			}
+		}
+		for id := range c.required {
+			if !used[id] {
+				t.Errorf("template %d lacks element %d", c.id, id)
+			}
+		}
+	}
+}
+
+func TestNetflow9RoundTrip(t *testing.T) {
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, ExportOptions{Version: 9, SourceID: 7})
+	flows := testFlows()
+	for _, f := range flows {
+		if err := exporter.Export(f); err != nil {
+			t.Fatalf("cannot export: %s", err)
+		}
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("cannot flush: %s", err)
+	}
+	decoder := newMessageDecoder(0, 0)
+	decoded, skipped, err := decoder.decode("test", collector.receive())
+	if err != nil || skipped != 0 {
+		t.Fatalf("cannot decode: %v, %d data sets skipped", err, skipped)
+	}
+	checkTemplateElements(t, decoder, 7)
+	// The export time of the header has a second precision
+	compareFlows(t, flows, decoded, time.Second)
+}
+
+func TestIPFIXRoundTrip(t *testing.T) {
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, ExportOptions{Version: 10, SourceID: 9})
+	flows := testFlows()
+	for _, f := range flows {
+		if err := exporter.Export(f); err != nil {
+			t.Fatalf("cannot export: %s", err)
+		}
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("cannot flush: %s", err)
+	}
+	decoder := newMessageDecoder(0, 0)
+	decoded, skipped, err := decoder.decode("test", collector.receive())
+	if err != nil || skipped != 0 {
+		t.Fatalf("cannot decode: %v, %d data sets skipped", err, skipped)
+	}
+	checkTemplateElements(t, decoder, 9)
+	compareFlows(t, flows, decoded, 0)
+}
+
+func TestNetflow5RoundTrip(t *testing.T) {
+	f := testFlows()[0]
+	message := exportMessages(t, ExportOptions{Version: 5}, []Flow{f}, 1)[0]
+	decoded, skipped, err := newMessageDecoder(0, 0).decode("test", message)
+	if err != nil || skipped != 0 {
+		t.Fatalf("cannot decode: %v, %d data sets skipped", err, skipped)
+	}
+	// Netflow v5 has no VLAN, MAC addresses nor fragment identification, and 16 bit AS numbers
+	f.key.vlanId, f.key.sourceMacAddress, f.key.destinationMacAddress, f.key.fragmentIdentification = 0, [6]byte{}, [6]byte{}, 0
+	f.key.macAddresses = 0
+	f.destinationAS = asTrans
+	compareFlows(t, []Flow{f}, decoded, 2*time.Millisecond)
+}
+
+func TestUnknownTemplateSets(t *testing.T) {
+	// Templates are only sent with the first message using them
+	tcp := testFlows()[0]
+	messages := exportMessages(t, ExportOptions{Version: 9, SourceID: 7}, []Flow{tcp, tcp}, 2)
+	decoder := newMessageDecoder(0, 0)
+	flows, skipped, err := decoder.decode("test", messages[1])
+	if err != nil || len(flows) != 0 || skipped != 1 {
+		t.Fatalf("message received before the templates: %d flows, %d data sets skipped, error %v, expected 1 skipped set",
+			len(flows), skipped, err)
+	}
+	if flows, _, err := decoder.decode("test", messages[0]); err != nil || len(flows) != 1 {
+		t.Fatalf("message with templates: %d flows, error %v", len(flows), err)
+	}
+	// A data set of an unknown template does not stop the decoding of the next sets
+	unknown := append(append(append([]byte{}, messages[1][:netflow9HeaderSize]...), flowSet(999, 1, 2)...), messages[1][netflow9HeaderSize:]...)
+	flows, skipped, err = decoder.decode("test", unknown)
+	if err != nil || skipped != 1 {
+		t.Fatalf("%d data sets skipped, error %v, expected 1 skipped set", skipped, err)
+	}
+	compareFlows(t, []Flow{tcp}, flows, time.Second)
+}
+
+func TestNetflow9TemplateIDs(t *testing.T) {
+	decoder := newMessageDecoder(0, 0)
+	// Template 300 with a single IPv4 source address, followed by padding
+	valid := netflow9Message(flowSet(netflow9TemplateFlowSetID, 300, 1, fieldSourceIPv4Address, 4, 0, 0))
+	if _, _, err := decoder.decode("test", valid); err != nil {
+		t.Fatalf("padded template FlowSet rejected: %s", err)
+	}
+	if _, found := decoder.templates[templateKey{"test", 0, 300}]; !found {
+		t.Error("template 300 not stored")
+	}
+	if len(decoder.templates) != 1 {
+		t.Errorf("%d templates stored, expected 1", len(decoder.templates))
+	}
+	for _, c := range []struct {
+		name    string
+		message []byte
+	}{
+		{"template", netflow9Message(flowSet(netflow9TemplateFlowSetID, 255, 1, fieldSourceIPv4Address, 4))},
+		{"options template", netflow9Message(flowSet(netflow9OptionsTemplateFlowSetID, 2, 4, 4, 1, 4, fieldSourceIPv4Address, 4))},
+	} {
+		if _, _, err := decoder.decode("test", c.message); err == nil {
+			t.Errorf("%s with an ID below 256 accepted", c.name)
+		}
+	}
+	if len(decoder.templates) != 1 {
+		t.Errorf("%d templates stored, invalid templates kept", len(decoder.templates))
+	}
+}
+
+func TestCollector(t *testing.T) {
+	output := make(chan Flow, 16)
+	collector, err := NewCollector(CollectorOptions{UDPAddress: "127.0.0.1:0", TCPAddress: "127.0.0.1:0"}, output, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collector.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Stop()
+	for _, c := range []struct {
+		options ExportOptions
+		port    int
+	}{
+		{ExportOptions{Version: 9, SourceID: 1}, collector.udp.LocalAddr().(*net.UDPAddr).Port},
+		{ExportOptions{Version: 10, SourceID: 2, Transport: "tcp"}, collector.tcp.Addr().(*net.TCPAddr).Port},
+	} {
+		exporter, err := NewExporter("127.0.0.1", uint16(c.port), c.options, testLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter.BaseTime = time.Now().Add(-time.Hour)
+		flows := testFlows()
+		for _, f := range flows {
+			if err := exporter.Export(f); err != nil {
+				t.Fatalf("version %d: cannot export: %s", c.options.Version, err)
+			}
+		}
+		if err := exporter.Stop(); err != nil {
+			t.Fatalf("version %d: cannot flush: %s", c.options.Version, err)
+		}
+		var received []Flow
+		for range flows {
+			select {
+			case f := <-output:
+				received = append(received, f)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("version %d: %d flows received, expected %d", c.options.Version, len(received), len(flows))
+			}
+		}
+		compareFlows(t, flows, received, time.Second)
+	}
+}
+
+func TestRelayKeepsExportersApart(t *testing.T) {
+	output := make(chan Flow, 16)
+	relay, err := NewCollector(CollectorOptions{UDPAddress: "127.0.0.1:0", Relay: true}, output, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Stop()
+	port := uint16(relay.udp.LocalAddr().(*net.UDPAddr).Port)
+	f := testFlows()[0]
+	// Two routers export the same 5-tuple
+	for _, source := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)} {
+		exporter, err := NewExporter("127.0.0.1", port, ExportOptions{Version: 5, SourceAddress: source}, testLogger())
+		if err != nil {
+			t.Skipf("cannot export from %s: %s", source, err)
+		}
+		if err := exporter.Export(f); err != nil {
+			t.Fatal(err)
+		}
+		if err := exporter.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache, _ := newTestCache(t, false)
+	for i := 0; i < 2; i++ {
+		select {
+		case relayed := <-output:
+			cache.handleFlow(relayed)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%d flows relayed, expected 2", i)
+		}
+	}
+	flows := cache.Query(FlowQuery{})
+	if len(flows) != 2 {
+		t.Fatalf("%d cached flows, expected one per router", len(flows))
+	}
+	for _, cached := range flows {
+		if cached.packetDeltaCount != f.packetDeltaCount {
+			t.Errorf("flow of %s counts %d packets, expected %d", cached.key.exporterAddress, cached.packetDeltaCount, f.packetDeltaCount)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package flow
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"time"
+)
+
+// collectorConnection sends datagrams or stream messages to a collector,
+// reconnecting when the collector is unreachable
+type collectorConnection struct {
+	connection         net.Conn
+	address            string
+	transport          string
+	sourceAddress      net.IP // Local address of the datagrams or stream, any when nil
+	lastConnectAttempt time.Time
+	log                *log.Entry
+}
+
+func newCollectorConnection(destinationAddress string, destinationPort uint16, transport string, logger *log.Entry) collectorConnection {
+	return collectorConnection{
+		address:   net.JoinHostPort(destinationAddress, strconv.Itoa(int(destinationPort))),
+		transport: transport,
+		log:       logger,
+	}
+}
+
+func (c *collectorConnection) connect() error {
+	c.lastConnectAttempt = time.Now()
+	dialer := net.Dialer{}
+	if c.sourceAddress != nil {
+		switch c.transport {
+		case "udp":
+			dialer.LocalAddr = &net.UDPAddr{IP: c.sourceAddress}
+		case "tcp":
+			dialer.LocalAddr = &net.TCPAddr{IP: c.sourceAddress}
+		}
+	}
+	connection, err := dialer.Dial(c.transport, c.address)
+	if err != nil {
+		return err
+	}
+	c.connection = connection
+	return nil
+}
+
+// reconnect connects again to the collector when the connection was lost,
+// it tells if a new connection was opened
+func (c *collectorConnection) reconnect() (bool, error) {
+	if c.connection != nil {
+		return false, nil
+	}
+	if time.Since(c.lastConnectAttempt) < reconnectDelay {
+		return false, fmt.Errorf("not connected to collector %s", c.address)
+	}
+	if err := c.connect(); err != nil {
+		return false, err
+	}
+	c.log.Infof("Connected to collector %s", c.address)
+	return true, nil
+}
+
+func (c *collectorConnection) write(message []byte) error {
+	if _, err := c.reconnect(); err != nil {
+		return err
+	}
+	if c.transport == "tcp" {
+		_ = c.connection.SetWriteDeadline(time.Now().Add(reconnectDelay))
+	}
+	_, err := c.connection.Write(message)
+	if err != nil && c.transport == "tcp" {
+		c.log.Warnf("Connection to collector %s lost: %s", c.address, err)
+		_ = c.connection.Close()
+		c.connection = nil
+	}
+	return err
+}
+
+func (c *collectorConnection) close() error {
+	if c.connection == nil {
+		return nil
+	}
+	return c.connection.Close()
+}
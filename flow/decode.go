@@ -0,0 +1,506 @@
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	netflow9OptionsTemplateFlowSetID = 1
+	ipfixOptionsTemplateSetID        = 3
+	minDataSetID                     = 256
+	variableLength                   = 0xffff
+)
+
+var (
+	errTruncated       = errors.New("truncated message")
+	errUnknownTemplate = errors.New("unknown template")
+)
+
+// templateKey identifies a template announced by an exporter in one observation domain
+type templateKey struct {
+	source string
+	domain uint32
+	id     uint16
+}
+
+// receivedTemplate describes the data records of an exporter, options records are skipped
+type receivedTemplate struct {
+	fields  []templateField
+	options bool
+}
+
+// messageDecoder decodes Netflow v5, v9 and IPFIX messages, keeping the templates of each exporter
+type messageDecoder struct {
+	templates              map[templateKey]receivedTemplate
+	geoEnterpriseNumber    uint32
+	tunnelEnterpriseNumber uint32
+	lock                   sync.Mutex
+}
+
+func newMessageDecoder(geoEnterpriseNumber uint32, tunnelEnterpriseNumber uint32) *messageDecoder {
+	return &messageDecoder{
+		templates:              make(map[templateKey]receivedTemplate),
+		geoEnterpriseNumber:    geoEnterpriseNumber,
+		tunnelEnterpriseNumber: tunnelEnterpriseNumber,
+	}
+}
+
+// decode returns the flows of a message received from source and the number of data sets
+// skipped as their template is not known yet
+func (d *messageDecoder) decode(source string, message []byte) ([]Flow, int, error) {
+	if len(message) < 2 {
+		return nil, 0, errTruncated
+	}
+	switch version := binary.BigEndian.Uint16(message); version {
+	case 5:
+		flows, err := decodeNetflow5(message)
+		return flows, 0, err
+	case 9:
+		return d.decodeNetflow9(source, message)
+	case ipfixVersionNumber:
+		return d.decodeIPFIX(source, message)
+	default:
+		return nil, 0, fmt.Errorf("unsupported Netflow version %d", version)
+	}
+}
+
+// forget drops the templates of a source whose transport session ended
+func (d *messageDecoder) forget(source string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key := range d.templates {
+		if key.source == source {
+			delete(d.templates, key)
+		}
+	}
+}
+
+func decodeNetflow5(message []byte) ([]Flow, error) {
+	if len(message) < netflow5HeaderSize {
+		return nil, errTruncated
+	}
+	count := int(binary.BigEndian.Uint16(message[2:]))
+	if available := (len(message) - netflow5HeaderSize) / netflow5RecordSize; count > available {
+		count = available
+	}
+	nanoseconds := binary.BigEndian.Uint32(message[12:])
+	if nanoseconds >= uint32(time.Second) {
+		nanoseconds = 0
+	}
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(message[8:])), int64(nanoseconds))
+	baseTime := exportTime.Add(-time.Duration(binary.BigEndian.Uint32(message[4:])) * time.Millisecond)
+	sampling := binary.BigEndian.Uint16(message[22:])
+	flows := make([]Flow, count)
+	for i := range flows {
+		offset := netflow5HeaderSize + i*netflow5RecordSize
+		flows[i].DeserializeNetflow5(message[offset:offset+netflow5RecordSize], baseTime)
+		if interval := uint32(sampling & maxSamplingInterval); interval > 1 {
+			flows[i].samplingAlgorithm, flows[i].samplingInterval = uint8(sampling>>14), interval
+		}
+	}
+	return flows, nil
+}
+
+func (d *messageDecoder) decodeNetflow9(source string, message []byte) ([]Flow, int, error) {
+	if len(message) < netflow9HeaderSize {
+		return nil, 0, errTruncated
+	}
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(message[8:])), 0)
+	baseTime := exportTime.Add(-time.Duration(binary.BigEndian.Uint32(message[4:])) * time.Millisecond)
+	domain := binary.BigEndian.Uint32(message[16:])
+	var flows []Flow
+	skipped := 0
+	err := walkSets(message[netflow9HeaderSize:], func(id uint16, set []byte) error {
+		switch {
+		case id == netflow9TemplateFlowSetID:
+			return d.readNetflow9Templates(source, domain, set)
+		case id == netflow9OptionsTemplateFlowSetID:
+			return d.readNetflow9OptionsTemplates(source, domain, set)
+		case id >= minDataSetID:
+			decoded, err := d.readDataSet(templateKey{source, domain, id}, set, baseTime, exportTime)
+			if err == errUnknownTemplate {
+				// The templates of a UDP exporter arrive with its next refresh
+				skipped++
+				return nil
+			}
+			flows = append(flows, decoded...)
+			return err
+		}
+		return nil
+	})
+	return flows, skipped, err
+}
+
+func (d *messageDecoder) decodeIPFIX(source string, message []byte) ([]Flow, int, error) {
+	if len(message) < ipfixHeaderSize {
+		return nil, 0, errTruncated
+	}
+	length := int(binary.BigEndian.Uint16(message[2:]))
+	if length < ipfixHeaderSize || length > len(message) {
+		return nil, 0, errTruncated
+	}
+	exportTime := time.Unix(int64(binary.BigEndian.Uint32(message[4:])), 0)
+	domain := binary.BigEndian.Uint32(message[12:])
+	var flows []Flow
+	skipped := 0
+	err := walkSets(message[ipfixHeaderSize:length], func(id uint16, set []byte) error {
+		switch {
+		case id == ipfixTemplateSetID:
+			return d.readIPFIXTemplates(source, domain, set, false)
+		case id == ipfixOptionsTemplateSetID:
+			return d.readIPFIXTemplates(source, domain, set, true)
+		case id >= minDataSetID:
+			// IPFIX has no system uptime, relative times are not used
+			decoded, err := d.readDataSet(templateKey{source, domain, id}, set, exportTime, exportTime)
+			if err == errUnknownTemplate {
+				skipped++
+				return nil
+			}
+			flows = append(flows, decoded...)
+			return err
+		}
+		return nil
+	})
+	return flows, skipped, err
+}
+
+// walkSets calls handle with the ID and content of each set or FlowSet
+func walkSets(buf []byte, handle func(id uint16, set []byte) error) error {
+	for len(buf) >= flowSetHeaderSize {
+		id := binary.BigEndian.Uint16(buf)
+		length := int(binary.BigEndian.Uint16(buf[2:]))
+		if length < flowSetHeaderSize || length > len(buf) {
+			return errTruncated
+		}
+		if err := handle(id, buf[flowSetHeaderSize:length]); err != nil {
+			return err
+		}
+		buf = buf[length:]
+	}
+	return nil
+}
+
+func (d *messageDecoder) setTemplate(key templateKey, template receivedTemplate) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.templates[key] = template
+}
+
+func (d *messageDecoder) readNetflow9Templates(source string, domain uint32, set []byte) error {
+	for len(set) >= 4 {
+		id := binary.BigEndian.Uint16(set)
+		count := int(binary.BigEndian.Uint16(set[2:]))
+		if id < minDataSetID {
+			if id == 0 && count == 0 {
+				// The rest of the FlowSet is padding
+				return nil
+			}
+			return fmt.Errorf("invalid template ID %d", id)
+		}
+		if len(set) < 4+count*4 {
+			return errTruncated
+		}
+		fields := make([]templateField, count)
+		for i := range fields {
+			offset := 4 + i*4
+			fields[i] = templateField{binary.BigEndian.Uint16(set[offset:]), binary.BigEndian.Uint16(set[offset+2:]), 0}
+		}
+		d.setTemplate(templateKey{source, domain, id}, receivedTemplate{fields: fields})
+		set = set[4+count*4:]
+	}
+	return nil
+}
+
+func (d *messageDecoder) readNetflow9OptionsTemplates(source string, domain uint32, set []byte) error {
+	for len(set) >= 6 {
+		id := binary.BigEndian.Uint16(set)
+		// Scope and option lengths are in bytes
+		count := int(binary.BigEndian.Uint16(set[2:])+binary.BigEndian.Uint16(set[4:])) / 4
+		if count == 0 || len(set) < 6+count*4 {
+			// The rest of the FlowSet is padding
+			return nil
+		}
+		if id < minDataSetID {
+			return fmt.Errorf("invalid options template ID %d", id)
+		}
+		fields := make([]templateField, count)
+		for i := range fields {
+			offset := 6 + i*4
+			fields[i] = templateField{binary.BigEndian.Uint16(set[offset:]), binary.BigEndian.Uint16(set[offset+2:]), 0}
+		}
+		d.setTemplate(templateKey{source, domain, id}, receivedTemplate{fields: fields, options: true})
+		set = set[6+count*4:]
+	}
+	return nil
+}
+
+func (d *messageDecoder) readIPFIXTemplates(source string, domain uint32, set []byte, options bool) error {
+	header := 4
+	if options {
+		header = 6
+	}
+	for len(set) >= header {
+		id := binary.BigEndian.Uint16(set)
+		count := int(binary.BigEndian.Uint16(set[2:]))
+		if id < minDataSetID {
+			// Padding or withdrawal of all templates, which only happens over TCP
+			return nil
+		}
+		if count == 0 {
+			d.lock.Lock()
+			delete(d.templates, templateKey{source, domain, id})
+			d.lock.Unlock()
+			set = set[4:]
+			continue
+		}
+		offset := header
+		fields := make([]templateField, count)
+		for i := range fields {
+			if offset+4 > len(set) {
+				return errTruncated
+			}
+			field := templateField{binary.BigEndian.Uint16(set[offset:]), binary.BigEndian.Uint16(set[offset+2:]), 0}
+			offset += 4
+			if field.id&0x8000 != 0 {
+				if offset+4 > len(set) {
+					return errTruncated
+				}
+				field.id &^= 0x8000
+				field.enterprise = binary.BigEndian.Uint32(set[offset:])
+				offset += 4
+			}
+			fields[i] = field
+		}
+		d.setTemplate(templateKey{source, domain, id}, receivedTemplate{fields: fields, options: options})
+		set = set[offset:]
+	}
+	return nil
+}
+
+// readDataSet decodes the records of a data set, relative times are based on baseTime
+func (d *messageDecoder) readDataSet(key templateKey, set []byte, baseTime time.Time, exportTime time.Time) ([]Flow, error) {
+	d.lock.Lock()
+	template, found := d.templates[key]
+	d.lock.Unlock()
+	if !found {
+		return nil, errUnknownTemplate
+	}
+	var flows []Flow
+	for {
+		var f Flow
+		length, ok := d.readRecord(&f, template.fields, set, baseTime)
+		if !ok || length == 0 {
+			// The rest of the set is padding
+			return flows, nil
+		}
+		set = set[length:]
+		if template.options || f.key.sourceIPAddress == nil {
+			continue
+		}
+		if f.key.ipVersion == 0 {
+			f.key.ipVersion = 6
+			if len(f.key.sourceIPAddress) == net.IPv4len {
+				f.key.ipVersion = 4
+			}
+		}
+		if f.start.IsZero() {
+			f.start = exportTime
+		}
+		if f.end.IsZero() {
+			f.end = exportTime
+		}
+		flows = append(flows, f)
+	}
+}
+
+// readRecord decodes one data record and returns its length, false when the set is too short
+func (d *messageDecoder) readRecord(f *Flow, fields []templateField, set []byte, baseTime time.Time) (int, bool) {
+	offset := 0
+	for _, field := range fields {
+		length := int(field.length)
+		if field.length == variableLength {
+			if offset+1 > len(set) {
+				return 0, false
+			}
+			length = int(set[offset])
+			offset++
+			if length == 255 {
+				if offset+2 > len(set) {
+					return 0, false
+				}
+				length = int(binary.BigEndian.Uint16(set[offset:]))
+				offset += 2
+			}
+		}
+		if offset+length > len(set) {
+			return 0, false
+		}
+		value := set[offset : offset+length]
+		offset += length
+		switch {
+		case field.enterprise == reverseInformationElementPEN:
+			f.deserializeReverseField(value, field.id)
+		case d.geoEnterpriseNumber != 0 && field.enterprise == d.geoEnterpriseNumber,
+			d.tunnelEnterpriseNumber != 0 && field.enterprise == d.tunnelEnterpriseNumber:
+			f.deserializePrivateField(value, field.id)
+		case field.enterprise == 0 && field.id&netflow9VendorField != 0:
+			f.deserializePrivateField(value, field.id&^netflow9VendorField)
+		case field.enterprise == 0:
+			f.deserializeField(value, field.id, baseTime)
+		}
+	}
+	return offset, true
+}
+
+// getUint reads a big endian unsigned integer of any length, the mirror of putUint
+func getUint(buf []byte) uint64 {
+	var value uint64
+	for _, b := range buf {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func getString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+// getTunnelAddress reads a tunnel endpoint, nil when unset
+func getTunnelAddress(buf []byte) net.IP {
+	ip := net.IP(buf)
+	if len(buf) != net.IPv6len || ip.Equal(net.IPv6zero) {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return copyIP(ip4)
+	}
+	return copyIP(ip)
+}
+
+func millisecondsTime(milliseconds uint64) time.Time {
+	return time.Unix(int64(milliseconds/1000), int64(milliseconds%1000)*int64(time.Millisecond))
+}
+
+func (f *Flow) deserializePrivateField(buf []byte, id uint16) {
+	switch id {
+	case fieldTunnelType:
+		f.key.tunnelType = uint8(getUint(buf))
+	case fieldTunnelID:
+		f.key.tunnelID = uint32(getUint(buf))
+	case fieldTunnelSourceAddress:
+		f.tunnelSource = getTunnelAddress(buf)
+	case fieldTunnelDestinationAddress:
+		f.tunnelDestination = getTunnelAddress(buf)
+	case fieldSourceCountryCode:
+		f.sourceCountry = getString(buf)
+	case fieldDestinationCountryCode:
+		f.destinationCountry = getString(buf)
+	case fieldSourceCity:
+		f.sourceCity = getString(buf)
+	case fieldDestinationCity:
+		f.destinationCity = getString(buf)
+	}
+}
+
+func (f *Flow) deserializeReverseField(buf []byte, id uint16) {
+	switch id {
+	case fieldOctetDeltaCount:
+		f.reverseOctetDeltaCount = getUint(buf)
+	case fieldPacketDeltaCount:
+		f.reversePacketDeltaCount = getUint(buf)
+	case fieldTCPControlBits:
+		f.reverseTcpControlBits = uint16(getUint(buf))
+	case fieldFlowStartMilliseconds:
+		f.reverseStart = millisecondsTime(getUint(buf))
+	case fieldFlowEndMilliseconds:
+		f.reverseEnd = millisecondsTime(getUint(buf))
+	}
+}
+
+// deserializeField is the mirror of serializeField
+func (f *Flow) deserializeField(buf []byte, id uint16, baseTime time.Time) {
+	switch id {
+	case fieldOctetDeltaCount:
+		f.octetDeltaCount = getUint(buf)
+	case fieldPacketDeltaCount:
+		f.packetDeltaCount = getUint(buf)
+	case fieldProtocolIdentifier:
+		f.key.protocolIdentifier = uint8(getUint(buf))
+	case fieldIPClassOfService:
+		f.key.ipClassOfService = uint8(getUint(buf))
+	case fieldTCPControlBits:
+		f.tcpControlBits = uint16(getUint(buf))
+	case fieldSourceTransportPort:
+		f.key.sourceTransportPort = uint16(getUint(buf))
+	case fieldDestinationTransportPort:
+		f.key.destinationTransportPort = uint16(getUint(buf))
+	case fieldSourceIPv4Address, fieldSourceIPv6Address:
+		f.key.sourceIPAddress = copyIP(buf)
+	case fieldDestinationIPv4Address, fieldDestinationIPv6Address:
+		f.key.destinationIPAddress = copyIP(buf)
+	case fieldIngressInterface:
+		f.ifIndex = uint16(getUint(buf))
+	case fieldEgressInterface:
+		f.outputInterface = uint32(getUint(buf))
+	case fieldIPNextHopIPv4Address, fieldIPNextHopIPv6Address:
+		if nextHop := net.IP(buf); !nextHop.IsUnspecified() {
+			f.nextHop = copyIP(buf)
+		}
+	case fieldFlowStartSysUpTime:
+		f.start = baseTime.Add(time.Duration(getUint(buf)) * time.Millisecond)
+	case fieldFlowEndSysUpTime:
+		f.end = baseTime.Add(time.Duration(getUint(buf)) * time.Millisecond)
+	case fieldFlowStartSeconds:
+		f.start = time.Unix(int64(getUint(buf)), 0)
+	case fieldFlowEndSeconds:
+		f.end = time.Unix(int64(getUint(buf)), 0)
+	case fieldFlowStartMilliseconds:
+		f.start = millisecondsTime(getUint(buf))
+	case fieldFlowEndMilliseconds:
+		f.end = millisecondsTime(getUint(buf))
+	case fieldFlowEndReason:
+		f.flowEndReason = uint8(getUint(buf))
+	case fieldFlowLabelIPv6:
+		f.key.flowLabelIPv6 = uint32(getUint(buf))
+	case fieldIcmpTypeCodeIPv4, fieldIcmpTypeCodeIPv6:
+		f.key.icmpTypeCode = uint16(getUint(buf))
+	case fieldSamplingInterval:
+		f.samplingInterval = uint32(getUint(buf))
+	case fieldSamplingAlgorithm:
+		f.samplingAlgorithm = uint8(getUint(buf))
+	case fieldFragmentIdentification:
+		f.key.fragmentIdentification = uint32(getUint(buf))
+	case fieldSourceMacAddress:
+		copy(f.key.sourceMacAddress[:], buf)
+		if f.key.sourceMacAddress != [6]byte{} {
+			f.key.macAddresses |= macSource
+		}
+	case fieldDestinationMacAddress:
+		copy(f.key.destinationMacAddress[:], buf)
+		if f.key.destinationMacAddress != [6]byte{} {
+			f.key.macAddresses |= macDestination
+		}
+	case fieldVlanId:
+		f.key.vlanId = uint16(getUint(buf))
+	case fieldIPVersion:
+		f.key.ipVersion = uint8(getUint(buf))
+	case fieldBgpSourceAsNumber:
+		f.sourceAS = uint32(getUint(buf))
+	case fieldBgpDestinationAsNumber:
+		f.destinationAS = uint32(getUint(buf))
+	case fieldSourceIPv4PrefixLength, fieldSourceIPv6PrefixLength:
+		f.sourcePrefixLength = uint8(getUint(buf))
+	case fieldDestinationIPv4PrefixLength, fieldDestinationIPv6PrefixLength:
+		f.destinationPrefixLength = uint8(getUint(buf))
+	}
+}
@@ -0,0 +1,94 @@
+package flow
+
+import (
+	"container/heap"
+	"time"
+)
+
+type expiryEntry struct {
+	key      uint64
+	deadline time.Time
+	index    int
+}
+
+// expiryQueue is a min-heap of flow deadlines
+type expiryQueue []*expiryEntry
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*q = old[:n-1]
+	return entry
+}
+
+// idleDeadline is the time after which the flow expires if no packet is seen
+func (c *Cache) idleDeadline(flow Flow) time.Time {
+	return flow.end.Add(time.Duration(c.idleTimeout) * time.Second)
+}
+
+// activeDeadline is the time after which a long lasting flow is exported
+func (c *Cache) activeDeadline(flow Flow) time.Time {
+	return flow.start.Add(time.Duration(c.activeTimeout) * time.Second)
+}
+
+// schedule sets the expiry deadline of the flow stored under key, c.lock must be held
+func (c *Cache) schedule(key uint64, flow Flow) {
+	deadline := c.idleDeadline(flow)
+	if active := c.activeDeadline(flow); active.Before(deadline) {
+		deadline = active
+	}
+	if entry, found := c.deadlines[key]; found {
+		entry.deadline = deadline
+		heap.Fix(&c.expiries, entry.index)
+		return
+	}
+	entry := &expiryEntry{key: key, deadline: deadline}
+	heap.Push(&c.expiries, entry)
+	c.deadlines[key] = entry
+}
+
+// unschedule forgets the deadline of a flow leaving the cache, c.lock must be held
+func (c *Cache) unschedule(key uint64) {
+	if entry, found := c.deadlines[key]; found {
+		heap.Remove(&c.expiries, entry.index)
+		delete(c.deadlines, key)
+	}
+}
+
+// expire exports every flow whose deadline is reached, c.lock must be held
+func (c *Cache) expire(now time.Time) {
+	for len(c.expiries) > 0 && !c.expiries[0].deadline.After(now) {
+		entry := c.expiries[0]
+		reason := flowEndReasonActiveTimeout
+		if raw, found := c.Flows.Peek(entry.key); found {
+			if flow, casted := raw.(Flow); casted && !c.idleDeadline(flow).After(c.activeDeadline(flow)) {
+				reason = flowEndReasonIdleTimeout
+			}
+		}
+		c.remove(entry.key, reason)
+		// The flow was already gone from the cache
+		if len(c.expiries) > 0 && c.expiries[0] == entry {
+			heap.Pop(&c.expiries)
+			delete(c.deadlines, entry.key)
+		}
+	}
+}
@@ -13,90 +13,250 @@ const (
 	netflow5HeaderSize = 24
 	netflow5RecordSize = 48
 	exportBufferSize   = 1400
+	reconnectDelay     = 5 * time.Second
 )
 
+// processStart is the boot time of the system uptime of Netflow messages
+var processStart = time.Now()
+
+// ExportOptions selects the export protocol
+type ExportOptions struct {
+	Version                 uint16        // 5, 9 or 10 (IPFIX)
+	Transport               string        // udp or tcp (IPFIX only)
+	SourceID                uint32        // Netflow v9 source ID or IPFIX observation domain ID
+	TemplateRefreshPackets  uint32        // Number of packets between template refreshes (0 to disable)
+	TemplateRefreshInterval time.Duration // Time between template refreshes (0 to disable)
+	Biflow                  bool          // Export biflows as RFC 5103 records (IPFIX only)
+	GeoEnterpriseNumber     uint32        // Export the GeoIP fields under this PEN with IPFIX, as vendor fields with v9 (0 to disable)
+	TunnelEnterpriseNumber  uint32        // Export the tunnel of decapsulated flows under this PEN with IPFIX, as vendor fields with v9 (0 to disable)
+	SourceAddress           net.IP        // Local address the collector receives the messages from (default: any)
+	Format                  string        // netflow (default) or json
+	JSONOutput              JSONOutputOptions
+}
+
+// Exporter is the sink of the netflow and json formats
 type Exporter struct {
-	Input          chan Flow
-	lastFlow       *Flow
-	usedBufferSize uint32
-	TotalFlowCount uint32
-	BaseTime       time.Time
-	buffer         []byte
-	connection     net.Conn
-	killSwitch     chan int
-	log            *log.Entry
+	collectorConnection
+	lastFlow                *Flow
+	usedBufferSize          uint32
+	TotalFlowCount          uint32
+	BaseTime                time.Time
+	buffer                  []byte
+	version                 uint16
+	biflow                  bool
+	sourceID                uint32
+	sequence                uint32
+	netflow5Sequences       map[uint16]uint32 // By engine type and ID
+	templates               templateSet
+	templateRefreshPackets  uint32
+	templateRefreshInterval time.Duration
+	packetsSinceTemplate    uint32
+	lastTemplate            time.Time
+	announced               map[*template]bool // Templates sent since the last refresh
+	pending                 recordBuffer
+	output                  *jsonOutput
+	interfaceNames          map[uint16]string
 }
 
-func NewExporter(destinationAddress string, destinationPort uint16, maxFlows uint32, logger *log.Entry) (*Exporter, error) {
+func NewExporter(destinationAddress string, destinationPort uint16, options ExportOptions, logger *log.Entry) (*Exporter, error) {
 	logger = logger.WithField("component", "exporter")
-	connection, err := net.Dial("udp4",
-		fmt.Sprintf("%s:%d", destinationAddress, destinationPort))
+	if options.Format == "json" {
+		return newJSONExporter(options, logger)
+	}
+	if len(options.Format) > 0 && options.Format != "netflow" {
+		return nil, fmt.Errorf("unsupported export format %s", options.Format)
+	}
+	if options.Version != 5 && options.Version != 9 && options.Version != 10 {
+		return nil, fmt.Errorf("unsupported Netflow version %d", options.Version)
+	}
+	if options.Biflow && options.Version != 10 {
+		return nil, fmt.Errorf("biflow export requires IPFIX")
+	}
+	if options.GeoEnterpriseNumber == reverseInformationElementPEN || options.TunnelEnterpriseNumber == reverseInformationElementPEN {
+		return nil, fmt.Errorf("enterprise number %d is reserved for reverse elements", reverseInformationElementPEN)
+	}
+	if len(options.Transport) == 0 {
+		options.Transport = "udp"
+	}
+	if options.Transport != "udp" && !(options.Transport == "tcp" && options.Version == 10) {
+		return nil, fmt.Errorf("transport %s not supported with Netflow version %d", options.Transport, options.Version)
+	}
+	exporter := Exporter{
+		BaseTime:                processStart,
+		collectorConnection:     newCollectorConnection(destinationAddress, destinationPort, options.Transport, logger),
+		buffer:                  make([]byte, exportBufferSize),
+		version:                 options.Version,
+		biflow:                  options.Biflow,
+		sourceID:                options.SourceID,
+		templateRefreshPackets:  options.TemplateRefreshPackets,
+		templateRefreshInterval: options.TemplateRefreshInterval,
+		netflow5Sequences:       make(map[uint16]uint32),
+	}
+	exporter.sourceAddress = options.SourceAddress
+	switch options.Version {
+	case 9:
+		exporter.templates = netflow9Templates(options.GeoEnterpriseNumber != 0, options.TunnelEnterpriseNumber != 0)
+	case 10:
+		exporter.templates = ipfixTemplates(options.Biflow, options.GeoEnterpriseNumber, options.TunnelEnterpriseNumber)
+	}
+	if err := exporter.connect(); err != nil {
+		if exporter.transport != "tcp" {
+			return nil, err
+		}
+		// The collector may not be up yet, retry when exporting
+		logger.Warnf("Cannot connect to collector %s: %s", exporter.address, err)
+	}
+	return &exporter, nil
+}
+
+// newJSONExporter writes the flows as JSON lines instead of sending them to a collector
+func newJSONExporter(options ExportOptions, logger *log.Entry) (*Exporter, error) {
+	output, err := newJSONOutput(options.JSONOutput, logger)
 	if err != nil {
 		return nil, err
 	}
 	exporter := Exporter{
-		Input:      make(chan Flow, maxFlows),
-		connection: connection,
-		buffer:     make([]byte, exportBufferSize),
-		killSwitch: make(chan int, 0),
-		log:        logger,
+		BaseTime:       processStart,
+		biflow:         options.Biflow,
+		output:         output,
+		interfaceNames: make(map[uint16]string),
 	}
+	exporter.address = output.name()
+	exporter.log = logger
 	return &exporter, nil
 }
 
-func (e *Exporter) Listen() {
-	for {
-		select {
-		case <-e.killSwitch:
-			e.log.Info("Received a listener kill switch")
-			return
-		case flow := <-e.Input:
-			err := e.ExportNetflow5(flow)
-			if err != nil {
-				e.log.Errorf("Cannot export flow: %s", err)
-			}
+// send writes a message holding records flows to the collector,
+// reconnecting stream transports when needed
+func (e *Exporter) send(message []byte, records int) error {
+	err := e.write(message)
+	if err != nil {
+		if e.transport == "tcp" {
+			// Templates must be sent again on the next stream
+			e.lastTemplate = time.Time{}
 		}
+		return err
 	}
+	exporterDatagramsMetric.With(e.address).Inc()
+	exporterFlowsMetric.With(e.address).Add(uint64(records))
+	return nil
+}
+
+// WriteBatch exports each flow, the errors are reported once for the batch
+func (e *Exporter) WriteBatch(flows []Flow) error {
+	failed := 0
+	var err error
+	for _, flow := range flows {
+		if exportErr := e.Export(flow); exportErr != nil {
+			exporterErrorsMetric.With(e.address).Inc()
+			failed++
+			err = exportErr
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d flows not exported to %s: %s", failed, e.address, err)
+	}
+	return nil
+}
+
+func (e *Exporter) Flush() error {
+	if err := e.flush(); err != nil {
+		exporterErrorsMetric.With(e.address).Inc()
+		return err
+	}
+	return nil
 }
 
 func (e *Exporter) Start() error {
-	go e.Listen()
 	return nil
 }
 
 func (e *Exporter) Stop() error {
-	e.killSwitch <- 1
-	if err := e.flushBuffer(); err != nil {
+	if err := e.Flush(); err != nil {
 		e.log.Errorf("Cannot flush exporter buffer: %s", err)
 	}
-	err := e.connection.Close()
-	if err != nil {
-		return err
+	if e.output != nil {
+		return e.output.close()
+	}
+	return e.close()
+}
+
+// Export encodes the flow with the configured Netflow or IPFIX version.
+// Biflows are split in unidirectional flows unless exported as RFC 5103 records.
+func (e *Exporter) Export(flow Flow) error {
+	if e.biflow {
+		if e.output != nil {
+			return e.ExportJSON(flow)
+		}
+		return e.ExportIPFIX(flow)
+	}
+	for _, unidirectional := range flow.Split() {
+		if err := e.export(unidirectional); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (e *Exporter) export(flow Flow) error {
+	if e.output != nil {
+		return e.ExportJSON(flow)
+	}
+	switch e.version {
+	case 9:
+		return e.ExportNetflow9(flow)
+	case 10:
+		return e.ExportIPFIX(flow)
+	}
+	return e.ExportNetflow5(flow)
+}
+
+func (e *Exporter) flush() error {
+	if e.output != nil {
+		// JSON lines are written unbuffered
+		return nil
+	}
+	switch e.version {
+	case 9:
+		return e.flushNetflow9()
+	case 10:
+		return e.flushIPFIX()
+	}
+	return e.flushBuffer()
+}
+
 func (e *Exporter) ExportNetflow5(flow Flow) error {
 	if flow.key.ipVersion != 4 {
 		e.log.Debugf("Cannot export non IPv4 flow in Netflow V5: %s", flow.String())
 		return errors.New(fmt.Sprintf("IP version %d not supported in Netflow V5", flow.key.ipVersion))
 	}
-	// Create Netflow v5 header
-	if e.usedBufferSize == 0 &&
-		(e.usedBufferSize+netflow5HeaderSize <= exportBufferSize) {
-		binary.BigEndian.PutUint16(e.buffer[0:], uint16(5))  // NetFlow v5 Header constant value
-		e.buffer[20] = uint8(0)                              // engine type
-		e.buffer[21] = uint8(0)                              // engine id
-		binary.BigEndian.PutUint16(e.buffer[22:], uint16(0)) // sample rate
-		e.usedBufferSize = netflow5HeaderSize
+	for _, record := range flow.splitCounters() {
+		if err := e.bufferNetflow5(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) bufferNetflow5(flow Flow) error {
+	// The engine and the sampling rate apply to the whole datagram
+	sampling := netflow5SamplingField(flow.samplingAlgorithm, flow.samplingInterval)
+	if e.usedBufferSize > netflow5HeaderSize &&
+		(e.buffer[20] != flow.engineType || e.buffer[21] != flow.engineID || binary.BigEndian.Uint16(e.buffer[22:]) != sampling) {
+		if err := e.flushBuffer(); err != nil {
+			return err
+		}
 	}
-	e.lastFlow = &flow
-	if e.usedBufferSize+netflow5RecordSize <= exportBufferSize {
-		flow.SerializeNetflow5(e.buffer[e.usedBufferSize:],
-			e.BaseTime)
-		e.usedBufferSize += netflow5RecordSize
+	// Create Netflow v5 header, counters and times are written when flushing
+	if e.usedBufferSize <= netflow5HeaderSize {
+		binary.BigEndian.PutUint16(e.buffer[0:], uint16(5)) // NetFlow v5 Header constant value
+		e.buffer[20] = flow.engineType
+		e.buffer[21] = flow.engineID
+		binary.BigEndian.PutUint16(e.buffer[22:], sampling)
+		e.usedBufferSize = netflow5HeaderSize
 	}
-	// header update
+	flow.SerializeNetflow5(e.buffer[e.usedBufferSize:], e.BaseTime)
+	e.usedBufferSize += netflow5RecordSize
 	if e.usedBufferSize+netflow5RecordSize > exportBufferSize {
 		return e.flushBuffer()
 	}
@@ -104,19 +264,21 @@ func (e *Exporter) ExportNetflow5(flow Flow) error {
 }
 
 func (e *Exporter) flushBuffer() error {
-	if e.usedBufferSize > netflow5HeaderSize && e.lastFlow != nil {
-		flowCount := uint16((exportBufferSize - netflow5HeaderSize) / netflow5RecordSize)
-		e.TotalFlowCount += uint32(flowCount)
-		binary.BigEndian.PutUint16(e.buffer[2:], flowCount)
-		binary.BigEndian.PutUint32(e.buffer[4:],
-			uint32(e.lastFlow.end.Sub(e.BaseTime).Nanoseconds()/int64(time.Millisecond)))
-		binary.BigEndian.PutUint32(e.buffer[8:], uint32(e.lastFlow.end.Unix()))
-		binary.BigEndian.PutUint32(e.buffer[12:],
-			uint32(e.lastFlow.end.UnixNano()-e.lastFlow.end.Unix()*int64(time.Nanosecond)))
-		binary.BigEndian.PutUint32(e.buffer[16:], e.TotalFlowCount)
-		_, err := e.connection.Write(e.buffer[:e.usedBufferSize]) // UDP Send
-		e.usedBufferSize = netflow5HeaderSize
-		return err
+	if e.usedBufferSize <= netflow5HeaderSize {
+		return nil
 	}
-	return nil
+	now := time.Now()
+	records := int(e.usedBufferSize-netflow5HeaderSize) / netflow5RecordSize
+	engine := uint16(e.buffer[20])<<8 | uint16(e.buffer[21])
+	binary.BigEndian.PutUint16(e.buffer[2:], uint16(records))
+	binary.BigEndian.PutUint32(e.buffer[4:], uint32(sysUpTime(now, e.BaseTime)))
+	binary.BigEndian.PutUint32(e.buffer[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(e.buffer[12:], uint32(now.Nanosecond()))
+	// Sequence number of the first record, collectors follow one sequence per engine
+	binary.BigEndian.PutUint32(e.buffer[16:], e.netflow5Sequences[engine])
+	e.netflow5Sequences[engine] += uint32(records)
+	e.TotalFlowCount += uint32(records)
+	err := e.send(e.buffer[:e.usedBufferSize], records)
+	e.usedBufferSize = netflow5HeaderSize
+	return err
 }
@@ -0,0 +1,202 @@
+package flow
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/ripflow/metrics"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// FlowFilter selects the flows sent to a destination, empty criteria match every flow
+type FlowFilter struct {
+	Interfaces []uint16 // Input interface indexes
+	IPVersion  uint8
+	Protocols  []uint8
+}
+
+func (f FlowFilter) Match(flow *Flow) bool {
+	if f.IPVersion > 0 && flow.key.ipVersion != f.IPVersion {
+		return false
+	}
+	if len(f.Interfaces) > 0 {
+		found := false
+		for _, index := range f.Interfaces {
+			if index == flow.ifIndex {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Protocols) > 0 {
+		found := false
+		for _, protocol := range f.Protocols {
+			if protocol == flow.key.protocolIdentifier {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type destination struct {
+	queue   *SinkQueue
+	filter  FlowFilter
+	sampler *sampler
+	dropped *metrics.Counter
+}
+
+// Enricher adds information to the flows leaving the cache
+type Enricher interface {
+	Enrich(flow *Flow)
+}
+
+// Fanout enriches every flow leaving the cache and sends it to the matching destinations
+type Fanout struct {
+	Input        chan Flow
+	enrichers    []Enricher
+	destinations map[string]*destination
+	killSwitch   chan int
+	lock         sync.Mutex
+	log          *log.Entry
+}
+
+func NewFanout(maxFlows uint32, logger *log.Entry) *Fanout {
+	return &Fanout{
+		Input:        make(chan Flow, maxFlows),
+		destinations: make(map[string]*destination),
+		killSwitch:   make(chan int, 0),
+		log:          logger.WithField("component", "fanout"),
+	}
+}
+
+// SetDestination adds or replaces a destination, exporting one flow out of samplingRate flows when above 1.
+// The replaced sink queue is returned so it can be stopped.
+func (f *Fanout) SetDestination(name string, queue *SinkQueue, filter FlowFilter, samplingRate uint32) (*SinkQueue, error) {
+	dest := &destination{queue: queue, filter: filter, dropped: fanoutDroppedMetric.With(name)}
+	if samplingRate > 1 {
+		s, err := newSampler(SamplingRandom, samplingRate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sampling for destination %s: %s", name, err)
+		}
+		dest.sampler = s
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var previous *SinkQueue
+	if existing, found := f.destinations[name]; found {
+		previous = existing.queue
+	}
+	f.destinations[name] = dest
+	return previous, nil
+}
+
+// SetFilter replaces the filter of a destination
+func (f *Fanout) SetFilter(name string, filter FlowFilter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if existing, found := f.destinations[name]; found {
+		existing.filter = filter
+	}
+}
+
+// SetEnrichers replaces the enrichers applied, in order, to each flow
+func (f *Fanout) SetEnrichers(enrichers ...Enricher) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.enrichers = enrichers
+}
+
+// RemoveDestination stops sending flows to a destination and returns its sink queue
+func (f *Fanout) RemoveDestination(name string) *SinkQueue {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	existing, found := f.destinations[name]
+	if !found {
+		return nil
+	}
+	delete(f.destinations, name)
+	return existing.queue
+}
+
+func (f *Fanout) dispatch(flow Flow) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, enricher := range f.enrichers {
+		enricher.Enrich(&flow)
+	}
+	for _, dest := range f.destinations {
+		if !dest.filter.Match(&flow) {
+			continue
+		}
+		if dest.sampler != nil {
+			if !dest.sampler.sample() {
+				continue
+			}
+			sampled := flow
+			// Collectors scale counts with the product of packet and flow sampling rates
+			interval := dest.sampler.interval
+			if sampled.samplingInterval > 1 {
+				interval *= sampled.samplingInterval
+			}
+			if interval > maxSamplingInterval {
+				interval = maxSamplingInterval
+			}
+			sampled.samplingInterval = interval
+			if sampled.samplingAlgorithm == 0 {
+				sampled.samplingAlgorithm = dest.sampler.algorithm
+			}
+			dest.send(sampled)
+			continue
+		}
+		dest.send(flow)
+	}
+}
+
+// send queues the flow for the sink, it is dropped when the sink is late so the other destinations
+// and the configuration changes are not blocked, f.lock being held
+func (dest *destination) send(flow Flow) {
+	select {
+	case dest.queue.Input <- flow:
+	default:
+		dest.dropped.Inc()
+	}
+}
+
+func (f *Fanout) Listen() {
+	for {
+		select {
+		case <-f.killSwitch:
+			f.log.Info("Received a listener kill switch")
+			return
+		case flow := <-f.Input:
+			f.dispatch(flow)
+		}
+	}
+}
+
+func (f *Fanout) Start() error {
+	go f.Listen()
+	return nil
+}
+
+func (f *Fanout) Stop() error {
+	f.killSwitch <- 1
+	// Dispatch flows still waiting in the input queue
+drain:
+	for {
+		select {
+		case flow := <-f.Input:
+			f.dispatch(flow)
+		default:
+			break drain
+		}
+	}
+	return nil
+}
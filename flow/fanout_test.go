@@ -0,0 +1,106 @@
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFanoutDropsFlowsOfFullQueues(t *testing.T) {
+	fanout := NewFanout(16, testLogger())
+	// Neither queue is read, the first one is full after a flow
+	late := NewSinkQueue(nil, 1, nil, testLogger())
+	other := NewSinkQueue(nil, 16, nil, testLogger())
+	if _, err := fanout.SetDestination("test-late", late, FlowFilter{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fanout.SetDestination("test-other", other, FlowFilter{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	dropped := fanoutDroppedMetric.With("test-late")
+	before := dropped.Value()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	done := make(chan struct{})
+	go func() {
+		for i := uint16(0); i < 3; i++ {
+			fanout.dispatch(testPacketFlow("192.0.2.1", "198.51.100.2", 40000+i, 80, 0, start))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("fanout blocked by a full queue")
+	}
+	if count := dropped.Value() - before; count != 2 {
+		t.Errorf("%d flows dropped, expected 2", count)
+	}
+	if len(late.Input) != 1 || len(other.Input) != 3 {
+		t.Errorf("%d and %d flows queued, expected 1 and 3", len(late.Input), len(other.Input))
+	}
+	// The destinations can still be changed
+	if queue := fanout.RemoveDestination("test-late"); queue != late {
+		t.Error("late destination not removed")
+	}
+	f := <-other.Input
+	if !f.key.sourceIPAddress.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("unexpected flow from %s", f.key.sourceIPAddress)
+	}
+}
+
+func TestFanoutFilters(t *testing.T) {
+	fanout := NewFanout(16, testLogger())
+	queues := map[string]*SinkQueue{}
+	for name, filter := range map[string]FlowFilter{
+		"test-all":  {},
+		"test-ipv6": {IPVersion: 6},
+		"test-eth1": {Interfaces: []uint16{2}, Protocols: []uint8{17}},
+	} {
+		queues[name] = NewSinkQueue(nil, 16, nil, testLogger())
+		if _, err := fanout.SetDestination(name, queues[name], filter, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sampled := NewSinkQueue(nil, 16, nil, testLogger())
+	if _, err := fanout.SetDestination("test-sampled", sampled, FlowFilter{}, 4); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tcp := testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, 0, start)
+	tcp.ifIndex = 2
+	udp := testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 53, 0, start)
+	udp.key.protocolIdentifier, udp.ifIndex = 17, 2
+	ipv6 := testPacketFlow("192.0.2.1", "198.51.100.2", 40000, 80, 0, start)
+	ipv6.key.sourceIPAddress, ipv6.key.destinationIPAddress = net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ipv6.key.ipVersion, ipv6.samplingAlgorithm, ipv6.samplingInterval = 6, SamplingDeterministic, 10
+	for i := 0; i < 4; i++ {
+		fanout.dispatch(tcp)
+		fanout.dispatch(udp)
+		fanout.dispatch(ipv6)
+	}
+	for name, count := range map[string]int{"test-all": 12, "test-ipv6": 4, "test-eth1": 4} {
+		if len(queues[name].Input) != count {
+			t.Errorf("%d flows sent to %s, expected %d", len(queues[name].Input), name, count)
+		}
+	}
+	// One flow out of 4 is exported, the packet sampling is combined with the flow sampling
+	if len(sampled.Input) != 3 {
+		t.Fatalf("%d sampled flows out of 12, expected 3", len(sampled.Input))
+	}
+	for len(sampled.Input) > 0 {
+		f := <-sampled.Input
+		expected := uint32(4)
+		if f.key.ipVersion == 6 {
+			expected = 40
+		}
+		if f.samplingInterval != expected || f.samplingAlgorithm == 0 {
+			t.Errorf("flow sampled with %d/%d, expected an interval of %d", f.samplingAlgorithm, f.samplingInterval, expected)
+		}
+	}
+	// The interface was recreated with another index
+	fanout.SetFilter("test-eth1", FlowFilter{Interfaces: []uint16{3}})
+	fanout.dispatch(udp)
+	if len(queues["test-eth1"].Input) != 4 {
+		t.Errorf("flow of the previous interface index sent")
+	}
+}
@@ -71,14 +71,105 @@ func tcpFlag(t *layers.TCP) uint16 {
 }
 
 type Flow struct {
-	octetDeltaCount  uint64
-	packetDeltaCount uint64
-	start            time.Time
-	end              time.Time
-	key              FlowKey
-	tcpControlBits   uint16 // NetFlow version 1, 5, 7
-	flowEndReason    uint8
-	ifIndex          uint16
+	octetDeltaCount         uint64
+	packetDeltaCount        uint64
+	start                   time.Time
+	end                     time.Time
+	key                     FlowKey
+	tcpControlBits          uint16 // NetFlow version 1, 5, 7
+	flowEndReason           uint8
+	ifIndex                 uint16
+	reverseOctetDeltaCount  uint64 // RFC 5103 biflow counters
+	reversePacketDeltaCount uint64
+	reverseTcpControlBits   uint16
+	reverseStart            time.Time
+	reverseEnd              time.Time
+	samplingInterval        uint32
+	samplingAlgorithm       uint8
+	engineType              uint8 // Netflow v5 header, set by the capture
+	engineID                uint8
+	tunnelSource            net.IP // Outer endpoints of decapsulated flows
+	tunnelDestination       net.IP
+	sourceAS                uint32 // Filled by enrichers
+	destinationAS           uint32
+	sourcePrefixLength      uint8
+	destinationPrefixLength uint8
+	nextHop                 net.IP
+	outputInterface         uint32
+	sourceCountry           string // ISO 3166 code
+	sourceCity              string
+	destinationCountry      string
+	destinationCity         string
+}
+
+// asTrans replaces 4-byte AS numbers in 2-byte fields (RFC 6793)
+const asTrans = 23456
+
+func (f *Flow) SourceIP() net.IP {
+	return f.key.sourceIPAddress
+}
+
+func (f *Flow) DestinationIP() net.IP {
+	return f.key.destinationIPAddress
+}
+
+func (f *Flow) SourceAS() uint32 {
+	return f.sourceAS
+}
+
+func (f *Flow) DestinationAS() uint32 {
+	return f.destinationAS
+}
+
+func (f *Flow) SourcePrefixLength() uint8 {
+	return f.sourcePrefixLength
+}
+
+func (f *Flow) DestinationPrefixLength() uint8 {
+	return f.destinationPrefixLength
+}
+
+// SetSourceAS sets the origin AS and prefix length of the source address
+func (f *Flow) SetSourceAS(as uint32, prefixLength uint8) {
+	f.sourceAS, f.sourcePrefixLength = as, prefixLength
+}
+
+// SetDestinationAS sets the origin AS and prefix length of the destination address
+func (f *Flow) SetDestinationAS(as uint32, prefixLength uint8) {
+	f.destinationAS, f.destinationPrefixLength = as, prefixLength
+}
+
+// SetRoute sets the next hop, output interface and prefix length of the route to the destination
+func (f *Flow) SetRoute(nextHop net.IP, outputInterface uint32, prefixLength uint8) {
+	f.nextHop, f.outputInterface, f.destinationPrefixLength = nextHop, outputInterface, prefixLength
+}
+
+// SetSourceGeo sets the country code and city of the source address
+func (f *Flow) SetSourceGeo(country string, city string) {
+	f.sourceCountry, f.sourceCity = country, city
+}
+
+// SetDestinationGeo sets the country code and city of the destination address
+func (f *Flow) SetDestinationGeo(country string, city string) {
+	f.destinationCountry, f.destinationCity = country, city
+}
+
+// Anonymize replaces the IP and MAC addresses of the flow key with the values returned by ip and mac.
+// The functions must return new slices, the addresses are shared with the other destinations.
+func (f *Flow) Anonymize(ip func(net.IP) net.IP, mac func(net.HardwareAddr) net.HardwareAddr) {
+	f.key.sourceIPAddress = ip(f.key.sourceIPAddress)
+	f.key.destinationIPAddress = ip(f.key.destinationIPAddress)
+	f.tunnelSource = ip(f.tunnelSource)
+	f.tunnelDestination = ip(f.tunnelDestination)
+	copy(f.key.sourceMacAddress[:], mac(net.HardwareAddr(f.key.sourceMacAddress[:])))
+	copy(f.key.destinationMacAddress[:], mac(net.HardwareAddr(f.key.destinationMacAddress[:])))
+}
+
+func netflow5AS(as uint32) uint16 {
+	if as > 0xffff {
+		return asTrans
+	}
+	return uint16(as)
 }
 
 func NewFlow(parameters ParserParameters, info gopacket.CaptureInfo, iface net.Interface) Flow {
@@ -90,6 +181,22 @@ func NewFlow(parameters ParserParameters, info gopacket.CaptureInfo, iface net.I
 		case layers.LayerTypeEthernet:
 			copy(key.sourceMacAddress[0:6], parameters.eth.SrcMAC)
 			copy(key.destinationMacAddress[0:6], parameters.eth.DstMAC)
+			key.macAddresses = macSource | macDestination
+		case layers.LayerTypeLinuxSLL:
+			// Only the sender address is known
+			if parameters.sll.AddrType == arphrdEthernet && parameters.sll.AddrLen == 6 {
+				copy(key.sourceMacAddress[0:6], parameters.sll.Addr)
+				key.macAddresses = macSource
+			}
+		case layerTypeLinuxSLL2:
+			if parameters.sll2.AddrType == arphrdEthernet && parameters.sll2.AddrLen == 6 {
+				copy(key.sourceMacAddress[0:6], parameters.sll2.Addr)
+				key.macAddresses = macSource
+			}
+			// The any pseudo-interface has no index, the header tells the interface of each packet
+			if iface.Index == 0 {
+				flow.ifIndex = uint16(parameters.sll2.InterfaceIndex)
+			}
 		case layers.LayerTypeDot1Q:
 			key.vlanId = parameters.dot1q.VLANIdentifier
 		case layers.LayerTypeIPv4:
@@ -125,12 +232,79 @@ func NewFlow(parameters ParserParameters, info gopacket.CaptureInfo, iface net.I
 	return flow
 }
 
+// Split returns the forward flow and, when packets were seen in the reverse direction,
+// the reverse flow of a biflow as two unidirectional flows
+func (f Flow) Split() []Flow {
+	forward := f
+	forward.reverseOctetDeltaCount = 0
+	forward.reversePacketDeltaCount = 0
+	forward.reverseTcpControlBits = 0
+	forward.reverseStart, forward.reverseEnd = time.Time{}, time.Time{}
+	if f.reversePacketDeltaCount == 0 {
+		return []Flow{forward}
+	}
+	reverse := forward
+	reverse.key = f.key.Reverse()
+	reverse.octetDeltaCount = f.reverseOctetDeltaCount
+	reverse.packetDeltaCount = f.reversePacketDeltaCount
+	reverse.tcpControlBits = f.reverseTcpControlBits
+	reverse.start, reverse.end = f.reverseStart, f.reverseEnd
+	reverse.sourceAS, reverse.destinationAS = f.destinationAS, f.sourceAS
+	reverse.sourcePrefixLength, reverse.destinationPrefixLength = f.destinationPrefixLength, f.sourcePrefixLength
+	reverse.sourceCountry, reverse.destinationCountry = f.destinationCountry, f.sourceCountry
+	reverse.sourceCity, reverse.destinationCity = f.destinationCity, f.sourceCity
+	reverse.tunnelSource, reverse.tunnelDestination = f.tunnelDestination, f.tunnelSource
+	// The route to the source is unknown
+	reverse.nextHop, reverse.outputInterface = nil, 0
+	return []Flow{forward, reverse}
+}
+
 func (f *Flow) String() string {
 	return fmt.Sprintf("key:%s, tcpFlag:%d, octets:%d, packet:%d, start:%s, end:%s, iface:%d",
 		f.key.String(), f.tcpControlBits, f.octetDeltaCount,
 		f.packetDeltaCount, f.start.String(), f.end.String(), f.ifIndex)
 }
 
+// maxNetflow5Counter is the largest packet or octet count of a Netflow v5 record
+const maxNetflow5Counter = 1<<32 - 1
+
+// netflow5Time is the system uptime at t of Netflow v5 and v9, flows older than baseTime start at boot
+func netflow5Time(t time.Time, baseTime time.Time) uint32 {
+	if t.Before(baseTime) {
+		return 0
+	}
+	return uint32(sysUpTime(t, baseTime))
+}
+
+// splitCounters divides the flow in records whose counters fit in the 32-bit Netflow v5 fields
+func (f Flow) splitCounters() []Flow {
+	parts := (f.octetDeltaCount + maxNetflow5Counter - 1) / maxNetflow5Counter
+	if packetParts := (f.packetDeltaCount + maxNetflow5Counter - 1) / maxNetflow5Counter; packetParts > parts {
+		parts = packetParts
+	}
+	if parts <= 1 {
+		return []Flow{f}
+	}
+	flows := make([]Flow, parts)
+	for i := range flows {
+		flows[i] = f
+		flows[i].octetDeltaCount = f.octetDeltaCount / parts
+		if uint64(i) < f.octetDeltaCount%parts {
+			flows[i].octetDeltaCount++
+		}
+		flows[i].packetDeltaCount = f.packetDeltaCount / parts
+		if uint64(i) < f.packetDeltaCount%parts {
+			flows[i].packetDeltaCount++
+		}
+		// Collectors reject records without packets, a flow of fewer packets than records,
+		// such as one of IPv6 jumbograms, is accounted one packet per record
+		if flows[i].packetDeltaCount == 0 {
+			flows[i].packetDeltaCount = 1
+		}
+	}
+	return flows
+}
+
 func (f *Flow) SerializeNetflow5(buf []byte, baseTime time.Time) {
 	source := f.key.sourceIPAddress.To4()
 	if source == nil {
@@ -142,13 +316,17 @@ func (f *Flow) SerializeNetflow5(buf []byte, baseTime time.Time) {
 	}
 	copy(buf[0:], source)
 	copy(buf[4:], destination)
-	binary.BigEndian.PutUint32(buf[8:], uint32(0)) // Nexthop Address, cannot lookup always 0
+	if nextHop := f.nextHop.To4(); nextHop != nil {
+		copy(buf[8:], nextHop)
+	} else {
+		binary.BigEndian.PutUint32(buf[8:], uint32(0))
+	}
 	binary.BigEndian.PutUint16(buf[12:], f.ifIndex)
-	binary.BigEndian.PutUint16(buf[14:], uint16(0)) // Output IFIndex, cannot lookup always 0
+	binary.BigEndian.PutUint16(buf[14:], uint16(f.outputInterface))
 	binary.BigEndian.PutUint32(buf[16:], uint32(f.packetDeltaCount))
 	binary.BigEndian.PutUint32(buf[20:], uint32(f.octetDeltaCount))
-	binary.BigEndian.PutUint32(buf[24:], uint32(f.start.Sub(baseTime).Nanoseconds()/int64(time.Millisecond)))
-	binary.BigEndian.PutUint32(buf[28:], uint32(f.end.Sub(baseTime).Nanoseconds()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint32(buf[24:], netflow5Time(f.start, baseTime))
+	binary.BigEndian.PutUint32(buf[28:], netflow5Time(f.end, baseTime))
 	if f.key.icmpTypeCode > 0 {
 		binary.BigEndian.PutUint16(buf[32:], uint16(0))
 		binary.BigEndian.PutUint16(buf[34:], f.key.icmpTypeCode)
@@ -161,9 +339,38 @@ func (f *Flow) SerializeNetflow5(buf []byte, baseTime time.Time) {
 	buf[37] = uint8(f.tcpControlBits)
 	buf[38] = f.key.protocolIdentifier
 	buf[39] = f.key.ipClassOfService
-	binary.BigEndian.PutUint16(buf[40:], uint16(0)) // Source AS, cannot lookup always 0
-	binary.BigEndian.PutUint16(buf[42:], uint16(0)) // Destination AS, cannot lookup always 0
-	buf[44] = uint8(0)                              // Source Address Prefix Length
-	buf[45] = uint8(0)                              // Destination Address Prefix Length
+	binary.BigEndian.PutUint16(buf[40:], netflow5AS(f.sourceAS))
+	binary.BigEndian.PutUint16(buf[42:], netflow5AS(f.destinationAS))
+	buf[44] = f.sourcePrefixLength
+	buf[45] = f.destinationPrefixLength
 	binary.BigEndian.PutUint16(buf[46:], uint16(0)) // padding
 }
+
+// DeserializeNetflow5 reads a Netflow v5 record, the mirror of SerializeNetflow5
+func (f *Flow) DeserializeNetflow5(buf []byte, baseTime time.Time) {
+	f.key.ipVersion = 4
+	f.key.sourceIPAddress = copyIP(buf[0:4])
+	f.key.destinationIPAddress = copyIP(buf[4:8])
+	if nextHop := net.IP(buf[8:12]); !nextHop.Equal(net.IPv4zero) {
+		f.nextHop = copyIP(nextHop)
+	}
+	f.ifIndex = binary.BigEndian.Uint16(buf[12:])
+	f.outputInterface = uint32(binary.BigEndian.Uint16(buf[14:]))
+	f.packetDeltaCount = uint64(binary.BigEndian.Uint32(buf[16:]))
+	f.octetDeltaCount = uint64(binary.BigEndian.Uint32(buf[20:]))
+	f.start = baseTime.Add(time.Duration(binary.BigEndian.Uint32(buf[24:])) * time.Millisecond)
+	f.end = baseTime.Add(time.Duration(binary.BigEndian.Uint32(buf[28:])) * time.Millisecond)
+	f.key.protocolIdentifier = buf[38]
+	if layers.IPProtocol(f.key.protocolIdentifier) == layers.IPProtocolICMPv4 {
+		f.key.icmpTypeCode = binary.BigEndian.Uint16(buf[34:])
+	} else {
+		f.key.sourceTransportPort = binary.BigEndian.Uint16(buf[32:])
+		f.key.destinationTransportPort = binary.BigEndian.Uint16(buf[34:])
+	}
+	f.tcpControlBits = uint16(buf[37])
+	f.key.ipClassOfService = buf[39]
+	f.sourceAS = uint32(binary.BigEndian.Uint16(buf[40:]))
+	f.destinationAS = uint32(binary.BigEndian.Uint16(buf[42:]))
+	f.sourcePrefixLength = buf[44]
+	f.destinationPrefixLength = buf[45]
+}
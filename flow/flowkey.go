@@ -9,6 +9,12 @@ import (
 	"net"
 )
 
+// MAC addresses known in a flow key, raw IP and PPP links have none and Linux cooked headers only the sender
+const (
+	macSource      uint8 = 1
+	macDestination uint8 = 2
+)
+
 type FlowKey struct {
 	sourceIPAddress          net.IP // NetFlow version 1, 5, 7, 8(FullFlow)
 	destinationIPAddress     net.IP // NetFlow version 1, 5, 7, 8(FullFlow)
@@ -20,9 +26,13 @@ type FlowKey struct {
 	vlanId                   uint16
 	sourceMacAddress         [6]byte
 	destinationMacAddress    [6]byte
+	macAddresses             uint8 // macSource and macDestination when the link layer has them
 	protocolIdentifier       uint8 // NetFlow version 1, 5, 7, 8(FullFlow)
 	ipClassOfService         uint8 // NetFlow version 1, 5, 7, 8(FullFlow)
 	ipVersion                uint8
+	tunnelType               uint8 // Set on decapsulated flows, the tunnel ID separates the tenants
+	tunnelID                 uint32
+	exporterAddress          net.IP // Set on relayed flows, the records of each router are aggregated apart
 }
 
 func (fk FlowKey) SortKeyHeader() []byte {
@@ -62,20 +72,84 @@ func (fk FlowKey) SortKeyHeader() []byte {
 	return buf
 }
 
+// SerializeKey serializes the key with its source endpoint first, each direction of a flow has its own key
 func (fk FlowKey) SerializeKey() []byte {
-	buf := make([]byte, 55)
-	copy(buf[0:], fk.SortKeyHeader())
+	buf := make([]byte, 76)
+	copy(buf[0:], fk.sourceIPAddress.To16())
+	binary.BigEndian.PutUint16(buf[16:], fk.sourceTransportPort)
+	copy(buf[18:], fk.sourceMacAddress[0:6])
+	copy(buf[24:], fk.destinationIPAddress.To16())
+	binary.BigEndian.PutUint16(buf[40:], fk.destinationTransportPort)
+	copy(buf[42:], fk.destinationMacAddress[0:6])
 	binary.BigEndian.PutUint16(buf[48:], fk.icmpTypeCode>>8)
 	binary.BigEndian.PutUint16(buf[50:], fk.vlanId)
 	buf[52] = fk.protocolIdentifier
 	buf[53] = fk.ipClassOfService
 	buf[54] = fk.ipVersion
+	buf[55] = fk.tunnelType
+	binary.BigEndian.PutUint32(buf[56:], fk.tunnelID)
+	copy(buf[60:], fk.exporterAddress.To16())
+	return buf
+}
+
+// serializeBiflowKey orders the endpoints with SortKeyHeader and leaves out the fields that may differ
+// between the directions of a biflow: the ICMP type of requests and replies, the class of service and
+// the MAC addresses of Linux cooked headers, which only have the one of the sender
+func (fk FlowKey) serializeBiflowKey() []byte {
+	if fk.macAddresses != macSource|macDestination {
+		fk.sourceMacAddress, fk.destinationMacAddress = [6]byte{}, [6]byte{}
+	}
+	buf := fk.SerializeKey()
+	copy(buf[0:], fk.SortKeyHeader())
+	binary.BigEndian.PutUint16(buf[48:], 0)
+	buf[53] = 0
 	return buf
 }
 
+// icmpReplies maps the ICMP and ICMPv6 request types to their reply types, and back
+var icmpReplies = map[uint8]map[uint8]uint8{
+	1:  {0: 8, 8: 0, 13: 14, 14: 13, 15: 16, 16: 15, 17: 18, 18: 17},
+	58: {128: 129, 129: 128},
+}
+
+// SameDirection tells if both keys have the same source endpoint
+func (fk FlowKey) SameDirection(other FlowKey) bool {
+	return fk.sourceIPAddress.Equal(other.sourceIPAddress) &&
+		fk.sourceTransportPort == other.sourceTransportPort &&
+		fk.sourceMacAddress == other.sourceMacAddress
+}
+
+// Reverse returns the key of the opposite direction
+func (fk FlowKey) Reverse() FlowKey {
+	reverse := fk
+	reverse.sourceIPAddress, reverse.destinationIPAddress = fk.destinationIPAddress, fk.sourceIPAddress
+	reverse.sourceTransportPort, reverse.destinationTransportPort = fk.destinationTransportPort, fk.sourceTransportPort
+	reverse.sourceMacAddress, reverse.destinationMacAddress = fk.destinationMacAddress, fk.sourceMacAddress
+	reverse.macAddresses = 0
+	if fk.macAddresses&macSource != 0 {
+		reverse.macAddresses |= macDestination
+	}
+	if fk.macAddresses&macDestination != 0 {
+		reverse.macAddresses |= macSource
+	}
+	if reply, found := icmpReplies[fk.protocolIdentifier][fk.ICMPType()]; found {
+		reverse.icmpTypeCode = uint16(reply)<<8 | uint16(fk.ICMPCode())
+	}
+	return reverse
+}
+
 func (fk FlowKey) Hash() uint64 {
+	return fk.hash(fk.SerializeKey())
+}
+
+// biflowHash is the same for both directions of a biflow
+func (fk FlowKey) biflowHash() uint64 {
+	return fk.hash(fk.serializeBiflowKey())
+}
+
+func (fk FlowKey) hash(key []byte) uint64 {
 	hash := fnv.New64a()
-	_, err := hash.Write(fk.SerializeKey())
+	_, err := hash.Write(key)
 	if err != nil {
 		log.Errorf("cannot create key for flow key: %s (%s)", err, fk.String())
 	}
@@ -89,3 +163,82 @@ func (fk FlowKey) String() string {
 		fk.sourceTransportPort, fk.destinationTransportPort, fk.icmpTypeCode, fk.vlanId,
 		fk.protocolIdentifier, fk.ipClassOfService, fk.ipVersion)
 }
+
+func (fk FlowKey) IPVersion() uint8 {
+	return fk.ipVersion
+}
+
+func (fk FlowKey) SourceIP() net.IP {
+	return fk.sourceIPAddress
+}
+
+func (fk FlowKey) DestinationIP() net.IP {
+	return fk.destinationIPAddress
+}
+
+// SourcePort is 0 for ICMP flows
+func (fk FlowKey) SourcePort() uint16 {
+	return fk.sourceTransportPort
+}
+
+// DestinationPort is 0 for ICMP flows
+func (fk FlowKey) DestinationPort() uint16 {
+	return fk.destinationTransportPort
+}
+
+func (fk FlowKey) Protocol() uint8 {
+	return fk.protocolIdentifier
+}
+
+func (fk FlowKey) ICMPType() uint8 {
+	return uint8(fk.icmpTypeCode >> 8)
+}
+
+func (fk FlowKey) ICMPCode() uint8 {
+	return uint8(fk.icmpTypeCode)
+}
+
+// ClassOfService is the IPv4 TOS or the IPv6 traffic class
+func (fk FlowKey) ClassOfService() uint8 {
+	return fk.ipClassOfService
+}
+
+func (fk FlowKey) VlanID() uint16 {
+	return fk.vlanId
+}
+
+// SourceMAC is nil when the link layer has no source MAC address
+func (fk FlowKey) SourceMAC() net.HardwareAddr {
+	if fk.macAddresses&macSource == 0 {
+		return nil
+	}
+	return append(net.HardwareAddr(nil), fk.sourceMacAddress[:]...)
+}
+
+// DestinationMAC is nil when the link layer has no destination MAC address
+func (fk FlowKey) DestinationMAC() net.HardwareAddr {
+	if fk.macAddresses&macDestination == 0 {
+		return nil
+	}
+	return append(net.HardwareAddr(nil), fk.destinationMacAddress[:]...)
+}
+
+// FlowLabel is the IPv6 flow label
+func (fk FlowKey) FlowLabel() uint32 {
+	return fk.flowLabelIPv6
+}
+
+// FragmentID is the IPv4 identification or the IPv6 fragment identification
+func (fk FlowKey) FragmentID() uint32 {
+	return fk.fragmentIdentification
+}
+
+// TunnelType is one of the Tunnel constants, 0 for flows not carried by a decapsulated tunnel
+func (fk FlowKey) TunnelType() uint8 {
+	return fk.tunnelType
+}
+
+// TunnelID is the GRE key, ERSPAN session, VXLAN or Geneve VNI, or top MPLS label
+func (fk FlowKey) TunnelID() uint32 {
+	return fk.tunnelID
+}
@@ -1,17 +1,26 @@
 package flow
 
 import (
+	"fmt"
+	"github.com/COSAE-FR/ripflow/metrics"
 	"github.com/COSAE-FR/ripflow/utils"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type PacketLayers struct {
 	eth   layers.Ethernet
+	sll   layers.LinuxSLL
+	sll2  linuxSLL2
+	loop  layers.Loopback
 	dot1q layers.Dot1Q
 	ip4   layers.IPv4
 	ip6   layers.IPv6
@@ -22,36 +31,136 @@ type PacketLayers struct {
 }
 
 type ParserParameters struct {
-	parser  *gopacket.DecodingLayerParser
-	eth     *layers.Ethernet
-	dot1q   *layers.Dot1Q
-	ip4     *layers.IPv4
-	ip6     *layers.IPv6
-	tcp     *layers.TCP
-	udp     *layers.UDP
-	sctp    *layers.SCTP
-	icmp4   *layers.ICMPv4
-	icmp6   *layers.ICMPv6
-	decoded []gopacket.LayerType
+	linkType layers.LinkType
+	parser   *gopacket.DecodingLayerParser // Starts with the link layer
+	ipv4     *gopacket.DecodingLayerParser
+	ipv6     *gopacket.DecodingLayerParser
+	eth      *layers.Ethernet
+	sll      *layers.LinuxSLL
+	sll2     *linuxSLL2
+	loop     *layers.Loopback
+	dot1q    *layers.Dot1Q
+	ip4      *layers.IPv4
+	ip6      *layers.IPv6
+	tcp      *layers.TCP
+	udp      *layers.UDP
+	sctp     *layers.SCTP
+	icmp4    *layers.ICMPv4
+	icmp6    *layers.ICMPv6
+	decoded  []gopacket.LayerType
+	tunnels  *ParserParameters // Inner packets, created on the first decapsulated packet
 }
 
 type PacketHandler struct {
-	handle       *pcap.Handle
-	iface        *net.Interface
-	Worker       chan Flow
-	killSwitch   chan int
-	ifaceWasDown bool
-	log          *log.Entry
+	handle            *pcap.Handle
+	source            gopacket.PacketDataSource // The pcap handle, unless read by a ring
+	ring              captureRing               // Set when the interface is not captured with libpcap
+	iface             *net.Interface
+	Worker            chan Flow
+	Done              chan struct{} // Closed when the packet source is exhausted
+	killSwitch        chan int
+	ifaceWasDown      bool
+	realtime          bool
+	sampler           *sampler
+	engineType        uint8
+	engineID          uint8
+	linkType          layers.LinkType
+	tunnels           uint8 // tunnelBit of each decapsulated tunnel type
+	sflowAgent        *SFlowAgent
+	sflow             *sflowSource
+	decodeErrors      *metrics.Counter
+	nonIP             *metrics.Counter
+	unregisterMetrics func()
+	listening         bool // Listen runs and waits for the kill switch
+	closed            bool
+	lock              sync.Mutex
+	log               *log.Entry
+}
+
+// captureRing is a capture backend read by several workers
+type captureRing interface {
+	setFilter(filter string) error
+	start(handler *PacketHandler)
+	stop()
+	collectStats(iface string)
 }
 
 func (handler *PacketHandler) SetFilter(filter string) error {
+	if handler.ring != nil {
+		return handler.ring.setFilter(filter)
+	}
 	return handler.handle.SetBPFFilter(filter)
 }
 
+// SetSampling accounts only one packet out of each interval packets
+func (handler *PacketHandler) SetSampling(algorithm uint8, interval uint32) error {
+	s, err := newSampler(algorithm, interval)
+	if err != nil {
+		return err
+	}
+	handler.sampler = s
+	return nil
+}
+
+// SetEngine identifies the flows of the interface in the Netflow v5 header
+func (handler *PacketHandler) SetEngine(engineType uint8, engineID uint8) {
+	handler.engineType = engineType
+	handler.engineID = engineID
+}
+
+// SetDecapsulation accounts the packets carried by the tunnels of the given types instead of the tunnels
+func (handler *PacketHandler) SetDecapsulation(tunnelTypes ...uint8) error {
+	var tunnels uint8
+	for _, tunnelType := range tunnelTypes {
+		if len(TunnelName(tunnelType)) == 0 {
+			return fmt.Errorf("unknown tunnel type %d", tunnelType)
+		}
+		tunnels |= tunnelBit(tunnelType)
+	}
+	handler.tunnels = tunnels
+	return nil
+}
+
+// SetSFlowAgent sends the headers of the sampled packets to the sFlow agent
+func (handler *PacketHandler) SetSFlowAgent(agent *SFlowAgent) {
+	handler.sflowAgent = agent
+}
+
+// samplingRate is the number of packets seen for each decoded packet
+func (handler *PacketHandler) samplingRate() uint32 {
+	if handler.sampler == nil {
+		return 1
+	}
+	return handler.sampler.interval
+}
+
+// countPacket accounts a captured packet, before sampling, in the sFlow sample pool
+func (handler *PacketHandler) countPacket() {
+	if handler.sflow != nil {
+		atomic.AddUint32(&handler.sflow.pool, 1)
+	}
+}
+
 func (handler *PacketHandler) Close() {
+	if handler.ring != nil {
+		handler.ring.stop()
+		return
+	}
 	handler.handle.Close()
 }
 
+// bringUp brings the captured interface up when it is down, it is put down again on Stop
+func (handler *PacketHandler) bringUp() {
+	if !strings.Contains(handler.iface.Flags.String(), "up") {
+		handler.log.Warnf("Interface %s is down", handler.iface.Name)
+		if err := utils.NetInterfaceUp(*handler.iface); err != nil {
+			handler.log.Errorf("Cannot bring %s up: %s", handler.iface.Name, err)
+		} else {
+			handler.ifaceWasDown = true
+		}
+	}
+}
+
 func NewHandler(iface *net.Interface, worker chan Flow, logger *log.Entry) (*PacketHandler, error) {
 	handler := &PacketHandler{
 		iface: iface,
@@ -60,71 +169,237 @@ func NewHandler(iface *net.Interface, worker chan Flow, logger *log.Entry) (*Pac
 			"interface": iface.Name,
 		}),
 	}
-	if !strings.Contains(iface.Flags.String(), "up") {
-		handler.log.Warnf("Interface %s is down", iface.Name)
-		if err := utils.NetInterfaceUp(*iface); err != nil {
-			handler.log.Errorf("Cannot bring %s up: %s", iface.Name, err)
-		} else {
-			handler.ifaceWasDown = true
-		}
-	}
+	handler.bringUp()
 	handle, err := pcap.OpenLive(iface.Name, 65536, true, pcap.BlockForever)
 	if err != nil {
 		handler.log.Errorf("Unable to open packet capture on interface %s", iface.Name)
 		return handler, err
 	}
+	handler.linkType = handle.LinkType()
+	if err := checkLinkType(handler.linkType); err != nil {
+		handle.Close()
+		return handler, fmt.Errorf("cannot capture %s: %s", iface.Name, err)
+	}
 	handler.handle = handle
+	handler.source = handle
 	handler.Worker = worker
+	handler.Done = make(chan struct{})
 	handler.killSwitch = make(chan int, 0)
 	return handler, nil
 }
 
-func (handler *PacketHandler) Listen() {
-	handler.log.Debugf("Listening on interface %s", handler.iface.Name)
-	src := gopacket.NewPacketSource(handler.handle, layers.LayerTypeEthernet)
-	in := src.Packets()
+// NewFileHandler reads packets from a pcap or pcapng file.
+// When realtime is set, packets are paced according to their timestamps.
+func NewFileHandler(path string, realtime bool, worker chan Flow, logger *log.Entry) (*PacketHandler, error) {
+	handler := &PacketHandler{
+		iface:    &net.Interface{Name: filepath.Base(path)},
+		realtime: realtime,
+		log: logger.WithFields(log.Fields{
+			"component": "replay",
+			"file":      path,
+		}),
+	}
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		handler.log.Errorf("Unable to open capture file %s", path)
+		return handler, err
+	}
+	handler.linkType = handle.LinkType()
+	if err := checkLinkType(handler.linkType); err != nil {
+		handle.Close()
+		return handler, fmt.Errorf("cannot read %s: %s", path, err)
+	}
+	handler.handle = handle
+	handler.source = handle
+	handler.Worker = worker
+	handler.Done = make(chan struct{})
+	handler.killSwitch = make(chan int, 0)
+	return handler, nil
+}
+
+// ReplayFiles starts the capture file handlers one after another, each file is read
+// and its flows are exported before the next one starts, as files may cover different periods.
+// The cache must follow the packet time. The replay ends early when stop is closed,
+// the handlers and the cache are stopped by the caller afterwards.
+func ReplayFiles(cache *Cache, captures []*PacketHandler, stop <-chan struct{}) error {
+	for _, capture := range captures {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err := capture.Start(); err != nil {
+			return err
+		}
+		select {
+		case <-capture.Done:
+		case <-stop:
+			return nil
+		}
+		cache.RestartPacketTime()
+	}
+	return nil
+}
+
+func newParserParameters(linkType layers.LinkType) ParserParameters {
 	var pl PacketLayers
+	decoders := []gopacket.DecodingLayer{&pl.eth, &pl.sll, &pl.sll2, &pl.loop, &pl.dot1q, &pl.ip4, &pl.ip6, &pl.tcp, &pl.udp, &pl.icmp4, &pl.icmp6}
 	pp := ParserParameters{
-		parser:  gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &pl.eth, &pl.dot1q, &pl.ip4, &pl.ip6, &pl.tcp, &pl.udp, &pl.icmp4, &pl.icmp6),
-		decoded: []gopacket.LayerType{},
-		eth:     &pl.eth,
-		dot1q:   &pl.dot1q,
-		ip4:     &pl.ip4,
-		ip6:     &pl.ip6,
-		tcp:     &pl.tcp,
-		udp:     &pl.udp,
-		icmp4:   &pl.icmp4,
-		icmp6:   &pl.icmp6,
+		linkType: linkType,
+		parser:   gopacket.NewDecodingLayerParser(firstLayer(linkType), decoders...),
+		ipv4:     gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, decoders...),
+		ipv6:     gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, decoders...),
+		decoded:  []gopacket.LayerType{},
+		eth:      &pl.eth,
+		sll:      &pl.sll,
+		sll2:     &pl.sll2,
+		loop:     &pl.loop,
+		dot1q:    &pl.dot1q,
+		ip4:      &pl.ip4,
+		ip6:      &pl.ip6,
+		tcp:      &pl.tcp,
+		udp:      &pl.udp,
+		icmp4:    &pl.icmp4,
+		icmp6:    &pl.icmp6,
 	}
 	pp.parser.IgnoreUnsupported = true
+	pp.ipv4.IgnoreUnsupported = true
+	pp.ipv6.IgnoreUnsupported = true
+	return pp
+}
+
+// decode sends the flow of an IP packet to the worker
+func (handler *PacketHandler) decode(pp *ParserParameters, data []byte, info gopacket.CaptureInfo) {
+	if handler.sflow != nil {
+		handler.sflow.sample(handler.samplingRate(), handler.linkType, data, info)
+	}
+	err := pp.decodeLink(data)
+	if err != nil {
+		handler.decodeErrors.Inc()
+		handler.log.Tracef("Error when decoding packet: %s", err)
+	}
+	flow := NewFlow(*pp, info, *handler.iface)
+	if handler.tunnels != 0 {
+		flow = handler.decapsulate(pp, flow, data, info)
+	}
+	if flow.key.ipVersion == 0 {
+		handler.nonIP.Inc()
+		handler.log.Tracef("Not an IP packet: %s, layers: %v", flow.String(), pp.decoded)
+		return
+	}
+	if handler.sampler != nil {
+		flow.samplingAlgorithm = handler.sampler.algorithm
+		flow.samplingInterval = handler.sampler.interval
+	}
+	flow.engineType, flow.engineID = handler.engineType, handler.engineID
+	handler.Worker <- flow
+}
+
+func (handler *PacketHandler) Listen() {
+	handler.log.Debugf("Listening on interface %s", handler.iface.Name)
+	src := gopacket.NewPacketSource(handler.source, handler.linkType)
+	in := src.Packets()
+	pp := newParserParameters(handler.linkType)
+	var firstPacket, replayStart time.Time
 	for {
 		select {
 		case <-handler.killSwitch:
 			handler.log.Info("Received a listener kill switch")
 			return
-		case packet := <-in:
-			err := pp.parser.DecodeLayers(packet.Data(), &pp.decoded)
-			if err != nil {
-				handler.log.Tracef("Error when decoding packet: %s", err)
+		case packet, ok := <-in:
+			if !ok {
+				handler.log.Infof("End of packet source %s", handler.iface.Name)
+				in = nil
+				close(handler.Done)
+				continue
 			}
-			flow := NewFlow(pp, packet.Metadata().CaptureInfo, *handler.iface)
-			if flow.key.ipVersion == 0 {
-				handler.log.Tracef("Not an IP packet: %s, layers: %v", flow.String(), pp.decoded)
+			handler.countPacket()
+			if handler.sampler != nil && !handler.sampler.sample() {
 				continue
 			}
-			handler.Worker <- flow
+			if handler.realtime {
+				timestamp := packet.Metadata().Timestamp
+				if firstPacket.IsZero() {
+					firstPacket, replayStart = timestamp, time.Now()
+				} else if wait := timestamp.Sub(firstPacket) - time.Since(replayStart); wait > 0 {
+					timer := time.NewTimer(wait)
+					select {
+					case <-handler.killSwitch:
+						timer.Stop()
+						handler.log.Info("Received a listener kill switch")
+						return
+					case <-timer.C:
+					}
+				}
+			}
+			handler.decode(&pp, packet.Data(), packet.Metadata().CaptureInfo)
 		}
 	}
 }
 
+// collectStats mirrors the capture statistics in the metrics
+func (handler *PacketHandler) collectStats() {
+	if handler.ring != nil {
+		handler.ring.collectStats(handler.iface.Name)
+		return
+	}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.closed {
+		return
+	}
+	stats, err := handler.handle.Stats()
+	if err != nil {
+		return
+	}
+	capturePacketsMetric.With(handler.iface.Name).Set(uint64(stats.PacketsReceived))
+	captureDroppedMetric.With(handler.iface.Name).Set(uint64(stats.PacketsDropped))
+	captureIfDroppedMetric.With(handler.iface.Name).Set(uint64(stats.PacketsIfDropped))
+}
+
 func (handler *PacketHandler) Start() error {
+	handler.decodeErrors = captureDecodeErrorsMetric.With(handler.iface.Name)
+	handler.nonIP = captureNonIPMetric.With(handler.iface.Name)
+	handler.unregisterMetrics = metrics.Default.OnCollect(handler.collectStats)
+	if handler.sflowAgent != nil {
+		handler.sflow = handler.sflowAgent.register(*handler.iface)
+	}
+	if handler.ring != nil {
+		handler.ring.start(handler)
+		return nil
+	}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.closed {
+		return fmt.Errorf("capture of %s is stopped", handler.iface.Name)
+	}
+	handler.listening = true
 	go handler.Listen()
 	return nil
 }
 
 func (handler *PacketHandler) Stop() error {
-	handler.killSwitch <- 1
-	handler.handle.Close()
+	if handler.unregisterMetrics != nil {
+		handler.unregisterMetrics()
+	}
+	if handler.ring != nil {
+		handler.ring.stop()
+	} else {
+		handler.lock.Lock()
+		listening := handler.listening
+		handler.closed = true
+		handler.lock.Unlock()
+		// Capture files not replayed yet were never started
+		if listening {
+			handler.killSwitch <- 1
+		}
+		handler.lock.Lock()
+		handler.handle.Close()
+		handler.lock.Unlock()
+	}
+	if handler.sflow != nil {
+		handler.sflowAgent.unregister(handler.sflow)
+	}
 	if handler.ifaceWasDown {
 		if err := utils.NetInterfaceDown(*handler.iface); err != nil {
 			handler.log.Errorf("Cannot bring %s down: %s", handler.iface.Name, err)
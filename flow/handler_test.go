@@ -0,0 +1,134 @@
+package flow
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// testPacket is an Ethernet frame carrying a UDP datagram
+func testPacket(t *testing.T, source net.IP, destination net.IP, sourcePort uint16, destinationPort uint16) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: source, DstIP: destination}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sourcePort), DstPort: layers.UDPPort(destinationPort)}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, options, eth, ip, udp, gopacket.Payload("payload")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testCapture writes the packets at the given times in a pcap file and returns a handler replaying it
+func testCapture(t *testing.T, name string, packet []byte, times []time.Time, realtime bool, worker chan Flow) *PacketHandler {
+	t.Helper()
+	var file bytes.Buffer
+	writer := pcapgo.NewWriter(&file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, timestamp := range times {
+		info := gopacket.CaptureInfo{Timestamp: timestamp, CaptureLength: len(packet), Length: len(packet)}
+		if err := writer.WritePacket(info, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader, err := pcapgo.NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PacketHandler{
+		source:     reader,
+		linkType:   reader.LinkType(),
+		iface:      &net.Interface{Name: name},
+		realtime:   realtime,
+		Worker:     worker,
+		Done:       make(chan struct{}),
+		killSwitch: make(chan int),
+		log:        testLogger(),
+	}
+}
+
+// stopListening stops a handler without pcap handle
+func stopListening(t *testing.T, handler *PacketHandler) {
+	t.Helper()
+	select {
+	case handler.killSwitch <- 1:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s does not stop", handler.iface.Name)
+	}
+}
+
+func TestReplayFilesOfDifferentPeriods(t *testing.T) {
+	output := make(chan Flow, 16)
+	cache, err := NewCache(16, 15, 1800, output, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.UsePacketTime()
+	if err := cache.Start(); err != nil {
+		t.Fatal(err)
+	}
+	packet := testPacket(t, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 5000, 53)
+	// The second file is older than the first one, its packets are 10s apart, below the idle timeout
+	recent := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	older := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	captures := []*PacketHandler{
+		testCapture(t, "recent", packet, []time.Time{recent, recent.Add(10 * time.Second), recent.Add(20 * time.Second)}, false, cache.Input),
+		testCapture(t, "older", packet, []time.Time{older, older.Add(10 * time.Second), older.Add(20 * time.Second)}, false, cache.Input),
+	}
+	if err := ReplayFiles(cache, captures, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, capture := range captures {
+		stopListening(t, capture)
+	}
+	_ = cache.Stop()
+	close(output)
+	var flows []Flow
+	for f := range output {
+		flows = append(flows, f)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("%d flows exported, expected one per file", len(flows))
+	}
+	for i, start := range []time.Time{recent, older} {
+		if flows[i].packetDeltaCount != 3 || !flows[i].start.Equal(start) || !flows[i].end.Equal(start.Add(20*time.Second)) {
+			t.Errorf("flow %d: %d packets from %s to %s, expected 3 packets from %s", i,
+				flows[i].packetDeltaCount, flows[i].start, flows[i].end, start)
+		}
+		if flows[i].flowEndReason != flowEndReasonForceEnd {
+			t.Errorf("flow %d: end reason %d, expected the end of the file", i, flows[i].flowEndReason)
+		}
+	}
+}
+
+func TestRealtimeReplayStops(t *testing.T) {
+	worker := make(chan Flow, 4)
+	packet := testPacket(t, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 5000, 53)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// The second packet would be replayed an hour later
+	capture := testCapture(t, "paced", packet, []time.Time{start, start.Add(time.Hour)}, true, worker)
+	if err := capture.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-worker:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first packet not replayed")
+	}
+	stopListening(t, capture)
+}
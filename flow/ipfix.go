@@ -0,0 +1,159 @@
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// RFC 7011
+const (
+	ipfixHeaderSize    = 16
+	ipfixTemplateSetID = 2
+	ipfixVersionNumber = 10
+)
+
+var ipfixBiflowFields = []templateField{
+	{fieldOctetDeltaCount, 8, reverseInformationElementPEN},
+	{fieldPacketDeltaCount, 8, reverseInformationElementPEN},
+	{fieldTCPControlBits, 2, reverseInformationElementPEN},
+	{fieldFlowStartMilliseconds, 8, reverseInformationElementPEN},
+	{fieldFlowEndMilliseconds, 8, reverseInformationElementPEN},
+}
+
+// ipfixTemplates returns the IPFIX templates, with RFC 5103 reverse elements for biflows
+// and the GeoIP and tunnel elements when their enterprise number is not 0
+func ipfixTemplates(biflow bool, geoEnterpriseNumber uint32, tunnelEnterpriseNumber uint32) templateSet {
+	templates := ipfixBaseTemplates()
+	if biflow {
+		templates.ipv4 = newTemplate(templateIDIPv4, append(templates.ipv4.fields, ipfixBiflowFields...)...)
+		templates.ipv6 = newTemplate(templateIDIPv6, append(templates.ipv6.fields, ipfixBiflowFields...)...)
+	}
+	if geoEnterpriseNumber != 0 {
+		templates.ipv4 = newTemplate(templateIDIPv4, append(templates.ipv4.fields, geoFields(geoEnterpriseNumber)...)...)
+		templates.ipv6 = newTemplate(templateIDIPv6, append(templates.ipv6.fields, geoFields(geoEnterpriseNumber)...)...)
+	}
+	if tunnelEnterpriseNumber != 0 {
+		templates = templates.withTunnels(tunnelEnterpriseNumber)
+	}
+	return templates
+}
+
+func ipfixBaseTemplates() templateSet {
+	return templateSet{
+		ipv4: newTemplate(templateIDIPv4,
+			templateField{fieldSourceIPv4Address, 4, 0},
+			templateField{fieldDestinationIPv4Address, 4, 0},
+			templateField{fieldSourceTransportPort, 2, 0},
+			templateField{fieldDestinationTransportPort, 2, 0},
+			templateField{fieldProtocolIdentifier, 1, 0},
+			templateField{fieldIPClassOfService, 1, 0},
+			templateField{fieldTCPControlBits, 2, 0},
+			templateField{fieldIngressInterface, 4, 0},
+			templateField{fieldOctetDeltaCount, 8, 0},
+			templateField{fieldPacketDeltaCount, 8, 0},
+			templateField{fieldFlowStartMilliseconds, 8, 0},
+			templateField{fieldFlowEndMilliseconds, 8, 0},
+			templateField{fieldFlowEndReason, 1, 0},
+			templateField{fieldIcmpTypeCodeIPv4, 2, 0},
+			templateField{fieldVlanId, 2, 0},
+			templateField{fieldSourceMacAddress, 6, 0},
+			templateField{fieldDestinationMacAddress, 6, 0},
+			templateField{fieldIPVersion, 1, 0},
+			templateField{fieldSamplingInterval, 4, 0},
+			templateField{fieldSamplingAlgorithm, 1, 0},
+			templateField{fieldFragmentIdentification, 4, 0},
+			templateField{fieldBgpSourceAsNumber, 4, 0},
+			templateField{fieldBgpDestinationAsNumber, 4, 0},
+			templateField{fieldSourceIPv4PrefixLength, 1, 0},
+			templateField{fieldDestinationIPv4PrefixLength, 1, 0},
+			templateField{fieldIPNextHopIPv4Address, 4, 0},
+			templateField{fieldEgressInterface, 4, 0},
+		),
+		ipv6: newTemplate(templateIDIPv6,
+			templateField{fieldSourceIPv6Address, 16, 0},
+			templateField{fieldDestinationIPv6Address, 16, 0},
+			templateField{fieldSourceTransportPort, 2, 0},
+			templateField{fieldDestinationTransportPort, 2, 0},
+			templateField{fieldProtocolIdentifier, 1, 0},
+			templateField{fieldIPClassOfService, 1, 0},
+			templateField{fieldTCPControlBits, 2, 0},
+			templateField{fieldIngressInterface, 4, 0},
+			templateField{fieldOctetDeltaCount, 8, 0},
+			templateField{fieldPacketDeltaCount, 8, 0},
+			templateField{fieldFlowStartMilliseconds, 8, 0},
+			templateField{fieldFlowEndMilliseconds, 8, 0},
+			templateField{fieldFlowEndReason, 1, 0},
+			templateField{fieldIcmpTypeCodeIPv6, 2, 0},
+			templateField{fieldVlanId, 2, 0},
+			templateField{fieldSourceMacAddress, 6, 0},
+			templateField{fieldDestinationMacAddress, 6, 0},
+			templateField{fieldIPVersion, 1, 0},
+			templateField{fieldSamplingInterval, 4, 0},
+			templateField{fieldSamplingAlgorithm, 1, 0},
+			templateField{fieldFlowLabelIPv6, 4, 0},
+			templateField{fieldBgpSourceAsNumber, 4, 0},
+			templateField{fieldBgpDestinationAsNumber, 4, 0},
+			templateField{fieldSourceIPv6PrefixLength, 1, 0},
+			templateField{fieldDestinationIPv6PrefixLength, 1, 0},
+			templateField{fieldIPNextHopIPv6Address, 16, 0},
+			templateField{fieldEgressInterface, 4, 0},
+		),
+	}
+}
+
+func (e *Exporter) ExportIPFIX(flow Flow) error {
+	t := e.templateFor(&flow)
+	if t == nil {
+		e.log.Debugf("Cannot export flow in IPFIX: %s", flow.String())
+		return fmt.Errorf("IP version %d not supported in IPFIX", flow.key.ipVersion)
+	}
+	if e.messageSize(ipfixHeaderSize, t) > exportBufferSize {
+		if err := e.flushIPFIX(); err != nil {
+			return err
+		}
+		if e.messageSize(ipfixHeaderSize, t) > exportBufferSize {
+			return fmt.Errorf("template %d and its record do not fit in an IPFIX message", t.id)
+		}
+	}
+	e.lastFlow = &flow
+	e.pending.add(&flow, t, e.BaseTime)
+	return nil
+}
+
+func (e *Exporter) flushIPFIX() error {
+	if e.pending.records == 0 {
+		return nil
+	}
+	if e.transport == "tcp" {
+		// A new connection is a new transport session, its sequence numbers start at 0
+		// and the collector knows none of the templates (RFC 7011 section 10.4.3.1)
+		opened, err := e.reconnect()
+		if err != nil {
+			e.pending.reset()
+			return err
+		}
+		if opened {
+			e.sequence = 0
+			e.lastTemplate = time.Time{}
+		}
+	}
+	now := time.Now()
+	offset := ipfixHeaderSize
+	if templates := e.pendingTemplates(now); len(templates) > 0 {
+		offset += serializeTemplates(e.buffer[offset:], ipfixTemplateSetID, templates)
+	}
+	offset += e.pending.serialize(e.buffer[offset:])
+	binary.BigEndian.PutUint16(e.buffer[0:], uint16(ipfixVersionNumber))
+	binary.BigEndian.PutUint16(e.buffer[2:], uint16(offset))
+	binary.BigEndian.PutUint32(e.buffer[4:], uint32(now.Unix()))
+	// Sequence number is the count of data records sent before this message in the transport session
+	binary.BigEndian.PutUint32(e.buffer[8:], e.sequence)
+	binary.BigEndian.PutUint32(e.buffer[12:], e.sourceID)
+	e.packetsSinceTemplate++
+	records := e.pending.records
+	e.sequence += uint32(records)
+	e.TotalFlowCount += uint32(records)
+	e.pending.reset()
+	return e.send(e.buffer[:offset], records)
+}
@@ -0,0 +1,97 @@
+package flow
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// readIPFIXMessage reads a message from an IPFIX stream, it returns its sequence number
+// and tells if it holds a template set
+func readIPFIXMessage(t *testing.T, conn net.Conn) (uint32, bool) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, ipfixHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("no message received: %s", err)
+	}
+	message := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	copy(message, header)
+	if _, err := io.ReadFull(conn, message[ipfixHeaderSize:]); err != nil {
+		t.Fatalf("truncated message: %s", err)
+	}
+	templates := false
+	for offset := ipfixHeaderSize; offset+flowSetHeaderSize <= len(message); offset += int(binary.BigEndian.Uint16(message[offset+2:])) {
+		if binary.BigEndian.Uint16(message[offset:]) == ipfixTemplateSetID {
+			templates = true
+		}
+		if binary.BigEndian.Uint16(message[offset+2:]) < flowSetHeaderSize {
+			t.Fatalf("set of %d bytes", binary.BigEndian.Uint16(message[offset+2:]))
+		}
+	}
+	return binary.BigEndian.Uint32(message[8:]), templates
+}
+
+func TestIPFIXReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	exporter, err := NewExporter("127.0.0.1", port, ExportOptions{Version: 10, Transport: "tcp", SourceID: 1}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.close()
+	export := func() error {
+		for _, f := range testFlows() {
+			if err := exporter.Export(f); err != nil {
+				return err
+			}
+		}
+		return exporter.Flush()
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []struct {
+		sequence  uint32
+		templates bool
+	}{{0, true}, {2, false}} {
+		if err := export(); err != nil {
+			t.Fatal(err)
+		}
+		if sequence, templates := readIPFIXMessage(t, conn); sequence != expected.sequence || templates != expected.templates {
+			t.Errorf("message %d: sequence %d, templates %t, expected %d and %t", i, sequence, templates, expected.sequence, expected.templates)
+		}
+	}
+
+	// The exporter notices the lost connection when writing
+	_ = conn.Close()
+	lost := false
+	for i := 0; i < 50 && !lost; i++ {
+		lost = export() != nil
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !lost {
+		t.Fatal("lost connection not noticed")
+	}
+	// The next message is the first one of a new transport session
+	exporter.lastConnectAttempt = time.Time{}
+	if err := export(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if sequence, templates := readIPFIXMessage(t, conn); sequence != 0 || !templates {
+		t.Errorf("first message after reconnecting: sequence %d, templates %t", sequence, templates)
+	}
+}
@@ -0,0 +1,168 @@
+package flow
+
+import (
+	"encoding/json"
+	"github.com/google/gopacket/layers"
+	"net"
+	"time"
+)
+
+var tcpControlBitNames = []struct {
+	bit  uint16
+	name string
+}{
+	{tcpControlBitsFIN, "FIN"},
+	{tcpControlBitsSYN, "SYN"},
+	{tcpControlBitsRST, "RST"},
+	{tcpControlBitsPSH, "PSH"},
+	{tcpControlBitsACK, "ACK"},
+	{tcpControlBitsURG, "URG"},
+	{tcpControlBitsECE, "ECE"},
+	{tcpControlBitsCWR, "CWR"},
+	{tcpControlBitsNS, "NS"},
+}
+
+func tcpFlagNames(flags uint16) []string {
+	names := []string{}
+	for _, flag := range tcpControlBitNames {
+		if flags&flag.bit != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	return names
+}
+
+// jsonFlow is the JSON lines representation of a flow
+type jsonFlow struct {
+	Start                   time.Time  `json:"start"`
+	End                     time.Time  `json:"end"`
+	Interface               string     `json:"interface,omitempty"`
+	InterfaceIndex          uint16     `json:"interface_index"`
+	IPVersion               uint8      `json:"ip_version"`
+	SourceIP                net.IP     `json:"source_ip"`
+	DestinationIP           net.IP     `json:"destination_ip"`
+	SourcePort              uint16     `json:"source_port"`
+	DestinationPort         uint16     `json:"destination_port"`
+	Protocol                uint8      `json:"protocol"`
+	ICMPType                *uint8     `json:"icmp_type,omitempty"`
+	ICMPCode                *uint8     `json:"icmp_code,omitempty"`
+	ClassOfService          uint8      `json:"tos"`
+	VlanID                  uint16     `json:"vlan_id,omitempty"`
+	SourceMAC               string     `json:"source_mac,omitempty"`
+	DestinationMAC          string     `json:"destination_mac,omitempty"`
+	FlowLabel               uint32     `json:"flow_label,omitempty"`
+	FragmentID              uint32     `json:"fragment_id,omitempty"`
+	Octets                  uint64     `json:"octets"`
+	Packets                 uint64     `json:"packets"`
+	TCPFlags                []string   `json:"tcp_flags"`
+	FlowEndReason           string     `json:"flow_end_reason"`
+	SamplingInterval        uint32     `json:"sampling_interval,omitempty"`
+	TunnelType              string     `json:"tunnel_type,omitempty"`
+	TunnelID                *uint32    `json:"tunnel_id,omitempty"`
+	TunnelSource            net.IP     `json:"tunnel_source,omitempty"`
+	TunnelDestination       net.IP     `json:"tunnel_destination,omitempty"`
+	ReverseOctets           uint64     `json:"reverse_octets,omitempty"`
+	ReversePackets          uint64     `json:"reverse_packets,omitempty"`
+	ReverseTCPFlags         []string   `json:"reverse_tcp_flags,omitempty"`
+	ReverseStart            *time.Time `json:"reverse_start,omitempty"`
+	ReverseEnd              *time.Time `json:"reverse_end,omitempty"`
+	SourceAS                uint32     `json:"source_as,omitempty"`
+	DestinationAS           uint32     `json:"destination_as,omitempty"`
+	SourcePrefixLength      uint8      `json:"source_prefix_length,omitempty"`
+	DestinationPrefixLength uint8      `json:"destination_prefix_length,omitempty"`
+	NextHop                 net.IP     `json:"next_hop,omitempty"`
+	OutputInterface         uint32     `json:"output_interface_index,omitempty"`
+	SourceCountry           string     `json:"source_country,omitempty"`
+	SourceCity              string     `json:"source_city,omitempty"`
+	DestinationCountry      string     `json:"destination_country,omitempty"`
+	DestinationCity         string     `json:"destination_city,omitempty"`
+}
+
+func newJSONFlow(f *Flow, interfaceName string) jsonFlow {
+	record := jsonFlow{
+		Start:                   f.start,
+		End:                     f.end,
+		Interface:               interfaceName,
+		InterfaceIndex:          f.ifIndex,
+		IPVersion:               f.key.ipVersion,
+		SourceIP:                f.key.sourceIPAddress,
+		DestinationIP:           f.key.destinationIPAddress,
+		SourcePort:              f.key.sourceTransportPort,
+		DestinationPort:         f.key.destinationTransportPort,
+		Protocol:                f.key.protocolIdentifier,
+		ClassOfService:          f.key.ipClassOfService,
+		VlanID:                  f.key.vlanId,
+		SourceMAC:               f.key.SourceMAC().String(),
+		DestinationMAC:          f.key.DestinationMAC().String(),
+		FlowLabel:               f.key.flowLabelIPv6,
+		FragmentID:              f.key.fragmentIdentification,
+		Octets:                  f.octetDeltaCount,
+		Packets:                 f.packetDeltaCount,
+		TCPFlags:                tcpFlagNames(f.tcpControlBits),
+		FlowEndReason:           flowEndReasonName(f.flowEndReason),
+		SamplingInterval:        f.samplingInterval,
+		TunnelType:              TunnelName(f.key.tunnelType),
+		TunnelSource:            f.tunnelSource,
+		TunnelDestination:       f.tunnelDestination,
+		SourceAS:                f.sourceAS,
+		DestinationAS:           f.destinationAS,
+		SourcePrefixLength:      f.sourcePrefixLength,
+		DestinationPrefixLength: f.destinationPrefixLength,
+		NextHop:                 f.nextHop,
+		OutputInterface:         f.outputInterface,
+		SourceCountry:           f.sourceCountry,
+		SourceCity:              f.sourceCity,
+		DestinationCountry:      f.destinationCountry,
+		DestinationCity:         f.destinationCity,
+	}
+	switch layers.IPProtocol(f.key.protocolIdentifier) {
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		icmpType, icmpCode := uint8(f.key.icmpTypeCode>>8), uint8(f.key.icmpTypeCode)
+		record.ICMPType, record.ICMPCode = &icmpType, &icmpCode
+	}
+	if f.key.tunnelType != 0 {
+		// VNI and labels may be 0
+		tunnelID := f.key.tunnelID
+		record.TunnelID = &tunnelID
+	}
+	if f.reversePacketDeltaCount > 0 {
+		record.ReverseOctets = f.reverseOctetDeltaCount
+		record.ReversePackets = f.reversePacketDeltaCount
+		record.ReverseTCPFlags = tcpFlagNames(f.reverseTcpControlBits)
+		reverseStart, reverseEnd := f.reverseStart, f.reverseEnd
+		record.ReverseStart, record.ReverseEnd = &reverseStart, &reverseEnd
+	}
+	return record
+}
+
+// MarshalJSON encodes the flow like the JSON lines output, without the interface name
+func (f Flow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newJSONFlow(&f, ""))
+}
+
+// ExportJSON writes the flow as a JSON object on its own line
+func (e *Exporter) ExportJSON(flow Flow) error {
+	line, err := json.Marshal(newJSONFlow(&flow, e.interfaceName(flow.ifIndex)))
+	if err != nil {
+		return err
+	}
+	if err := e.output.write(append(line, '\n')); err != nil {
+		return err
+	}
+	exporterDatagramsMetric.With(e.address).Inc()
+	exporterFlowsMetric.With(e.address).Inc()
+	return nil
+}
+
+// interfaceName returns the name of the capturing interface, empty when unknown
+func (e *Exporter) interfaceName(index uint16) string {
+	if name, found := e.interfaceNames[index]; found {
+		return name
+	}
+	name := ""
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		name = iface.Name
+	}
+	e.interfaceNames[index] = name
+	return name
+}
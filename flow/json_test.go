@@ -0,0 +1,190 @@
+package flow
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDir returns a temporary directory removed by the test
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ripflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// decodeJSONFlow marshals the flow and decodes it in a map to check the names and omitted fields
+func decodeJSONFlow(t *testing.T, f Flow) map[string]interface{} {
+	t.Helper()
+	line, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(line, &record); err != nil {
+		t.Fatalf("cannot decode %s: %s", line, err)
+	}
+	return record
+}
+
+func TestJSONFlow(t *testing.T) {
+	flows := testFlows()
+	tcp := decodeJSONFlow(t, flows[0])
+	for name, value := range map[string]interface{}{
+		"source_ip":         "192.0.2.1",
+		"destination_ip":    "198.51.100.2",
+		"source_port":       43210.0,
+		"destination_port":  443.0,
+		"protocol":          6.0,
+		"tos":               40.0,
+		"vlan_id":           12.0,
+		"source_mac":        "02:00:00:00:00:01",
+		"destination_mac":   "02:00:00:00:00:02",
+		"octets":            123456.0,
+		"packets":           321.0,
+		"tcp_flags":         []interface{}{"SYN", "ACK"},
+		"sampling_interval": 100.0,
+		"source_as":         64500.0,
+		"destination_as":    4200000000.0,
+		"next_hop":          "192.0.2.254",
+		"start":             flows[0].start.Format(time.RFC3339Nano),
+	} {
+		if !reflect.DeepEqual(tcp[name], value) {
+			t.Errorf("TCP flow: %s is %v, expected %v", name, tcp[name], value)
+		}
+	}
+	for _, name := range []string{"interface", "icmp_type", "icmp_code", "tunnel_type", "tunnel_id", "reverse_octets", "reverse_start", "source_country"} {
+		if value, found := tcp[name]; found {
+			t.Errorf("TCP flow: %s is %v, expected to be omitted", name, value)
+		}
+	}
+
+	// Type 128 is echo request, its code 0 is kept
+	icmp := decodeJSONFlow(t, flows[1])
+	if icmp["icmp_type"] != 128.0 || icmp["icmp_code"] != 0.0 || icmp["flow_label"] != float64(0xbeef) {
+		t.Errorf("ICMPv6 flow: type %v, code %v, flow label %v", icmp["icmp_type"], icmp["icmp_code"], icmp["flow_label"])
+	}
+	if flags, found := icmp["tcp_flags"].([]interface{}); !found || len(flags) != 0 {
+		t.Errorf("ICMPv6 flow: TCP flags %v, expected an empty list", icmp["tcp_flags"])
+	}
+
+	// A tunnel identifier of 0 is still a tunnel identifier
+	biflow := flows[0]
+	biflow.key.tunnelType, biflow.key.tunnelID = TunnelVXLAN, 0
+	biflow.reverseOctetDeltaCount, biflow.reversePacketDeltaCount = 600, 5
+	biflow.reverseTcpControlBits = tcpControlBitsSYN | tcpControlBitsACK | tcpControlBitsFIN
+	biflow.reverseStart, biflow.reverseEnd = biflow.start.Add(time.Millisecond), biflow.end
+	record := decodeJSONFlow(t, biflow)
+	if record["tunnel_type"] != "vxlan" || record["tunnel_id"] != 0.0 {
+		t.Errorf("tunnel %v, identifier %v, expected vxlan and 0", record["tunnel_type"], record["tunnel_id"])
+	}
+	if record["reverse_octets"] != 600.0 || record["reverse_packets"] != 5.0 ||
+		!reflect.DeepEqual(record["reverse_tcp_flags"], []interface{}{"FIN", "SYN", "ACK"}) {
+		t.Errorf("reverse direction: %v octets, %v packets, flags %v",
+			record["reverse_octets"], record["reverse_packets"], record["reverse_tcp_flags"])
+	}
+	if record["reverse_start"] != biflow.reverseStart.Format(time.RFC3339Nano) {
+		t.Errorf("reverse start %v, expected %s", record["reverse_start"], biflow.reverseStart)
+	}
+}
+
+func TestJSONFileRotation(t *testing.T) {
+	dir := testDir(t)
+	path := filepath.Join(dir, "flows.json")
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	output, err := newJSONOutput(JSONOutputOptions{Destination: path, MaxSize: 250, MaxFiles: 2}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := output.write(line); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated files are named after the millisecond of their rotation
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := output.close(); err != nil {
+		t.Fatal(err)
+	}
+	// Two lines fit below the maximum size: 4 rotations, the 2 most recent files are kept
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Errorf("%d rotated files kept, expected 2: %v", len(rotated), rotated)
+	}
+	for _, file := range append(rotated, path) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != 2*len(line) {
+			t.Errorf("%s holds %d bytes, expected 2 lines", file, len(content))
+		}
+	}
+
+	// Appending to an existing file counts its size
+	output, err = newJSONOutput(JSONOutputOptions{Destination: path, MaxSize: 250}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+	if output.size != int64(2*len(line)) || !output.rotationDue(len(line)) {
+		t.Errorf("reopened file of %d bytes not due for rotation", output.size)
+	}
+}
+
+func TestJSONUnixSocket(t *testing.T) {
+	path := filepath.Join(testDir(t), "flows.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", path, err)
+	}
+	defer listener.Close()
+	exporter, err := NewExporter("", 0, ExportOptions{Format: "json", JSONOutput: JSONOutputOptions{Destination: "unixgram://" + path}}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Stop()
+	if exporter.address != "unixgram://"+path {
+		t.Errorf("exporter named %s", exporter.address)
+	}
+	flows := testFlows()
+	for _, f := range flows {
+		if err := exporter.Export(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65536)
+	for i, f := range flows {
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatalf("line %d not received: %s", i, err)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(buf[:n])))
+		if !scanner.Scan() || scanner.Scan() {
+			t.Fatalf("datagram %d does not hold a single line: %q", i, buf[:n])
+		}
+		var record jsonFlow
+		if err := json.Unmarshal(buf[:n], &record); err != nil {
+			t.Fatal(err)
+		}
+		if !record.SourceIP.Equal(f.key.sourceIPAddress) || record.Packets != f.packetDeltaCount {
+			t.Errorf("line %d: %s with %d packets, expected %s with %d", i,
+				record.SourceIP, record.Packets, f.key.sourceIPAddress, f.packetDeltaCount)
+		}
+	}
+}
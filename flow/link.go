@@ -0,0 +1,218 @@
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// AnyInterface is the Linux pcap pseudo-interface capturing every interface
+const AnyInterface = "any"
+
+// Link types missing from gopacket, or reported with their DLT value by live captures
+const (
+	linkTypeRawDLT    layers.LinkType = 12 // DLT_RAW of Linux and FreeBSD, LinkTypeRaw in capture files
+	linkTypePPPSerial layers.LinkType = 50
+	// LINKTYPE_LINUX_SLL2 (276), gopacket truncates the link types of handles and files to 8 bits
+	linkTypeLinuxSLL2 layers.LinkType = 276 & 0xff
+)
+
+const (
+	sllHeaderSize  = 16
+	sll2HeaderSize = 20
+	nullHeaderSize = 4
+	arphrdEthernet = 1
+	pppIPv4        = 0x0021
+	pppIPv6        = 0x0057
+)
+
+var errTruncatedLinkHeader = errors.New("truncated link header")
+
+var layerTypeLinuxSLL2 = gopacket.RegisterLayerType(1276, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// linuxSLL2 is the Linux cooked header v2, which also tells the interface of the packet
+type linuxSLL2 struct {
+	layers.BaseLayer
+	EthernetType   layers.EthernetType
+	InterfaceIndex uint32
+	AddrType       uint16
+	PacketType     layers.LinuxSLLPacketType
+	AddrLen        uint8
+	Addr           net.HardwareAddr
+}
+
+func (sll *linuxSLL2) LayerType() gopacket.LayerType {
+	return layerTypeLinuxSLL2
+}
+
+func (sll *linuxSLL2) CanDecode() gopacket.LayerClass {
+	return layerTypeLinuxSLL2
+}
+
+func (sll *linuxSLL2) NextLayerType() gopacket.LayerType {
+	return sll.EthernetType.LayerType()
+}
+
+func (sll *linuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < sll2HeaderSize {
+		return errTruncatedLinkHeader
+	}
+	sll.EthernetType = layers.EthernetType(binary.BigEndian.Uint16(data[0:]))
+	sll.InterfaceIndex = binary.BigEndian.Uint32(data[4:])
+	sll.AddrType = binary.BigEndian.Uint16(data[8:])
+	sll.PacketType = layers.LinuxSLLPacketType(data[10])
+	sll.AddrLen = data[11]
+	length := int(sll.AddrLen)
+	if length > 8 {
+		length = 8
+	}
+	sll.Addr = net.HardwareAddr(data[12 : 12+length])
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:sll2HeaderSize], Payload: data[sll2HeaderSize:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll := &linuxSLL2{}
+	if err := sll.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll)
+	return p.NextDecoder(sll.EthernetType)
+}
+
+// InterfaceByName returns the interface to capture, including the any pseudo-interface
+func InterfaceByName(name string) (*net.Interface, error) {
+	if name == AnyInterface {
+		// Flows are accounted on interface 0, unless the cooked headers are SLL2 ones
+		return &net.Interface{Name: AnyInterface, Flags: net.FlagUp}, nil
+	}
+	return net.InterfaceByName(name)
+}
+
+// checkLinkType returns an error when the packets of the link type cannot be decoded
+func checkLinkType(linkType layers.LinkType) error {
+	switch linkType {
+	case layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, linkTypeLinuxSLL2, layers.LinkTypeNull, layers.LinkTypeLoop,
+		layers.LinkTypeRaw, linkTypeRawDLT, layers.LinkTypeIPv4, layers.LinkTypeIPv6, layers.LinkTypePPP, linkTypePPPSerial:
+		return nil
+	}
+	return fmt.Errorf("unsupported link type %s", linkType)
+}
+
+// firstLayer is the first layer of the link types parsed by gopacket
+func firstLayer(linkType layers.LinkType) gopacket.LayerType {
+	switch linkType {
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case linkTypeLinuxSLL2:
+		return layerTypeLinuxSLL2
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback
+	}
+	return layers.LayerTypeEthernet
+}
+
+// decodeLink parses a packet starting with the header of the link type of the parameters
+func (pp *ParserParameters) decodeLink(data []byte) error {
+	switch pp.linkType {
+	case layers.LinkTypePPP, linkTypePPPSerial:
+		payload, err := pppPayload(data)
+		if err != nil {
+			pp.decoded = pp.decoded[:0]
+			return err
+		}
+		return pp.decodeIP(payload)
+	case layers.LinkTypeRaw, linkTypeRawDLT, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return pp.decodeIP(data)
+	}
+	return pp.parser.DecodeLayers(data, &pp.decoded)
+}
+
+// decodeFrom parses a packet starting with the first layer, Ethernet, IPv4 or IPv6
+func (pp *ParserParameters) decodeFrom(first gopacket.LayerType, data []byte) error {
+	switch first {
+	case layers.LayerTypeIPv4:
+		return pp.ipv4.DecodeLayers(data, &pp.decoded)
+	case layers.LayerTypeIPv6:
+		return pp.ipv6.DecodeLayers(data, &pp.decoded)
+	}
+	return pp.parser.DecodeLayers(data, &pp.decoded)
+}
+
+// decodeIP parses a packet starting with its IP header, other packets decode no layer
+func (pp *ParserParameters) decodeIP(data []byte) error {
+	pp.decoded = pp.decoded[:0]
+	if len(data) == 0 {
+		return nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return pp.decodeFrom(layers.LayerTypeIPv4, data)
+	case 6:
+		return pp.decodeFrom(layers.LayerTypeIPv6, data)
+	}
+	return nil
+}
+
+// pppPayload returns the IP packet of a PPP frame, nil for the other protocols
+func pppPayload(data []byte) ([]byte, error) {
+	// Address and control fields, unless compressed
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0x03 {
+		data = data[2:]
+	}
+	if len(data) < 1 {
+		return nil, errTruncatedLinkHeader
+	}
+	// Compressed protocol fields have their lowest bit set
+	protocol, size := uint16(data[0]), 1
+	if data[0]&0x01 == 0 {
+		if len(data) < 2 {
+			return nil, errTruncatedLinkHeader
+		}
+		protocol, size = binary.BigEndian.Uint16(data), 2
+	}
+	if protocol != pppIPv4 && protocol != pppIPv6 {
+		return nil, nil
+	}
+	return data[size:], nil
+}
+
+// sflowHeader returns the sFlow header protocol of a packet and its sampled part.
+// Packets of links unknown to sFlow are sampled from their IP header, nil when they have none.
+func sflowHeader(linkType layers.LinkType, data []byte) (uint32, []byte) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return sflowHeaderProtocolEthernet, data
+	case layers.LinkTypePPP, linkTypePPPSerial:
+		return sflowHeaderProtocolPPP, data
+	case layers.LinkTypeLinuxSLL:
+		data = skipHeader(data, sllHeaderSize)
+	case linkTypeLinuxSLL2:
+		data = skipHeader(data, sll2HeaderSize)
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		data = skipHeader(data, nullHeaderSize)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return sflowHeaderProtocolIPv4, data
+	case 6:
+		return sflowHeaderProtocolIPv6, data
+	}
+	return 0, nil
+}
+
+func skipHeader(data []byte, size int) []byte {
+	if len(data) < size {
+		return nil
+	}
+	return data[size:]
+}
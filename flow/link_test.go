@@ -0,0 +1,249 @@
+package flow
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testIPPacket is an IP packet carrying a UDP datagram from port 5000 to port 53
+func testIPPacket(t *testing.T, ipVersion uint8) []byte {
+	t.Helper()
+	var ip gopacket.SerializableLayer
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 53}
+	switch ipVersion {
+	case 4:
+		ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.IPv4(192, 0, 2, 1), DstIP: net.IPv4(198, 51, 100, 53)}
+		_ = udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	case 6:
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::53")}
+		_ = udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, options, ip, udp, gopacket.Payload("query")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sllHeader returns a Linux cooked header v1 sent by 02:00:00:00:00:01
+func sllHeader(protocol layers.EthernetType) []byte {
+	return concat([]byte{0, 4, 0, arphrdEthernet, 0, 6}, []byte{2, 0, 0, 0, 0, 1, 0, 0}, uint16Bytes(uint16(protocol)))
+}
+
+// sll2Header returns a Linux cooked header v2 of the interface ifIndex, with a MAC address of
+// 02:00:00:00:00:01 on Ethernet, ARPHRD_NONE tun devices have none
+func sll2Header(protocol layers.EthernetType, ifIndex uint32, hardwareType uint16) []byte {
+	length, address := byte(0), make([]byte, 8)
+	if hardwareType == arphrdEthernet {
+		length, address = 6, []byte{2, 0, 0, 0, 0, 1, 0, 0}
+	}
+	return concat(uint16Bytes(uint16(protocol)), []byte{0, 0}, uint32Bytes(ifIndex), uint16Bytes(hardwareType), []byte{4, length}, address)
+}
+
+func TestLinkTypes(t *testing.T) {
+	ipv4, ipv6 := testIPPacket(t, 4), testIPPacket(t, 6)
+	ethernet := concat([]byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1}, uint16Bytes(uint16(layers.EthernetTypeIPv4)), ipv4)
+	const arphrdNone = 0xfffe
+	for _, c := range []struct {
+		name           string
+		linkType       layers.LinkType
+		data           []byte
+		ifIndex        int // Of the captured interface
+		ipVersion      uint8
+		sourceMAC      string
+		destinationMAC string
+		flowIfIndex    uint16
+	}{
+		{"Ethernet", layers.LinkTypeEthernet, ethernet, 3, 4, "02:00:00:00:00:01", "02:00:00:00:00:02", 3},
+		{"SLL", layers.LinkTypeLinuxSLL, concat(sllHeader(layers.EthernetTypeIPv6), ipv6), 0, 6, "02:00:00:00:00:01", "", 0},
+		{"SLL2 of the any interface", linkTypeLinuxSLL2, concat(sll2Header(layers.EthernetTypeIPv4, 7, arphrdEthernet), ipv4), 0, 4, "02:00:00:00:00:01", "", 7},
+		{"SLL2 of an interface", linkTypeLinuxSLL2, concat(sll2Header(layers.EthernetTypeIPv4, 7, arphrdEthernet), ipv4), 3, 4, "02:00:00:00:00:01", "", 3},
+		{"SLL2 of a tun device", linkTypeLinuxSLL2, concat(sll2Header(layers.EthernetTypeIPv6, 9, arphrdNone), ipv6), 0, 6, "", "", 9},
+		{"truncated SLL2", linkTypeLinuxSLL2, sll2Header(layers.EthernetTypeIPv4, 7, arphrdEthernet)[:12], 0, 0, "", "", 0},
+		{"NULL", layers.LinkTypeNull, concat([]byte{2, 0, 0, 0}, ipv4), 1, 4, "", "", 1},
+		{"LOOP", layers.LinkTypeLoop, concat([]byte{0, 0, 0, 2}, ipv4), 1, 4, "", "", 1},
+		{"raw IPv4", layers.LinkTypeRaw, ipv4, 5, 4, "", "", 5},
+		{"raw IPv6 DLT", linkTypeRawDLT, ipv6, 5, 6, "", "", 5},
+		{"IPv4", layers.LinkTypeIPv4, ipv4, 5, 4, "", "", 5},
+		{"IPv6", layers.LinkTypeIPv6, ipv6, 5, 6, "", "", 5},
+		{"PPP", layers.LinkTypePPP, concat([]byte{0xff, 0x03, 0x00, 0x21}, ipv4), 6, 4, "", "", 6},
+		{"PPP with compressed fields", linkTypePPPSerial, concat([]byte{0x57}, ipv6), 6, 6, "", "", 6},
+		{"PPP LCP", layers.LinkTypePPP, concat([]byte{0xff, 0x03, 0xc0, 0x21}, ipv4), 6, 0, "", "", 6},
+	} {
+		if err := checkLinkType(c.linkType); err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		pp := newParserParameters(c.linkType)
+		_ = pp.decodeLink(c.data)
+		info := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(c.data), Length: len(c.data)}
+		f := NewFlow(pp, info, net.Interface{Index: c.ifIndex})
+		key := f.Key()
+		if key.IPVersion() != c.ipVersion {
+			t.Errorf("%s: IP version %d, expected %d", c.name, key.IPVersion(), c.ipVersion)
+			continue
+		}
+		if c.ipVersion != 0 && (key.SourcePort() != 5000 || key.DestinationPort() != 53) {
+			t.Errorf("%s: ports %d -> %d", c.name, key.SourcePort(), key.DestinationPort())
+		}
+		if key.SourceMAC().String() != c.sourceMAC || key.DestinationMAC().String() != c.destinationMAC {
+			t.Errorf("%s: MAC addresses %q -> %q, expected %q -> %q", c.name, key.SourceMAC(), key.DestinationMAC(), c.sourceMAC, c.destinationMAC)
+		}
+		if c.sourceMAC == "" && key.SourceMAC() != nil || c.destinationMAC == "" && key.DestinationMAC() != nil {
+			t.Errorf("%s: MAC addresses of a link without them are not nil", c.name)
+		}
+		if f.InterfaceIndex() != c.flowIfIndex {
+			t.Errorf("%s: interface %d, expected %d", c.name, f.InterfaceIndex(), c.flowIfIndex)
+		}
+	}
+	if err := checkLinkType(layers.LinkTypeFDDI); err == nil {
+		t.Error("FDDI accepted")
+	}
+	// sFlow samples the IP header of SLL2 packets
+	if protocol, header := sflowHeader(linkTypeLinuxSLL2, concat(sll2Header(layers.EthernetTypeIPv4, 7, arphrdEthernet), ipv4)); protocol != sflowHeaderProtocolIPv4 || len(header) != len(ipv4) {
+		t.Errorf("SLL2 sampled as protocol %d with %d bytes", protocol, len(header))
+	}
+}
+
+func TestFlowsWithoutMAC(t *testing.T) {
+	raw := testFlows()
+	for i := range raw {
+		raw[i].key.sourceMacAddress, raw[i].key.destinationMacAddress, raw[i].key.macAddresses = [6]byte{}, [6]byte{}, 0
+	}
+	// Flows of both kinds are exported by the same exporter
+	flows := append(testFlows(), raw...)
+	for _, version := range []uint16{9, 10} {
+		collector := newTestCollector(t)
+		exporter := newTestExporter(t, collector, ExportOptions{Version: version, SourceID: 3})
+		for _, f := range flows {
+			if err := exporter.Export(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := exporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		decoder := newMessageDecoder(0, 0)
+		decoded, skipped, err := decoder.decode("test", collector.receive())
+		if err != nil || skipped != 0 {
+			t.Fatalf("version %d: cannot decode: %v, %d data sets skipped", version, err, skipped)
+		}
+		compareFlows(t, flows, decoded, time.Second)
+		for _, id := range []uint16{templateIDIPv4 + templateVariantNoMAC, templateIDIPv6 + templateVariantNoMAC} {
+			received, found := decoder.templates[templateKey{"test", 3, id}]
+			if !found {
+				t.Errorf("version %d: template %d not announced", version, id)
+				continue
+			}
+			for _, field := range received.fields {
+				if field.id == fieldSourceMacAddress || field.id == fieldDestinationMacAddress {
+					t.Errorf("version %d: template %d has the MAC field %d", version, id, field.id)
+				}
+			}
+		}
+		if _, found := decoder.templates[templateKey{"test", 3, templateIDIPv4 + templateVariantTunnel}]; found {
+			t.Errorf("version %d: tunnel template announced without decapsulated flows", version)
+		}
+	}
+
+	for _, c := range []struct {
+		macAddresses uint8
+		fields       []string
+	}{
+		{0, nil},
+		{macSource, []string{"source_mac"}},
+		{macSource | macDestination, []string{"source_mac", "destination_mac"}},
+	} {
+		f := testFlows()[0]
+		f.key.macAddresses = c.macAddresses
+		line, err := json.Marshal(newJSONFlow(&f, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			t.Fatal(err)
+		}
+		_, source := fields["source_mac"]
+		_, destination := fields["destination_mac"]
+		if source != (c.macAddresses&macSource != 0) || destination != (c.macAddresses&macDestination != 0) {
+			t.Errorf("MAC addresses %d written as %s, expected %v", c.macAddresses, line, c.fields)
+		}
+	}
+
+	// The MAC addresses follow the direction of reversed keys
+	key := testFlows()[0].key
+	key.macAddresses = macSource
+	if reverse := key.Reverse(); reverse.SourceMAC() != nil || reverse.DestinationMAC().String() != "02:00:00:00:00:01" {
+		t.Errorf("reversed key from %s to %s", reverse.SourceMAC(), reverse.DestinationMAC())
+	}
+}
+
+func TestTemplateVariants(t *testing.T) {
+	const geo, tunnels = 64512, 64513
+	// Each flow uses another template: IPv4 or IPv6, decapsulated or not, with or without MAC addresses
+	var flows []Flow
+	for _, f := range testFlows() {
+		f.sourceCountry, f.destinationCity = "FR", "Paris"
+		for _, tunnel := range []bool{false, true} {
+			for _, mac := range []bool{true, false} {
+				variant := f
+				if tunnel {
+					variant.key.tunnelType, variant.key.tunnelID = TunnelGeneve, 42
+					variant.tunnelSource, variant.tunnelDestination = net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:1::2")
+				}
+				if !mac {
+					variant.key.sourceMacAddress, variant.key.destinationMacAddress, variant.key.macAddresses = [6]byte{}, [6]byte{}, 0
+				}
+				flows = append(flows, variant)
+			}
+		}
+	}
+	// The templates of every variant do not fit in one message
+	for _, options := range []ExportOptions{
+		{Version: 9, SourceID: 1, GeoEnterpriseNumber: geo, TunnelEnterpriseNumber: tunnels},
+		{Version: 10, SourceID: 2, GeoEnterpriseNumber: geo, TunnelEnterpriseNumber: tunnels},
+		{Version: 10, SourceID: 3, Biflow: true, GeoEnterpriseNumber: geo, TunnelEnterpriseNumber: tunnels},
+	} {
+		collector := newTestCollector(t)
+		exporter := newTestExporter(t, collector, options)
+		// A decapsulated IPv6 flow alone, then every variant
+		for _, f := range append([]Flow{flows[7]}, flows...) {
+			if err := exporter.Export(f); err != nil {
+				t.Fatalf("version %d: cannot export: %s", options.Version, err)
+			}
+		}
+		if err := exporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		decoder := newMessageDecoder(geo, tunnels)
+		var decoded []Flow
+		for len(decoded) <= len(flows) {
+			message := collector.receive()
+			if len(message) > exportBufferSize {
+				t.Errorf("version %d: message of %d bytes", options.Version, len(message))
+			}
+			received, skipped, err := decoder.decode("test", message)
+			if err != nil || skipped != 0 {
+				t.Fatalf("version %d: cannot decode: %v, %d data sets skipped", options.Version, err, skipped)
+			}
+			decoded = append(decoded, received...)
+		}
+		compareFlows(t, append([]Flow{flows[7]}, flows...), decoded, time.Second)
+		for i, f := range decoded[1:] {
+			if !f.tunnelDestination.Equal(flows[i].tunnelDestination) || f.destinationCity != "Paris" {
+				t.Errorf("version %d: flow %d to %s in tunnel to %s", options.Version, i, f.destinationCity, f.tunnelDestination)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package flow
+
+import "github.com/COSAE-FR/ripflow/metrics"
+
+var (
+	capturePacketsMetric = metrics.Default.NewCounterVec("ripflow_capture_packets_total",
+		"Packets received by the capture", "interface")
+	captureDroppedMetric = metrics.Default.NewCounterVec("ripflow_capture_dropped_packets_total",
+		"Packets dropped by the capture buffer", "interface")
+	captureIfDroppedMetric = metrics.Default.NewCounterVec("ripflow_capture_interface_dropped_packets_total",
+		"Packets dropped by the network interface", "interface")
+	captureQueueFreezesMetric = metrics.Default.NewCounterVec("ripflow_capture_queue_freezes_total",
+		"AF_PACKET ring queue freezes", "interface")
+	captureDecodeErrorsMetric = metrics.Default.NewCounterVec("ripflow_capture_decode_errors_total",
+		"Packets that could not be fully decoded", "interface")
+	captureNonIPMetric = metrics.Default.NewCounterVec("ripflow_capture_non_ip_packets_total",
+		"Non IP packets skipped", "interface")
+	cacheFlowsMetric = metrics.Default.NewGauge("ripflow_cache_flows",
+		"Flows in the cache")
+	cacheEvictionsMetric = metrics.Default.NewCounterVec("ripflow_cache_evictions_total",
+		"Flows leaving the cache", "reason")
+	fanoutDroppedMetric = metrics.Default.NewCounterVec("ripflow_fanout_dropped_flows_total",
+		"Flows dropped as the queue of the destination was full", "collector")
+	exporterDatagramsMetric = metrics.Default.NewCounterVec("ripflow_exporter_datagrams_total",
+		"Datagrams or messages sent to the collector", "collector")
+	exporterFlowsMetric = metrics.Default.NewCounterVec("ripflow_exporter_flows_total",
+		"Flow records sent to the collector", "collector")
+	exporterErrorsMetric = metrics.Default.NewCounterVec("ripflow_exporter_errors_total",
+		"Export errors", "collector")
+	collectorMessagesMetric = metrics.Default.NewCounterVec("ripflow_collector_messages_total",
+		"Netflow and IPFIX messages received", "exporter")
+	collectorFlowsMetric = metrics.Default.NewCounterVec("ripflow_collector_flows_total",
+		"Flow records decoded", "exporter")
+	collectorErrorsMetric = metrics.Default.NewCounterVec("ripflow_collector_errors_total",
+		"Messages that could not be fully decoded", "exporter")
+	collectorUnknownTemplateMetric = metrics.Default.NewCounterVec("ripflow_collector_unknown_template_sets_total",
+		"Data sets skipped as their template was not received yet", "exporter")
+)
+
+func flowEndReasonName(reason uint8) string {
+	switch reason {
+	case flowEndReasonIdleTimeout:
+		return "idle_timeout"
+	case flowEndReasonActiveTimeout:
+		return "active_timeout"
+	case flowEndReasonEndOfFlow:
+		return "end_of_flow"
+	case flowEndReasonForceEnd:
+		return "force_end"
+	case flowEndReasonLackOfResources:
+		return "lack_of_resources"
+	}
+	return "unknown"
+}
@@ -0,0 +1,149 @@
+package flow
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// netflow5Header holds the fields of a Netflow v5 header checked by the tests
+type netflow5Header struct {
+	count    uint16
+	uptime   time.Duration
+	export   time.Time
+	sequence uint32
+	engine   uint16
+}
+
+func readNetflow5Header(t *testing.T, message []byte) netflow5Header {
+	t.Helper()
+	if len(message) < netflow5HeaderSize || binary.BigEndian.Uint16(message) != 5 {
+		t.Fatalf("not a Netflow v5 message: %x", message)
+	}
+	header := netflow5Header{
+		count:    binary.BigEndian.Uint16(message[2:]),
+		uptime:   time.Duration(binary.BigEndian.Uint32(message[4:])) * time.Millisecond,
+		export:   time.Unix(int64(binary.BigEndian.Uint32(message[8:])), int64(binary.BigEndian.Uint32(message[12:]))),
+		sequence: binary.BigEndian.Uint32(message[16:]),
+		engine:   binary.BigEndian.Uint16(message[20:]),
+	}
+	if length := netflow5HeaderSize + int(header.count)*netflow5RecordSize; length != len(message) {
+		t.Fatalf("%d records announced in a message of %d bytes", header.count, len(message))
+	}
+	return header
+}
+
+func TestNetflow5Header(t *testing.T) {
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, ExportOptions{Version: 5})
+	first, second := testFlows()[0], testFlows()[0]
+	first.engineType, first.engineID = 1, 1
+	second.engineType, second.engineID = 1, 2
+	// Each change of engine starts a new message, each engine follows its own sequence
+	for _, f := range []Flow{first, first, first, second, second, first} {
+		if err := exporter.Export(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []struct {
+		count    uint16
+		sequence uint32
+		engine   uint16
+	}{
+		{3, 0, 0x0101},
+		{2, 0, 0x0102},
+		{1, 3, 0x0101},
+	} {
+		message := collector.receive()
+		header := readNetflow5Header(t, message)
+		if header.count != expected.count || header.sequence != expected.sequence || header.engine != expected.engine {
+			t.Errorf("message %d: %d records, sequence %d, engine %04x, expected %d records, sequence %d, engine %04x", i,
+				header.count, header.sequence, header.engine, expected.count, expected.sequence, expected.engine)
+		}
+		// The test exporter started an hour ago
+		if header.uptime < time.Hour || header.uptime > time.Hour+time.Minute {
+			t.Errorf("message %d: uptime %s, expected an hour", i, header.uptime)
+		}
+		if d := time.Since(header.export); d < 0 || d > time.Minute {
+			t.Errorf("message %d: exported at %s", i, header.export)
+		}
+		// Record times are relative to the uptime of the header
+		boot := header.export.Add(-header.uptime)
+		start := boot.Add(time.Duration(binary.BigEndian.Uint32(message[netflow5HeaderSize+24:])) * time.Millisecond)
+		if d := start.Sub(first.start); d < -2*time.Millisecond || d > 2*time.Millisecond {
+			t.Errorf("message %d: record started at %s, expected %s", i, start, first.start)
+		}
+	}
+	if exporter.TotalFlowCount != 6 {
+		t.Errorf("%d flows counted, expected 6", exporter.TotalFlowCount)
+	}
+}
+
+func TestSplitCounters(t *testing.T) {
+	for _, c := range []struct {
+		octets   uint64
+		packets  uint64
+		records  int
+		exported uint64 // Packets of the records, at least one each
+	}{
+		{maxNetflow5Counter, 1, 1, 1},
+		{maxNetflow5Counter + 1, 1, 2, 2},
+		{10<<32 + 5, 1 << 20, 11, 1 << 20},
+		{10<<32 + 5, 3, 11, 11},
+		{1 << 40, 3 << 32, 257, 3 << 32},
+		{1000, 5 << 32, 6, 5 << 32},
+	} {
+		f := testFlows()[0]
+		f.octetDeltaCount, f.packetDeltaCount = c.octets, c.packets
+		records := f.splitCounters()
+		if len(records) != c.records {
+			t.Errorf("%d octets and %d packets split in %d records, expected %d", c.octets, c.packets, len(records), c.records)
+			continue
+		}
+		var octets, packets uint64
+		for _, record := range records {
+			if record.octetDeltaCount > maxNetflow5Counter || record.packetDeltaCount > maxNetflow5Counter {
+				t.Errorf("record of %d octets and %d packets exceeds 32 bits", record.octetDeltaCount, record.packetDeltaCount)
+			}
+			if record.packetDeltaCount == 0 {
+				t.Errorf("record of %d octets without packets", record.octetDeltaCount)
+			}
+			if !record.key.sourceIPAddress.Equal(f.key.sourceIPAddress) || record.start != f.start {
+				t.Errorf("record of another flow: %s", record.String())
+			}
+			octets += record.octetDeltaCount
+			packets += record.packetDeltaCount
+		}
+		if octets != c.octets || packets != c.exported {
+			t.Errorf("records sum %d octets and %d packets, expected %d and %d", octets, packets, c.octets, c.exported)
+		}
+	}
+
+	// The records of a large flow are exported and decoded with the same total
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, ExportOptions{Version: 5})
+	f := testFlows()[0]
+	f.octetDeltaCount, f.packetDeltaCount = 3<<32+7, 1<<33
+	if err := exporter.Export(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := newMessageDecoder(0, 0).decode("test", collector.receive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var octets, packets uint64
+	for _, record := range decoded {
+		octets += record.octetDeltaCount
+		packets += record.packetDeltaCount
+	}
+	if len(decoded) != 4 || octets != f.octetDeltaCount || packets != f.packetDeltaCount {
+		t.Errorf("%d records of %d octets and %d packets decoded, expected 4 records of %d and %d",
+			len(decoded), octets, packets, f.octetDeltaCount, f.packetDeltaCount)
+	}
+}
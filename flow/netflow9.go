@@ -0,0 +1,151 @@
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	netflow9HeaderSize        = 20
+	netflow9TemplateFlowSetID = 0
+	flowSetHeaderSize         = 4
+)
+
+// netflow9Templates returns the Netflow v9 templates, with the GeoIP vendor fields when geo is set
+// and the templates of decapsulated flows when tunnels is set
+func netflow9Templates(geo bool, tunnels bool) templateSet {
+	templates := netflow9BaseTemplates()
+	if geo {
+		templates.ipv4 = newTemplate(templateIDIPv4, append(templates.ipv4.fields, geoFields(0)...)...)
+		templates.ipv6 = newTemplate(templateIDIPv6, append(templates.ipv6.fields, geoFields(0)...)...)
+	}
+	if tunnels {
+		templates = templates.withTunnels(0)
+	}
+	return templates
+}
+
+func netflow9BaseTemplates() templateSet {
+	return templateSet{
+		ipv4: newTemplate(templateIDIPv4,
+			templateField{fieldSourceIPv4Address, 4, 0},
+			templateField{fieldDestinationIPv4Address, 4, 0},
+			templateField{fieldSourceTransportPort, 2, 0},
+			templateField{fieldDestinationTransportPort, 2, 0},
+			templateField{fieldProtocolIdentifier, 1, 0},
+			templateField{fieldIPClassOfService, 1, 0},
+			templateField{fieldTCPControlBits, 1, 0},
+			templateField{fieldIngressInterface, 2, 0},
+			templateField{fieldOctetDeltaCount, 8, 0},
+			templateField{fieldPacketDeltaCount, 8, 0},
+			templateField{fieldFlowStartSysUpTime, 4, 0},
+			templateField{fieldFlowEndSysUpTime, 4, 0},
+			templateField{fieldIcmpTypeCodeIPv4, 2, 0},
+			templateField{fieldVlanId, 2, 0},
+			templateField{fieldSourceMacAddress, 6, 0},
+			templateField{fieldDestinationMacAddress, 6, 0},
+			templateField{fieldIPVersion, 1, 0},
+			templateField{fieldSamplingInterval, 4, 0},
+			templateField{fieldSamplingAlgorithm, 1, 0},
+			templateField{fieldFragmentIdentification, 4, 0},
+			templateField{fieldBgpSourceAsNumber, 4, 0},
+			templateField{fieldBgpDestinationAsNumber, 4, 0},
+			templateField{fieldSourceIPv4PrefixLength, 1, 0},
+			templateField{fieldDestinationIPv4PrefixLength, 1, 0},
+			templateField{fieldIPNextHopIPv4Address, 4, 0},
+			templateField{fieldEgressInterface, 2, 0},
+		),
+		ipv6: newTemplate(templateIDIPv6,
+			templateField{fieldSourceIPv6Address, 16, 0},
+			templateField{fieldDestinationIPv6Address, 16, 0},
+			templateField{fieldSourceTransportPort, 2, 0},
+			templateField{fieldDestinationTransportPort, 2, 0},
+			templateField{fieldProtocolIdentifier, 1, 0},
+			templateField{fieldIPClassOfService, 1, 0},
+			templateField{fieldTCPControlBits, 1, 0},
+			templateField{fieldIngressInterface, 2, 0},
+			templateField{fieldOctetDeltaCount, 8, 0},
+			templateField{fieldPacketDeltaCount, 8, 0},
+			templateField{fieldFlowStartSysUpTime, 4, 0},
+			templateField{fieldFlowEndSysUpTime, 4, 0},
+			templateField{fieldIcmpTypeCodeIPv6, 2, 0},
+			templateField{fieldVlanId, 2, 0},
+			templateField{fieldSourceMacAddress, 6, 0},
+			templateField{fieldDestinationMacAddress, 6, 0},
+			templateField{fieldIPVersion, 1, 0},
+			templateField{fieldSamplingInterval, 4, 0},
+			templateField{fieldSamplingAlgorithm, 1, 0},
+			templateField{fieldFlowLabelIPv6, 3, 0},
+			templateField{fieldBgpSourceAsNumber, 4, 0},
+			templateField{fieldBgpDestinationAsNumber, 4, 0},
+			templateField{fieldSourceIPv6PrefixLength, 1, 0},
+			templateField{fieldDestinationIPv6PrefixLength, 1, 0},
+			templateField{fieldIPNextHopIPv6Address, 16, 0},
+			templateField{fieldEgressInterface, 2, 0},
+		),
+	}
+}
+
+// templatesDue tells if the templates must be announced again
+func (e *Exporter) templatesDue(now time.Time) bool {
+	if e.lastTemplate.IsZero() {
+		return true
+	}
+	// Templates are sent once per stream connection
+	if e.transport == "tcp" {
+		return false
+	}
+	if e.templateRefreshPackets > 0 && e.packetsSinceTemplate >= e.templateRefreshPackets {
+		return true
+	}
+	if e.templateRefreshInterval > 0 && now.Sub(e.lastTemplate) >= e.templateRefreshInterval {
+		return true
+	}
+	return false
+}
+
+func (e *Exporter) ExportNetflow9(flow Flow) error {
+	t := e.templateFor(&flow)
+	if t == nil {
+		e.log.Debugf("Cannot export flow in Netflow V9: %s", flow.String())
+		return fmt.Errorf("IP version %d not supported in Netflow V9", flow.key.ipVersion)
+	}
+	if e.messageSize(netflow9HeaderSize, t) > exportBufferSize {
+		if err := e.flushNetflow9(); err != nil {
+			return err
+		}
+		if e.messageSize(netflow9HeaderSize, t) > exportBufferSize {
+			return fmt.Errorf("template %d and its record do not fit in a Netflow V9 packet", t.id)
+		}
+	}
+	e.lastFlow = &flow
+	e.pending.add(&flow, t, e.BaseTime)
+	return nil
+}
+
+func (e *Exporter) flushNetflow9() error {
+	if e.pending.records == 0 {
+		return nil
+	}
+	now := time.Now()
+	count := e.pending.records
+	offset := netflow9HeaderSize
+	if templates := e.pendingTemplates(now); len(templates) > 0 {
+		offset += serializeTemplates(e.buffer[offset:], netflow9TemplateFlowSetID, templates)
+		count += len(templates)
+	}
+	offset += e.pending.serialize(e.buffer[offset:])
+	binary.BigEndian.PutUint16(e.buffer[0:], uint16(9)) // NetFlow v9 Header constant value
+	binary.BigEndian.PutUint16(e.buffer[2:], uint16(count))
+	binary.BigEndian.PutUint32(e.buffer[4:], uint32(sysUpTime(now, e.BaseTime)))
+	binary.BigEndian.PutUint32(e.buffer[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(e.buffer[12:], e.sequence)
+	binary.BigEndian.PutUint32(e.buffer[16:], e.sourceID)
+	e.sequence++
+	e.packetsSinceTemplate++
+	records := e.pending.records
+	e.TotalFlowCount += uint32(records)
+	e.pending.reset()
+	return e.send(e.buffer[:offset], records)
+}
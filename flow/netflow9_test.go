@@ -0,0 +1,281 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// testCollector receives the messages of an exporter on a local UDP socket
+type testCollector struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testCollector{t: t, conn: conn}
+}
+
+func (c *testCollector) port() uint16 {
+	return uint16(c.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func (c *testCollector) receive() []byte {
+	buf := make([]byte, 65536)
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatalf("no message received: %s", err)
+	}
+	return buf[:n]
+}
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+func newTestExporter(t *testing.T, collector *testCollector, options ExportOptions) *Exporter {
+	exporter, err := NewExporter("127.0.0.1", collector.port(), options, testLogger())
+	if err != nil {
+		t.Fatalf("cannot create exporter: %s", err)
+	}
+	t.Cleanup(func() { _ = exporter.close() })
+	// The test flows start before the process
+	exporter.BaseTime = time.Now().Add(-time.Hour)
+	return exporter
+}
+
+// testFlows returns an IPv4 TCP flow and an IPv6 ICMP flow filling the fields of the base templates
+func testFlows() []Flow {
+	start := time.Now().Add(-10 * time.Second).Truncate(time.Millisecond)
+	tcp := Flow{
+		key: FlowKey{
+			sourceIPAddress:          net.IPv4(192, 0, 2, 1).To4(),
+			destinationIPAddress:     net.IPv4(198, 51, 100, 2).To4(),
+			fragmentIdentification:   4242,
+			sourceTransportPort:      43210,
+			destinationTransportPort: 443,
+			vlanId:                   12,
+			sourceMacAddress:         [6]byte{0x02, 0, 0, 0, 0, 1},
+			destinationMacAddress:    [6]byte{0x02, 0, 0, 0, 0, 2},
+			macAddresses:             macSource | macDestination,
+			protocolIdentifier:       6,
+			ipClassOfService:         0x28,
+			ipVersion:                4,
+		},
+		octetDeltaCount:         123456,
+		packetDeltaCount:        321,
+		tcpControlBits:          tcpControlBitsSYN | tcpControlBitsACK,
+		ifIndex:                 3,
+		start:                   start,
+		end:                     start.Add(5 * time.Second),
+		samplingInterval:        100,
+		samplingAlgorithm:       SamplingDeterministic,
+		sourceAS:                64500,
+		destinationAS:           4200000000,
+		sourcePrefixLength:      24,
+		destinationPrefixLength: 16,
+		nextHop:                 net.IPv4(192, 0, 2, 254).To4(),
+		outputInterface:         4,
+	}
+	icmp := Flow{
+		key: FlowKey{
+			sourceIPAddress:       net.ParseIP("2001:db8::1"),
+			destinationIPAddress:  net.ParseIP("2001:db8::2"),
+			flowLabelIPv6:         0xbeef,
+			icmpTypeCode:          128 << 8,
+			sourceMacAddress:      [6]byte{0x02, 0, 0, 0, 0, 3},
+			destinationMacAddress: [6]byte{0x02, 0, 0, 0, 0, 4},
+			macAddresses:          macSource | macDestination,
+			protocolIdentifier:    58,
+			ipVersion:             6,
+		},
+		octetDeltaCount:         640,
+		packetDeltaCount:        10,
+		ifIndex:                 5,
+		start:                   start.Add(time.Second),
+		end:                     start.Add(9 * time.Second),
+		sourcePrefixLength:      64,
+		destinationPrefixLength: 48,
+		nextHop:                 net.ParseIP("2001:db8::fe"),
+		outputInterface:         6,
+	}
+	return []Flow{tcp, icmp}
+}
+
+// netflow9Record maps the element IDs of a data record to their values
+type netflow9Record map[uint16][]byte
+
+// decodeNetflow9 decodes the data records of a Netflow v9 message, the templates it
+// defines are added to templates
+func decodeNetflow9(t *testing.T, message []byte, templates map[uint16][]templateField) []netflow9Record {
+	t.Helper()
+	if len(message) < netflow9HeaderSize || binary.BigEndian.Uint16(message) != 9 {
+		t.Fatalf("not a Netflow v9 message: % x", message)
+	}
+	var records []netflow9Record
+	for offset := netflow9HeaderSize; offset+flowSetHeaderSize <= len(message); {
+		id := binary.BigEndian.Uint16(message[offset:])
+		length := int(binary.BigEndian.Uint16(message[offset+2:]))
+		if length < flowSetHeaderSize || offset+length > len(message) {
+			t.Fatalf("FlowSet %d of %d bytes at offset %d", id, length, offset)
+		}
+		set := message[offset+flowSetHeaderSize : offset+length]
+		offset += length
+		if id == netflow9TemplateFlowSetID {
+			for len(set) >= 4 {
+				templateID, count := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+				set = set[4:]
+				fields := make([]templateField, count)
+				for i := range fields {
+					fields[i] = templateField{id: binary.BigEndian.Uint16(set[4*i:]), length: binary.BigEndian.Uint16(set[4*i+2:])}
+				}
+				templates[templateID] = fields
+				set = set[4*count:]
+			}
+			continue
+		}
+		fields, found := templates[id]
+		if !found {
+			t.Fatalf("data FlowSet of unknown template %d", id)
+		}
+		size := 0
+		for _, field := range fields {
+			size += int(field.length)
+		}
+		for ; len(set) >= size; set = set[size:] {
+			record := make(netflow9Record)
+			position := 0
+			for _, field := range fields {
+				record[field.id] = set[position : position+int(field.length)]
+				position += int(field.length)
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestNetflow9Export(t *testing.T) {
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, ExportOptions{Version: 9, SourceID: 7})
+	flows := testFlows()
+	for _, f := range flows {
+		if err := exporter.Export(f); err != nil {
+			t.Fatalf("cannot export: %s", err)
+		}
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("cannot flush: %s", err)
+	}
+	templates := make(map[uint16][]templateField)
+	records := decodeNetflow9(t, collector.receive(), templates)
+	if len(records) != len(flows) {
+		t.Fatalf("%d records, expected %d", len(records), len(flows))
+	}
+
+	// Each template uses the ICMP type element of its IP version
+	for _, c := range []struct {
+		id        uint16
+		icmp      uint16
+		forbidden uint16
+	}{
+		{templateIDIPv4, fieldIcmpTypeCodeIPv4, fieldIcmpTypeCodeIPv6},
+		{templateIDIPv6, fieldIcmpTypeCodeIPv6, fieldIcmpTypeCodeIPv4},
+	} {
+		used := make(map[uint16]bool)
+		for _, field := range templates[c.id] {
+			used[field.id] = true
+		}
+		if !used[c.icmp] || used[c.forbidden] {
+			t.Errorf("template %d: element %d used %t, element %d used %t", c.id, c.icmp, used[c.icmp], c.forbidden, used[c.forbidden])
+		}
+	}
+
+	uint16Bytes := func(value uint16) []byte {
+		return []byte{byte(value >> 8), byte(value)}
+	}
+	uint32Bytes := func(value uint32) []byte {
+		return []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+	}
+	uptime := func(at time.Time) []byte {
+		return uint32Bytes(uint32(at.Sub(exporter.BaseTime) / time.Millisecond))
+	}
+	tcp, icmp := flows[0], flows[1]
+	for i, expected := range []netflow9Record{
+		{
+			fieldSourceIPv4Address:        tcp.key.sourceIPAddress,
+			fieldDestinationIPv4Address:   tcp.key.destinationIPAddress,
+			fieldSourceTransportPort:      uint16Bytes(tcp.key.sourceTransportPort),
+			fieldDestinationTransportPort: uint16Bytes(tcp.key.destinationTransportPort),
+			fieldProtocolIdentifier:       {6},
+			fieldIPClassOfService:         {tcp.key.ipClassOfService},
+			fieldTCPControlBits:           {byte(tcp.tcpControlBits)},
+			fieldOctetDeltaCount:          {0, 0, 0, 0, 0, 0x01, 0xe2, 0x40},
+			fieldPacketDeltaCount:         {0, 0, 0, 0, 0, 0, 0x01, 0x41},
+			fieldFlowStartSysUpTime:       uptime(tcp.start),
+			fieldFlowEndSysUpTime:         uptime(tcp.end),
+			fieldIcmpTypeCodeIPv4:         {0, 0},
+			fieldVlanId:                   uint16Bytes(tcp.key.vlanId),
+			fieldSourceMacAddress:         tcp.key.sourceMacAddress[:],
+			fieldDestinationMacAddress:    tcp.key.destinationMacAddress[:],
+			fieldIPVersion:                {4},
+			fieldFragmentIdentification:   uint32Bytes(tcp.key.fragmentIdentification),
+		},
+		{
+			fieldSourceIPv6Address:      icmp.key.sourceIPAddress,
+			fieldDestinationIPv6Address: icmp.key.destinationIPAddress,
+			fieldProtocolIdentifier:     {58},
+			fieldOctetDeltaCount:        {0, 0, 0, 0, 0, 0, 0x02, 0x80},
+			fieldPacketDeltaCount:       {0, 0, 0, 0, 0, 0, 0, 0x0a},
+			fieldFlowStartSysUpTime:     uptime(icmp.start),
+			fieldFlowEndSysUpTime:       uptime(icmp.end),
+			fieldIcmpTypeCodeIPv6:       {128, 0},
+			fieldSourceMacAddress:       icmp.key.sourceMacAddress[:],
+			fieldDestinationMacAddress:  icmp.key.destinationMacAddress[:],
+			fieldIPVersion:              {6},
+			fieldFlowLabelIPv6:          {0, 0xbe, 0xef},
+		},
+	} {
+		for id, value := range expected {
+			if !bytes.Equal(records[i][id], value) {
+				t.Errorf("record %d: element %d is % x, expected % x", i, id, records[i][id], value)
+			}
+		}
+	}
+}
+
+func TestNetflow9UptimeBeforeBase(t *testing.T) {
+	collector := newTestCollector(t)
+	exporter := newTestExporter(t, collector, ExportOptions{Version: 9})
+	// A replayed flow starting before the exporter
+	f := testFlows()[0]
+	exporter.BaseTime = f.start.Add(time.Second)
+	if err := exporter.Export(f); err != nil {
+		t.Fatalf("cannot export: %s", err)
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("cannot flush: %s", err)
+	}
+	records := decodeNetflow9(t, collector.receive(), make(map[uint16][]templateField))
+	if len(records) != 1 {
+		t.Fatalf("%d records, expected 1", len(records))
+	}
+	start := binary.BigEndian.Uint32(records[0][fieldFlowStartSysUpTime])
+	end := binary.BigEndian.Uint32(records[0][fieldFlowEndSysUpTime])
+	if start != 0 || end != 4000 {
+		t.Errorf("uptimes %d and %d, expected 0 and 4000", start, end)
+	}
+}
@@ -0,0 +1,159 @@
+package flow
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const rotatedFileTimeFormat = "20060102-150405.000"
+
+// JSONOutputOptions selects where JSON lines are written
+type JSONOutputOptions struct {
+	Destination    string        // "stdout", a file path, unix:///path (stream) or unixgram:///path
+	MaxSize        int64         // Rotate the file above this size in bytes (0 to disable)
+	RotateInterval time.Duration // Rotate the file after this time (0 to disable)
+	MaxFiles       int           // Rotated files to keep (0 to keep all)
+}
+
+// jsonOutput writes lines to stdout, a rotated file or a Unix socket
+type jsonOutput struct {
+	options JSONOutputOptions
+	file    *os.File
+	size    int64
+	opened  time.Time
+	socket  collectorConnection
+	log     *log.Entry
+}
+
+func newJSONOutput(options JSONOutputOptions, logger *log.Entry) (*jsonOutput, error) {
+	output := &jsonOutput{options: options, log: logger}
+	switch {
+	case len(options.Destination) == 0 || options.Destination == "stdout" || options.Destination == "-":
+		output.file = os.Stdout
+	case strings.HasPrefix(options.Destination, "unix://"), strings.HasPrefix(options.Destination, "unixgram://"):
+		parts := strings.SplitN(options.Destination, "://", 2)
+		output.socket = collectorConnection{address: parts[1], transport: parts[0], log: logger}
+		if err := output.socket.connect(); err != nil {
+			// The reader may not be up yet, retry when writing
+			logger.Warnf("Cannot connect to %s: %s", options.Destination, err)
+		}
+	default:
+		if err := output.openFile(); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+func (o *jsonOutput) isFile() bool {
+	return o.file != nil && o.file != os.Stdout
+}
+
+func (o *jsonOutput) openFile() error {
+	file, err := os.OpenFile(o.options.Destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	o.file = file
+	o.size = info.Size()
+	o.opened = time.Now()
+	return nil
+}
+
+func (o *jsonOutput) rotationDue(length int) bool {
+	if o.size == 0 {
+		return false
+	}
+	if o.options.MaxSize > 0 && o.size+int64(length) > o.options.MaxSize {
+		return true
+	}
+	return o.options.RotateInterval > 0 && time.Since(o.opened) >= o.options.RotateInterval
+}
+
+// rotate renames the current file with its rotation time and opens a new one
+func (o *jsonOutput) rotate() error {
+	if err := o.file.Close(); err != nil {
+		o.log.Warnf("Cannot close %s: %s", o.options.Destination, err)
+	}
+	o.file = nil
+	rotated := o.options.Destination + "." + time.Now().Format(rotatedFileTimeFormat)
+	if err := os.Rename(o.options.Destination, rotated); err != nil {
+		o.log.Errorf("Cannot rotate %s: %s", o.options.Destination, err)
+	}
+	if err := o.openFile(); err != nil {
+		return err
+	}
+	o.removeOldFiles()
+	return nil
+}
+
+func (o *jsonOutput) removeOldFiles() {
+	if o.options.MaxFiles <= 0 {
+		return
+	}
+	rotated, err := filepath.Glob(o.options.Destination + ".*")
+	if err != nil || len(rotated) <= o.options.MaxFiles {
+		return
+	}
+	// Rotation times sort in name order
+	sort.Strings(rotated)
+	for _, path := range rotated[:len(rotated)-o.options.MaxFiles] {
+		if err := os.Remove(path); err != nil {
+			o.log.Warnf("Cannot remove %s: %s", path, err)
+		}
+	}
+}
+
+func (o *jsonOutput) write(line []byte) error {
+	if len(o.socket.transport) > 0 {
+		err := o.socket.write(line)
+		if err != nil && o.socket.connection != nil && o.socket.transport == "unix" {
+			o.log.Warnf("Connection to %s lost: %s", o.options.Destination, err)
+			_ = o.socket.connection.Close()
+			o.socket.connection = nil
+		}
+		return err
+	}
+	if o.file == nil {
+		// A previous rotation failed to open the new file
+		if err := o.openFile(); err != nil {
+			return err
+		}
+	}
+	if o.isFile() && o.rotationDue(len(line)) {
+		if err := o.rotate(); err != nil {
+			return fmt.Errorf("cannot open %s after rotation: %s", o.options.Destination, err)
+		}
+	}
+	n, err := o.file.Write(line)
+	o.size += int64(n)
+	return err
+}
+
+func (o *jsonOutput) close() error {
+	if len(o.socket.transport) > 0 {
+		return o.socket.close()
+	}
+	if o.isFile() {
+		return o.file.Close()
+	}
+	return nil
+}
+
+// name is used in logs and metrics
+func (o *jsonOutput) name() string {
+	if o.file == os.Stdout {
+		return "stdout"
+	}
+	return o.options.Destination
+}
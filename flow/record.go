@@ -0,0 +1,210 @@
+package flow
+
+import (
+	"net"
+	"time"
+)
+
+// Flow end reasons, from the IPFIX flowEndReason element
+const (
+	EndReasonIdleTimeout     = flowEndReasonIdleTimeout
+	EndReasonActiveTimeout   = flowEndReasonActiveTimeout
+	EndReasonEndOfFlow       = flowEndReasonEndOfFlow // TCP FIN or RST
+	EndReasonForceEnd        = flowEndReasonForceEnd  // Shutdown or control socket
+	EndReasonLackOfResources = flowEndReasonLackOfResources
+)
+
+// Record is a copy of the fields of a flow, safe to keep and modify
+type Record struct {
+	Start             time.Time // First packet
+	End               time.Time // Last packet
+	InterfaceIndex    uint16    // Capture interface
+	IPVersion         uint8     // 4 or 6
+	SourceIP          net.IP
+	DestinationIP     net.IP
+	SourcePort        uint16 // 0 for ICMP
+	DestinationPort   uint16 // 0 for ICMP
+	Protocol          uint8  // IP protocol number
+	ICMPType          uint8
+	ICMPCode          uint8
+	ClassOfService    uint8 // IPv4 TOS or IPv6 traffic class
+	VlanID            uint16
+	SourceMAC         net.HardwareAddr // nil when the link layer has no MAC addresses
+	DestinationMAC    net.HardwareAddr // nil as well with Linux cooked headers
+	FlowLabel         uint32           // IPv6 only
+	FragmentID        uint32
+	Octets            uint64
+	Packets           uint64
+	TCPFlags          uint16 // Union of the TCP control bits, FIN is 0x01
+	EndReason         uint8  // One of the EndReason constants, 0 while the flow is active
+	SamplingAlgorithm uint8  // SamplingDeterministic or SamplingRandom, 0 without sampling
+	SamplingInterval  uint32 // One packet or flow accounted out of SamplingInterval
+	// Tunnel of decapsulated flows, TunnelType is 0 for the other flows
+	TunnelType        uint8  // One of the Tunnel constants
+	TunnelID          uint32 // GRE key, ERSPAN session, VNI or top MPLS label
+	TunnelSource      net.IP // Outer endpoints, nil for MPLS over Ethernet
+	TunnelDestination net.IP
+	// Counters of the opposite direction of biflows, zero for unidirectional flows
+	ReverseOctets   uint64
+	ReversePackets  uint64
+	ReverseTCPFlags uint16
+	ReverseStart    time.Time
+	ReverseEnd      time.Time
+	// Filled by enrichment, zero when unknown
+	SourceAS                uint32
+	DestinationAS           uint32
+	SourcePrefixLength      uint8
+	DestinationPrefixLength uint8
+	NextHop                 net.IP
+	OutputInterface         uint32
+	SourceCountry           string // ISO 3166 code
+	SourceCity              string
+	DestinationCountry      string
+	DestinationCity         string
+}
+
+// Record copies the fields of the flow
+func (f *Flow) Record() Record {
+	record := Record{
+		Start:                   f.start,
+		End:                     f.end,
+		InterfaceIndex:          f.ifIndex,
+		IPVersion:               f.key.ipVersion,
+		SourceIP:                copyIP(f.key.sourceIPAddress),
+		DestinationIP:           copyIP(f.key.destinationIPAddress),
+		SourcePort:              f.key.sourceTransportPort,
+		DestinationPort:         f.key.destinationTransportPort,
+		Protocol:                f.key.protocolIdentifier,
+		ICMPType:                f.key.ICMPType(),
+		ICMPCode:                f.key.ICMPCode(),
+		ClassOfService:          f.key.ipClassOfService,
+		VlanID:                  f.key.vlanId,
+		SourceMAC:               f.key.SourceMAC(),
+		DestinationMAC:          f.key.DestinationMAC(),
+		FlowLabel:               f.key.flowLabelIPv6,
+		FragmentID:              f.key.fragmentIdentification,
+		Octets:                  f.octetDeltaCount,
+		Packets:                 f.packetDeltaCount,
+		TCPFlags:                f.tcpControlBits,
+		EndReason:               f.flowEndReason,
+		SamplingAlgorithm:       f.samplingAlgorithm,
+		SamplingInterval:        f.samplingInterval,
+		TunnelType:              f.key.tunnelType,
+		TunnelID:                f.key.tunnelID,
+		ReverseOctets:           f.reverseOctetDeltaCount,
+		ReversePackets:          f.reversePacketDeltaCount,
+		ReverseTCPFlags:         f.reverseTcpControlBits,
+		ReverseStart:            f.reverseStart,
+		ReverseEnd:              f.reverseEnd,
+		SourceAS:                f.sourceAS,
+		DestinationAS:           f.destinationAS,
+		SourcePrefixLength:      f.sourcePrefixLength,
+		DestinationPrefixLength: f.destinationPrefixLength,
+		OutputInterface:         f.outputInterface,
+		SourceCountry:           f.sourceCountry,
+		SourceCity:              f.sourceCity,
+		DestinationCountry:      f.destinationCountry,
+		DestinationCity:         f.destinationCity,
+	}
+	if f.nextHop != nil {
+		record.NextHop = copyIP(f.nextHop)
+	}
+	if f.tunnelSource != nil {
+		record.TunnelSource, record.TunnelDestination = copyIP(f.tunnelSource), copyIP(f.tunnelDestination)
+	}
+	return record
+}
+
+// Key returns the fields identifying the flow
+func (f *Flow) Key() FlowKey {
+	return f.key
+}
+
+func (f *Flow) Start() time.Time {
+	return f.start
+}
+
+func (f *Flow) End() time.Time {
+	return f.end
+}
+
+func (f *Flow) InterfaceIndex() uint16 {
+	return f.ifIndex
+}
+
+func (f *Flow) Octets() uint64 {
+	return f.octetDeltaCount
+}
+
+func (f *Flow) Packets() uint64 {
+	return f.packetDeltaCount
+}
+
+func (f *Flow) TCPFlags() uint16 {
+	return f.tcpControlBits
+}
+
+func (f *Flow) EndReason() uint8 {
+	return f.flowEndReason
+}
+
+func (f *Flow) SamplingAlgorithm() uint8 {
+	return f.samplingAlgorithm
+}
+
+func (f *Flow) SamplingInterval() uint32 {
+	return f.samplingInterval
+}
+
+func (f *Flow) ReverseOctets() uint64 {
+	return f.reverseOctetDeltaCount
+}
+
+func (f *Flow) ReversePackets() uint64 {
+	return f.reversePacketDeltaCount
+}
+
+func (f *Flow) ReverseTCPFlags() uint16 {
+	return f.reverseTcpControlBits
+}
+
+func (f *Flow) ReverseStart() time.Time {
+	return f.reverseStart
+}
+
+func (f *Flow) ReverseEnd() time.Time {
+	return f.reverseEnd
+}
+
+// TunnelSource is the outer source address of decapsulated flows
+func (f *Flow) TunnelSource() net.IP {
+	return f.tunnelSource
+}
+
+func (f *Flow) TunnelDestination() net.IP {
+	return f.tunnelDestination
+}
+
+func (f *Flow) NextHop() net.IP {
+	return f.nextHop
+}
+
+func (f *Flow) OutputInterface() uint32 {
+	return f.outputInterface
+}
+
+func (f *Flow) SourceCountry() string {
+	return f.sourceCountry
+}
+
+func (f *Flow) SourceCity() string {
+	return f.sourceCity
+}
+
+func (f *Flow) DestinationCountry() string {
+	return f.destinationCountry
+}
+
+func (f *Flow) DestinationCity() string {
+	return f.destinationCity
+}
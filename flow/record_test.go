@@ -0,0 +1,50 @@
+package flow
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	flows := testFlows()
+	tcp := flows[0]
+	tcp.key.tunnelType, tcp.key.tunnelID = TunnelGRE, 7
+	tcp.tunnelSource, tcp.tunnelDestination = net.IPv4(203, 0, 113, 1).To4(), net.IPv4(203, 0, 113, 2).To4()
+	tcp.sourceCountry, tcp.flowEndReason = "FR", flowEndReasonIdleTimeout
+	record := tcp.Record()
+	if !record.SourceIP.Equal(tcp.key.sourceIPAddress) || record.SourcePort != 43210 || record.DestinationPort != 443 ||
+		record.Protocol != 6 || record.ClassOfService != 0x28 || record.VlanID != 12 || record.IPVersion != 4 {
+		t.Errorf("key fields copied as %+v", record)
+	}
+	if record.Octets != 123456 || record.Packets != 321 || record.TCPFlags != tcpControlBitsSYN|tcpControlBitsACK ||
+		record.EndReason != EndReasonIdleTimeout || record.SamplingInterval != 100 || record.SamplingAlgorithm != SamplingDeterministic {
+		t.Errorf("counters copied as %+v", record)
+	}
+	if record.SourceMAC.String() != "02:00:00:00:00:01" || record.DestinationMAC.String() != "02:00:00:00:00:02" {
+		t.Errorf("MAC addresses copied as %s and %s", record.SourceMAC, record.DestinationMAC)
+	}
+	if record.TunnelType != TunnelGRE || record.TunnelID != 7 || !record.TunnelDestination.Equal(net.IPv4(203, 0, 113, 2)) {
+		t.Errorf("tunnel copied as %d/%d to %s", record.TunnelType, record.TunnelID, record.TunnelDestination)
+	}
+	if record.SourceAS != 64500 || record.DestinationAS != 4200000000 || !record.NextHop.Equal(tcp.nextHop) || record.SourceCountry != "FR" {
+		t.Errorf("enrichment copied as %+v", record)
+	}
+	// Records do not share memory with the flow
+	record.SourceIP[0], record.NextHop[0], record.SourceMAC[0], record.TunnelSource[0] = 0, 0, 0, 0
+	if tcp.key.sourceIPAddress[0] != 192 || tcp.nextHop[0] != 192 || tcp.key.sourceMacAddress[0] != 0x02 || tcp.tunnelSource[0] != 203 {
+		t.Error("flow modified through its record")
+	}
+
+	icmp := flows[1].Record()
+	if icmp.ICMPType != 128 || icmp.ICMPCode != 0 || icmp.FlowLabel != 0xbeef || icmp.TunnelSource != nil {
+		t.Errorf("ICMPv6 record: type %d, code %d, flow label %x, tunnel source %s", icmp.ICMPType, icmp.ICMPCode, icmp.FlowLabel, icmp.TunnelSource)
+	}
+
+	// Accessors return the same values
+	key := tcp.Key()
+	if tcp.Octets() != record.Octets || tcp.Packets() != record.Packets || tcp.InterfaceIndex() != record.InterfaceIndex ||
+		!tcp.Start().Equal(record.Start) || !tcp.End().Equal(record.End) || key.SourcePort() != record.SourcePort ||
+		key.Protocol() != record.Protocol || key.FragmentID() != record.FragmentID || tcp.SourceCountry() != "FR" {
+		t.Error("accessors and record differ")
+	}
+}
@@ -0,0 +1,66 @@
+package flow
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Sampling algorithms, as encoded in the Netflow v5 header and Netflow v9 35:SAMPLING_ALGORITHM
+const (
+	SamplingDeterministic uint8 = 1
+	SamplingRandom        uint8 = 2
+)
+
+// Netflow v5 sampling interval is on 14 bits
+const maxSamplingInterval = 0x3fff
+
+// sampler selects one packet out of each interval packets
+type sampler struct {
+	algorithm uint8
+	interval  uint32
+	count     uint32
+	selected  uint32
+	random    *rand.Rand
+}
+
+func newSampler(algorithm uint8, interval uint32) (*sampler, error) {
+	if algorithm != SamplingDeterministic && algorithm != SamplingRandom {
+		return nil, fmt.Errorf("unknown sampling algorithm %d", algorithm)
+	}
+	if interval < 2 || interval > maxSamplingInterval {
+		return nil, fmt.Errorf("sampling interval must be between 2 and %d", maxSamplingInterval)
+	}
+	s := &sampler{
+		algorithm: algorithm,
+		interval:  interval,
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.nextWindow()
+	return s, nil
+}
+
+func (s *sampler) nextWindow() {
+	s.count = 0
+	if s.algorithm == SamplingRandom {
+		s.selected = uint32(s.random.Int63n(int64(s.interval)))
+	}
+}
+
+// sample tells if the current packet must be accounted
+func (s *sampler) sample() bool {
+	selected := s.count == s.selected
+	s.count++
+	if s.count == s.interval {
+		s.nextWindow()
+	}
+	return selected
+}
+
+// netflow5SamplingField encodes the sampling mode and interval as in the Netflow v5 header
+func netflow5SamplingField(algorithm uint8, interval uint32) uint16 {
+	if interval < 2 {
+		return 0
+	}
+	return uint16(algorithm&0x3)<<14 | uint16(interval&maxSamplingInterval)
+}
@@ -0,0 +1,86 @@
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	for _, algorithm := range []uint8{SamplingDeterministic, SamplingRandom} {
+		s, err := newSampler(algorithm, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for window := 0; window < 50; window++ {
+			selected := 0
+			for i := 0; i < 10; i++ {
+				if s.sample() {
+					selected++
+					if algorithm == SamplingDeterministic && i != 0 {
+						t.Errorf("deterministic sampling selected packet %d of the window", i)
+					}
+				}
+			}
+			if selected != 1 {
+				t.Fatalf("algorithm %d selected %d packets out of 10", algorithm, selected)
+			}
+		}
+	}
+	for _, c := range []struct {
+		algorithm uint8
+		interval  uint32
+	}{{3, 10}, {SamplingRandom, 1}, {SamplingDeterministic, maxSamplingInterval + 1}} {
+		if _, err := newSampler(c.algorithm, c.interval); err == nil {
+			t.Errorf("sampler %d/%d accepted", c.algorithm, c.interval)
+		}
+	}
+}
+
+func TestNetflow5SamplingField(t *testing.T) {
+	for _, c := range []struct {
+		algorithm uint8
+		interval  uint32
+		field     uint16
+	}{
+		{0, 0, 0},
+		{SamplingDeterministic, 1, 0},
+		{SamplingDeterministic, 100, 0x4064},
+		{SamplingRandom, maxSamplingInterval, 0xbfff},
+	} {
+		if field := netflow5SamplingField(c.algorithm, c.interval); field != c.field {
+			t.Errorf("sampling %d/%d encoded as %#04x, expected %#04x", c.algorithm, c.interval, field, c.field)
+		}
+	}
+}
+
+func TestCaptureSampling(t *testing.T) {
+	worker := make(chan Flow, 16)
+	packet := testPacket(t, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 5000, 53)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	var times []time.Time
+	for i := 0; i < 9; i++ {
+		times = append(times, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	capture := testCapture(t, "sampled", packet, times, false, worker)
+	if err := capture.SetSampling(SamplingDeterministic, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := capture.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-capture.Done
+	stopListening(t, capture)
+	if len(worker) != 3 {
+		t.Fatalf("%d packets accounted out of 9, expected 3", len(worker))
+	}
+	for i := 0; i < 3; i++ {
+		f := <-worker
+		if f.samplingAlgorithm != SamplingDeterministic || f.samplingInterval != 3 {
+			t.Errorf("flow sampled with %d/%d, expected deterministic/3", f.samplingAlgorithm, f.samplingInterval)
+		}
+		if expected := times[3*i]; !f.start.Equal(expected) {
+			t.Errorf("packet at %s accounted, expected the one at %s", f.start, expected)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/utils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sflowVersion                = 5
+	sflowMaxHeaderSize          = 40 // With an IPv6 agent address
+	sflowFlowSampleFormat       = 1
+	sflowCounterSampleFormat    = 2
+	sflowRawHeaderFormat        = 1
+	sflowGenericCountersFormat  = 1
+	sflowGenericCountersSize    = 88
+	sflowHeaderProtocolEthernet = 1
+	sflowHeaderProtocolPPP      = 7
+	sflowHeaderProtocolIPv4     = 11
+	sflowHeaderProtocolIPv6     = 12
+	sflowEthernetIfType         = 6
+	sflowFlushInterval          = time.Second
+	defaultSFlowHeaderSize      = 128
+	defaultSFlowCounterInterval = 20 * time.Second
+	sflowSampleQueueSize        = 4096
+)
+
+// SFlowOptions configures the sFlow agent
+type SFlowOptions struct {
+	AgentAddress    net.IP        // Agent address of the datagrams, the local address of the socket if not set
+	SubAgentID      uint32        // Distinguishes several agents sharing the same address
+	HeaderSize      uint32        // Bytes of each sampled packet sent to the collector (default: 128)
+	CounterInterval time.Duration // Time between interface counter samples (default: 20s)
+}
+
+// packetSample is the truncated header of a sampled packet
+type packetSample struct {
+	source       *sflowSource
+	samplingRate uint32
+	pool         uint32
+	drops        uint32
+	frameLength  uint32
+	protocol     uint32 // sFlow header protocol
+	header       []byte
+}
+
+// sflowSource is a sampled interface, pool and drops are updated by the capture workers
+type sflowSource struct {
+	iface           net.Interface
+	pool            uint32
+	drops           uint32
+	flowSequence    uint32
+	counterSequence uint32
+	agent           *SFlowAgent
+}
+
+// sample queues the packet header, the sample is dropped when the agent is late
+func (s *sflowSource) sample(samplingRate uint32, linkType layers.LinkType, data []byte, info gopacket.CaptureInfo) {
+	protocol, header := sflowHeader(linkType, data)
+	if header == nil {
+		return
+	}
+	// The frame length does not count the capture header replaced by the IP header
+	frameLength := uint32(info.Length)
+	if stripped := uint32(len(data) - len(header)); stripped < frameLength {
+		frameLength -= stripped
+	}
+	data = header
+	length := len(data)
+	if uint32(length) > s.agent.headerSize {
+		length = int(s.agent.headerSize)
+	}
+	sample := packetSample{
+		source:       s,
+		samplingRate: samplingRate,
+		pool:         atomic.LoadUint32(&s.pool),
+		drops:        atomic.LoadUint32(&s.drops),
+		frameLength:  frameLength,
+		protocol:     protocol,
+		header:       make([]byte, length),
+	}
+	copy(sample.header, data)
+	select {
+	case s.agent.samples <- sample:
+	default:
+		atomic.AddUint32(&s.drops, 1)
+	}
+}
+
+// SFlowAgent sends sampled packet headers and interface counters to an sFlow v5 collector
+type SFlowAgent struct {
+	collectorConnection
+	samples         chan packetSample
+	sources         map[*sflowSource]bool
+	agentAddress    net.IP
+	subAgentID      uint32
+	headerSize      uint32
+	counterInterval time.Duration
+	startTime       time.Time
+	sequence        uint32
+	records         []byte
+	sampleCount     uint32
+	datagram        []byte
+	killSwitch      chan int
+	lock            sync.Mutex
+}
+
+func NewSFlowAgent(destinationAddress string, destinationPort uint16, options SFlowOptions, logger *log.Entry) (*SFlowAgent, error) {
+	logger = logger.WithField("component", "sflow")
+	if options.HeaderSize == 0 {
+		options.HeaderSize = defaultSFlowHeaderSize
+	}
+	if options.CounterInterval == 0 {
+		options.CounterInterval = defaultSFlowCounterInterval
+	}
+	if options.AgentAddress != nil && options.AgentAddress.To4() == nil && options.AgentAddress.To16() == nil {
+		return nil, fmt.Errorf("invalid agent address %s", options.AgentAddress)
+	}
+	agent := &SFlowAgent{
+		collectorConnection: newCollectorConnection(destinationAddress, destinationPort, "udp", logger),
+		samples:             make(chan packetSample, sflowSampleQueueSize),
+		sources:             make(map[*sflowSource]bool),
+		agentAddress:        options.AgentAddress,
+		subAgentID:          options.SubAgentID,
+		headerSize:          options.HeaderSize,
+		counterInterval:     options.CounterInterval,
+		startTime:           time.Now(),
+		records:             make([]byte, 0, exportBufferSize),
+		datagram:            make([]byte, 0, exportBufferSize),
+		killSwitch:          make(chan int, 0),
+	}
+	if err := agent.connect(); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// register starts sampling an interface
+func (a *SFlowAgent) register(iface net.Interface) *sflowSource {
+	source := &sflowSource{iface: iface, agent: a}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sources[source] = true
+	return source
+}
+
+func (a *SFlowAgent) unregister(source *sflowSource) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.sources, source)
+}
+
+func (a *SFlowAgent) Listen() {
+	flushTicker := time.NewTicker(sflowFlushInterval)
+	defer flushTicker.Stop()
+	counterTicker := time.NewTicker(a.counterInterval)
+	defer counterTicker.Stop()
+	for {
+		select {
+		case <-a.killSwitch:
+			a.log.Info("Received a listener kill switch")
+			return
+		case sample := <-a.samples:
+			a.addFlowSample(sample)
+		case <-counterTicker.C:
+			a.addCounterSamples()
+		case <-flushTicker.C:
+			a.flush()
+		}
+	}
+}
+
+func (a *SFlowAgent) Start() error {
+	go a.Listen()
+	return nil
+}
+
+func (a *SFlowAgent) Stop() error {
+	a.killSwitch <- 1
+drain:
+	for {
+		select {
+		case sample := <-a.samples:
+			a.addFlowSample(sample)
+		default:
+			break drain
+		}
+	}
+	a.flush()
+	return a.close()
+}
+
+// reserve flushes the pending samples when size more bytes do not fit in the datagram
+func (a *SFlowAgent) reserve(size int) {
+	if sflowMaxHeaderSize+len(a.records)+size > exportBufferSize {
+		a.flush()
+	}
+}
+
+func (a *SFlowAgent) addFlowSample(sample packetSample) {
+	headerLength := len(sample.header)
+	paddedHeader := (headerLength + 3) &^ 3
+	recordSize := 16 + paddedHeader
+	sampleSize := 32 + 8 + recordSize
+	a.reserve(8 + sampleSize)
+	sample.source.flowSequence++
+	ifIndex := uint32(sample.source.iface.Index)
+	a.records = appendUint32(a.records, sflowFlowSampleFormat, uint32(sampleSize))
+	a.records = appendUint32(a.records,
+		sample.source.flowSequence,
+		ifIndex, // source ID, type 0 (ifIndex)
+		sample.samplingRate,
+		sample.pool,
+		sample.drops,
+		ifIndex, // input
+		0,       // output unknown
+		1,       // records
+		sflowRawHeaderFormat,
+		uint32(recordSize),
+		sample.protocol,
+		sample.frameLength,
+		0, // stripped
+		uint32(headerLength))
+	a.records = append(a.records, sample.header...)
+	a.records = append(a.records, make([]byte, paddedHeader-headerLength)...)
+	a.sampleCount++
+}
+
+func (a *SFlowAgent) addCounterSamples() {
+	a.lock.Lock()
+	sources := make([]*sflowSource, 0, len(a.sources))
+	for source := range a.sources {
+		sources = append(sources, source)
+	}
+	a.lock.Unlock()
+	for _, source := range sources {
+		counters, err := utils.ReadInterfaceCounters(source.iface)
+		if err != nil {
+			a.log.Debugf("Cannot read %s counters: %s", source.iface.Name, err)
+			continue
+		}
+		a.addCounterSample(source, counters)
+	}
+}
+
+func (a *SFlowAgent) addCounterSample(source *sflowSource, counters utils.InterfaceCounters) {
+	sampleSize := 12 + 8 + sflowGenericCountersSize
+	a.reserve(8 + sampleSize)
+	source.counterSequence++
+	status := uint32(0)
+	if counters.Up {
+		status = 3 // admin and operational status up
+	}
+	promiscuous := uint32(0)
+	if counters.Promiscuous {
+		promiscuous = 1
+	}
+	ifIndex := uint32(source.iface.Index)
+	a.records = appendUint32(a.records, sflowCounterSampleFormat, uint32(sampleSize),
+		source.counterSequence, ifIndex, 1, sflowGenericCountersFormat, sflowGenericCountersSize,
+		ifIndex, sflowEthernetIfType)
+	a.records = appendUint64(a.records, counters.Speed)
+	a.records = appendUint32(a.records, 0, status) // direction unknown
+	a.records = appendUint64(a.records, counters.InOctets)
+	a.records = appendUint32(a.records,
+		uint32(counters.InPackets-counters.InMulticastPackets),
+		uint32(counters.InMulticastPackets),
+		0, // broadcast packets are counted as multicast
+		uint32(counters.InDiscards),
+		uint32(counters.InErrors),
+		0) // unknown protocols
+	a.records = appendUint64(a.records, counters.OutOctets)
+	a.records = appendUint32(a.records,
+		uint32(counters.OutPackets),
+		0,
+		0,
+		uint32(counters.OutDiscards),
+		uint32(counters.OutErrors),
+		promiscuous)
+	a.sampleCount++
+}
+
+// agentIP returns the agent address of the datagrams
+func (a *SFlowAgent) agentIP() net.IP {
+	if a.agentAddress != nil {
+		return a.agentAddress
+	}
+	if a.connection != nil {
+		if local, ok := a.connection.LocalAddr().(*net.UDPAddr); ok {
+			return local.IP
+		}
+	}
+	return net.IPv4zero
+}
+
+func (a *SFlowAgent) flush() {
+	if a.sampleCount == 0 {
+		return
+	}
+	a.sequence++
+	a.datagram = appendUint32(a.datagram[:0], sflowVersion)
+	agentIP := a.agentIP()
+	if ip := agentIP.To4(); ip != nil {
+		a.datagram = appendUint32(a.datagram, 1)
+		a.datagram = append(a.datagram, ip...)
+	} else {
+		a.datagram = appendUint32(a.datagram, 2)
+		a.datagram = append(a.datagram, agentIP.To16()...)
+	}
+	a.datagram = appendUint32(a.datagram,
+		a.subAgentID,
+		a.sequence,
+		uint32(time.Since(a.startTime).Nanoseconds()/int64(time.Millisecond)),
+		a.sampleCount)
+	a.datagram = append(a.datagram, a.records...)
+	if err := a.write(a.datagram); err != nil {
+		exporterErrorsMetric.With(a.address).Inc()
+		a.log.Errorf("Cannot send sFlow datagram: %s", err)
+	} else {
+		exporterDatagramsMetric.With(a.address).Inc()
+	}
+	a.records = a.records[:0]
+	a.sampleCount = 0
+}
+
+func appendUint32(buf []byte, values ...uint32) []byte {
+	for _, value := range values {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], value)
+		buf = append(buf, b[:]...)
+	}
+	return buf
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	return append(buf, b[:]...)
+}
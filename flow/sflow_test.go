@@ -0,0 +1,103 @@
+package flow
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/COSAE-FR/ripflow/utils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestSFlowDatagram(t *testing.T) {
+	collector := newTestCollector(t)
+	agent, err := NewSFlowAgent("127.0.0.1", collector.port(), SFlowOptions{
+		AgentAddress: net.IPv4(192, 0, 2, 10),
+		SubAgentID:   3,
+		HeaderSize:   64,
+	}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = agent.close() })
+	source := agent.register(net.Interface{Index: 7, Name: "eth7"})
+	packet := append(testPacket(t, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 5000, 53), make([]byte, 100)...)
+	source.pool = 1000
+	source.sample(100, layers.LinkTypeEthernet, packet, gopacket.CaptureInfo{Length: len(packet), CaptureLength: len(packet)})
+	agent.addFlowSample(<-agent.samples)
+	agent.addCounterSample(source, utils.InterfaceCounters{
+		Speed: 1000000000, Up: true, InOctets: 1 << 40, InPackets: 100, InMulticastPackets: 10,
+		OutOctets: 4242, OutPackets: 21, OutErrors: 2,
+	})
+	agent.flush()
+
+	var datagram layers.SFlowDatagram
+	if err := datagram.DecodeFromBytes(collector.receive(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatalf("cannot decode the datagram: %s", err)
+	}
+	if datagram.DatagramVersion != 5 || !datagram.AgentAddress.Equal(net.IPv4(192, 0, 2, 10)) ||
+		datagram.SubAgentID != 3 || datagram.SequenceNumber != 1 || datagram.SampleCount != 2 {
+		t.Errorf("datagram header %+v", datagram)
+	}
+	if len(datagram.FlowSamples) != 1 || len(datagram.CounterSamples) != 1 {
+		t.Fatalf("%d flow and %d counter samples", len(datagram.FlowSamples), len(datagram.CounterSamples))
+	}
+	sample := datagram.FlowSamples[0]
+	if sample.SamplingRate != 100 || sample.SamplePool != 1000 || sample.InputInterface != 7 || sample.SequenceNumber != 1 {
+		t.Errorf("flow sample %+v", sample)
+	}
+	record, ok := sample.Records[0].(layers.SFlowRawPacketFlowRecord)
+	if !ok {
+		t.Fatalf("unexpected flow record %T", sample.Records[0])
+	}
+	if record.HeaderProtocol != layers.SFlowProtoEthernet || record.FrameLength != uint32(len(packet)) || record.HeaderLength != 64 {
+		t.Errorf("raw header protocol %d, frame length %d, header length %d", record.HeaderProtocol, record.FrameLength, record.HeaderLength)
+	}
+	if udp, ok := record.Header.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || udp.DstPort != 53 {
+		t.Errorf("sampled header does not carry the UDP datagram: %v", record.Header)
+	}
+	counters, ok := datagram.CounterSamples[0].Records[0].(layers.SFlowGenericInterfaceCounters)
+	if !ok {
+		t.Fatalf("unexpected counter record %T", datagram.CounterSamples[0].Records[0])
+	}
+	if counters.IfIndex != 7 || counters.IfSpeed != 1000000000 || counters.IfStatus != 3 || counters.IfInOctets != 1<<40 ||
+		counters.IfInUcastPkts != 90 || counters.IfInMulticastPkts != 10 || counters.IfOutOctets != 4242 ||
+		counters.IfOutUcastPkts != 21 || counters.IfOutErrors != 2 {
+		t.Errorf("interface counters %+v", counters)
+	}
+}
+
+func TestSFlowHeader(t *testing.T) {
+	ip := testPacket(t, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 5000, 53)[14:]
+	sll := append(make([]byte, sllHeaderSize), ip...)
+	for _, c := range []struct {
+		name     string
+		linkType layers.LinkType
+		data     []byte
+		protocol uint32
+		length   int
+	}{
+		{"raw IPv4", layers.LinkTypeRaw, ip, sflowHeaderProtocolIPv4, len(ip)},
+		{"Linux SLL", layers.LinkTypeLinuxSLL, sll, sflowHeaderProtocolIPv4, len(ip)},
+		{"truncated SLL", layers.LinkTypeLinuxSLL, sll[:10], 0, 0},
+		{"not IP", layers.LinkTypeRaw, []byte{0x10, 0}, 0, 0},
+	} {
+		protocol, header := sflowHeader(c.linkType, c.data)
+		if protocol != c.protocol || len(header) != c.length {
+			t.Errorf("%s: protocol %d with %d bytes, expected %d with %d", c.name, protocol, len(header), c.protocol, c.length)
+		}
+	}
+}
+
+func TestSFlowSampleDrops(t *testing.T) {
+	agent := &SFlowAgent{samples: make(chan packetSample, 1), headerSize: 128}
+	source := &sflowSource{agent: agent}
+	packet := testPacket(t, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), 5000, 53)
+	info := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(packet), CaptureLength: len(packet)}
+	source.sample(1, layers.LinkTypeEthernet, packet, info)
+	source.sample(1, layers.LinkTypeEthernet, packet, info)
+	if source.drops != 1 || len(agent.samples) != 1 {
+		t.Errorf("%d samples dropped with %d queued, expected 1 and 1", source.drops, len(agent.samples))
+	}
+}
@@ -0,0 +1,172 @@
+package flow
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxSinkBatchSize = 256
+	// Records buffered by a sink are sent at least at this interval
+	sinkFlushInterval = time.Second
+)
+
+// Sink writes the flows of a destination, such as a Netflow collector or a JSON lines file.
+// Its methods are called from a single goroutine, so a sink needs no locking of its own.
+type Sink interface {
+	Start() error
+	// Stop flushes the sink and releases its resources
+	Stop() error
+	// Flush sends the buffered records
+	Flush() error
+	// WriteBatch writes or buffers the flows, the slice is reused after the call
+	WriteBatch(flows []Flow) error
+}
+
+// SinkConfig is given to the sink factories
+type SinkConfig struct {
+	Name     string
+	MaxFlows uint32
+	// Decode unmarshals the configuration block of the destination into the sink configuration
+	Decode func(out interface{}) error
+}
+
+// SinkFactory builds a sink from the configuration of its destination
+type SinkFactory func(config SinkConfig, logger *log.Entry) (Sink, error)
+
+var (
+	sinkFactories     = make(map[string]SinkFactory)
+	sinkFactoriesLock sync.Mutex
+)
+
+// RegisterSink makes a sink type available to the destinations configuration.
+// It panics when the type is already registered, it is usually called from an init function.
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactoriesLock.Lock()
+	defer sinkFactoriesLock.Unlock()
+	if _, found := sinkFactories[name]; found {
+		panic(fmt.Sprintf("sink type %s registered twice", name))
+	}
+	sinkFactories[name] = factory
+}
+
+// SinkTypes returns the registered sink types
+func SinkTypes() []string {
+	sinkFactoriesLock.Lock()
+	defer sinkFactoriesLock.Unlock()
+	names := make([]string, 0, len(sinkFactories))
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSink builds a sink of a registered type
+func NewSink(sinkType string, config SinkConfig, logger *log.Entry) (Sink, error) {
+	sinkFactoriesLock.Lock()
+	factory, found := sinkFactories[sinkType]
+	sinkFactoriesLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unknown sink type %s, registered types: %v", sinkType, SinkTypes())
+	}
+	return factory(config, logger)
+}
+
+// SinkQueue queues the flows of a destination and writes them in batches to its sink
+type SinkQueue struct {
+	Input      chan Flow
+	sink       Sink
+	anonymizer Enricher
+	batch      []Flow
+	pending    bool // Flows written since the last flush
+	killSwitch chan int
+	log        *log.Entry
+}
+
+// NewSinkQueue queues up to maxFlows flows for the sink, the anonymizer is optional
+func NewSinkQueue(sink Sink, maxFlows uint32, anonymizer Enricher, logger *log.Entry) *SinkQueue {
+	return &SinkQueue{
+		Input:      make(chan Flow, maxFlows),
+		sink:       sink,
+		anonymizer: anonymizer,
+		batch:      make([]Flow, 0, maxSinkBatchSize),
+		killSwitch: make(chan int, 0),
+		log:        logger.WithField("component", "sink"),
+	}
+}
+
+// write sends a batch of flows, starting with first, taking the flows already queued
+func (q *SinkQueue) write(first Flow) {
+	q.batch = append(q.batch[:0], first)
+fill:
+	for len(q.batch) < maxSinkBatchSize {
+		select {
+		case flow := <-q.Input:
+			q.batch = append(q.batch, flow)
+		default:
+			break fill
+		}
+	}
+	if q.anonymizer != nil {
+		for i := range q.batch {
+			q.anonymizer.Enrich(&q.batch[i])
+		}
+	}
+	if err := q.sink.WriteBatch(q.batch); err != nil {
+		q.log.Errorf("Cannot write flows: %s", err)
+	}
+	q.pending = true
+}
+
+func (q *SinkQueue) flush() {
+	if !q.pending {
+		return
+	}
+	q.pending = false
+	if err := q.sink.Flush(); err != nil {
+		q.log.Errorf("Cannot flush sink: %s", err)
+	}
+}
+
+func (q *SinkQueue) Listen() {
+	ticker := time.NewTicker(sinkFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.killSwitch:
+			q.log.Info("Received a listener kill switch")
+			return
+		case flow := <-q.Input:
+			q.write(flow)
+		case <-ticker.C:
+			q.flush()
+		}
+	}
+}
+
+func (q *SinkQueue) Start() error {
+	if err := q.sink.Start(); err != nil {
+		return err
+	}
+	go q.Listen()
+	return nil
+}
+
+func (q *SinkQueue) Stop() error {
+	q.killSwitch <- 1
+	// Write flows still waiting in the queue
+drain:
+	for {
+		select {
+		case flow := <-q.Input:
+			q.write(flow)
+		default:
+			break drain
+		}
+	}
+	return q.sink.Stop()
+}
@@ -0,0 +1,130 @@
+package flow
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recordingSink keeps the batches it receives
+type recordingSink struct {
+	batches [][]Flow
+	flushes int
+	started bool
+	stopped bool
+	lock    sync.Mutex
+}
+
+func (s *recordingSink) Start() error {
+	s.started = true
+	return nil
+}
+
+func (s *recordingSink) Stop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	return nil
+}
+
+func (s *recordingSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushes++
+	return nil
+}
+
+func (s *recordingSink) WriteBatch(flows []Flow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batches = append(s.batches, append([]Flow(nil), flows...))
+	return nil
+}
+
+func (s *recordingSink) state() (flows int, batches int, flushes int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, batch := range s.batches {
+		flows += len(batch)
+	}
+	return flows, len(s.batches), s.flushes
+}
+
+// countingEnricher marks the flows it enriches
+type countingEnricher struct{}
+
+func (countingEnricher) Enrich(f *Flow) {
+	f.sourceAS = 65000
+}
+
+func TestSinkRegistry(t *testing.T) {
+	sink := &recordingSink{}
+	RegisterSink("test-recording", func(config SinkConfig, _ *log.Entry) (Sink, error) {
+		if config.Name != "recorder" {
+			return nil, errors.New("unexpected name")
+		}
+		return sink, nil
+	})
+	built, err := NewSink("test-recording", SinkConfig{Name: "recorder"}, testLogger())
+	if err != nil || built != sink {
+		t.Fatalf("registered sink not built: %v", err)
+	}
+	if _, err := NewSink("test-recording", SinkConfig{Name: "other"}, testLogger()); err == nil {
+		t.Error("factory error not returned")
+	}
+	if _, err := NewSink("test-missing", SinkConfig{}, testLogger()); err == nil || !strings.Contains(err.Error(), "test-recording") {
+		t.Errorf("unknown type error %v does not list the registered types", err)
+	}
+	types := SinkTypes()
+	for i := 1; i < len(types); i++ {
+		if types[i-1] >= types[i] {
+			t.Errorf("sink types not sorted: %v", types)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("sink type registered twice")
+		}
+	}()
+	RegisterSink("test-recording", func(SinkConfig, *log.Entry) (Sink, error) { return nil, nil })
+}
+
+func TestSinkQueue(t *testing.T) {
+	sink := &recordingSink{}
+	queue := NewSinkQueue(sink, 1024, countingEnricher{}, testLogger())
+	// Flows queued before the start are written in full batches
+	for i := 0; i < maxSinkBatchSize+10; i++ {
+		queue.Input <- testFlows()[0]
+	}
+	if err := queue.Start(); err != nil || !sink.started {
+		t.Fatalf("sink not started: %v", err)
+	}
+	deadline := time.Now().Add(2*sinkFlushInterval + time.Second)
+	for {
+		flows, batches, flushes := sink.state()
+		if flows == maxSinkBatchSize+10 && flushes > 0 {
+			if batches != 2 {
+				t.Errorf("%d flows written in %d batches, expected 2", flows, batches)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d flows written and %d flushes", flows, flushes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sink.batches[0][0].sourceAS != 65000 {
+		t.Error("flows written without anonymization")
+	}
+	queue.Input <- testFlows()[1]
+	if err := queue.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if flows, _, _ := sink.state(); flows != maxSinkBatchSize+11 || !sink.stopped {
+		t.Errorf("%d flows written before the sink stopped, expected %d", flows, maxSinkBatchSize+11)
+	}
+}
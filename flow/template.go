@@ -0,0 +1,515 @@
+package flow
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// https://www.iana.org/assignments/ipfix/ipfix.xml Information Elements
+// NetFlow v9 field types share the same numbering
+const (
+	fieldOctetDeltaCount             uint16 = 1
+	fieldPacketDeltaCount            uint16 = 2
+	fieldProtocolIdentifier          uint16 = 4
+	fieldIPClassOfService            uint16 = 5
+	fieldTCPControlBits              uint16 = 6
+	fieldSourceTransportPort         uint16 = 7
+	fieldSourceIPv4Address           uint16 = 8
+	fieldSourceIPv4PrefixLength      uint16 = 9
+	fieldIngressInterface            uint16 = 10
+	fieldDestinationTransportPort    uint16 = 11
+	fieldDestinationIPv4Address      uint16 = 12
+	fieldDestinationIPv4PrefixLength uint16 = 13
+	fieldEgressInterface             uint16 = 14
+	fieldIPNextHopIPv4Address        uint16 = 15
+	fieldBgpSourceAsNumber           uint16 = 16
+	fieldBgpDestinationAsNumber      uint16 = 17
+	fieldFlowEndSysUpTime            uint16 = 21
+	fieldFlowStartSysUpTime          uint16 = 22
+	fieldSourceIPv6Address           uint16 = 27
+	fieldDestinationIPv6Address      uint16 = 28
+	fieldSourceIPv6PrefixLength      uint16 = 29
+	fieldDestinationIPv6PrefixLength uint16 = 30
+	fieldFlowLabelIPv6               uint16 = 31
+	fieldIcmpTypeCodeIPv4            uint16 = 32
+	fieldSamplingInterval            uint16 = 34
+	fieldSamplingAlgorithm           uint16 = 35
+	fieldFragmentIdentification      uint16 = 54
+	fieldSourceMacAddress            uint16 = 56
+	fieldVlanId                      uint16 = 58
+	fieldIPVersion                   uint16 = 60
+	fieldIPNextHopIPv6Address        uint16 = 62
+	fieldDestinationMacAddress       uint16 = 80
+	fieldFlowEndReason               uint16 = 136
+	fieldIcmpTypeCodeIPv6            uint16 = 139
+	fieldFlowStartSeconds            uint16 = 150
+	fieldFlowEndSeconds              uint16 = 151
+	fieldFlowStartMilliseconds       uint16 = 152
+	fieldFlowEndMilliseconds         uint16 = 153
+)
+
+// Enterprise specific elements carrying the GeoIP enrichment, exported under the
+// Private Enterprise Number configured on the exporter with IPFIX, as vendor fields with Netflow v9
+const (
+	fieldSourceCountryCode      uint16 = 1
+	fieldDestinationCountryCode uint16 = 2
+	fieldSourceCity             uint16 = 3
+	fieldDestinationCity        uint16 = 4
+	countryCodeLength                  = 2
+	cityLength                         = 32
+	netflow9VendorField         uint16 = 0x8000
+)
+
+// Enterprise specific elements of the tunnel of decapsulated flows, numbered after the GeoIP elements
+// so that both can share an enterprise number. The endpoints are IPv6 addresses, IPv4-mapped for IPv4 tunnels.
+const (
+	fieldTunnelType               uint16 = 5
+	fieldTunnelID                 uint16 = 6
+	fieldTunnelSourceAddress      uint16 = 7
+	fieldTunnelDestinationAddress uint16 = 8
+)
+
+// geoFields returns the GeoIP fields, under enterprise for IPFIX or as vendor fields when 0
+func geoFields(enterprise uint32) []templateField {
+	fields := []templateField{
+		{fieldSourceCountryCode, countryCodeLength, enterprise},
+		{fieldDestinationCountryCode, countryCodeLength, enterprise},
+		{fieldSourceCity, cityLength, enterprise},
+		{fieldDestinationCity, cityLength, enterprise},
+	}
+	if enterprise == 0 {
+		for i := range fields {
+			fields[i].id |= netflow9VendorField
+		}
+	}
+	return fields
+}
+
+// tunnelFields returns the tunnel fields, under enterprise for IPFIX or as vendor fields when 0
+func tunnelFields(enterprise uint32) []templateField {
+	fields := []templateField{
+		{fieldTunnelType, 1, enterprise},
+		{fieldTunnelID, 4, enterprise},
+		{fieldTunnelSourceAddress, 16, enterprise},
+		{fieldTunnelDestinationAddress, 16, enterprise},
+	}
+	if enterprise == 0 {
+		for i := range fields {
+			fields[i].id |= netflow9VendorField
+		}
+	}
+	return fields
+}
+
+// RFC 5103 reverse Information Elements are the forward elements
+// under the reverse Private Enterprise Number
+const reverseInformationElementPEN uint32 = 29305
+
+// Template IDs below 256 are reserved for set IDs
+const (
+	templateIDIPv4 uint16 = 256
+	templateIDIPv6 uint16 = 257
+)
+
+// Template variants, the offset of their template ID from templateIDIPv4
+const (
+	templateVariantIPv6   = 1
+	templateVariantTunnel = 2 // Followed by the tunnel fields
+	templateVariantNoMAC  = 4 // Without the MAC address fields
+	templateVariants      = 8
+)
+
+type templateField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32 // IPFIX only, 0 for IANA elements
+}
+
+type template struct {
+	id         uint16
+	fields     []templateField
+	recordSize int
+}
+
+func newTemplate(id uint16, fields ...templateField) *template {
+	t := &template{id: id, fields: fields}
+	for _, field := range fields {
+		t.recordSize += int(field.length)
+	}
+	return t
+}
+
+// serializeDefinition writes the template record and returns its size
+func (t *template) serializeDefinition(buf []byte) int {
+	binary.BigEndian.PutUint16(buf[0:], t.id)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(t.fields)))
+	offset := 4
+	for _, field := range t.fields {
+		if field.enterprise == 0 {
+			binary.BigEndian.PutUint16(buf[offset:], field.id)
+		} else {
+			binary.BigEndian.PutUint16(buf[offset:], field.id|0x8000)
+			binary.BigEndian.PutUint32(buf[offset+4:], field.enterprise)
+		}
+		binary.BigEndian.PutUint16(buf[offset+2:], field.length)
+		offset += field.definitionSize()
+	}
+	return offset
+}
+
+func (t *template) definitionSize() int {
+	size := 4
+	for _, field := range t.fields {
+		size += field.definitionSize()
+	}
+	return size
+}
+
+func (field templateField) definitionSize() int {
+	if field.enterprise == 0 {
+		return 4
+	}
+	return 8
+}
+
+// putUint writes the length lowest bytes of value in network order
+func putUint(buf []byte, length uint16, value uint64) {
+	for i := int(length) - 1; i >= 0; i-- {
+		buf[i] = byte(value)
+		value >>= 8
+	}
+}
+
+func unixMilliseconds(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
+
+func sysUpTime(t time.Time, baseTime time.Time) uint64 {
+	return uint64(t.Sub(baseTime).Nanoseconds() / int64(time.Millisecond))
+}
+
+// serializeRecord writes the flow as a data record described by t
+func (f *Flow) serializeRecord(buf []byte, t *template, baseTime time.Time) {
+	offset := 0
+	for _, field := range t.fields {
+		switch {
+		case field.enterprise == reverseInformationElementPEN:
+			f.serializeReverseField(buf[offset:offset+int(field.length)], field, baseTime)
+		case field.enterprise != 0 || field.id&netflow9VendorField != 0:
+			f.serializePrivateField(buf[offset:offset+int(field.length)], field)
+		default:
+			f.serializeField(buf[offset:offset+int(field.length)], field, baseTime)
+		}
+		offset += int(field.length)
+	}
+}
+
+// putString writes value truncated or padded with zeros to the length of buf
+func putString(buf []byte, value string) {
+	n := copy(buf, value)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+func (f *Flow) serializePrivateField(buf []byte, field templateField) {
+	switch field.id &^ netflow9VendorField {
+	case fieldTunnelType:
+		putUint(buf, field.length, uint64(f.key.tunnelType))
+	case fieldTunnelID:
+		putUint(buf, field.length, uint64(f.key.tunnelID))
+	case fieldTunnelSourceAddress:
+		copy(buf, tunnelAddress(f.tunnelSource))
+	case fieldTunnelDestinationAddress:
+		copy(buf, tunnelAddress(f.tunnelDestination))
+	case fieldSourceCountryCode:
+		putString(buf, f.sourceCountry)
+	case fieldDestinationCountryCode:
+		putString(buf, f.destinationCountry)
+	case fieldSourceCity:
+		putString(buf, f.sourceCity)
+	case fieldDestinationCity:
+		putString(buf, f.destinationCity)
+	default:
+		putString(buf, "")
+	}
+}
+
+func (f *Flow) serializeReverseField(buf []byte, field templateField, baseTime time.Time) {
+	switch field.id {
+	case fieldOctetDeltaCount:
+		putUint(buf, field.length, f.reverseOctetDeltaCount)
+	case fieldPacketDeltaCount:
+		putUint(buf, field.length, f.reversePacketDeltaCount)
+	case fieldTCPControlBits:
+		putUint(buf, field.length, uint64(f.reverseTcpControlBits))
+	case fieldFlowStartMilliseconds:
+		putUint(buf, field.length, unixMilliseconds(f.reverseStart))
+	case fieldFlowEndMilliseconds:
+		putUint(buf, field.length, unixMilliseconds(f.reverseEnd))
+	default:
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+}
+
+func (f *Flow) serializeField(buf []byte, field templateField, baseTime time.Time) {
+	switch field.id {
+	case fieldOctetDeltaCount:
+		putUint(buf, field.length, f.octetDeltaCount)
+	case fieldPacketDeltaCount:
+		putUint(buf, field.length, f.packetDeltaCount)
+	case fieldProtocolIdentifier:
+		putUint(buf, field.length, uint64(f.key.protocolIdentifier))
+	case fieldIPClassOfService:
+		putUint(buf, field.length, uint64(f.key.ipClassOfService))
+	case fieldTCPControlBits:
+		putUint(buf, field.length, uint64(f.tcpControlBits))
+	case fieldSourceTransportPort:
+		putUint(buf, field.length, uint64(f.key.sourceTransportPort))
+	case fieldDestinationTransportPort:
+		putUint(buf, field.length, uint64(f.key.destinationTransportPort))
+	case fieldSourceIPv4Address:
+		copy(buf, f.key.sourceIPAddress.To4())
+	case fieldDestinationIPv4Address:
+		copy(buf, f.key.destinationIPAddress.To4())
+	case fieldSourceIPv6Address:
+		copy(buf, f.key.sourceIPAddress.To16())
+	case fieldDestinationIPv6Address:
+		copy(buf, f.key.destinationIPAddress.To16())
+	case fieldIngressInterface:
+		putUint(buf, field.length, uint64(f.ifIndex))
+	case fieldEgressInterface:
+		putUint(buf, field.length, uint64(f.outputInterface))
+	case fieldIPNextHopIPv4Address:
+		if nextHop := f.nextHop.To4(); nextHop != nil {
+			copy(buf, nextHop)
+		} else {
+			copy(buf, net.IPv4zero.To4())
+		}
+	case fieldIPNextHopIPv6Address:
+		if f.nextHop != nil {
+			copy(buf, f.nextHop.To16())
+		} else {
+			copy(buf, net.IPv6zero)
+		}
+	case fieldFlowStartSysUpTime:
+		putUint(buf, field.length, uint64(netflow5Time(f.start, baseTime)))
+	case fieldFlowEndSysUpTime:
+		putUint(buf, field.length, uint64(netflow5Time(f.end, baseTime)))
+	case fieldFlowStartMilliseconds:
+		putUint(buf, field.length, unixMilliseconds(f.start))
+	case fieldFlowEndMilliseconds:
+		putUint(buf, field.length, unixMilliseconds(f.end))
+	case fieldFlowEndReason:
+		putUint(buf, field.length, uint64(f.flowEndReason))
+	case fieldFlowLabelIPv6:
+		putUint(buf, field.length, uint64(f.key.flowLabelIPv6))
+	case fieldIcmpTypeCodeIPv4, fieldIcmpTypeCodeIPv6:
+		putUint(buf, field.length, uint64(f.key.icmpTypeCode))
+	case fieldSamplingInterval:
+		putUint(buf, field.length, uint64(f.samplingInterval))
+	case fieldSamplingAlgorithm:
+		putUint(buf, field.length, uint64(f.samplingAlgorithm))
+	case fieldFragmentIdentification:
+		putUint(buf, field.length, uint64(f.key.fragmentIdentification))
+	case fieldSourceMacAddress:
+		copy(buf, f.key.sourceMacAddress[0:6])
+	case fieldDestinationMacAddress:
+		copy(buf, f.key.destinationMacAddress[0:6])
+	case fieldVlanId:
+		putUint(buf, field.length, uint64(f.key.vlanId))
+	case fieldIPVersion:
+		putUint(buf, field.length, uint64(f.key.ipVersion))
+	case fieldBgpSourceAsNumber:
+		putUint(buf, field.length, uint64(f.sourceAS))
+	case fieldBgpDestinationAsNumber:
+		putUint(buf, field.length, uint64(f.destinationAS))
+	case fieldSourceIPv4PrefixLength, fieldSourceIPv6PrefixLength:
+		putUint(buf, field.length, uint64(f.sourcePrefixLength))
+	case fieldDestinationIPv4PrefixLength, fieldDestinationIPv6PrefixLength:
+		putUint(buf, field.length, uint64(f.destinationPrefixLength))
+	default:
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+}
+
+type dataSet struct {
+	template *template
+	records  []byte
+}
+
+// recordBuffer accumulates data records grouped by template until a message is sent
+type recordBuffer struct {
+	sets    []*dataSet
+	size    int
+	records int
+}
+
+func paddedSetSize(length int) int {
+	return (length + 3) &^ 3
+}
+
+// sizeWith returns the size of the data sets if a record of t was added
+func (b *recordBuffer) sizeWith(t *template) int {
+	for _, set := range b.sets {
+		if set.template == t {
+			return b.size - paddedSetSize(flowSetHeaderSize+len(set.records)) +
+				paddedSetSize(flowSetHeaderSize+len(set.records)+t.recordSize)
+		}
+	}
+	return b.size + paddedSetSize(flowSetHeaderSize+t.recordSize)
+}
+
+func (b *recordBuffer) add(flow *Flow, t *template, baseTime time.Time) {
+	var current *dataSet
+	for _, set := range b.sets {
+		if set.template == t {
+			current = set
+			break
+		}
+	}
+	if current == nil {
+		current = &dataSet{template: t}
+		b.sets = append(b.sets, current)
+	}
+	b.size = b.sizeWith(t)
+	record := make([]byte, t.recordSize)
+	flow.serializeRecord(record, t, baseTime)
+	current.records = append(current.records, record...)
+	b.records++
+}
+
+// serialize writes every data set, padded to 32 bits, and returns the written size
+func (b *recordBuffer) serialize(buf []byte) int {
+	offset := 0
+	for _, set := range b.sets {
+		length := paddedSetSize(flowSetHeaderSize + len(set.records))
+		binary.BigEndian.PutUint16(buf[offset:], set.template.id)
+		binary.BigEndian.PutUint16(buf[offset+2:], uint16(length))
+		copy(buf[offset+flowSetHeaderSize:], set.records)
+		for i := offset + flowSetHeaderSize + len(set.records); i < offset+length; i++ {
+			buf[i] = 0
+		}
+		offset += length
+	}
+	return offset
+}
+
+func (b *recordBuffer) reset() {
+	b.sets = b.sets[:0]
+	b.size = 0
+	b.records = 0
+}
+
+// templateSet holds the templates used to export IPv4 and IPv6 flows
+type templateSet struct {
+	ipv4     *template
+	ipv6     *template
+	tunnels  []templateField             // Set when the tunnel fields are exported
+	variants [templateVariants]*template // Other variants of the base templates, built for the first flow using them
+}
+
+// withTunnels exports the decapsulated flows with the tunnel fields
+func (s templateSet) withTunnels(enterprise uint32) templateSet {
+	s.tunnels = tunnelFields(enterprise)
+	return s
+}
+
+// variant returns the template variant of a flow
+func (s templateSet) variant(flow *Flow) int {
+	variant := 0
+	if flow.key.ipVersion == 6 {
+		variant |= templateVariantIPv6
+	}
+	if flow.key.tunnelType != 0 && s.tunnels != nil {
+		variant |= templateVariantTunnel
+	}
+	if flow.key.macAddresses == 0 {
+		variant |= templateVariantNoMAC
+	}
+	return variant
+}
+
+// newVariant returns a variant of the base templates
+func (s templateSet) newVariant(variant int) *template {
+	base := s.ipv4
+	if variant&templateVariantIPv6 != 0 {
+		base = s.ipv6
+	}
+	fields := make([]templateField, 0, len(base.fields)+len(s.tunnels))
+	for _, field := range base.fields {
+		mac := field.enterprise == 0 && (field.id == fieldSourceMacAddress || field.id == fieldDestinationMacAddress)
+		if !mac || variant&templateVariantNoMAC == 0 {
+			fields = append(fields, field)
+		}
+	}
+	if variant&templateVariantTunnel != 0 {
+		fields = append(fields, s.tunnels...)
+	}
+	return newTemplate(templateIDIPv4+uint16(variant), fields...)
+}
+
+// templateFor returns the template of the flow, the variants are built for the first flow using them
+func (e *Exporter) templateFor(flow *Flow) *template {
+	if flow.key.ipVersion != 4 && flow.key.ipVersion != 6 {
+		return nil
+	}
+	variant := e.templates.variant(flow)
+	switch variant {
+	case 0:
+		return e.templates.ipv4
+	case templateVariantIPv6:
+		return e.templates.ipv6
+	}
+	if e.templates.variants[variant] == nil {
+		e.templates.variants[variant] = e.templates.newVariant(variant)
+	}
+	return e.templates.variants[variant]
+}
+
+// messageSize returns the size of a message holding the pending records and a record of t,
+// with the templates of every record as they may be sent with any message
+func (e *Exporter) messageSize(headerSize int, t *template) int {
+	size := headerSize + e.pending.sizeWith(t) + flowSetHeaderSize + t.definitionSize()
+	for _, set := range e.pending.sets {
+		if set.template != t {
+			size += set.template.definitionSize()
+		}
+	}
+	return size
+}
+
+// pendingTemplates returns the templates of the pending records not announced yet. A message only
+// announces the templates of its own records, every variant in use may not fit in one message.
+// When a refresh is due, every template is announced again with the next record using it.
+func (e *Exporter) pendingTemplates(now time.Time) []*template {
+	if e.templatesDue(now) {
+		e.announced = make(map[*template]bool)
+		e.packetsSinceTemplate = 0
+		e.lastTemplate = now
+	}
+	var templates []*template
+	for _, set := range e.pending.sets {
+		if !e.announced[set.template] {
+			e.announced[set.template] = true
+			templates = append(templates, set.template)
+		}
+	}
+	return templates
+}
+
+// serializeTemplates writes a template set with the given set ID and returns its size
+func serializeTemplates(buf []byte, setID uint16, templates []*template) int {
+	offset := flowSetHeaderSize
+	for _, t := range templates {
+		offset += t.serializeDefinition(buf[offset:])
+	}
+	binary.BigEndian.PutUint16(buf[0:], setID)
+	binary.BigEndian.PutUint16(buf[2:], uint16(offset))
+	return offset
+}
@@ -0,0 +1,299 @@
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sort"
+)
+
+// Tunnel types, also the exported tunnel type values
+const (
+	TunnelGRE    uint8 = 1
+	TunnelERSPAN uint8 = 2
+	TunnelVXLAN  uint8 = 3
+	TunnelGeneve uint8 = 4
+	TunnelMPLS   uint8 = 5
+)
+
+var tunnelNames = map[uint8]string{
+	TunnelGRE:    "gre",
+	TunnelERSPAN: "erspan",
+	TunnelVXLAN:  "vxlan",
+	TunnelGeneve: "geneve",
+	TunnelMPLS:   "mpls",
+}
+
+const (
+	vxlanPort  = 4789
+	genevePort = 6081
+	// Nested tunnels decapsulated at most, the metadata of the innermost one is kept
+	maxTunnelDepth = 4
+)
+
+// RFC 2784 and RFC 2890 GRE header flags
+const (
+	greChecksumPresent uint16 = 0x8000
+	greRoutingPresent  uint16 = 0x4000
+	greKeyPresent      uint16 = 0x2000
+	greSequencePresent uint16 = 0x1000
+	greVersionMask     uint16 = 0x0007
+)
+
+const (
+	ethernetTypeERSPANIII layers.EthernetType = 0x22eb
+	erspanIIHeaderSize                        = 8
+	erspanIIIHeaderSize                       = 12
+	erspanIIIPlatformSize                     = 8 // Optional platform specific subheader
+	vxlanHeaderSize                           = 8
+	vxlanFlagVNI                              = 0x08
+	geneveHeaderSize                          = 8
+	mplsBottomOfStack                         = 0x100
+)
+
+// TunnelType returns the tunnel type of a decapsulation name
+func TunnelType(name string) (uint8, error) {
+	for tunnelType, tunnelName := range tunnelNames {
+		if tunnelName == name {
+			return tunnelType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tunnel type %s, supported types: %v", name, TunnelTypes())
+}
+
+// TunnelTypes returns the names of the tunnel types that can be decapsulated
+func TunnelTypes() []string {
+	names := make([]string, 0, len(tunnelNames))
+	for _, name := range tunnelNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TunnelName returns the name of a tunnel type, empty for flows not carried by a tunnel
+func TunnelName(tunnelType uint8) string {
+	return tunnelNames[tunnelType]
+}
+
+// tunnel is a decapsulated tunnel header
+type tunnel struct {
+	tunnelType uint8
+	id         uint32 // GRE key, ERSPAN session, VNI or top MPLS label
+	payload    []byte
+	first      gopacket.LayerType // Layer the payload starts with
+}
+
+// tunnelBit is the bit of a tunnel type in the decapsulation set of a handler
+func tunnelBit(tunnelType uint8) uint8 {
+	return 1 << tunnelType
+}
+
+// findTunnel returns the enabled tunnel carried by the last decoded layer of pp
+func findTunnel(pp *ParserParameters, enabled uint8) (tunnel, bool) {
+	if len(pp.decoded) == 0 {
+		return tunnel{}, false
+	}
+	switch pp.decoded[len(pp.decoded)-1] {
+	case layers.LayerTypeEthernet:
+		return mplsTunnel(pp.eth.EthernetType, pp.eth.Payload, enabled)
+	case layers.LayerTypeDot1Q:
+		return mplsTunnel(pp.dot1q.Type, pp.dot1q.Payload, enabled)
+	case layers.LayerTypeLinuxSLL:
+		return mplsTunnel(pp.sll.EthernetType, pp.sll.Payload, enabled)
+	case layerTypeLinuxSLL2:
+		return mplsTunnel(pp.sll2.EthernetType, pp.sll2.Payload, enabled)
+	case layers.LayerTypeIPv4:
+		// Only the first fragment holds the tunnel header, and not the whole payload
+		if pp.ip4.Protocol == layers.IPProtocolGRE && pp.ip4.Flags&layers.IPv4MoreFragments == 0 && pp.ip4.FragOffset == 0 {
+			return greTunnel(pp.ip4.Payload, enabled)
+		}
+	case layers.LayerTypeIPv6:
+		if pp.ip6.NextHeader == layers.IPProtocolGRE {
+			return greTunnel(pp.ip6.Payload, enabled)
+		}
+	case layers.LayerTypeUDP:
+		switch {
+		case pp.udp.DstPort == vxlanPort && enabled&tunnelBit(TunnelVXLAN) != 0:
+			return vxlanTunnel(pp.udp.Payload)
+		case pp.udp.DstPort == genevePort && enabled&tunnelBit(TunnelGeneve) != 0:
+			return geneveTunnel(pp.udp.Payload)
+		}
+	}
+	return tunnel{}, false
+}
+
+func greTunnel(data []byte, enabled uint8) (tunnel, bool) {
+	if len(data) < 4 {
+		return tunnel{}, false
+	}
+	flags := binary.BigEndian.Uint16(data)
+	// Source routed and PPTP (version 1) GRE are not decapsulated
+	if flags&(greRoutingPresent|greVersionMask) != 0 {
+		return tunnel{}, false
+	}
+	protocol := layers.EthernetType(binary.BigEndian.Uint16(data[2:]))
+	offset := 4
+	if flags&greChecksumPresent != 0 {
+		offset += 4
+	}
+	var key uint32
+	if flags&greKeyPresent != 0 {
+		if len(data) < offset+4 {
+			return tunnel{}, false
+		}
+		key = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	}
+	if flags&greSequencePresent != 0 {
+		offset += 4
+	}
+	if len(data) < offset {
+		return tunnel{}, false
+	}
+	payload := data[offset:]
+	switch protocol {
+	case layers.EthernetTypeERSPAN, ethernetTypeERSPANIII:
+		if enabled&tunnelBit(TunnelERSPAN) != 0 {
+			return erspanTunnel(protocol, flags&greSequencePresent != 0, payload)
+		}
+	case layers.EthernetTypeMPLSUnicast, layers.EthernetTypeMPLSMulticast:
+		return mplsTunnel(protocol, payload, enabled)
+	}
+	if enabled&tunnelBit(TunnelGRE) == 0 {
+		return tunnel{}, false
+	}
+	switch protocol {
+	case layers.EthernetTypeIPv4:
+		return tunnel{TunnelGRE, key, payload, layers.LayerTypeIPv4}, true
+	case layers.EthernetTypeIPv6:
+		return tunnel{TunnelGRE, key, payload, layers.LayerTypeIPv6}, true
+	case layers.EthernetTypeTransparentEthernetBridging:
+		// NVGRE carries the virtual subnet ID in the key
+		return tunnel{TunnelGRE, key, payload, layers.LayerTypeEthernet}, true
+	}
+	return tunnel{}, false
+}
+
+// erspanTunnel decodes the mirrored frame of ERSPAN type I, II or III, type I has no sequence number nor header
+func erspanTunnel(protocol layers.EthernetType, sequence bool, data []byte) (tunnel, bool) {
+	if protocol == layers.EthernetTypeERSPAN && !sequence {
+		return tunnel{TunnelERSPAN, 0, data, layers.LayerTypeEthernet}, true
+	}
+	size := erspanIIHeaderSize
+	version := uint8(1)
+	if protocol == ethernetTypeERSPANIII {
+		size, version = erspanIIIHeaderSize, 2
+	}
+	if len(data) < size || data[0]>>4 != version {
+		return tunnel{}, false
+	}
+	if version == 2 && data[11]&0x01 != 0 {
+		size += erspanIIIPlatformSize
+		if len(data) < size {
+			return tunnel{}, false
+		}
+	}
+	session := uint32(binary.BigEndian.Uint16(data[2:]) & 0x03ff)
+	return tunnel{TunnelERSPAN, session, data[size:], layers.LayerTypeEthernet}, true
+}
+
+func vxlanTunnel(data []byte) (tunnel, bool) {
+	if len(data) < vxlanHeaderSize || data[0]&vxlanFlagVNI == 0 {
+		return tunnel{}, false
+	}
+	vni := binary.BigEndian.Uint32(data[4:]) >> 8
+	return tunnel{TunnelVXLAN, vni, data[vxlanHeaderSize:], layers.LayerTypeEthernet}, true
+}
+
+func geneveTunnel(data []byte) (tunnel, bool) {
+	if len(data) < geneveHeaderSize || data[0]>>6 != 0 {
+		return tunnel{}, false
+	}
+	size := geneveHeaderSize + int(data[0]&0x3f)*4
+	if len(data) < size {
+		return tunnel{}, false
+	}
+	vni := binary.BigEndian.Uint32(data[4:]) >> 8
+	switch layers.EthernetType(binary.BigEndian.Uint16(data[2:])) {
+	case layers.EthernetTypeTransparentEthernetBridging:
+		return tunnel{TunnelGeneve, vni, data[size:], layers.LayerTypeEthernet}, true
+	case layers.EthernetTypeIPv4:
+		return tunnel{TunnelGeneve, vni, data[size:], layers.LayerTypeIPv4}, true
+	case layers.EthernetTypeIPv6:
+		return tunnel{TunnelGeneve, vni, data[size:], layers.LayerTypeIPv6}, true
+	}
+	return tunnel{}, false
+}
+
+// mplsTunnel skips the label stack of IP packets, pseudowires are not decapsulated
+func mplsTunnel(protocol layers.EthernetType, data []byte, enabled uint8) (tunnel, bool) {
+	if (protocol != layers.EthernetTypeMPLSUnicast && protocol != layers.EthernetTypeMPLSMulticast) ||
+		enabled&tunnelBit(TunnelMPLS) == 0 || len(data) < 4 {
+		return tunnel{}, false
+	}
+	label := binary.BigEndian.Uint32(data) >> 12
+	for offset := 0; offset+4 <= len(data); offset += 4 {
+		if binary.BigEndian.Uint32(data[offset:])&mplsBottomOfStack == 0 {
+			continue
+		}
+		payload := data[offset+4:]
+		if len(payload) == 0 {
+			return tunnel{}, false
+		}
+		switch payload[0] >> 4 {
+		case 4:
+			return tunnel{TunnelMPLS, label, payload, layers.LayerTypeIPv4}, true
+		case 6:
+			return tunnel{TunnelMPLS, label, payload, layers.LayerTypeIPv6}, true
+		}
+		return tunnel{}, false
+	}
+	return tunnel{}, false
+}
+
+// decapsulate replaces the flow of a tunnel with the flow of the IP packet it carries.
+// The outer flow is kept when the tunnel carries another protocol, such as ARP.
+func (handler *PacketHandler) decapsulate(pp *ParserParameters, flow Flow, data []byte, info gopacket.CaptureInfo) Flow {
+	current, carrier := pp, flow
+	for depth := 0; depth < maxTunnelDepth; depth++ {
+		carried, found := findTunnel(current, handler.tunnels)
+		if !found {
+			break
+		}
+		if pp.tunnels == nil {
+			// Each decoding goroutine has its own parsers
+			inner := newParserParameters(layers.LinkTypeEthernet)
+			pp.tunnels = &inner
+		}
+		if err := pp.tunnels.decodeFrom(carried.first, carried.payload); err != nil {
+			handler.log.Tracef("Error when decoding tunneled packet: %s", err)
+		}
+		current = pp.tunnels
+		// The inner packet is accounted without the outer headers
+		innerInfo := info
+		if headers := len(data) - len(carried.payload); headers < innerInfo.Length {
+			innerInfo.Length -= headers
+		}
+		inner := NewFlow(*current, innerInfo, *handler.iface)
+		if inner.key.ipVersion == 0 {
+			// Such as MPLS over Ethernet in an overlay, decapsulated on the next round
+			continue
+		}
+		inner.key.tunnelType, inner.key.tunnelID = carried.tunnelType, carried.id
+		// Endpoints of the closest outer IP header, none for MPLS directly over Ethernet
+		inner.tunnelSource, inner.tunnelDestination = carrier.key.sourceIPAddress, carrier.key.destinationIPAddress
+		flow, carrier = inner, inner
+	}
+	return flow
+}
+
+// tunnelAddress writes a tunnel endpoint in a 16 bytes field, IPv4 addresses are IPv4-mapped
+func tunnelAddress(ip net.IP) net.IP {
+	if ip == nil {
+		return net.IPv6zero
+	}
+	return ip.To16()
+}
@@ -0,0 +1,239 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var allTunnels = tunnelBit(TunnelGRE) | tunnelBit(TunnelERSPAN) | tunnelBit(TunnelVXLAN) | tunnelBit(TunnelGeneve) | tunnelBit(TunnelMPLS)
+
+// Start of the inner packets, only their first nibble is read by the parsers
+var (
+	innerIPv4     = []byte{0x45, 0, 0, 20}
+	innerIPv6     = []byte{0x60, 0, 0, 0}
+	innerEthernet = []byte{2, 0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 2, 0x08, 0x00}
+)
+
+// concat joins the parts of a tunnel header
+func concat(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+func uint16Bytes(value uint16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, value)
+	return buf
+}
+
+func uint32Bytes(value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return buf
+}
+
+// mplsLabel returns a label stack entry with a TTL of 64
+func mplsLabel(label uint32, bottom bool) []byte {
+	entry := label<<12 | 64
+	if bottom {
+		entry |= mplsBottomOfStack
+	}
+	return uint32Bytes(entry)
+}
+
+type tunnelCase struct {
+	name    string
+	parse   func() (tunnel, bool)
+	found   bool
+	id      uint32
+	first   gopacket.LayerType
+	payload []byte
+}
+
+func checkTunnels(t *testing.T, tunnelType uint8, cases []tunnelCase) {
+	t.Helper()
+	for _, c := range cases {
+		parsed, found := c.parse()
+		if found != c.found {
+			t.Errorf("%s: found %t, expected %t", c.name, found, c.found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if parsed.tunnelType != tunnelType || parsed.id != c.id || parsed.first != c.first || !bytes.Equal(parsed.payload, c.payload) {
+			t.Errorf("%s: %s tunnel %d to %s with payload %x, expected %s tunnel %d to %s with payload %x", c.name,
+				TunnelName(parsed.tunnelType), parsed.id, parsed.first, parsed.payload, TunnelName(tunnelType), c.id, c.first, c.payload)
+		}
+	}
+}
+
+func TestGRETunnel(t *testing.T) {
+	gre := func(enabled uint8, parts ...[]byte) func() (tunnel, bool) {
+		return func() (tunnel, bool) { return greTunnel(concat(parts...), enabled) }
+	}
+	flags := func(flags uint16, protocol layers.EthernetType) []byte {
+		return concat(uint16Bytes(flags), uint16Bytes(uint16(protocol)))
+	}
+	checksum, sequence := []byte{0xab, 0xcd, 0, 0}, uint32Bytes(99)
+	checkTunnels(t, TunnelGRE, []tunnelCase{
+		{"IPv4", gre(allTunnels, flags(0, layers.EthernetTypeIPv4), innerIPv4), true, 0, layers.LayerTypeIPv4, innerIPv4},
+		{"IPv6 with checksum, key and sequence",
+			gre(allTunnels, flags(greChecksumPresent|greKeyPresent|greSequencePresent, layers.EthernetTypeIPv6), checksum, uint32Bytes(0x01020304), sequence, innerIPv6),
+			true, 0x01020304, layers.LayerTypeIPv6, innerIPv6},
+		{"NVGRE", gre(allTunnels, flags(greKeyPresent, layers.EthernetTypeTransparentEthernetBridging), uint32Bytes(5000<<8), innerEthernet),
+			true, 5000 << 8, layers.LayerTypeEthernet, innerEthernet},
+		{"GRE not enabled", gre(tunnelBit(TunnelMPLS), flags(0, layers.EthernetTypeIPv4), innerIPv4), false, 0, 0, nil},
+		{"ARP", gre(allTunnels, flags(0, layers.EthernetTypeARP), innerIPv4), false, 0, 0, nil},
+		{"source routed", gre(allTunnels, flags(greRoutingPresent, layers.EthernetTypeIPv4), innerIPv4), false, 0, 0, nil},
+		{"PPTP", gre(allTunnels, flags(greKeyPresent|1, layers.EthernetTypePPP), uint32Bytes(1), innerIPv4), false, 0, 0, nil},
+		{"truncated header", gre(allTunnels, []byte{0, 0, 0x08}), false, 0, 0, nil},
+		{"truncated key", gre(allTunnels, flags(greChecksumPresent|greKeyPresent, layers.EthernetTypeIPv4), checksum, []byte{1, 2}), false, 0, 0, nil},
+		{"truncated sequence", gre(allTunnels, flags(greSequencePresent, layers.EthernetTypeIPv4), []byte{0, 0}), false, 0, 0, nil},
+		{"empty payload", gre(allTunnels, flags(greKeyPresent, layers.EthernetTypeIPv4), uint32Bytes(7)), true, 7, layers.LayerTypeIPv4, []byte{}},
+	})
+	// Tunnels carried by GRE are those of the carried protocol
+	checkTunnels(t, TunnelERSPAN, []tunnelCase{
+		{"ERSPAN type II", gre(allTunnels, flags(greSequencePresent, layers.EthernetTypeERSPAN), sequence, []byte{0x10, 0, 0, 42, 0, 0, 0, 0}, innerEthernet),
+			true, 42, layers.LayerTypeEthernet, innerEthernet},
+		{"ERSPAN not enabled", gre(tunnelBit(TunnelGRE), flags(greSequencePresent, layers.EthernetTypeERSPAN), sequence, []byte{0x10, 0, 0, 42, 0, 0, 0, 0}, innerEthernet),
+			false, 0, 0, nil},
+	})
+	checkTunnels(t, TunnelMPLS, []tunnelCase{
+		{"MPLS", gre(allTunnels, flags(0, layers.EthernetTypeMPLSUnicast), mplsLabel(16, true), innerIPv4), true, 16, layers.LayerTypeIPv4, innerIPv4},
+	})
+}
+
+func TestERSPANTunnel(t *testing.T) {
+	erspan := func(protocol layers.EthernetType, sequence bool, parts ...[]byte) func() (tunnel, bool) {
+		return func() (tunnel, bool) { return erspanTunnel(protocol, sequence, concat(parts...)) }
+	}
+	typeII := []byte{0x10, 0x00, 0x04, 0x2a, 0, 0, 0, 0} // Session 42 under a COS of 1
+	typeIII := []byte{0x20, 0x00, 0x00, 0x07, 0, 0, 0, 0, 0, 0, 0, 0}
+	typeIIIPlatform := []byte{0x20, 0x00, 0x00, 0x07, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	platform := make([]byte, erspanIIIPlatformSize)
+	checkTunnels(t, TunnelERSPAN, []tunnelCase{
+		{"type I", erspan(layers.EthernetTypeERSPAN, false, innerEthernet), true, 0, layers.LayerTypeEthernet, innerEthernet},
+		{"type II", erspan(layers.EthernetTypeERSPAN, true, typeII, innerEthernet), true, 42, layers.LayerTypeEthernet, innerEthernet},
+		{"type II of another version", erspan(layers.EthernetTypeERSPAN, true, typeIII[:8], innerEthernet), false, 0, 0, nil},
+		{"truncated type II", erspan(layers.EthernetTypeERSPAN, true, typeII[:7]), false, 0, 0, nil},
+		{"type III", erspan(ethernetTypeERSPANIII, true, typeIII, innerEthernet), true, 7, layers.LayerTypeEthernet, innerEthernet},
+		{"type III with platform subheader", erspan(ethernetTypeERSPANIII, true, typeIIIPlatform, platform, innerEthernet),
+			true, 7, layers.LayerTypeEthernet, innerEthernet},
+		{"truncated type III", erspan(ethernetTypeERSPANIII, true, typeIII[:11]), false, 0, 0, nil},
+		{"truncated platform subheader", erspan(ethernetTypeERSPANIII, true, typeIIIPlatform, platform[:4]), false, 0, 0, nil},
+	})
+}
+
+func TestVXLANTunnel(t *testing.T) {
+	vxlan := func(parts ...[]byte) func() (tunnel, bool) {
+		return func() (tunnel, bool) { return vxlanTunnel(concat(parts...)) }
+	}
+	header := []byte{vxlanFlagVNI, 0, 0, 0, 0x12, 0x34, 0x56, 0}
+	checkTunnels(t, TunnelVXLAN, []tunnelCase{
+		{"VNI", vxlan(header, innerEthernet), true, 0x123456, layers.LayerTypeEthernet, innerEthernet},
+		{"without VNI", vxlan([]byte{0, 0, 0, 0, 0x12, 0x34, 0x56, 0}, innerEthernet), false, 0, 0, nil},
+		{"truncated", vxlan(header[:7]), false, 0, 0, nil},
+	})
+}
+
+func TestGeneveTunnel(t *testing.T) {
+	geneve := func(parts ...[]byte) func() (tunnel, bool) {
+		return func() (tunnel, bool) { return geneveTunnel(concat(parts...)) }
+	}
+	header := func(options uint8, protocol layers.EthernetType) []byte {
+		return concat([]byte{options, 0}, uint16Bytes(uint16(protocol)), []byte{0, 0, 0x2a, 0})
+	}
+	options := make([]byte, 8)
+	checkTunnels(t, TunnelGeneve, []tunnelCase{
+		{"Ethernet", geneve(header(0, layers.EthernetTypeTransparentEthernetBridging), innerEthernet), true, 42, layers.LayerTypeEthernet, innerEthernet},
+		{"IPv4 after options", geneve(header(2, layers.EthernetTypeIPv4), options, innerIPv4), true, 42, layers.LayerTypeIPv4, innerIPv4},
+		{"IPv6", geneve(header(0, layers.EthernetTypeIPv6), innerIPv6), true, 42, layers.LayerTypeIPv6, innerIPv6},
+		{"ARP", geneve(header(0, layers.EthernetTypeARP), innerEthernet), false, 0, 0, nil},
+		{"version 1", geneve(header(0x40, layers.EthernetTypeIPv4), innerIPv4), false, 0, 0, nil},
+		{"truncated header", geneve(header(0, layers.EthernetTypeIPv4)[:7]), false, 0, 0, nil},
+		{"truncated options", geneve(header(2, layers.EthernetTypeIPv4), options[:4]), false, 0, 0, nil},
+	})
+}
+
+func TestMPLSTunnel(t *testing.T) {
+	mpls := func(protocol layers.EthernetType, enabled uint8, parts ...[]byte) func() (tunnel, bool) {
+		return func() (tunnel, bool) { return mplsTunnel(protocol, concat(parts...), enabled) }
+	}
+	unicast, multicast := layers.EthernetTypeMPLSUnicast, layers.EthernetTypeMPLSMulticast
+	checkTunnels(t, TunnelMPLS, []tunnelCase{
+		{"IPv4", mpls(unicast, allTunnels, mplsLabel(100, true), innerIPv4), true, 100, layers.LayerTypeIPv4, innerIPv4},
+		{"label stack", mpls(multicast, allTunnels, mplsLabel(100, false), mplsLabel(200, true), innerIPv6), true, 100, layers.LayerTypeIPv6, innerIPv6},
+		{"pseudowire", mpls(unicast, allTunnels, mplsLabel(100, true), []byte{0, 0, 0, 0}, innerEthernet), false, 0, 0, nil},
+		{"not MPLS", mpls(layers.EthernetTypeIPv4, allTunnels, mplsLabel(100, true), innerIPv4), false, 0, 0, nil},
+		{"MPLS not enabled", mpls(unicast, tunnelBit(TunnelGRE), mplsLabel(100, true), innerIPv4), false, 0, 0, nil},
+		{"without bottom of stack", mpls(unicast, allTunnels, mplsLabel(100, false), mplsLabel(200, false)), false, 0, 0, nil},
+		{"truncated label", mpls(unicast, allTunnels, mplsLabel(100, true)[:3]), false, 0, 0, nil},
+		{"truncated stack", mpls(unicast, allTunnels, mplsLabel(100, false), mplsLabel(200, true)[:2]), false, 0, 0, nil},
+		{"empty payload", mpls(unicast, allTunnels, mplsLabel(100, true)), false, 0, 0, nil},
+	})
+}
+
+func TestTunnelExport(t *testing.T) {
+	const enterprise = 64512
+	tunneled := testFlows()[0]
+	tunneled.key.tunnelType, tunneled.key.tunnelID = TunnelVXLAN, 42
+	tunneled.tunnelSource, tunneled.tunnelDestination = net.IPv4(203, 0, 113, 1).To4(), net.IPv4(203, 0, 113, 2).To4()
+	for _, c := range []struct {
+		options ExportOptions
+		tunnels bool
+	}{
+		{ExportOptions{Version: 9, SourceID: 1, TunnelEnterpriseNumber: enterprise}, true},
+		{ExportOptions{Version: 10, SourceID: 2, TunnelEnterpriseNumber: enterprise}, true},
+		// The GeoIP fields do not export the tunnels
+		{ExportOptions{Version: 9, SourceID: 3, GeoEnterpriseNumber: enterprise}, false},
+		{ExportOptions{Version: 10, SourceID: 4, GeoEnterpriseNumber: enterprise}, false},
+	} {
+		collector := newTestCollector(t)
+		exporter := newTestExporter(t, collector, c.options)
+		flows := append([]Flow{tunneled}, testFlows()...)
+		for _, f := range flows {
+			if err := exporter.Export(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := exporter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		decoder := newMessageDecoder(0, enterprise)
+		decoded, skipped, err := decoder.decode("test", collector.receive())
+		if err != nil || skipped != 0 {
+			t.Fatalf("version %d: cannot decode: %v, %d data sets skipped", c.options.Version, err, skipped)
+		}
+		_, found := decoder.templates[templateKey{"test", c.options.SourceID, templateIDIPv4 + templateVariantTunnel}]
+		if found != c.tunnels {
+			t.Errorf("version %d: tunnel template announced %t, expected %t", c.options.Version, found, c.tunnels)
+		}
+		ipv4 := decoder.templates[templateKey{"test", c.options.SourceID, templateIDIPv4}]
+		private := 0
+		for _, field := range ipv4.fields {
+			if field.enterprise != 0 || field.id&netflow9VendorField != 0 {
+				private++
+			}
+		}
+		if expected := len(geoFields(0)); c.tunnels && private != 0 || !c.tunnels && private != expected {
+			t.Errorf("version %d: %d private fields in the IPv4 template", c.options.Version, private)
+		}
+		if !c.tunnels {
+			flows[0].key.tunnelType, flows[0].key.tunnelID = 0, 0
+		}
+		compareFlows(t, flows, decoded, time.Second)
+		if c.tunnels && (!decoded[0].tunnelSource.Equal(tunneled.tunnelSource) || !decoded[0].tunnelDestination.Equal(tunneled.tunnelDestination)) {
+			t.Errorf("version %d: tunnel from %s to %s", c.options.Version, decoded[0].tunnelSource, decoded[0].tunnelDestination)
+		}
+	}
+}
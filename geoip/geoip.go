@@ -0,0 +1,190 @@
+// Package geoip enriches flows with the country, city and AS of their addresses
+// from local MaxMind GeoLite2 or GeoIP2 databases
+package geoip
+
+import (
+	"github.com/COSAE-FR/ripflow/flow"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// database is a MaxMind DB file reloaded when it changes on disk
+type database struct {
+	path     string
+	reader   *mmdbReader
+	modified time.Time
+	lock     sync.RWMutex
+}
+
+func openDatabase(path string) (*database, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	db := &database{path: path}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *database) load() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	reader, err := openMMDB(db.path)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	db.reader = reader
+	db.modified = info.ModTime()
+	db.lock.Unlock()
+	return nil
+}
+
+func (db *database) changed() bool {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return !info.ModTime().Equal(db.modified)
+}
+
+func (db *database) lookup(ip net.IP) map[string]interface{} {
+	if db == nil || ip == nil {
+		return nil
+	}
+	db.lock.RLock()
+	reader := db.reader
+	db.lock.RUnlock()
+	record, err := reader.lookup(ip)
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+// field follows the path of map keys in a record
+func field(record map[string]interface{}, path ...string) interface{} {
+	var value interface{} = record
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// Enricher annotates flows with the GeoIP information of their addresses
+type Enricher struct {
+	country        *database
+	city           *database
+	asn            *database
+	reloadInterval time.Duration
+	killSwitch     chan int
+	log            *log.Entry
+}
+
+// NewEnricher opens the Country, City and ASN databases, empty paths are skipped
+func NewEnricher(countryPath string, cityPath string, asnPath string, reloadInterval time.Duration, logger *log.Entry) (*Enricher, error) {
+	enricher := &Enricher{
+		reloadInterval: reloadInterval,
+		killSwitch:     make(chan int, 0),
+		log:            logger.WithField("component", "geoip"),
+	}
+	var err error
+	if enricher.country, err = openDatabase(countryPath); err != nil {
+		return nil, err
+	}
+	if enricher.city, err = openDatabase(cityPath); err != nil {
+		return nil, err
+	}
+	if enricher.asn, err = openDatabase(asnPath); err != nil {
+		return nil, err
+	}
+	return enricher, nil
+}
+
+// Geo returns the country ISO code, the English city name and the AS number of ip
+func (e *Enricher) Geo(ip net.IP) (country string, city string, as uint32) {
+	if record := e.city.lookup(ip); record != nil {
+		country, _ = field(record, "country", "iso_code").(string)
+		city, _ = field(record, "city", "names", "en").(string)
+	}
+	if record := e.country.lookup(ip); record != nil {
+		if code, ok := field(record, "country", "iso_code").(string); ok {
+			country = code
+		} else if code, ok := field(record, "registered_country", "iso_code").(string); ok && len(country) == 0 {
+			country = code
+		}
+	}
+	if record := e.asn.lookup(ip); record != nil {
+		if number, ok := field(record, "autonomous_system_number").(uint64); ok {
+			as = uint32(number)
+		}
+	}
+	return country, city, as
+}
+
+// Enrich sets the GeoIP information of the flow, AS numbers found by the BGP enricher are kept
+func (e *Enricher) Enrich(f *flow.Flow) {
+	country, city, as := e.Geo(f.SourceIP())
+	f.SetSourceGeo(country, city)
+	if as > 0 && f.SourceAS() == 0 {
+		f.SetSourceAS(as, f.SourcePrefixLength())
+	}
+	country, city, as = e.Geo(f.DestinationIP())
+	f.SetDestinationGeo(country, city)
+	if as > 0 && f.DestinationAS() == 0 {
+		f.SetDestinationAS(as, f.DestinationPrefixLength())
+	}
+}
+
+func (e *Enricher) reloadChanged() {
+	for _, db := range []*database{e.country, e.city, e.asn} {
+		if db == nil || !db.changed() {
+			continue
+		}
+		if err := db.load(); err != nil {
+			e.log.Errorf("Cannot reload %s, keeping the previous one: %s", db.path, err)
+			continue
+		}
+		e.log.Infof("Reloaded %s", db.path)
+	}
+}
+
+func (e *Enricher) Listen() {
+	ticker := time.NewTicker(e.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.killSwitch:
+			e.log.Info("Received a listener kill switch")
+			return
+		case <-ticker.C:
+			e.reloadChanged()
+		}
+	}
+}
+
+func (e *Enricher) Start() error {
+	if e.reloadInterval > 0 {
+		go e.Listen()
+	}
+	return nil
+}
+
+func (e *Enricher) Stop() error {
+	if e.reloadInterval > 0 {
+		e.killSwitch <- 1
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	lru "github.com/hashicorp/golang-lru"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// https://maxmind.github.io/MaxMind-DB/
+const (
+	mmdbDataSeparatorSize = 16
+	mmdbRecordCacheSize   = 4096
+	mmdbTypeExtended      = 0
+	mmdbTypePointer       = 1
+	mmdbTypeString        = 2
+	mmdbTypeDouble        = 3
+	mmdbTypeBytes         = 4
+	mmdbTypeUint16        = 5
+	mmdbTypeUint32        = 6
+	mmdbTypeMap           = 7
+	mmdbTypeInt32         = 8
+	mmdbTypeUint64        = 9
+	mmdbTypeUint128       = 10
+	mmdbTypeArray         = 11
+	mmdbTypeBoolean       = 14
+	mmdbTypeFloat         = 15
+)
+
+var (
+	mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+	errMMDBCorrupted   = errors.New("corrupted MaxMind database")
+)
+
+// mmdbReader looks up addresses in a MaxMind DB file loaded in memory
+type mmdbReader struct {
+	tree         []byte
+	data         decoder
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	databaseType string
+	records      *lru.Cache // Decoded records by data offset, shared by many networks
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if index < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind database", path)
+	}
+	metadataDecoder := decoder{buffer: buffer[index+len(mmdbMetadataMarker):]}
+	raw, _, err := metadataDecoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupted
+	}
+	reader := &mmdbReader{
+		nodeCount:  toUint(metadata["node_count"]),
+		recordSize: toUint(metadata["record_size"]),
+		ipVersion:  toUint(metadata["ip_version"]),
+	}
+	reader.databaseType, _ = metadata["database_type"].(string)
+	if reader.recordSize != 24 && reader.recordSize != 28 && reader.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", reader.recordSize)
+	}
+	treeSize := reader.recordSize * 2 / 8 * reader.nodeCount
+	if treeSize+mmdbDataSeparatorSize > uint(index) {
+		return nil, errMMDBCorrupted
+	}
+	reader.tree = buffer[:treeSize]
+	reader.data = decoder{buffer: buffer[treeSize+mmdbDataSeparatorSize : index]}
+	if reader.records, err = lru.New(mmdbRecordCacheSize); err != nil {
+		return nil, err
+	}
+	// IPv4 addresses are stored under ::/96 in IPv6 databases
+	if reader.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.nodeCount; i++ {
+			node = reader.readNode(node, 0)
+		}
+		reader.ipv4Start = node
+	}
+	return reader, nil
+}
+
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+	b := r.tree
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		return uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2])
+	case 28:
+		offset := node * 7
+		if bit == 0 {
+			return (uint(b[offset+3])&0xf0)<<20 | uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2])
+		}
+		return (uint(b[offset+3])&0x0f)<<24 | uint(b[offset+4])<<16 | uint(b[offset+5])<<8 | uint(b[offset+6])
+	}
+	offset := node*8 + bit*4
+	return uint(b[offset])<<24 | uint(b[offset+1])<<16 | uint(b[offset+2])<<8 | uint(b[offset+3])
+}
+
+// lookup returns the record of the network holding ip
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	key := ip.To4()
+	if key != nil {
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	} else {
+		key = ip.To16()
+	}
+	if key == nil {
+		return nil, nil
+	}
+	for i := 0; i < len(key)*8 && node < r.nodeCount; i++ {
+		bit := uint(key[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	offset := node - r.nodeCount - mmdbDataSeparatorSize
+	if cached, found := r.records.Get(offset); found {
+		return cached.(map[string]interface{}), nil
+	}
+	raw, _, err := r.data.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := raw.(map[string]interface{})
+	r.records.Add(offset, record)
+	return record, nil
+}
+
+// decoder reads values of the MaxMind DB data section
+type decoder struct {
+	buffer []byte
+}
+
+func (d *decoder) bytes(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buffer)) {
+		return nil, errMMDBCorrupted
+	}
+	return d.buffer[offset : offset+size], nil
+}
+
+func readUint(b []byte) uint64 {
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value
+}
+
+// decode returns the value at offset and the offset of the next value
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	header, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	control := header[0]
+	offset++
+	valueType := control >> 5
+	if valueType == mmdbTypePointer {
+		return d.decodePointer(control, offset)
+	}
+	if valueType == mmdbTypeExtended {
+		extended, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		valueType = 7 + extended[0]
+		offset++
+	}
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		b, err := d.bytes(offset, extra)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + uint(readUint(b))
+		default:
+			size = 65821 + uint(readUint(b))
+		}
+	}
+	switch valueType {
+	case mmdbTypeMap:
+		value := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, entry interface{}
+			if key, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			if entry, offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupted
+			}
+			value[name] = entry
+		}
+		return value, offset, nil
+	case mmdbTypeArray:
+		value := make([]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			if value[i], offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case mmdbTypeBoolean:
+		return size != 0, offset, nil
+	}
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch valueType {
+	case mmdbTypeString:
+		return string(b), offset, nil
+	case mmdbTypeBytes:
+		return b, offset, nil
+	case mmdbTypeDouble:
+		return math.Float64frombits(readUint(b)), offset, nil
+	case mmdbTypeFloat:
+		return float64(math.Float32frombits(uint32(readUint(b)))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		return readUint(b), offset, nil
+	case mmdbTypeUint128:
+		// Only the lowest 64 bits are kept
+		if len(b) > 8 {
+			b = b[len(b)-8:]
+		}
+		return readUint(b), offset, nil
+	case mmdbTypeInt32:
+		return int64(int32(uint32(readUint(b)))), offset, nil
+	}
+	// Data cache containers and end markers are not found in records
+	return nil, offset, nil
+}
+
+func (d *decoder) decodePointer(control byte, offset uint) (interface{}, uint, error) {
+	size := uint((control>>3)&0x3) + 1
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	high := uint(control & 0x7)
+	var pointer uint
+	switch size {
+	case 1:
+		pointer = high<<8 | uint(b[0])
+	case 2:
+		pointer = (high<<16 | uint(readUint(b))) + 2048
+	case 3:
+		pointer = (high<<24 | uint(readUint(b))) + 526336
+	default:
+		pointer = uint(readUint(b))
+	}
+	value, _, err := d.decode(pointer)
+	return value, offset + size, err
+}
+
+func toUint(value interface{}) uint {
+	if v, ok := value.(uint64); ok {
+		return uint(v)
+	}
+	return 0
+}
@@ -0,0 +1,501 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mmdbPointer is encoded as a pointer of the given size to the data at offset
+type mmdbPointer struct {
+	offset int
+	size   int
+}
+
+// mmdbUint128 is encoded as an unsigned 128 bits integer
+type mmdbUint128 [16]byte
+
+// mmdbEncoder writes values in the MaxMind DB data format
+type mmdbEncoder struct {
+	buf []byte
+}
+
+func (e *mmdbEncoder) control(valueType byte, size int) {
+	typeBits, extended := valueType, []byte(nil)
+	if valueType > 7 {
+		typeBits, extended = mmdbTypeExtended, []byte{valueType - 7}
+	}
+	var sizeBits byte
+	var extra []byte
+	switch {
+	case size < 29:
+		sizeBits = byte(size)
+	case size < 285:
+		sizeBits, extra = 29, []byte{byte(size - 29)}
+	case size < 65821:
+		sizeBits, extra = 30, []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		sizeBits, extra = 31, []byte{byte((size - 65821) >> 16), byte((size - 65821) >> 8), byte(size - 65821)}
+	}
+	e.buf = append(e.buf, typeBits<<5|sizeBits)
+	e.buf = append(e.buf, extended...)
+	e.buf = append(e.buf, extra...)
+}
+
+// unsigned writes the value on its significant bytes only
+func (e *mmdbEncoder) unsigned(valueType byte, value uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	significant := bytes.TrimLeft(b[:], "\x00")
+	e.control(valueType, len(significant))
+	e.buf = append(e.buf, significant...)
+}
+
+// encode writes the value and returns its offset
+func (e *mmdbEncoder) encode(value interface{}) int {
+	offset := len(e.buf)
+	switch v := value.(type) {
+	case string:
+		e.control(mmdbTypeString, len(v))
+		e.buf = append(e.buf, v...)
+	case []byte:
+		e.control(mmdbTypeBytes, len(v))
+		e.buf = append(e.buf, v...)
+	case float64:
+		e.control(mmdbTypeDouble, 8)
+		e.buf = append(e.buf, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], math.Float64bits(v))
+	case float32:
+		e.control(mmdbTypeFloat, 4)
+		e.buf = append(e.buf, make([]byte, 4)...)
+		binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], math.Float32bits(v))
+	case uint16:
+		e.unsigned(mmdbTypeUint16, uint64(v))
+	case uint32:
+		e.unsigned(mmdbTypeUint32, uint64(v))
+	case uint64:
+		e.unsigned(mmdbTypeUint64, v)
+	case mmdbUint128:
+		e.control(mmdbTypeUint128, 16)
+		e.buf = append(e.buf, v[:]...)
+	case int32:
+		e.control(mmdbTypeInt32, 4)
+		e.buf = append(e.buf, make([]byte, 4)...)
+		binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], uint32(v))
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		e.control(mmdbTypeBoolean, size)
+	case []interface{}:
+		e.control(mmdbTypeArray, len(v))
+		for _, item := range v {
+			e.encode(item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.control(mmdbTypeMap, len(v))
+		for _, key := range keys {
+			e.encode(key)
+			e.encode(v[key])
+		}
+	case mmdbPointer:
+		var b [4]byte
+		pointer := v.offset
+		switch v.size {
+		case 2:
+			pointer -= 2048
+		case 3:
+			pointer -= 526336
+		}
+		binary.BigEndian.PutUint32(b[:], uint32(pointer))
+		high := byte(0)
+		if v.size < 4 {
+			high = byte(pointer>>(8*uint(v.size))) & 0x7
+		}
+		e.buf = append(e.buf, mmdbTypePointer<<5|byte(v.size-1)<<3|high)
+		e.buf = append(e.buf, b[4-v.size:]...)
+	default:
+		panic("unsupported value")
+	}
+	return offset
+}
+
+// treeNode is a node of the search tree, a record holds a node, a data offset or nothing
+type treeNode struct {
+	children [2]*treeNode
+	data     [2]int // Data offset plus one, 0 when the record is empty or a node
+	index    int
+}
+
+// mmdbNetwork is a network of the database and the data of its record
+type mmdbNetwork struct {
+	cidr string
+	data int // Offset in the data section
+}
+
+// buildMMDB writes a database of the given record size and IP version, the networks must not overlap
+func buildMMDB(t *testing.T, recordSize int, ipVersion int, networks []mmdbNetwork, data []byte) []byte {
+	t.Helper()
+	root := &treeNode{}
+	for _, network := range networks {
+		_, prefix, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, _ := prefix.Mask.Size()
+		key := prefix.IP.To16()
+		if ip4 := prefix.IP.To4(); ip4 != nil {
+			if ipVersion == 4 {
+				key = ip4
+			} else {
+				// IPv4 networks are stored under ::/96
+				key = append(make(net.IP, 12), ip4...)
+				length += 96
+			}
+		}
+		node := root
+		for i := 0; i < length; i++ {
+			bit := int(key[i/8]>>(7-uint(i%8))) & 1
+			if i == length-1 {
+				node.data[bit] = network.data + 1
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &treeNode{}
+			}
+			node = node.children[bit]
+		}
+	}
+	var nodes []*treeNode
+	var number func(node *treeNode)
+	number = func(node *treeNode) {
+		node.index = len(nodes)
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil {
+				number(child)
+			}
+		}
+	}
+	number(root)
+	nodeCount := len(nodes)
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit := range records {
+			switch {
+			case node.children[bit] != nil:
+				records[bit] = uint32(node.children[bit].index)
+			case node.data[bit] > 0:
+				records[bit] = uint32(nodeCount + mmdbDataSeparatorSize + node.data[bit] - 1)
+			default:
+				records[bit] = uint32(nodeCount)
+			}
+		}
+		tree = append(tree, encodeNode(recordSize, records[0], records[1])...)
+	}
+	metadata := mmdbEncoder{}
+	metadata.encode(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"database_type":               "Test-DB",
+		"ip_version":                  uint16(ipVersion),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	})
+	file := append(tree, make([]byte, mmdbDataSeparatorSize)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	return append(file, metadata.buf...)
+}
+
+func encodeNode(recordSize int, left uint32, right uint32) []byte {
+	switch recordSize {
+	case 24:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)}
+	case 28:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left),
+			byte(left>>20)&0xf0 | byte(right>>24)&0x0f, byte(right >> 16), byte(right >> 8), byte(right)}
+	}
+	node := make([]byte, 8)
+	binary.BigEndian.PutUint32(node, left)
+	binary.BigEndian.PutUint32(node[4:], right)
+	return node
+}
+
+func writeMMDB(t *testing.T, dir string, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ripflow-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestDecoder(t *testing.T) {
+	var uint128 mmdbUint128
+	uint128[7], uint128[15] = 1, 42
+	long := string(bytes.Repeat([]byte("a"), 300))
+	longer := string(bytes.Repeat([]byte("b"), 70000))
+	values := []interface{}{
+		"short",
+		string(bytes.Repeat([]byte("c"), 100)),
+		long,
+		longer,
+		[]byte{1, 2, 3},
+		3.25,
+		float32(-1.5),
+		uint16(0),
+		uint16(443),
+		uint32(4200000000),
+		uint64(1) << 40,
+		uint128,
+		int32(-42),
+		true,
+		false,
+		[]interface{}{"en", uint16(7)},
+		map[string]interface{}{"iso_code": "FR", "names": map[string]interface{}{"en": "France"}},
+	}
+	expected := []interface{}{
+		"short",
+		string(bytes.Repeat([]byte("c"), 100)),
+		long,
+		longer,
+		[]byte{1, 2, 3},
+		3.25,
+		-1.5,
+		uint64(0),
+		uint64(443),
+		uint64(4200000000),
+		uint64(1) << 40,
+		uint64(42), // Only the lowest 64 bits are kept
+		int64(-42),
+		true,
+		false,
+		[]interface{}{"en", uint64(7)},
+		map[string]interface{}{"iso_code": "FR", "names": map[string]interface{}{"en": "France"}},
+	}
+	encoder := mmdbEncoder{}
+	offsets := make([]int, len(values))
+	for i, value := range values {
+		offsets[i] = encoder.encode(value)
+	}
+	d := decoder{buffer: encoder.buf}
+	for i := range values {
+		value, next, err := d.decode(uint(offsets[i]))
+		if err != nil {
+			t.Errorf("value %d: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, expected[i]) {
+			t.Errorf("value %d decoded as %#v, expected %#v", i, value, expected[i])
+		}
+		if end := len(encoder.buf); i+1 < len(offsets) {
+			end = offsets[i+1]
+			if next != uint(end) {
+				t.Errorf("value %d ends at %d, expected %d", i, next, end)
+			}
+		}
+	}
+	last := encoder.buf[offsets[len(offsets)-1]:]
+	for size := 1; size < len(last); size++ {
+		truncated := decoder{buffer: last[:size]}
+		if _, _, err := truncated.decode(0); err == nil {
+			t.Errorf("map truncated to %d bytes decoded", size)
+		}
+	}
+	// Map keys are strings
+	invalid := mmdbEncoder{}
+	invalid.control(mmdbTypeMap, 1)
+	invalid.encode(uint16(1))
+	invalid.encode("value")
+	if _, _, err := (&decoder{buffer: invalid.buf}).decode(0); err == nil {
+		t.Error("map with an integer key decoded")
+	}
+}
+
+func TestDecodePointers(t *testing.T) {
+	encoder := mmdbEncoder{}
+	near := encoder.encode("near")
+	// Each pointer size covers a larger range of offsets
+	encoder.encode(make([]byte, 3000))
+	middle := encoder.encode("middle")
+	encoder.encode(make([]byte, 530000))
+	far := encoder.encode("far")
+	record := encoder.encode(map[string]interface{}{
+		"a": mmdbPointer{near, 1},
+		"b": mmdbPointer{middle, 2},
+		"c": mmdbPointer{far, 3},
+		"d": mmdbPointer{far, 4},
+		"e": []interface{}{mmdbPointer{near, 4}, "after"},
+	})
+	value, _, err := (&decoder{buffer: encoder.buf}).decode(uint(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"a": "near", "b": "middle", "c": "far", "d": "far", "e": []interface{}{"near", "after"}}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("record decoded as %v", value)
+	}
+	dangling := mmdbEncoder{}
+	dangling.encode(mmdbPointer{1000, 1})
+	if _, _, err := (&decoder{buffer: dangling.buf}).decode(0); err == nil {
+		t.Error("pointer outside the data section decoded")
+	}
+}
+
+func TestReadNode(t *testing.T) {
+	// The 28 bits records share the middle byte of the node
+	for _, c := range []struct {
+		recordSize  int
+		left, right uint32
+	}{
+		{24, 0xabcdef, 0x123456},
+		{28, 0xabcdef1, 0x2345678},
+		{32, 0xfedcba98, 0x12345678},
+	} {
+		reader := &mmdbReader{recordSize: uint(c.recordSize)}
+		reader.tree = append(encodeNode(c.recordSize, 1, 2), encodeNode(c.recordSize, c.left, c.right)...)
+		if left, right := reader.readNode(1, 0), reader.readNode(1, 1); left != uint(c.left) || right != uint(c.right) {
+			t.Errorf("record size %d: node read as %#x/%#x, expected %#x/%#x", c.recordSize, left, right, c.left, c.right)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir := tempDir(t)
+	data := mmdbEncoder{}
+	france := data.encode(map[string]interface{}{"iso_code": "FR"})
+	documentation := data.encode(map[string]interface{}{"country": mmdbPointer{france, 1}, "network": "documentation"})
+	ipv6 := data.encode(map[string]interface{}{"country": mmdbPointer{france, 1}, "network": "ipv6"})
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			networks := []mmdbNetwork{{"192.0.2.0/24", documentation}, {"198.51.100.128/25", documentation}}
+			if ipVersion == 6 {
+				networks = append(networks, mmdbNetwork{"2001:db8::/32", ipv6})
+			}
+			path := writeMMDB(t, dir, "test.mmdb", buildMMDB(t, recordSize, ipVersion, networks, data.buf))
+			reader, err := openMMDB(path)
+			if err != nil {
+				t.Fatalf("record size %d, IPv%d: %s", recordSize, ipVersion, err)
+			}
+			if reader.databaseType != "Test-DB" {
+				t.Errorf("database type %s", reader.databaseType)
+			}
+			expected := map[string]string{
+				"192.0.2.1":          "documentation",
+				"::ffff:192.0.2.255": "documentation",
+				"198.51.100.200":     "documentation",
+				"198.51.100.100":     "",
+				"203.0.113.1":        "",
+				"2001:db8:1::1":      "",
+				"2001:db9::1":        "",
+			}
+			if ipVersion == 6 {
+				expected["2001:db8:1::1"] = "ipv6"
+			}
+			for address, network := range expected {
+				record, err := reader.lookup(net.ParseIP(address))
+				if err != nil {
+					t.Errorf("record size %d, IPv%d, %s: %s", recordSize, ipVersion, address, err)
+					continue
+				}
+				if name, _ := field(record, "network").(string); name != network {
+					t.Errorf("record size %d, IPv%d: %s found in %q, expected %q", recordSize, ipVersion, address, name, network)
+				}
+				if len(network) > 0 && field(record, "country", "iso_code") != "FR" {
+					t.Errorf("record size %d, IPv%d: %s record %v", recordSize, ipVersion, address, record)
+				}
+			}
+		}
+	}
+	for name, content := range map[string][]byte{
+		"no metadata":    data.buf,
+		"record size":    bytes.Replace(buildMMDB(t, 24, 4, nil, data.buf), []byte("record_size\xa1\x18"), []byte("record_size\xa1\x14"), 1),
+		"truncated tree": buildMMDB(t, 24, 4, nil, nil)[2:],
+	} {
+		if _, err := openMMDB(writeMMDB(t, dir, "invalid.mmdb", content)); err == nil {
+			t.Errorf("database with invalid %s opened", name)
+		}
+	}
+}
+
+func TestEnricher(t *testing.T) {
+	dir := tempDir(t)
+	data := mmdbEncoder{}
+	city := data.encode(map[string]interface{}{
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Paris", "fr": "Paris"}},
+		"country": map[string]interface{}{"iso_code": "FR"},
+	})
+	cityPath := writeMMDB(t, dir, "city.mmdb", buildMMDB(t, 28, 6, []mmdbNetwork{{"192.0.2.0/24", city}}, data.buf))
+	data = mmdbEncoder{}
+	country := data.encode(map[string]interface{}{"country": map[string]interface{}{"iso_code": "BE"}})
+	registered := data.encode(map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "NL"}})
+	countryPath := writeMMDB(t, dir, "country.mmdb", buildMMDB(t, 24, 6,
+		[]mmdbNetwork{{"198.51.100.0/24", country}, {"2001:db8::/32", registered}}, data.buf))
+	data = mmdbEncoder{}
+	asn := data.encode(map[string]interface{}{"autonomous_system_number": uint32(64500)})
+	asnPath := writeMMDB(t, dir, "asn.mmdb", buildMMDB(t, 32, 6, []mmdbNetwork{{"192.0.2.0/25", asn}}, data.buf))
+
+	enricher, err := NewEnricher(countryPath, cityPath, asnPath, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]struct {
+		country string
+		city    string
+		as      uint32
+	}{
+		"192.0.2.1":    {"FR", "Paris", 64500},
+		"192.0.2.200":  {"FR", "Paris", 0},
+		"198.51.100.1": {"BE", "", 0},
+		"2001:db8::1":  {"NL", "", 0},
+		"203.0.113.1":  {"", "", 0},
+	} {
+		country, city, as := enricher.Geo(net.ParseIP(address))
+		if country != expected.country || city != expected.city || as != expected.as {
+			t.Errorf("%s located in %s/%s AS%d, expected %+v", address, country, city, as, expected)
+		}
+	}
+
+	if _, err := NewEnricher(filepath.Join(dir, "missing.mmdb"), "", "", 0, testLogger()); err == nil {
+		t.Error("missing database opened")
+	}
+	if enricher, err := NewEnricher("", "", asnPath, 0, testLogger()); err != nil {
+		t.Error(err)
+	} else if country, _, as := enricher.Geo(net.ParseIP("192.0.2.1")); country != "" || as != 64500 {
+		t.Errorf("ASN only enricher returned %s AS%d", country, as)
+	}
+}
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
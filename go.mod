@@ -11,6 +11,7 @@ require (
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/ogier/pflag v0.0.1 // indirect
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6 // indirect
 	gopkg.in/hlandau/configurable.v1 v1.0.1 // indirect
 	gopkg.in/hlandau/easyconfig.v1 v1.0.17
@@ -0,0 +1,139 @@
+// Package lpm provides a longest prefix match table for IPv4 and IPv6 prefixes
+package lpm
+
+import (
+	"net"
+)
+
+// node is a path compressed trie node, only nodes holding a prefix have set
+type node struct {
+	key      [net.IPv6len]byte
+	length   int
+	children [2]*node
+	value    interface{}
+	set      bool
+}
+
+// Trie maps IP prefixes to values
+type Trie struct {
+	ipv4  *node
+	ipv6  *node
+	count int
+}
+
+func NewTrie() *Trie {
+	return &Trie{}
+}
+
+// bit returns the bit of key at position index, 0 being the most significant bit
+func bit(key *[net.IPv6len]byte, index int) int {
+	return int(key[index/8]>>(7-uint(index%8))) & 1
+}
+
+// commonLength returns the number of leading bits shared by a and b, up to max
+func commonLength(a *[net.IPv6len]byte, b *[net.IPv6len]byte, max int) int {
+	length := 0
+	for i := 0; length < max; i++ {
+		diff := a[i] ^ b[i]
+		if diff == 0 {
+			length += 8
+			continue
+		}
+		for diff&0x80 == 0 {
+			diff <<= 1
+			length++
+		}
+		break
+	}
+	if length > max {
+		return max
+	}
+	return length
+}
+
+func mask(key [net.IPv6len]byte, length int) [net.IPv6len]byte {
+	var masked [net.IPv6len]byte
+	full := length / 8
+	copy(masked[:full], key[:full])
+	if remainder := length % 8; remainder > 0 {
+		masked[full] = key[full] & (0xff << uint(8-remainder))
+	}
+	return masked
+}
+
+// toKey returns the address bits and the root of its family
+func (t *Trie) toKey(ip net.IP) (key [net.IPv6len]byte, root **node, bits int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4)
+		return key, &t.ipv4, 8 * net.IPv4len
+	}
+	copy(key[:], ip.To16())
+	return key, &t.ipv6, 8 * net.IPv6len
+}
+
+// Insert adds or replaces the value of a prefix
+func (t *Trie) Insert(prefix *net.IPNet, value interface{}) {
+	key, current, bits := t.toKey(prefix.IP)
+	length, maskBits := prefix.Mask.Size()
+	// IPv4 prefixes may come with an IPv6 mask
+	if maskBits != bits {
+		length -= maskBits - bits
+	}
+	if length < 0 {
+		return
+	}
+	key = mask(key, length)
+	for {
+		n := *current
+		if n == nil {
+			*current = &node{key: key, length: length, value: value, set: true}
+			t.count++
+			return
+		}
+		shortest := n.length
+		if length < shortest {
+			shortest = length
+		}
+		common := commonLength(&n.key, &key, shortest)
+		if common < n.length {
+			split := &node{key: mask(key, common), length: common}
+			split.children[bit(&n.key, common)] = n
+			*current = split
+			n = split
+		}
+		if n.length == length {
+			if !n.set {
+				t.count++
+			}
+			n.value, n.set = value, true
+			return
+		}
+		current = &n.children[bit(&key, n.length)]
+	}
+}
+
+// Lookup returns the value of the longest prefix holding ip and the length of this prefix
+func (t *Trie) Lookup(ip net.IP) (value interface{}, length int, found bool) {
+	if ip == nil {
+		return nil, 0, false
+	}
+	key, root, bits := t.toKey(ip)
+	for n := *root; n != nil; {
+		if n.length > bits || commonLength(&n.key, &key, n.length) < n.length {
+			break
+		}
+		if n.set {
+			value, length, found = n.value, n.length, true
+		}
+		if n.length == bits {
+			break
+		}
+		n = n.children[bit(&key, n.length)]
+	}
+	return value, length, found
+}
+
+// Len returns the number of prefixes in the trie
+func (t *Trie) Len() int {
+	return t.count
+}
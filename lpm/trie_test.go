@@ -0,0 +1,106 @@
+package lpm
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix
+}
+
+func TestOverlappingPrefixes(t *testing.T) {
+	prefixes := []string{"10.1.2.0/24", "10.0.0.0/8", "0.0.0.0/0", "10.1.0.0/16", "10.1.2.128/25", "10.1.3.0/24",
+		"2001:db8::/32", "2001:db8:1::/48", "::/0"}
+	trie := NewTrie()
+	for _, prefix := range prefixes {
+		trie.Insert(mustParseCIDR(t, prefix), prefix)
+	}
+	// Replacing a value does not add a prefix
+	trie.Insert(mustParseCIDR(t, "10.0.0.0/8"), "10.0.0.0/8")
+	if trie.Len() != len(prefixes) {
+		t.Errorf("%d prefixes, expected %d", trie.Len(), len(prefixes))
+	}
+	for _, c := range []struct {
+		address string
+		prefix  string
+		length  int
+	}{
+		{"10.1.2.3", "10.1.2.0/24", 24},
+		{"10.1.2.200", "10.1.2.128/25", 25},
+		{"10.1.3.1", "10.1.3.0/24", 24},
+		{"10.1.4.1", "10.1.0.0/16", 16},
+		{"10.2.0.1", "10.0.0.0/8", 8},
+		{"192.0.2.1", "0.0.0.0/0", 0},
+		{"2001:db8:1::1", "2001:db8:1::/48", 48},
+		{"2001:db8:2::1", "2001:db8::/32", 32},
+		{"2001:db9::1", "::/0", 0},
+		// IPv4-mapped addresses are looked up among the IPv4 prefixes
+		{"::ffff:10.1.2.3", "10.1.2.0/24", 24},
+	} {
+		value, length, found := trie.Lookup(net.ParseIP(c.address))
+		if !found || value != c.prefix || length != c.length {
+			t.Errorf("%s matched %v/%d (%t), expected %s", c.address, value, length, found, c.prefix)
+		}
+	}
+	if _, _, found := trie.Lookup(nil); found {
+		t.Error("nil address matched")
+	}
+}
+
+func TestIPv4MappedPrefixes(t *testing.T) {
+	trie := NewTrie()
+	// An IPv4 prefix written as an IPv4-mapped IPv6 prefix, or with a 16 bytes address and mask
+	trie.Insert(mustParseCIDR(t, "::ffff:198.51.100.0/120"), "mapped")
+	trie.Insert(&net.IPNet{IP: net.ParseIP("192.0.2.0"), Mask: net.CIDRMask(120, 128)}, "long mask")
+	for address, expected := range map[string]string{
+		"198.51.100.7":        "mapped",
+		"::ffff:198.51.100.7": "mapped",
+		"192.0.2.1":           "long mask",
+		"::ffff:c000:0201":    "long mask",
+	} {
+		if value, length, found := trie.Lookup(net.ParseIP(address)); !found || value != expected || length != 24 {
+			t.Errorf("%s matched %v/%d (%t), expected %s/24", address, value, length, found, expected)
+		}
+	}
+	if _, _, found := trie.Lookup(net.ParseIP("2001:db8::1")); found {
+		t.Error("IPv6 address matched an IPv4 prefix")
+	}
+}
+
+func TestRandomPrefixes(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	trie := NewTrie()
+	var prefixes []*net.IPNet
+	for i := 0; i < 500; i++ {
+		ip := make(net.IP, net.IPv4len)
+		random.Read(ip)
+		// Short prefixes in a small space overlap often
+		ip[0] &= 0x0f
+		prefix := &net.IPNet{IP: ip, Mask: net.CIDRMask(random.Intn(33), 32)}
+		prefix.IP = prefix.IP.Mask(prefix.Mask)
+		prefixes = append(prefixes, prefix)
+		trie.Insert(prefix, prefix.String())
+	}
+	for i := 0; i < 2000; i++ {
+		ip := make(net.IP, net.IPv4len)
+		random.Read(ip)
+		ip[0] &= 0x0f
+		expected, expectedLength := "", -1
+		for _, prefix := range prefixes {
+			if length, _ := prefix.Mask.Size(); prefix.Contains(ip) && length > expectedLength {
+				expected, expectedLength = prefix.String(), length
+			}
+		}
+		value, length, found := trie.Lookup(ip)
+		if found != (expectedLength >= 0) || (found && (value != expected || length != expectedLength)) {
+			t.Fatalf("%s matched %v/%d (%t), expected %s", ip, value, length, found, expected)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Package metrics exposes counters and gauges in the Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Default is the registry used by ripflow components
+var Default = NewRegistry()
+
+// Counter is a monotonic value
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Set mirrors a counter maintained elsewhere, like kernel statistics
+func (c *Counter) Set(n uint64) {
+	atomic.StoreUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	lock       sync.Mutex
+	values     map[string]interface{}
+}
+
+func (f *family) with(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	value, found := f.values[key]
+	if !found {
+		value = create()
+		f.values[key] = value
+	}
+	return value
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (f *family) write(w io.Writer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.metricType); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := ""
+		if len(f.labels) > 0 {
+			pairs := make([]string, len(f.labels))
+			for i, value := range strings.Split(key, "\xff") {
+				pairs[i] = fmt.Sprintf(`%s="%s"`, f.labels[i], escapeLabel(value))
+			}
+			labels = "{" + strings.Join(pairs, ",") + "}"
+		}
+		var err error
+		switch value := f.values[key].(type) {
+		case *Counter:
+			_, err = fmt.Fprintf(w, "%s%s %d\n", f.name, labels, value.Value())
+		case *Gauge:
+			_, err = fmt.Fprintf(w, "%s%s %g\n", f.name, labels, value.Value())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family) samples() []Sample {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	samples := make([]Sample, 0, len(f.values))
+	for key, raw := range f.values {
+		sample := Sample{Name: f.name, Labels: make(map[string]string, len(f.labels))}
+		if len(f.labels) > 0 {
+			for i, value := range strings.Split(key, "\xff") {
+				sample.Labels[f.labels[i]] = value
+			}
+		}
+		switch value := raw.(type) {
+		case *Counter:
+			sample.Value = float64(value.Value())
+		case *Gauge:
+			sample.Value = value.Value()
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// CounterVec is a set of counters distinguished by label values
+type CounterVec struct {
+	family *family
+}
+
+// With returns the counter for the label values, in the declaration order
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.family.with(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Delete forgets the counter for the label values
+func (v *CounterVec) Delete(values ...string) {
+	v.family.lock.Lock()
+	defer v.family.lock.Unlock()
+	delete(v.family.values, strings.Join(values, "\xff"))
+}
+
+// GaugeVec is a set of gauges distinguished by label values
+type GaugeVec struct {
+	family *family
+}
+
+// With returns the gauge for the label values, in the declaration order
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.family.with(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// Delete forgets the gauge for the label values
+func (v *GaugeVec) Delete(values ...string) {
+	v.family.lock.Lock()
+	defer v.family.lock.Unlock()
+	delete(v.family.values, strings.Join(values, "\xff"))
+}
+
+// Registry holds metric families and the hooks refreshing them before a scrape
+type Registry struct {
+	lock     sync.Mutex
+	families []*family
+	hooks    map[int]func()
+	nextHook int
+}
+
+func NewRegistry() *Registry {
+	return &Registry{hooks: make(map[int]func())}
+}
+
+func (r *Registry) register(name string, help string, metricType string, labels []string) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		values:     make(map[string]interface{}),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{family: r.register(name, help, "counter", labels)}
+}
+
+func (r *Registry) NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{family: r.register(name, help, "gauge", labels)}
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewGauge(name string, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// OnCollect registers a function called before each scrape, it returns a function removing the hook
+func (r *Registry) OnCollect(hook func()) func() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := r.nextHook
+	r.nextHook++
+	r.hooks[id] = hook
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.hooks, id)
+	}
+}
+
+// Sample is the value of a metric for one set of label values
+type Sample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// collect runs the collect hooks and returns the registered families
+func (r *Registry) collect() []*family {
+	r.lock.Lock()
+	hooks := make([]func(), 0, len(r.hooks))
+	for _, hook := range r.hooks {
+		hooks = append(hooks, hook)
+	}
+	families := append([]*family(nil), r.families...)
+	r.lock.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	return families
+}
+
+// Snapshot runs the collect hooks and returns the current value of every metric
+func (r *Registry) Snapshot() []Sample {
+	var samples []Sample
+	for _, f := range r.collect() {
+		samples = append(samples, f.samples()...)
+	}
+	return samples
+}
+
+// Write runs the collect hooks and writes every family in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	families := r.collect()
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry metrics over HTTP
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_ = r.Write(w)
+	})
+}
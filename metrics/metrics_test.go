@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	packets := registry.NewCounterVec("test_packets_total", "Captured packets", "interface")
+	packets.With("eth0").Add(42)
+	packets.With(`we"ird`).Inc()
+	flows := registry.NewGauge("test_flows", "Cached flows")
+	removeHook := registry.OnCollect(func() { flows.Set(2.5) })
+
+	recorder := httptest.NewRecorder()
+	Handler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if header := recorder.Header().Get("Content-Type"); header != contentType {
+		t.Errorf("content type %q", header)
+	}
+	body, _ := ioutil.ReadAll(recorder.Body)
+	expected := `# HELP test_packets_total Captured packets
+# TYPE test_packets_total counter
+test_packets_total{interface="eth0"} 42
+test_packets_total{interface="we\"ird"} 1
+# HELP test_flows Cached flows
+# TYPE test_flows gauge
+test_flows 2.5
+`
+	if string(body) != expected {
+		t.Errorf("exposition:\n%s\nexpected:\n%s", body, expected)
+	}
+
+	removeHook()
+	flows.Set(1)
+	packets.Delete("eth0")
+	var output strings.Builder
+	if err := registry.Write(&output); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output.String(), "eth0") || !strings.Contains(output.String(), "test_flows 1\n") {
+		t.Errorf("hook or deleted counter still used:\n%s", output.String())
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("test_errors_total", "Errors", "collector", "kind").With("a", "b").Add(3)
+	samples := registry.Snapshot()
+	if len(samples) != 1 || samples[0].Value != 3 || samples[0].Labels["collector"] != "a" || samples[0].Labels["kind"] != "b" {
+		t.Errorf("samples %+v", samples)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic with a missing label")
+		}
+	}()
+	registry.NewCounterVec("test_other_total", "Other", "collector", "kind").With("a")
+}
@@ -0,0 +1,289 @@
+// Package probe embeds the flow metering of ripflow in a Go program.
+// Packets of network interfaces or capture files are aggregated in a flow cache,
+// and the expired flows are sent to sinks and to a callback.
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/flow"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+const (
+	DefaultMaxFlows      = 65536
+	DefaultIdleTimeout   = 15
+	DefaultActiveTimeout = 1800
+)
+
+// Source is a network interface or a capture file
+type Source struct {
+	Interface    string // Network interface name
+	File         string // pcap or pcapng file, read instead of an interface
+	Realtime     bool   // Pace the packets of the file according to their timestamps
+	Filter       string // BPF filter
+	SamplingRate uint32 // Account one packet out of SamplingRate (disabled below 2)
+	SamplingMode uint8  // flow.SamplingDeterministic (default) or flow.SamplingRandom
+	Backend      string // pcap (default) or afpacket (Linux only)
+	Workers      int    // AF_PACKET sockets reading the interface (default: 1)
+	// Tunnel types, such as flow.TunnelVXLAN, whose inner packets are accounted instead of the tunnel
+	Decapsulation []uint8
+}
+
+// CacheOptions sizes the flow cache, zero values select the defaults
+type CacheOptions struct {
+	MaxFlows      uint32
+	IdleTimeout   uint32 // Seconds without packets before a flow expires
+	ActiveTimeout uint32 // Seconds before a long flow is exported and restarted
+	Bidirectional bool   // Keep both directions in one flow (RFC 5103 biflows)
+}
+
+// Destination sends the matching expired flows to a sink
+type Destination struct {
+	Name         string
+	Sink         flow.Sink
+	Filter       flow.FlowFilter
+	SamplingRate uint32        // Send one flow out of SamplingRate (disabled below 2)
+	Anonymizer   flow.Enricher // Applied to the flows of this destination only (optional)
+}
+
+type Options struct {
+	Sources      []Source
+	Cache        CacheOptions
+	Enrichers    []flow.Enricher // Applied in order to each expired flow
+	Destinations []Destination
+	// OnExpire is called with each expired flow, from its own goroutine
+	OnExpire func(flow.Record)
+}
+
+// Probe meters the flows of its sources
+type Probe struct {
+	cache    *flow.Cache
+	fanout   *flow.Fanout
+	captures []*flow.PacketHandler
+	queues   []*flow.SinkQueue
+	files    bool
+	replayed chan struct{} // Closed once the capture files are read, nil before Start
+	stop     chan struct{}
+}
+
+// callbackSink calls the OnExpire callback with each flow
+type callbackSink struct {
+	callback func(flow.Record)
+}
+
+func (s *callbackSink) Start() error {
+	return nil
+}
+
+func (s *callbackSink) Stop() error {
+	return nil
+}
+
+func (s *callbackSink) Flush() error {
+	return nil
+}
+
+func (s *callbackSink) WriteBatch(flows []flow.Flow) error {
+	for i := range flows {
+		s.callback(flows[i].Record())
+	}
+	return nil
+}
+
+func (c *CacheOptions) setDefaults() {
+	if c.MaxFlows == 0 {
+		c.MaxFlows = DefaultMaxFlows
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+	if c.ActiveTimeout == 0 {
+		c.ActiveTimeout = DefaultActiveTimeout
+	}
+}
+
+func New(options Options, logger *log.Entry) (*Probe, error) {
+	if len(options.Sources) == 0 {
+		return nil, errors.New("no packet source")
+	}
+	files := 0
+	for _, source := range options.Sources {
+		if len(source.File) > 0 {
+			files++
+		}
+	}
+	if files > 0 && files < len(options.Sources) {
+		// The cache follows either the packet timestamps or the wall clock
+		return nil, errors.New("capture files and interfaces cannot be mixed")
+	}
+	options.Cache.setDefaults()
+	p := &Probe{
+		fanout: flow.NewFanout(options.Cache.MaxFlows, logger),
+		files:  files > 0,
+		stop:   make(chan struct{}),
+	}
+	p.fanout.SetEnrichers(options.Enrichers...)
+	destinations := options.Destinations
+	if options.OnExpire != nil {
+		// The empty name cannot collide with the named destinations
+		destinations = append(destinations, Destination{Sink: &callbackSink{callback: options.OnExpire}})
+	}
+	names := make(map[string]bool)
+	for index, destination := range destinations {
+		if index < len(options.Destinations) && len(destination.Name) == 0 {
+			return nil, errors.New("destination without name")
+		}
+		if names[destination.Name] {
+			return nil, fmt.Errorf("duplicate destination name %s", destination.Name)
+		}
+		names[destination.Name] = true
+		queue := flow.NewSinkQueue(destination.Sink, options.Cache.MaxFlows, destination.Anonymizer, logger.WithField("collector", destination.Name))
+		if _, err := p.fanout.SetDestination(destination.Name, queue, destination.Filter, destination.SamplingRate); err != nil {
+			return nil, err
+		}
+		p.queues = append(p.queues, queue)
+	}
+	var err error
+	p.cache, err = flow.NewCache(options.Cache.MaxFlows, options.Cache.IdleTimeout, options.Cache.ActiveTimeout, p.fanout.Input, logger)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.UseBiflows(options.Cache.Bidirectional)
+	if files > 0 {
+		p.cache.UsePacketTime()
+	}
+	for _, source := range options.Sources {
+		capture, err := p.newCapture(source, logger)
+		if err != nil {
+			for _, opened := range p.captures {
+				opened.Close()
+			}
+			return nil, err
+		}
+		p.captures = append(p.captures, capture)
+	}
+	return p, nil
+}
+
+func (p *Probe) newCapture(source Source, logger *log.Entry) (*flow.PacketHandler, error) {
+	var capture *flow.PacketHandler
+	var err error
+	switch {
+	case len(source.File) > 0:
+		capture, err = flow.NewFileHandler(source.File, source.Realtime, p.cache.Input, logger)
+	case len(source.Interface) > 0:
+		var iface *net.Interface
+		if iface, err = flow.InterfaceByName(source.Interface); err != nil {
+			return nil, err
+		}
+		if source.Backend == "afpacket" {
+			workers := source.Workers
+			if workers < 1 {
+				workers = 1
+			}
+			capture, err = flow.NewAFPacketHandler(iface, workers, p.cache.Input, logger)
+		} else {
+			capture, err = flow.NewHandler(iface, p.cache.Input, logger)
+		}
+	default:
+		return nil, errors.New("source without interface or file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(source.Filter) > 0 {
+		if err := capture.SetFilter(source.Filter); err != nil {
+			capture.Close()
+			return nil, fmt.Errorf("cannot set BPF filter %s: %s", source.Filter, err)
+		}
+	}
+	if err := capture.SetDecapsulation(source.Decapsulation...); err != nil {
+		capture.Close()
+		return nil, err
+	}
+	if source.SamplingRate > 1 {
+		algorithm := source.SamplingMode
+		if algorithm == 0 {
+			algorithm = flow.SamplingDeterministic
+		}
+		if err := capture.SetSampling(algorithm, source.SamplingRate); err != nil {
+			capture.Close()
+			return nil, err
+		}
+	}
+	return capture, nil
+}
+
+func (p *Probe) Start() error {
+	for _, queue := range p.queues {
+		if err := queue.Start(); err != nil {
+			return err
+		}
+	}
+	if err := p.fanout.Start(); err != nil {
+		return err
+	}
+	if err := p.cache.Start(); err != nil {
+		return err
+	}
+	if p.files {
+		// Capture files are read one after another, they may cover different periods
+		p.replayed = make(chan struct{})
+		go func() {
+			defer close(p.replayed)
+			_ = flow.ReplayFiles(p.cache, p.captures, p.stop)
+		}()
+		return nil
+	}
+	for _, capture := range p.captures {
+		if err := capture.Start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop closes the sources and sends every cached flow to the destinations before stopping them
+func (p *Probe) Stop() error {
+	if p.replayed != nil {
+		close(p.stop)
+		<-p.replayed
+	}
+	for _, capture := range p.captures {
+		_ = capture.Stop()
+	}
+	_ = p.cache.Stop()
+	_ = p.fanout.Stop()
+	for _, queue := range p.queues {
+		_ = queue.Stop()
+	}
+	return nil
+}
+
+// Wait returns once every capture file is read, it never returns with network interfaces
+func (p *Probe) Wait() {
+	if p.replayed != nil {
+		<-p.replayed
+		return
+	}
+	for _, capture := range p.captures {
+		<-capture.Done
+	}
+}
+
+// Flows returns a copy of the active flows matching the query
+func (p *Probe) Flows(query flow.FlowQuery) []flow.Record {
+	flows := p.cache.Query(query)
+	records := make([]flow.Record, len(flows))
+	for i := range flows {
+		records[i] = flows[i].Record()
+	}
+	return records
+}
+
+// Expire sends every active flow to the destinations and returns their number
+func (p *Probe) Expire() int {
+	return p.cache.ExpireAll()
+}
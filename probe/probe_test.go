@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+)
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+// nullSink drops the flows
+type nullSink struct{}
+
+func (nullSink) Start() error                       { return nil }
+func (nullSink) Stop() error                        { return nil }
+func (nullSink) Flush() error                       { return nil }
+func (nullSink) WriteBatch(flows []flow.Flow) error { return nil }
+
+// writeCapture writes a pcap file of UDP datagrams from two clients to a DNS server
+func writeCapture(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ripflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "dns.pcap")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, client := range []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)} {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: client, DstIP: net.IPv4(198, 51, 100, 53)}
+		udp := &layers.UDP{SrcPort: 5000, DstPort: 53}
+		_ = udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload("query")); err != nil {
+			t.Fatal(err)
+		}
+		info := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Second), CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		if err := writer.WritePacket(info, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestOptions(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		options Options
+	}{
+		{"no source", Options{}},
+		{"files and interfaces", Options{Sources: []Source{{File: "a.pcap"}, {Interface: "lo"}}}},
+		{"empty source", Options{Sources: []Source{{}}}},
+		{"destination without name", Options{Sources: []Source{{File: "a.pcap"}}, Destinations: []Destination{{Sink: nullSink{}}}}},
+		{"duplicate destination", Options{Sources: []Source{{File: "a.pcap"}},
+			Destinations: []Destination{{Name: "a", Sink: nullSink{}}, {Name: "a", Sink: nullSink{}}}}},
+		{"missing file", Options{Sources: []Source{{File: "/nonexistent/a.pcap"}}}},
+	} {
+		if _, err := New(c.options, testLogger()); err == nil {
+			t.Errorf("%s accepted", c.name)
+		}
+	}
+	defaults := CacheOptions{ActiveTimeout: 60}
+	defaults.setDefaults()
+	if defaults.MaxFlows != DefaultMaxFlows || defaults.IdleTimeout != DefaultIdleTimeout || defaults.ActiveTimeout != 60 {
+		t.Errorf("cache options %+v", defaults)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var records []flow.Record
+	var lock sync.Mutex
+	p, err := New(Options{
+		Sources: []Source{{File: writeCapture(t)}},
+		OnExpire: func(record flow.Record) {
+			lock.Lock()
+			defer lock.Unlock()
+			records = append(records, record)
+		},
+	}, testLogger())
+	if err != nil {
+		t.Skipf("cannot read capture files: %s", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.Wait()
+	if active := p.Flows(flow.FlowQuery{}); len(active) != 0 {
+		t.Errorf("%d flows still active at the end of the file", len(active))
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(records) != 2 {
+		t.Fatalf("%d flows expired, expected one per client", len(records))
+	}
+	packets := make(map[string]uint64)
+	for _, record := range records {
+		packets[record.SourceIP.String()] = record.Packets
+		if record.EndReason != flow.EndReasonForceEnd || record.DestinationPort != 53 {
+			t.Errorf("flow to port %d ended by %d", record.DestinationPort, record.EndReason)
+		}
+	}
+	if packets["192.0.2.1"] != 2 || packets["192.0.2.2"] != 1 {
+		t.Errorf("packets by client: %v", packets)
+	}
+}
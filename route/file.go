@@ -0,0 +1,115 @@
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readRouteFile reads a snapshot of the routing table in the "ip route show" format, like
+// "10.0.0.0/8 via 192.0.2.1 dev eth0" or "default via 2001:db8::1 dev eth1 metric 1024".
+// Interfaces are resolved by name, unknown interfaces may be given by index with "ifindex".
+func readRouteFile(path string) ([]Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var routes []Route
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		route, err := parseRoute(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, line, err)
+		}
+		if route != nil {
+			routes = append(routes, *route)
+		}
+	}
+	return routes, scanner.Err()
+}
+
+// parseRoute returns nil for non unicast routes
+func parseRoute(fields []string) (*Route, error) {
+	switch fields[0] {
+	case "unicast":
+		fields = fields[1:]
+	case "blackhole", "unreachable", "prohibit", "local", "broadcast", "multicast", "throw", "anycast":
+		return nil, nil
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing prefix")
+	}
+	route := &Route{}
+	var err error
+	route.Prefix, err = parsePrefix(fields[0], fields)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			i++
+			// "via inet6 fe80::1" is used for IPv4 routes through IPv6 next hops
+			if (fields[i] == "inet" || fields[i] == "inet6") && i+1 < len(fields) {
+				i++
+			}
+			route.NextHop = net.ParseIP(fields[i])
+			if route.NextHop == nil {
+				return nil, fmt.Errorf("invalid next hop %s", fields[i])
+			}
+		case "dev":
+			i++
+			if iface, err := net.InterfaceByName(fields[i]); err == nil {
+				route.OutputInterface = uint32(iface.Index)
+			}
+		case "ifindex":
+			i++
+			index, err := strconv.ParseUint(fields[i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interface index %s", fields[i])
+			}
+			route.OutputInterface = uint32(index)
+		}
+	}
+	return route, nil
+}
+
+func parsePrefix(prefix string, fields []string) (*net.IPNet, error) {
+	if prefix == "default" {
+		// The family of the default route is the family of its next hop,
+		// "via inet6" only appears in IPv4 routes
+		for i := 1; i+1 < len(fields); i++ {
+			if fields[i] != "via" {
+				continue
+			}
+			if ip := net.ParseIP(fields[i+1]); ip != nil && ip.To4() == nil {
+				return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, nil
+			}
+		}
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, nil
+	}
+	if !strings.Contains(prefix, "/") {
+		ip := net.ParseIP(prefix)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid prefix %s", prefix)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(prefix)
+	return network, err
+}
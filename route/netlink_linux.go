@@ -0,0 +1,115 @@
+package route
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	rtNexthopSize = 8 // struct rtnexthop
+	rtAttrSize    = 4 // struct rtattr
+)
+
+// readNetlinkRoutes dumps the unicast routes of the main kernel routing table
+func readNetlinkRoutes() ([]Route, error) {
+	var routes []Route
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			if route, ok := parseRouteMessage(&messages[i]); ok {
+				routes = append(routes, route)
+			}
+		}
+	}
+	return routes, nil
+}
+
+func parseRouteMessage(message *syscall.NetlinkMessage) (Route, bool) {
+	var route Route
+	if message.Header.Type != syscall.RTM_NEWROUTE || len(message.Data) < syscall.SizeofRtMsg {
+		return route, false
+	}
+	// struct rtmsg: family, dst_len, src_len, tos, table, protocol, scope, type, flags
+	family := message.Data[0]
+	prefixLength := int(message.Data[1])
+	table := uint32(message.Data[4])
+	routeType := message.Data[7]
+	if routeType != syscall.RTN_UNICAST {
+		return route, false
+	}
+	bits := 8 * net.IPv4len
+	if family == syscall.AF_INET6 {
+		bits = 8 * net.IPv6len
+	}
+	attributes, err := syscall.ParseNetlinkRouteAttr(message)
+	if err != nil {
+		return route, false
+	}
+	destination := make(net.IP, bits/8)
+	for _, attribute := range attributes {
+		switch attribute.Attr.Type {
+		case syscall.RTA_TABLE:
+			if len(attribute.Value) >= 4 {
+				table = nativeEndian.Uint32(attribute.Value)
+			}
+		case syscall.RTA_DST:
+			copy(destination, attribute.Value)
+		case syscall.RTA_GATEWAY:
+			route.NextHop = net.IP(append([]byte(nil), attribute.Value...))
+		case syscall.RTA_OIF:
+			if len(attribute.Value) >= 4 {
+				route.OutputInterface = nativeEndian.Uint32(attribute.Value)
+			}
+		case syscall.RTA_MULTIPATH:
+			route.NextHop, route.OutputInterface = firstNexthop(attribute.Value)
+		}
+	}
+	if table != syscall.RT_TABLE_MAIN {
+		return route, false
+	}
+	route.Prefix = &net.IPNet{IP: destination, Mask: net.CIDRMask(prefixLength, bits)}
+	return route, true
+}
+
+// firstNexthop returns the gateway and interface of the first path of a multipath route
+func firstNexthop(value []byte) (net.IP, uint32) {
+	if len(value) < rtNexthopSize {
+		return nil, 0
+	}
+	// struct rtnexthop: len, flags, hops, ifindex, followed by attributes
+	length := int(nativeEndian.Uint16(value))
+	ifIndex := nativeEndian.Uint32(value[4:])
+	if length > len(value) {
+		length = len(value)
+	}
+	for offset := rtNexthopSize; offset+rtAttrSize <= length; {
+		attributeLength := int(nativeEndian.Uint16(value[offset:]))
+		attributeType := nativeEndian.Uint16(value[offset+2:])
+		if attributeLength < rtAttrSize || offset+attributeLength > length {
+			break
+		}
+		if attributeType == syscall.RTA_GATEWAY {
+			return net.IP(append([]byte(nil), value[offset+rtAttrSize:offset+attributeLength]...)), ifIndex
+		}
+		offset += (attributeLength + 3) &^ 3
+	}
+	return nil, ifIndex
+}
+
+// nativeEndian is the host byte order used by netlink
+var nativeEndian = func() binary.ByteOrder {
+	probe := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&probe))[0] == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
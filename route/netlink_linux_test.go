@@ -0,0 +1,127 @@
+package route
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// routeAttribute encodes a struct rtattr and its padded value
+func routeAttribute(attributeType uint16, value []byte) []byte {
+	attribute := make([]byte, rtAttrSize, rtAttrSize+len(value)+3)
+	nativeEndian.PutUint16(attribute, uint16(rtAttrSize+len(value)))
+	nativeEndian.PutUint16(attribute[2:], attributeType)
+	attribute = append(attribute, value...)
+	return append(attribute, make([]byte, (4-len(value)%4)%4)...)
+}
+
+func nativeUint32(value uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, value)
+	return b
+}
+
+// routeMessage encodes a RTM_NEWROUTE message of the main table
+func routeMessage(family byte, prefixLength byte, routeType byte, attributes ...[]byte) *syscall.NetlinkMessage {
+	data := make([]byte, syscall.SizeofRtMsg)
+	data[0], data[1], data[4], data[7] = family, prefixLength, syscall.RT_TABLE_MAIN, routeType
+	for _, attribute := range attributes {
+		data = append(data, attribute...)
+	}
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.SizeofNlMsghdr + len(data)), Type: syscall.RTM_NEWROUTE},
+		Data:   data,
+	}
+}
+
+func TestParseRouteMessage(t *testing.T) {
+	// struct rtnexthop of two paths, the first one through 192.0.2.1 on interface 3
+	multipath := make([]byte, rtNexthopSize)
+	gateway := routeAttribute(syscall.RTA_GATEWAY, net.IPv4(192, 0, 2, 1).To4())
+	nativeEndian.PutUint16(multipath, uint16(rtNexthopSize+len(gateway)))
+	nativeEndian.PutUint32(multipath[4:], 3)
+	multipath = append(multipath, gateway...)
+	second := make([]byte, rtNexthopSize)
+	nativeEndian.PutUint16(second, rtNexthopSize)
+	nativeEndian.PutUint32(second[4:], 4)
+	multipath = append(multipath, second...)
+
+	otherTable := routeMessage(syscall.AF_INET, 8, syscall.RTN_UNICAST,
+		routeAttribute(syscall.RTA_DST, []byte{10, 0, 0, 0}), routeAttribute(syscall.RTA_TABLE, nativeUint32(100)))
+	short := routeMessage(syscall.AF_INET, 0, syscall.RTN_UNICAST)
+	short.Data = short.Data[:4]
+	notRoute := routeMessage(syscall.AF_INET, 0, syscall.RTN_UNICAST)
+	notRoute.Header.Type = syscall.RTM_NEWADDR
+
+	for _, c := range []struct {
+		name    string
+		message *syscall.NetlinkMessage
+		prefix  string
+		nextHop net.IP
+		ifIndex uint32
+		ok      bool
+	}{
+		{"gateway", routeMessage(syscall.AF_INET, 24, syscall.RTN_UNICAST,
+			routeAttribute(syscall.RTA_DST, []byte{198, 51, 100, 0}),
+			routeAttribute(syscall.RTA_GATEWAY, []byte{192, 0, 2, 254}),
+			routeAttribute(syscall.RTA_OIF, nativeUint32(2))), "198.51.100.0/24", net.IPv4(192, 0, 2, 254), 2, true},
+		{"default", routeMessage(syscall.AF_INET6, 0, syscall.RTN_UNICAST,
+			routeAttribute(syscall.RTA_GATEWAY, net.ParseIP("fe80::1")),
+			routeAttribute(syscall.RTA_OIF, nativeUint32(5))), "::/0", net.ParseIP("fe80::1"), 5, true},
+		{"connected", routeMessage(syscall.AF_INET6, 64, syscall.RTN_UNICAST,
+			routeAttribute(syscall.RTA_DST, net.ParseIP("2001:db8::")),
+			routeAttribute(syscall.RTA_OIF, nativeUint32(6))), "2001:db8::/64", nil, 6, true},
+		{"multipath", routeMessage(syscall.AF_INET, 16, syscall.RTN_UNICAST,
+			routeAttribute(syscall.RTA_DST, []byte{172, 16, 0, 0}),
+			routeAttribute(syscall.RTA_MULTIPATH, multipath)), "172.16.0.0/16", net.IPv4(192, 0, 2, 1), 3, true},
+		{"main table attribute", routeMessage(syscall.AF_INET, 8, syscall.RTN_UNICAST,
+			routeAttribute(syscall.RTA_DST, []byte{10, 0, 0, 0}),
+			routeAttribute(syscall.RTA_TABLE, nativeUint32(syscall.RT_TABLE_MAIN))), "10.0.0.0/8", nil, 0, true},
+		{"other table", otherTable, "", nil, 0, false},
+		{"local", routeMessage(syscall.AF_INET, 32, syscall.RTN_LOCAL, routeAttribute(syscall.RTA_DST, []byte{127, 0, 0, 1})), "", nil, 0, false},
+		{"blackhole", routeMessage(syscall.AF_INET, 8, syscall.RTN_BLACKHOLE, routeAttribute(syscall.RTA_DST, []byte{10, 0, 0, 0})), "", nil, 0, false},
+		{"short", short, "", nil, 0, false},
+		{"not a route", notRoute, "", nil, 0, false},
+	} {
+		route, ok := parseRouteMessage(c.message)
+		if ok != c.ok {
+			t.Errorf("%s: parsed %t, expected %t", c.name, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if route.Prefix.String() != c.prefix || !route.NextHop.Equal(c.nextHop) || route.OutputInterface != c.ifIndex {
+			t.Errorf("%s: %s via %s on %d, expected %s via %s on %d", c.name,
+				route.Prefix, route.NextHop, route.OutputInterface, c.prefix, c.nextHop, c.ifIndex)
+		}
+	}
+}
+
+func TestFirstNexthop(t *testing.T) {
+	if nextHop, ifIndex := firstNexthop([]byte{1, 2, 3}); nextHop != nil || ifIndex != 0 {
+		t.Errorf("truncated next hop parsed as %s on %d", nextHop, ifIndex)
+	}
+	// The attribute length exceeds the next hop
+	value := make([]byte, rtNexthopSize)
+	nativeEndian.PutUint16(value, rtNexthopSize+8)
+	nativeEndian.PutUint32(value[4:], 9)
+	attribute := routeAttribute(syscall.RTA_GATEWAY, []byte{192, 0, 2, 1})
+	nativeEndian.PutUint16(attribute, 12)
+	value = append(value, attribute...)
+	if nextHop, ifIndex := firstNexthop(value); nextHop != nil || ifIndex != 9 {
+		t.Errorf("invalid gateway attribute parsed as %s on %d", nextHop, ifIndex)
+	}
+}
+
+func TestReadNetlinkRoutes(t *testing.T) {
+	routes, err := readNetlinkRoutes()
+	if err != nil {
+		t.Skipf("cannot dump the routes: %s", err)
+	}
+	for _, route := range routes {
+		if route.Prefix == nil {
+			t.Errorf("route without prefix: %+v", route)
+		}
+	}
+}
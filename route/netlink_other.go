@@ -0,0 +1,9 @@
+// +build !linux
+
+package route
+
+import "errors"
+
+func readNetlinkRoutes() ([]Route, error) {
+	return nil, errors.New("netlink routes are only available on Linux, use a route file")
+}
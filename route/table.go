@@ -0,0 +1,148 @@
+// Package route resolves the next hop and output interface of flows from the routing table
+package route
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/lpm"
+	lru "github.com/hashicorp/golang-lru"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	SourceNetlink = "netlink"
+	SourceFile    = "file"
+)
+
+// Route is a unicast route of the routing table
+type Route struct {
+	Prefix          *net.IPNet
+	NextHop         net.IP // nil for directly connected networks
+	OutputInterface uint32
+}
+
+type lookupResult struct {
+	route        *Route
+	prefixLength uint8
+}
+
+// Table holds a snapshot of the routing table, refreshed periodically
+type Table struct {
+	source          string
+	path            string
+	refreshInterval time.Duration
+	trie            *lpm.Trie
+	cache           *lru.Cache // Lookup results of trie by destination address, replaced with it
+	cacheSize       int
+	killSwitch      chan int
+	lock            sync.RWMutex
+	log             *log.Entry
+}
+
+// NewTable loads the kernel routes over netlink or the routes of a snapshot file
+func NewTable(source string, path string, refreshInterval time.Duration, cacheSize int, logger *log.Entry) (*Table, error) {
+	if source != SourceNetlink && source != SourceFile {
+		return nil, fmt.Errorf("unknown route source %s", source)
+	}
+	table := &Table{
+		source:          source,
+		path:            path,
+		refreshInterval: refreshInterval,
+		cacheSize:       cacheSize,
+		killSwitch:      make(chan int, 0),
+		log:             logger.WithField("component", "route"),
+	}
+	if err := table.load(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (t *Table) load() error {
+	var routes []Route
+	var err error
+	if t.source == SourceNetlink {
+		routes, err = readNetlinkRoutes()
+	} else {
+		routes, err = readRouteFile(t.path)
+	}
+	if err != nil {
+		return err
+	}
+	// Lookups running on the previous trie fill the previous cache
+	cache, err := lru.New(t.cacheSize)
+	if err != nil {
+		return err
+	}
+	trie := lpm.NewTrie()
+	for i := range routes {
+		trie.Insert(routes[i].Prefix, &routes[i])
+	}
+	t.lock.Lock()
+	t.trie, t.cache = trie, cache
+	t.lock.Unlock()
+	t.log.Debugf("Loaded %d routes", trie.Len())
+	return nil
+}
+
+// Lookup returns the route to ip and its prefix length
+func (t *Table) Lookup(ip net.IP) (*Route, uint8, bool) {
+	if ip == nil {
+		return nil, 0, false
+	}
+	t.lock.RLock()
+	trie, cache := t.trie, t.cache
+	t.lock.RUnlock()
+	key := string(ip.To16())
+	if cached, found := cache.Get(key); found {
+		result := cached.(lookupResult)
+		return result.route, result.prefixLength, result.route != nil
+	}
+	var result lookupResult
+	if value, length, found := trie.Lookup(ip); found {
+		result = lookupResult{route: value.(*Route), prefixLength: uint8(length)}
+	}
+	// Unrouted destinations are cached too
+	cache.Add(key, result)
+	return result.route, result.prefixLength, result.route != nil
+}
+
+// Enrich sets the next hop, output interface and prefix length of the flow destination
+func (t *Table) Enrich(f *flow.Flow) {
+	if route, length, found := t.Lookup(f.DestinationIP()); found {
+		f.SetRoute(route.NextHop, route.OutputInterface, length)
+	}
+}
+
+func (t *Table) Listen() {
+	ticker := time.NewTicker(t.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.killSwitch:
+			t.log.Info("Received a listener kill switch")
+			return
+		case <-ticker.C:
+			if err := t.load(); err != nil {
+				t.log.Errorf("Cannot refresh routes, keeping the previous ones: %s", err)
+			}
+		}
+	}
+}
+
+func (t *Table) Start() error {
+	if t.refreshInterval > 0 {
+		go t.Listen()
+	}
+	return nil
+}
+
+func (t *Table) Stop() error {
+	if t.refreshInterval > 0 {
+		t.killSwitch <- 1
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package route
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+func writeRoutes(t *testing.T, path string, routes string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(routes), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, c := range []struct {
+		line    string
+		prefix  string
+		nextHop net.IP
+		ifIndex uint32
+	}{
+		{"default via 192.0.2.1 dev nonexistent0 proto dhcp metric 100", "0.0.0.0/0", net.IPv4(192, 0, 2, 1), 0},
+		{"default via 2001:db8::1 ifindex 3 metric 1024 pref medium", "::/0", net.ParseIP("2001:db8::1"), 3},
+		{"unicast 10.0.0.0/8 via 192.0.2.2 ifindex 4", "10.0.0.0/8", net.IPv4(192, 0, 2, 2), 4},
+		{"10.1.0.0/16 via inet6 fe80::1 ifindex 5", "10.1.0.0/16", net.ParseIP("fe80::1"), 5},
+		{"198.51.100.7 ifindex 2 scope link", "198.51.100.7/32", nil, 2},
+		{"2001:db8:1::/48 ifindex 6", "2001:db8:1::/48", nil, 6},
+	} {
+		route, err := parseRoute(strings.Fields(c.line))
+		if err != nil || route == nil {
+			t.Errorf("%s: %v", c.line, err)
+			continue
+		}
+		if route.Prefix.String() != c.prefix || !route.NextHop.Equal(c.nextHop) || route.OutputInterface != c.ifIndex {
+			t.Errorf("%s: %s via %s on %d", c.line, route.Prefix, route.NextHop, route.OutputInterface)
+		}
+	}
+	for _, line := range []string{"blackhole 10.0.0.0/8", "local 127.0.0.1 dev lo", "unreachable 2001:db8::/32"} {
+		if route, err := parseRoute(strings.Fields(line)); route != nil || err != nil {
+			t.Errorf("%s: route %v, error %v", line, route, err)
+		}
+	}
+	for _, line := range []string{"10.0.0.0/33 ifindex 2", "nonsense via 192.0.2.1", "10.0.0.0/8 via nowhere", "10.0.0.0/8 ifindex eth0", "unicast"} {
+		if _, err := parseRoute(strings.Fields(line)); err == nil {
+			t.Errorf("%s accepted", line)
+		}
+	}
+}
+
+func TestTableReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ripflow-route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "routes")
+	writeRoutes(t, path, "# ip route show\ndefault via 192.0.2.1 ifindex 2\n198.51.100.0/24 via 192.0.2.2 ifindex 3\n")
+	table, err := NewTable(SourceFile, path, 0, 16, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := net.ParseIP("198.51.100.10")
+	if route, length, found := table.Lookup(destination); !found || length != 24 || !route.NextHop.Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Fatalf("route %+v/%d (%t)", route, length, found)
+	}
+	if _, _, found := table.Lookup(net.ParseIP("2001:db8::1")); found {
+		t.Error("IPv6 destination routed without IPv6 route")
+	}
+	writeRoutes(t, path, "default via 192.0.2.1 ifindex 2\n198.51.100.0/25 via 192.0.2.3 ifindex 4\n2001:db8::/32 ifindex 5\n")
+	if err := table.load(); err != nil {
+		t.Fatal(err)
+	}
+	// The cached lookups of the previous routes are forgotten
+	if route, length, found := table.Lookup(destination); !found || length != 25 || route.OutputInterface != 4 {
+		t.Errorf("route after reload %+v/%d (%t)", route, length, found)
+	}
+	if route, _, found := table.Lookup(net.ParseIP("2001:db8::1")); !found || route.OutputInterface != 5 {
+		t.Errorf("IPv6 route after reload %+v (%t)", route, found)
+	}
+
+	// Lookups running during reloads never see the routes of the previous file once loaded
+	var lookups sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		lookups.Add(1)
+		go func() {
+			defer lookups.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					table.Lookup(destination)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		nextHop := net.IPv4(192, 0, 2, byte(10+i))
+		writeRoutes(t, path, "198.51.100.0/24 via "+nextHop.String()+" ifindex 2\n")
+		if err := table.load(); err != nil {
+			t.Fatal(err)
+		}
+		if route, _, found := table.Lookup(destination); !found || !route.NextHop.Equal(nextHop) {
+			close(stop)
+			t.Fatalf("stale route after reload %d: %+v", i, route)
+		}
+	}
+	close(stop)
+	lookups.Wait()
+
+	if _, err := NewTable("bgp", path, 0, 16, testLogger()); err == nil {
+		t.Error("unknown source accepted")
+	}
+	if _, err := NewTable(SourceFile, path, 0, 0, testLogger()); err == nil {
+		t.Error("empty cache accepted")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/control"
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/metrics"
+	log "github.com/sirupsen/logrus"
+	"net"
+)
+
+// flowsArguments are the arguments of the flows command
+type flowsArguments struct {
+	Address   string `json:"address,omitempty"`
+	Port      uint16 `json:"port,omitempty"`
+	Protocol  uint8  `json:"protocol,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Sort      string `json:"sort,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+type logLevelArguments struct {
+	Level string `json:"level"`
+}
+
+func decodeArguments(raw json.RawMessage, arguments interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, arguments); err != nil {
+		return fmt.Errorf("invalid arguments: %s", err)
+	}
+	return nil
+}
+
+func (d *Daemon) listFlows(raw json.RawMessage) (interface{}, error) {
+	var arguments flowsArguments
+	if err := decodeArguments(raw, &arguments); err != nil {
+		return nil, err
+	}
+	query := flow.FlowQuery{
+		Port:     arguments.Port,
+		Protocol: arguments.Protocol,
+		SortBy:   arguments.Sort,
+		Limit:    arguments.Limit,
+	}
+	switch arguments.Sort {
+	case "", "octets", "packets", "start", "end":
+	default:
+		return nil, fmt.Errorf("unknown sort order %s", arguments.Sort)
+	}
+	if len(arguments.Address) > 0 {
+		if query.Address = net.ParseIP(arguments.Address); query.Address == nil {
+			return nil, fmt.Errorf("invalid address %s", arguments.Address)
+		}
+	}
+	if len(arguments.Interface) > 0 {
+		iface, err := flow.InterfaceByName(arguments.Interface)
+		if err != nil {
+			return nil, err
+		}
+		query.Interface = uint16(iface.Index)
+	}
+	flows := d.Cache.Query(query)
+	if flows == nil {
+		flows = []flow.Flow{}
+	}
+	return flows, nil
+}
+
+func (d *Daemon) statistics(json.RawMessage) (interface{}, error) {
+	return metrics.Default.Snapshot(), nil
+}
+
+func (d *Daemon) expireFlows(json.RawMessage) (interface{}, error) {
+	count := d.Cache.ExpireAll()
+	d.logger().Infof("%d flows expired from the control socket", count)
+	return count, nil
+}
+
+func (d *Daemon) setLogLevel(raw json.RawMessage) (interface{}, error) {
+	var arguments logLevelArguments
+	if err := decodeArguments(raw, &arguments); err != nil {
+		return nil, err
+	}
+	level, err := log.ParseLevel(arguments.Level)
+	if err != nil {
+		return nil, err
+	}
+	// The configuration is replaced by reloads
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.Configuration.Log.Logger.SetLevel(level)
+	d.Configuration.Log.Infof("Log level set to %s from the control socket", level)
+	return level.String(), nil
+}
+
+func (d *Daemon) reloadFromControl(json.RawMessage) (interface{}, error) {
+	d.logger().Info("Reloading configuration from the control socket")
+	return nil, d.Reload()
+}
+
+func (d *Daemon) startControl() error {
+	config := d.Configuration.Control
+	if config.Disable {
+		return nil
+	}
+	d.controlServer = control.NewServer(config.Socket, d.Configuration.Log)
+	d.controlServer.Handle("flows", d.listFlows)
+	d.controlServer.Handle("stats", d.statistics)
+	d.controlServer.Handle("expire", d.expireFlows)
+	d.controlServer.Handle("log-level", d.setLogLevel)
+	d.controlServer.Handle("reload", d.reloadFromControl)
+	return d.controlServer.Start()
+}
+
+func (d *Daemon) stopControl() {
+	if d.controlServer != nil {
+		_ = d.controlServer.Stop()
+		d.controlServer = nil
+	}
+}
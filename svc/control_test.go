@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/flow"
+	log "github.com/sirupsen/logrus"
+)
+
+// testDaemon runs the control socket of a daemon holding an empty cache
+func testDaemon(t *testing.T) (*Daemon, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ripflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.SetLevel(log.InfoLevel)
+	cache, err := flow.NewCache(16, 15, 1800, make(chan flow.Flow, 16), log.NewEntry(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "control.sock")
+	daemon := &Daemon{
+		Configuration: &configuration.MainConfiguration{Log: log.NewEntry(logger), Control: configuration.ControlConfig{Socket: socket}},
+		Cache:         cache,
+	}
+	if err := daemon.startControl(); err != nil {
+		t.Skipf("cannot listen on %s: %s", socket, err)
+	}
+	t.Cleanup(daemon.stopControl)
+	return daemon, socket
+}
+
+// captureStdout returns what run printed
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	err = run()
+	os.Stdout = stdout
+	_ = writer.Close()
+	var output bytes.Buffer
+	_, _ = io.Copy(&output, reader)
+	_ = reader.Close()
+	return output.String(), err
+}
+
+// ctlOutput runs a ctl command and returns what it printed
+func ctlOutput(t *testing.T, socket string, command string, args ...string) (string, error) {
+	t.Helper()
+	return captureStdout(t, func() error { return ctlCommand(socket, command, args) })
+}
+
+func TestCtl(t *testing.T) {
+	daemon, socket := testDaemon(t)
+	output, err := ctlOutput(t, socket, "log-level", "debug")
+	if err != nil || output != "Log level set to debug\n" {
+		t.Errorf("log-level printed %q, error %v", output, err)
+	}
+	if level := daemon.Configuration.Log.Logger.GetLevel(); level != log.DebugLevel {
+		t.Errorf("log level %s, expected debug", level)
+	}
+	if output, err := ctlOutput(t, socket, "expire"); err != nil || output != "0 flows expired\n" {
+		t.Errorf("expire printed %q, error %v", output, err)
+	}
+	if output, err := ctlOutput(t, socket, "flows"); err != nil || !strings.HasPrefix(output, "INTERFACE") || strings.Count(output, "\n") != 1 {
+		t.Errorf("flows of an empty cache printed %q, error %v", output, err)
+	}
+	// The metrics of the flow package are registered by its init
+	if output, err := ctlOutput(t, socket, "stats"); err != nil || !strings.Contains(output, "cache:\n") {
+		t.Errorf("stats printed %q, error %v", output, err)
+	}
+	for _, c := range []struct {
+		command string
+		args    []string
+		message string
+	}{
+		{"log-level", []string{"loud"}, "not a valid logrus Level"},
+		{"log-level", nil, "requires a level"},
+		{"flows", []string{"-sort", "size"}, "unknown sort order size"},
+		{"flows", []string{"-address", "192.0.2"}, "invalid address"},
+		{"flows", []string{"-port", "70000"}, "invalid port"},
+		{"restart", nil, "unknown command restart"},
+	} {
+		if _, err := ctlOutput(t, socket, c.command, c.args...); err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s %v returned %v, expected %s", c.command, c.args, err, c.message)
+		}
+	}
+}
+
+func TestComponent(t *testing.T) {
+	for name, component := range map[string]string{
+		"ripflow_cache_flows":                           "cache",
+		"ripflow_collector_unknown_template_sets_total": "collector",
+		"uptime": "uptime",
+	} {
+		if got := ctlComponent(name); got != component {
+			t.Errorf("component of %s is %s, expected %s", name, got, component)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/control"
+	"github.com/COSAE-FR/ripflow/metrics"
+	"github.com/COSAE-FR/ripflow/utils"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const ctlUsage = `Usage: %s ctl [-socket PATH] COMMAND [ARGUMENTS]
+
+Commands:
+  flows [-sort octets|packets|start|end] [-limit N] [-address IP] [-port PORT]
+        [-protocol NUMBER] [-interface NAME] [-json]
+                        list the flows of the cache
+  stats                 show the counters of each component
+  expire                export and remove every flow of the cache
+  log-level LEVEL       change the log level of the daemon
+  reload                reload the configuration file
+`
+
+// ctlFlow holds the fields of the flows command shown in a table
+type ctlFlow struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	InterfaceIndex  uint16    `json:"interface_index"`
+	SourceIP        net.IP    `json:"source_ip"`
+	DestinationIP   net.IP    `json:"destination_ip"`
+	SourcePort      uint16    `json:"source_port"`
+	DestinationPort uint16    `json:"destination_port"`
+	Protocol        uint8     `json:"protocol"`
+	Octets          uint64    `json:"octets"`
+	Packets         uint64    `json:"packets"`
+	ReverseOctets   uint64    `json:"reverse_octets"`
+	ReversePackets  uint64    `json:"reverse_packets"`
+	TunnelType      string    `json:"tunnel_type"`
+	TunnelID        uint32    `json:"tunnel_id"`
+}
+
+func ctlEndpoint(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func ctlInterfaceName(index uint16) string {
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		return iface.Name
+	}
+	return strconv.Itoa(int(index))
+}
+
+func ctlFlows(socket string, args []string) error {
+	flags := flag.NewFlagSet("flows", flag.ContinueOnError)
+	arguments := flowsArguments{}
+	flags.StringVar(&arguments.Sort, "sort", "octets", "sort order: octets, packets, start or end")
+	flags.IntVar(&arguments.Limit, "limit", 0, "maximum number of flows, 0 for every flow")
+	flags.StringVar(&arguments.Address, "address", "", "only flows from or to this address")
+	port := flags.Uint("port", 0, "only flows from or to this port")
+	protocol := flags.Uint("protocol", 0, "only flows of this IP protocol number")
+	flags.StringVar(&arguments.Interface, "interface", "", "only flows captured on this interface")
+	raw := flags.Bool("json", false, "print the flows in JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *port > 65535 || *protocol > 255 {
+		return fmt.Errorf("invalid port or protocol")
+	}
+	arguments.Port = uint16(*port)
+	arguments.Protocol = uint8(*protocol)
+	var flows []json.RawMessage
+	if err := control.Call(socket, "flows", arguments, &flows); err != nil {
+		return err
+	}
+	if *raw {
+		for _, flow := range flows {
+			fmt.Println(string(flow))
+		}
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(writer, "INTERFACE\tPROTOCOL\tSOURCE\tDESTINATION\tPACKETS\tOCTETS\tSTART\tDURATION")
+	for _, raw := range flows {
+		var flow ctlFlow
+		if err := json.Unmarshal(raw, &flow); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			ctlInterfaceName(flow.InterfaceIndex),
+			flow.Protocol,
+			ctlEndpoint(flow.SourceIP, flow.SourcePort),
+			ctlEndpoint(flow.DestinationIP, flow.DestinationPort),
+			flow.Packets+flow.ReversePackets,
+			flow.Octets+flow.ReverseOctets,
+			flow.Start.Local().Format("15:04:05"),
+			flow.End.Sub(flow.Start).Round(time.Millisecond))
+	}
+	return writer.Flush()
+}
+
+// ctlComponent returns the component of a ripflow_<component>_<name> metric
+func ctlComponent(name string) string {
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) < 3 {
+		return name
+	}
+	return parts[1]
+}
+
+func ctlStats(socket string) error {
+	var samples []metrics.Sample
+	if err := control.Call(socket, "stats", nil, &samples); err != nil {
+		return err
+	}
+	components := make(map[string][]string)
+	for _, sample := range samples {
+		labels := make([]string, 0, len(sample.Labels))
+		for key, value := range sample.Labels {
+			labels = append(labels, fmt.Sprintf("%s=%s", key, value))
+		}
+		sort.Strings(labels)
+		component := ctlComponent(sample.Name)
+		components[component] = append(components[component], fmt.Sprintf("  %s{%s}\t%s",
+			strings.TrimPrefix(sample.Name, fmt.Sprintf("%s_%s_", utils.Name, component)),
+			strings.Join(labels, ","),
+			strconv.FormatFloat(sample.Value, 'f', -1, 64)))
+	}
+	names := make([]string, 0, len(components))
+	for component := range components {
+		names = append(names, component)
+	}
+	sort.Strings(names)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, component := range names {
+		_, _ = fmt.Fprintf(writer, "%s:\n", component)
+		sort.Strings(components[component])
+		for _, line := range components[component] {
+			_, _ = fmt.Fprintln(writer, line)
+		}
+	}
+	return writer.Flush()
+}
+
+func ctlCommand(socket string, command string, args []string) error {
+	switch command {
+	case "flows":
+		return ctlFlows(socket, args)
+	case "stats":
+		return ctlStats(socket)
+	case "expire":
+		var count int
+		if err := control.Call(socket, "expire", nil, &count); err != nil {
+			return err
+		}
+		fmt.Printf("%d flows expired\n", count)
+	case "log-level":
+		if len(args) != 1 {
+			return fmt.Errorf("log-level requires a level")
+		}
+		var level string
+		if err := control.Call(socket, "log-level", logLevelArguments{Level: args[0]}, &level); err != nil {
+			return err
+		}
+		fmt.Printf("Log level set to %s\n", level)
+	case "reload":
+		if err := control.Call(socket, "reload", nil, nil); err != nil {
+			return err
+		}
+		fmt.Println("Configuration reloaded")
+	default:
+		return fmt.Errorf("unknown command %s", command)
+	}
+	return nil
+}
+
+// runCtl runs the ctl subcommand against a running daemon and returns the exit code
+func runCtl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	socket := flags.String("socket", configuration.DefaultControlSocket, "control socket of the daemon")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), ctlUsage, utils.Name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := ctlCommand(*socket, flags.Arg(0), flags.Args()[1:]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s ctl: %s\n", utils.Name, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/COSAE-FR/ripflow/bgp"
+	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/geoip"
+	"github.com/COSAE-FR/ripflow/route"
+	"time"
+)
+
+func newBGPTable(config *configuration.MainConfiguration) (*bgp.Table, error) {
+	if len(config.BGP.File) == 0 {
+		return nil, nil
+	}
+	return bgp.NewTable(config.BGP.File, config.BGP.Format, time.Duration(config.BGP.ReloadInterval)*time.Second, config.Log)
+}
+
+func newRouteTable(config *configuration.MainConfiguration) (*route.Table, error) {
+	if len(config.Routes.Source) == 0 {
+		return nil, nil
+	}
+	return route.NewTable(config.Routes.Source, config.Routes.File,
+		time.Duration(config.Routes.RefreshInterval)*time.Second, int(config.Routes.CacheSize), config.Log)
+}
+
+func newGeoIPEnricher(config *configuration.MainConfiguration) (*geoip.Enricher, error) {
+	if !config.GeoIP.Enabled() {
+		return nil, nil
+	}
+	return geoip.NewEnricher(config.GeoIP.Country, config.GeoIP.City, config.GeoIP.ASN,
+		time.Duration(config.GeoIP.ReloadInterval)*time.Second, config.Log)
+}
+
+// enrichers returns the configured enrichers in the order they are applied
+func (d *Daemon) enrichers() []flow.Enricher {
+	var enrichers []flow.Enricher
+	// The BGP prefix length replaces the routing table one when both are known
+	if d.Routes != nil {
+		enrichers = append(enrichers, d.Routes)
+	}
+	if d.BGP != nil {
+		enrichers = append(enrichers, d.BGP)
+	}
+	// GeoIP AS numbers only fill the ones missing from the BGP table
+	if d.GeoIP != nil {
+		enrichers = append(enrichers, d.GeoIP)
+	}
+	return enrichers
+}
+
+func (d *Daemon) setUpEnrichment() error {
+	var err error
+	if d.BGP, err = newBGPTable(d.Configuration); err != nil {
+		return err
+	}
+	if d.Routes, err = newRouteTable(d.Configuration); err != nil {
+		return err
+	}
+	if d.GeoIP, err = newGeoIPEnricher(d.Configuration); err != nil {
+		return err
+	}
+	d.Fanout.SetEnrichers(d.enrichers()...)
+	return nil
+}
+
+// reloadEnrichment replaces the enrichers whose configuration changed
+func (d *Daemon) reloadEnrichment(previous *configuration.MainConfiguration) {
+	config := d.Configuration
+	var stopped []interface{ Stop() error }
+	if config.BGP != previous.BGP {
+		if table, err := newBGPTable(config); err != nil {
+			config.Log.Errorf("Cannot load AS table: %s", err)
+			config.BGP = previous.BGP
+		} else {
+			if table != nil {
+				_ = table.Start()
+			}
+			if d.BGP != nil {
+				stopped = append(stopped, d.BGP)
+			}
+			d.BGP = table
+		}
+	}
+	if config.Routes != previous.Routes {
+		if table, err := newRouteTable(config); err != nil {
+			config.Log.Errorf("Cannot load routes: %s", err)
+			config.Routes = previous.Routes
+		} else {
+			if table != nil {
+				_ = table.Start()
+			}
+			if d.Routes != nil {
+				stopped = append(stopped, d.Routes)
+			}
+			d.Routes = table
+		}
+	}
+	if config.GeoIP != previous.GeoIP {
+		if enricher, err := newGeoIPEnricher(config); err != nil {
+			config.Log.Errorf("Cannot load GeoIP databases: %s", err)
+			config.GeoIP = previous.GeoIP
+		} else {
+			if enricher != nil {
+				_ = enricher.Start()
+			}
+			if d.GeoIP != nil {
+				stopped = append(stopped, d.GeoIP)
+			}
+			d.GeoIP = enricher
+		}
+	}
+	d.Fanout.SetEnrichers(d.enrichers()...)
+	for _, enricher := range stopped {
+		_ = enricher.Stop()
+	}
+}
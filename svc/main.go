@@ -1,89 +1,383 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/anonymize"
+	"github.com/COSAE-FR/ripflow/bgp"
 	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/control"
 	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/geoip"
+	"github.com/COSAE-FR/ripflow/route"
 	"github.com/COSAE-FR/ripflow/utils"
 	"github.com/COSAE-FR/riputils/common/logging"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/hlandau/easyconfig.v1"
 	"gopkg.in/hlandau/service.v2"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Daemon struct {
 	Configuration *configuration.MainConfiguration
-	Captures      []flow.PacketHandler
-	Exporter      *flow.Exporter
+	Captures      map[string]*flow.PacketHandler
+	Sinks         map[string]*flow.SinkQueue
+	Fanout        *flow.Fanout
+	SFlow         *flow.SFlowAgent
+	Collector     *flow.Collector
+	Relay         *flow.Collector
+	BGP           *bgp.Table
+	Routes        *route.Table
+	GeoIP         *geoip.Enricher
 	Cache         *flow.Cache
+	metricsServer *http.Server
+	controlServer *control.Server
+	reloadSignals chan os.Signal
+	lock          sync.Mutex
 }
 
-func (d Daemon) Start() error {
-	err := d.Exporter.Start()
+func (d *Daemon) Start() error {
+	if err := d.startMetrics(); err != nil {
+		return err
+	}
+	for _, sink := range d.Sinks {
+		if err := sink.Start(); err != nil {
+			return err
+		}
+	}
+	if d.BGP != nil {
+		if err := d.BGP.Start(); err != nil {
+			return err
+		}
+	}
+	if d.Routes != nil {
+		if err := d.Routes.Start(); err != nil {
+			return err
+		}
+	}
+	if d.GeoIP != nil {
+		if err := d.GeoIP.Start(); err != nil {
+			return err
+		}
+	}
+	err := d.Fanout.Start()
 	if err != nil {
 		return err
 	}
+	if d.Collector != nil {
+		if err := d.Collector.Start(); err != nil {
+			return err
+		}
+	}
 	err = d.Cache.Start()
 	if err != nil {
 		return err
 	}
-	for _, svr := range d.Captures {
-		svr := svr
-		err := svr.Start()
-		if err != nil {
+	if d.Relay != nil {
+		if err := d.Relay.Start(); err != nil {
 			return err
 		}
 	}
+	if d.SFlow != nil {
+		if err := d.SFlow.Start(); err != nil {
+			return err
+		}
+	}
+	if len(d.Configuration.Replay.Files) == 0 {
+		// Capture files are read one after another by Replay
+		for _, svr := range d.Captures {
+			svr := svr
+			err := svr.Start()
+			if err != nil {
+				return err
+			}
+		}
+		if err := d.startControl(); err != nil {
+			return err
+		}
+		d.watchReload()
+	}
 	return nil
 }
 
-func (d Daemon) Stop() error {
+func (d *Daemon) Stop() error {
+	d.stopWatchingReload()
+	// Control commands may be waiting for the daemon lock
+	d.stopControl()
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	for _, svr := range d.Captures {
 		_ = svr.Stop()
 	}
+	if d.SFlow != nil {
+		_ = d.SFlow.Stop()
+	}
+	if d.Relay != nil {
+		_ = d.Relay.Stop()
+	}
 	_ = d.Cache.Stop()
-	_ = d.Exporter.Stop()
+	if d.Collector != nil {
+		_ = d.Collector.Stop()
+	}
+	_ = d.Fanout.Stop()
+	if d.BGP != nil {
+		_ = d.BGP.Stop()
+	}
+	if d.Routes != nil {
+		_ = d.Routes.Stop()
+	}
+	if d.GeoIP != nil {
+		_ = d.GeoIP.Stop()
+	}
+	for _, sink := range d.Sinks {
+		_ = sink.Stop()
+	}
+	d.stopMetrics()
 	return nil
 }
 
+func newExporter(exporter configuration.ExporterConfig, logger *log.Entry) (*flow.Exporter, error) {
+	options := flow.ExportOptions{
+		Version:                 exporter.Version,
+		Transport:               exporter.Transport,
+		SourceID:                exporter.SourceID,
+		TemplateRefreshPackets:  exporter.TemplateRefreshPackets,
+		TemplateRefreshInterval: time.Duration(exporter.TemplateRefreshInterval) * time.Second,
+		Biflow:                  exporter.Biflow,
+		GeoEnterpriseNumber:     exporter.GeoEnterpriseNumber,
+		TunnelEnterpriseNumber:  exporter.TunnelEnterpriseNumber,
+		SourceAddress:           net.ParseIP(exporter.SourceAddress),
+		Format:                  exporter.Format,
+		JSONOutput: flow.JSONOutputOptions{
+			Destination:    exporter.Output,
+			MaxSize:        int64(exporter.MaxSize) * 1024 * 1024,
+			RotateInterval: time.Duration(exporter.RotateInterval) * time.Second,
+			MaxFiles:       int(exporter.MaxFiles),
+		},
+	}
+	return flow.NewExporter(exporter.Host, exporter.Port, options, logger.WithField("collector", exporter.Name))
+}
+
+func newAnonymizer(config configuration.AnonymizeConfig) (*anonymize.Anonymizer, error) {
+	options := anonymize.Options{
+		Mode:             config.Mode,
+		IPv4PrefixLength: int(config.IPv4PrefixLength),
+		IPv6PrefixLength: int(config.IPv6PrefixLength),
+		MAC:              config.MAC,
+		CacheSize:        int(config.CacheSize),
+	}
+	var err error
+	switch {
+	case len(config.KeyFile) > 0:
+		options.Key, err = anonymize.ReadKey(config.KeyFile)
+	case len(config.Key) > 0:
+		options.Key, err = hex.DecodeString(config.Key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read anonymization key: %s", err)
+	}
+	for _, scope := range config.Scope {
+		_, network, err := net.ParseCIDR(scope)
+		if err != nil {
+			return nil, err
+		}
+		options.Scope = append(options.Scope, network)
+	}
+	return anonymize.NewAnonymizer(options)
+}
+
+func newSFlowAgent(config *configuration.MainConfiguration) (*flow.SFlowAgent, error) {
+	return flow.NewSFlowAgent(config.SFlow.Host, config.SFlow.Port, flow.SFlowOptions{
+		AgentAddress:    net.ParseIP(config.SFlow.AgentAddress),
+		SubAgentID:      config.SFlow.SubAgentID,
+		HeaderSize:      config.SFlow.HeaderSize,
+		CounterInterval: time.Duration(config.SFlow.CounterInterval) * time.Second,
+	}, config.Log)
+}
+
+func newCollector(collector configuration.CollectorConfig, relay bool, output chan flow.Flow, logger *log.Entry) (*flow.Collector, error) {
+	return flow.NewCollector(flow.CollectorOptions{
+		UDPAddress:             collector.UDP,
+		TCPAddress:             collector.TCP,
+		GeoEnterpriseNumber:    collector.GeoEnterpriseNumber,
+		TunnelEnterpriseNumber: collector.TunnelEnterpriseNumber,
+		Relay:                  relay,
+	}, output, logger)
+}
+
+// exportFilter resolves the interface names of the exporter filter. The indexes are logged,
+// an interface recreated meanwhile, such as a VPN tun device, has another one.
+func exportFilter(exporter configuration.ExporterConfig, logger *log.Entry) (flow.FlowFilter, error) {
+	filter := flow.FlowFilter{
+		IPVersion: exporter.Filter.IPVersion,
+		Protocols: exporter.Filter.Protocols,
+	}
+	for _, name := range exporter.Filter.Interfaces {
+		iface, err := flow.InterfaceByName(name)
+		if err != nil {
+			return filter, err
+		}
+		logger.Infof("Exporting the flows of interface %s, index %d", name, iface.Index)
+		filter.Interfaces = append(filter.Interfaces, uint16(iface.Index))
+	}
+	return filter, nil
+}
+
+// addSink creates the sink of the exporter type and plugs it in the fanout, the replaced sink is returned
+func (d *Daemon) addSink(exporterConfig configuration.ExporterConfig) (*flow.SinkQueue, error) {
+	logger := d.Configuration.Log.WithField("collector", exporterConfig.Name)
+	filter, err := exportFilter(exporterConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	var anonymizer flow.Enricher
+	if len(exporterConfig.Anonymize.Mode) > 0 {
+		if anonymizer, err = newAnonymizer(exporterConfig.Anonymize); err != nil {
+			return nil, err
+		}
+	}
+	sink, err := flow.NewSink(exporterConfig.Format, flow.SinkConfig{
+		Name:     exporterConfig.Name,
+		MaxFlows: d.Configuration.Cache.Max,
+		Decode:   exporterConfig.Decode,
+	}, d.Configuration.Log)
+	if err != nil {
+		return nil, err
+	}
+	queue := flow.NewSinkQueue(sink, d.Configuration.Cache.Max, anonymizer, logger)
+	previous, err := d.Fanout.SetDestination(exporterConfig.Name, queue, filter, exporterConfig.SamplingRate)
+	if err != nil {
+		return nil, err
+	}
+	d.Sinks[exporterConfig.Name] = queue
+	return previous, nil
+}
+
+func (d *Daemon) newCapture(iface configuration.InterfaceConfig) (*flow.PacketHandler, error) {
+	logger := d.Configuration.Log.WithFields(log.Fields{
+		"app":       utils.Name,
+		"version":   utils.Version,
+		"component": "capture",
+		"interface": iface.Name,
+	})
+	netInterface, err := flow.InterfaceByName(iface.Name)
+	if err != nil {
+		return nil, err
+	}
+	var srv *flow.PacketHandler
+	if iface.Backend == "afpacket" {
+		srv, err = flow.NewAFPacketHandler(netInterface, int(iface.Workers), d.Cache.Input, logger)
+	} else {
+		srv, err = flow.NewHandler(netInterface, d.Cache.Input, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.SFlow != nil {
+		srv.SetSFlowAgent(d.SFlow)
+	}
+	srv.SetEngine(iface.EngineType, iface.EngineID)
+	if err = setDecapsulation(srv, iface.Decapsulation); err != nil {
+		log.Errorf("Cannot set decapsulation: %s", err)
+	}
+	if len(iface.Filter) > 0 {
+		if err = srv.SetFilter(iface.Filter); err != nil {
+			log.Errorf("Cannot set BPF filter %s: %s", iface.Filter, err)
+		}
+	}
+	if iface.SamplingRate > 1 {
+		algorithm := flow.SamplingDeterministic
+		if iface.SamplingMode == "random" {
+			algorithm = flow.SamplingRandom
+		}
+		if err = srv.SetSampling(algorithm, iface.SamplingRate); err != nil {
+			log.Errorf("Cannot set sampling rate %d: %s", iface.SamplingRate, err)
+		}
+	}
+	return srv, nil
+}
+
+// setDecapsulation makes the capture account the packets carried by the named tunnels
+func setDecapsulation(capture *flow.PacketHandler, names []string) error {
+	tunnelTypes := make([]uint8, 0, len(names))
+	for _, name := range names {
+		tunnelType, err := flow.TunnelType(name)
+		if err != nil {
+			return err
+		}
+		tunnelTypes = append(tunnelTypes, tunnelType)
+	}
+	return capture.SetDecapsulation(tunnelTypes...)
+}
+
 func New(cfg Config) (*Daemon, error) {
 	config, err := configuration.New(cfg.File)
 	if err != nil {
 		return nil, err
 	}
-	daemon := Daemon{Configuration: config}
+	daemon := Daemon{
+		Configuration: config,
+		Captures:      make(map[string]*flow.PacketHandler),
+		Sinks:         make(map[string]*flow.SinkQueue),
+		Fanout:        flow.NewFanout(config.Cache.Max, config.Log),
+	}
 
-	daemon.Exporter, err = flow.NewExporter(config.Exporter.Host, config.Exporter.Port, config.Cache.Max, config.Log)
-	if err != nil {
+	for _, exporterConfig := range config.Exporters {
+		if _, err := daemon.addSink(exporterConfig); err != nil {
+			return nil, err
+		}
+	}
+	if err := daemon.setUpEnrichment(); err != nil {
 		return nil, err
 	}
 
-	daemon.Cache, err = flow.NewCache(config.Cache.Max, config.Cache.IdleTimeout, config.Cache.ActiveTimeout, daemon.Exporter.Input, config.Log)
+	daemon.Cache, err = flow.NewCache(config.Cache.Max, config.Cache.IdleTimeout, config.Cache.ActiveTimeout, daemon.Fanout.Input, config.Log)
 	if err != nil {
 		return nil, err
 	}
+	if config.Cache.Bidirectional {
+		daemon.Cache.UseBiflows(true)
+	}
+	if len(config.SFlow.Host) > 0 {
+		daemon.SFlow, err = newSFlowAgent(config)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	for _, iface := range daemon.Configuration.Interfaces {
-		logger := daemon.Configuration.Log.WithFields(log.Fields{
-			"app":       utils.Name,
-			"version":   utils.Version,
-			"component": "capture",
-			"interface": iface.Name,
-		})
-		netInterface, err := net.InterfaceByName(iface.Name)
+	if config.Collector.Enabled() && len(cfg.Replay) == 0 {
+		// Decoded flows were aggregated by the exporter and skip the cache
+		daemon.Collector, err = newCollector(config.Collector, false, daemon.Fanout.Input, config.Log)
 		if err != nil {
-			return &daemon, err
+			return nil, err
 		}
-		srv, err := flow.NewHandler(netInterface, daemon.Cache.Input, logger)
+	}
+	if config.Relay.Enabled() && len(cfg.Replay) == 0 {
+		// Relayed flows are aggregated with the captured ones
+		daemon.Relay, err = newCollector(config.Relay, true, daemon.Cache.Input, config.Log.WithField("mode", "relay"))
 		if err != nil {
-			return &daemon, err
+			return nil, err
 		}
-		if len(iface.Filter) > 0 {
-			if err = srv.SetFilter(iface.Filter); err != nil {
-				log.Errorf("Cannot set BPF filter %s: %s", iface.Filter, err)
-			}
+	}
+
+	if len(cfg.Replay) > 0 {
+		if err := config.SetReplay(strings.Split(cfg.Replay, ","), cfg.Pacing); err != nil {
+			return nil, err
+		}
+		return &daemon, daemon.setUpReplay()
+	}
+
+	for name, iface := range daemon.Configuration.Interfaces {
+		srv, err := daemon.newCapture(iface)
+		if err != nil {
+			return &daemon, err
 		}
-		daemon.Captures = append(daemon.Captures, *srv)
+		daemon.Captures[name] = srv
 	}
 	return &daemon, nil
 }
@@ -96,6 +390,13 @@ func main() {
 		Component: "main",
 	})
 
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		os.Exit(runTop(os.Args[2:]))
+	}
+
 	cfg := Config{}
 
 	configurator := &easyconfig.Configurator{
@@ -109,6 +410,16 @@ func main() {
 	if len(cfg.File) == 0 {
 		cfg.File = defaultConfigFileLocation
 	}
+	if len(cfg.Replay) > 0 {
+		daemon, err := New(cfg)
+		if err != nil {
+			logger.Fatalf("Cannot set up replay: %v", err)
+		}
+		if err := daemon.Replay(); err != nil {
+			logger.Fatalf("Cannot replay capture files: %v", err)
+		}
+		return
+	}
 	logger.Debugf("Starting %s daemon", utils.Name)
 	service.Main(&service.Info{
 		Name:      utils.Name,
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/COSAE-FR/ripflow/metrics"
+	"net"
+	"net/http"
+)
+
+func (d *Daemon) startMetrics() error {
+	config := d.Configuration.Metrics
+	if len(config.Listen) == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, metrics.Handler(metrics.Default))
+	d.metricsServer = &http.Server{Handler: mux}
+	go func() {
+		if err := d.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			d.Configuration.Log.Errorf("Metrics server stopped: %s", err)
+		}
+	}()
+	d.Configuration.Log.Infof("Serving metrics on http://%s%s", listener.Addr(), config.Path)
+	return nil
+}
+
+func (d *Daemon) stopMetrics() {
+	if d.metricsServer != nil {
+		_ = d.metricsServer.Close()
+	}
+}
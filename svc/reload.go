@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/COSAE-FR/ripflow/configuration"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+func (d *Daemon) watchReload() {
+	d.reloadSignals = make(chan os.Signal, 1)
+	signal.Notify(d.reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range d.reloadSignals {
+			d.logger().Info("Reloading configuration")
+			if err := d.Reload(); err != nil {
+				d.logger().Errorf("Cannot reload configuration: %s", err)
+			}
+		}
+	}()
+}
+
+// logger returns the log of the current configuration
+func (d *Daemon) logger() *log.Entry {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.Configuration.Log
+}
+
+func (d *Daemon) stopWatchingReload() {
+	if d.reloadSignals != nil {
+		signal.Stop(d.reloadSignals)
+		close(d.reloadSignals)
+		d.reloadSignals = nil
+	}
+}
+
+// Reload reads the configuration file again and applies the changes to the running daemon.
+// Unchanged interfaces keep capturing and cached flows are kept.
+func (d *Daemon) Reload() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	previous := d.Configuration
+	config, err := previous.Reload()
+	if err != nil {
+		if config != nil {
+			config.CloseLog(previous)
+		}
+		return err
+	}
+	d.Configuration = config
+	previous.CloseLog(config)
+	if config.SFlow != previous.SFlow {
+		config.Log.Warn("sFlow configuration changes require a restart")
+		config.SFlow = previous.SFlow
+	}
+	if config.Collector != previous.Collector {
+		config.Log.Warn("Collector configuration changes require a restart")
+		config.Collector = previous.Collector
+	}
+	if config.Relay != previous.Relay {
+		config.Log.Warn("Relay configuration changes require a restart")
+		config.Relay = previous.Relay
+	}
+	if config.Control != previous.Control {
+		config.Log.Warn("Control socket configuration changes require a restart")
+		config.Control = previous.Control
+	}
+
+	previousExporters := make(map[string]configuration.ExporterConfig)
+	for _, exporterConfig := range previous.Exporters {
+		previousExporters[exporterConfig.Name] = exporterConfig
+	}
+	currentExporters := make(map[string]bool)
+	for _, exporterConfig := range config.Exporters {
+		currentExporters[exporterConfig.Name] = true
+		if existing, found := previousExporters[exporterConfig.Name]; found && reflect.DeepEqual(existing, exporterConfig) {
+			d.reloadFilter(exporterConfig)
+			continue
+		}
+		config.Log.Infof("Exporting to %s", exporterConfig.Name)
+		replaced, err := d.addSink(exporterConfig)
+		if err != nil {
+			config.Log.Errorf("Cannot export to %s: %s", exporterConfig.Name, err)
+			continue
+		}
+		if err := d.Sinks[exporterConfig.Name].Start(); err != nil {
+			config.Log.Errorf("Cannot export to %s: %s", exporterConfig.Name, err)
+		}
+		if replaced != nil {
+			_ = replaced.Stop()
+		}
+	}
+	for name := range previousExporters {
+		if currentExporters[name] {
+			continue
+		}
+		config.Log.Infof("Stopping export to %s", name)
+		if sink := d.Fanout.RemoveDestination(name); sink != nil {
+			_ = sink.Stop()
+		}
+		delete(d.Sinks, name)
+	}
+
+	d.reloadEnrichment(previous)
+
+	if config.Cache.IdleTimeout != previous.Cache.IdleTimeout || config.Cache.ActiveTimeout != previous.Cache.ActiveTimeout {
+		d.Cache.SetTimeouts(config.Cache.IdleTimeout, config.Cache.ActiveTimeout)
+	}
+	if config.Cache.Max != previous.Cache.Max {
+		d.Cache.Resize(config.Cache.Max)
+	}
+	if config.Cache.Bidirectional != previous.Cache.Bidirectional {
+		d.Cache.UseBiflows(config.Cache.Bidirectional)
+	}
+
+	for name, iface := range previous.Interfaces {
+		if current, found := config.Interfaces[name]; found && reflect.DeepEqual(current, iface) {
+			continue
+		}
+		if capture, running := d.Captures[name]; running {
+			config.Log.Infof("Stopping capture on %s", name)
+			_ = capture.Stop()
+			delete(d.Captures, name)
+		}
+	}
+	for name, iface := range config.Interfaces {
+		if _, running := d.Captures[name]; running {
+			continue
+		}
+		config.Log.Infof("Starting capture on %s", name)
+		capture, err := d.newCapture(iface)
+		if err != nil {
+			config.Log.Errorf("Cannot capture on %s: %s", name, err)
+			continue
+		}
+		if err := capture.Start(); err != nil {
+			config.Log.Errorf("Cannot capture on %s: %s", name, err)
+			continue
+		}
+		d.Captures[name] = capture
+	}
+
+	if config.Metrics != previous.Metrics {
+		d.stopMetrics()
+		if err := d.startMetrics(); err != nil {
+			config.Log.Errorf("Cannot start metrics server: %s", err)
+		}
+	}
+	return nil
+}
+
+// reloadFilter resolves the interfaces of an unchanged exporter filter again, they may have been recreated
+func (d *Daemon) reloadFilter(exporterConfig configuration.ExporterConfig) {
+	if len(exporterConfig.Filter.Interfaces) == 0 {
+		return
+	}
+	logger := d.Configuration.Log.WithField("collector", exporterConfig.Name)
+	filter, err := exportFilter(exporterConfig, logger)
+	if err != nil {
+		logger.Errorf("Cannot resolve the interfaces of the filter: %s", err)
+		return
+	}
+	d.Fanout.SetFilter(exporterConfig.Name, filter)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+func (d *Daemon) setUpReplay() error {
+	d.Cache.UsePacketTime()
+	realtime := d.Configuration.Replay.Pacing == "realtime"
+	for _, path := range d.Configuration.Replay.Files {
+		logger := d.Configuration.Log.WithFields(log.Fields{
+			"app":       utils.Name,
+			"version":   utils.Version,
+			"component": "replay",
+		})
+		srv, err := flow.NewFileHandler(path, realtime, d.Cache.Input, logger)
+		if err != nil {
+			return err
+		}
+		if err = setDecapsulation(srv, d.Configuration.Replay.Decapsulation); err != nil {
+			log.Errorf("Cannot set decapsulation: %s", err)
+		}
+		if d.SFlow != nil {
+			srv.SetSFlowAgent(d.SFlow)
+		}
+		if len(d.Configuration.Replay.Filter) > 0 {
+			if err = srv.SetFilter(d.Configuration.Replay.Filter); err != nil {
+				log.Errorf("Cannot set BPF filter %s: %s", d.Configuration.Replay.Filter, err)
+			}
+		}
+		d.Captures[path] = srv
+	}
+	return nil
+}
+
+// Replay reads the capture files in order, exports the resulting flows and stops the daemon
+func (d *Daemon) Replay() error {
+	if err := d.Start(); err != nil {
+		return err
+	}
+	var captures []*flow.PacketHandler
+	seen := make(map[string]bool)
+	for _, path := range d.Configuration.Replay.Files {
+		if !seen[path] {
+			captures = append(captures, d.Captures[path])
+			seen[path] = true
+		}
+	}
+	if err := flow.ReplayFiles(d.Cache, captures, nil); err != nil {
+		return err
+	}
+	return d.Stop()
+}
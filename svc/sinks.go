@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/flow"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sink types registered by third-party code are built like the netflow and json exporters,
+// from a file of this package calling flow.RegisterSink in its init function.
+func init() {
+	flow.RegisterSink("netflow", newExporterSink)
+	flow.RegisterSink("json", newExporterSink)
+}
+
+func newExporterSink(config flow.SinkConfig, logger *log.Entry) (flow.Sink, error) {
+	var exporter configuration.ExporterConfig
+	if err := config.Decode(&exporter); err != nil {
+		return nil, err
+	}
+	return newExporter(exporter, logger)
+}
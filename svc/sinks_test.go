@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/flow"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestExporterSinks(t *testing.T) {
+	types := strings.Join(flow.SinkTypes(), " ")
+	if !strings.Contains(types, "json") || !strings.Contains(types, "netflow") {
+		t.Fatalf("sink types %s, expected json and netflow", types)
+	}
+	dir, err := ioutil.TempDir("", "ripflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "flows.json")
+	exporter := configuration.ExporterConfig{Name: path, Format: "json", Output: path}
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	sink, err := flow.NewSink("json", flow.SinkConfig{Name: exporter.Name, MaxFlows: 16, Decode: exporter.Decode}, log.NewEntry(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteBatch([]flow.Flow{{}, {}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 2 {
+		t.Errorf("%d lines written by the json sink, expected 2", lines)
+	}
+}
@@ -3,5 +3,7 @@ package main
 const defaultConfigFileLocation = "/etc/ripflow/ripflow.yml"
 
 type Config struct {
-	File string `usage:"configuration file" default:"/etc/ripflow/ripflow.yml"`
+	File   string `usage:"configuration file" default:"/etc/ripflow/ripflow.yml"`
+	Replay string `usage:"replay pcap or pcapng files (comma separated) instead of capturing"`
+	Pacing string `usage:"replay pacing: fast or realtime"`
 }
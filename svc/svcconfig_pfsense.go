@@ -5,5 +5,7 @@ package main
 const defaultConfigFileLocation = "/conf/config.xml"
 
 type Config struct {
-	File string `usage:"configuration file" default:"/conf/config.xml"`
+	File   string `usage:"configuration file" default:"/conf/config.xml"`
+	Replay string `usage:"replay pcap or pcapng files (comma separated) instead of capturing"`
+	Pacing string `usage:"replay pacing: fast or realtime"`
 }
@@ -5,5 +5,7 @@ package main
 const defaultConfigFileLocation = "/usr/local/etc/ripflow/ripflow.yml"
 
 type Config struct {
-	File string `usage:"configuration file" default:"/usr/local/etc/ripflow/ripflow.yml"`
+	File   string `usage:"configuration file" default:"/usr/local/etc/ripflow/ripflow.yml"`
+	Replay string `usage:"replay pcap or pcapng files (comma separated) instead of capturing"`
+	Pacing string `usage:"replay pacing: fast or realtime"`
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/COSAE-FR/ripflow/configuration"
+	"github.com/COSAE-FR/ripflow/control"
+	"github.com/COSAE-FR/ripflow/flow"
+	"github.com/COSAE-FR/ripflow/utils"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	topMaxFlows      = 65536
+	topIdleTimeout   = 60
+	topActiveTimeout = 3600
+	topClearScreen   = "\033[H\033[2J"
+)
+
+// topSource returns the active flows shown by the top command
+type topSource interface {
+	flows() ([]ctlFlow, error)
+	name() string
+	stop()
+}
+
+// socketTopSource reads the cache of a running daemon through its control socket
+type socketTopSource struct {
+	path string
+}
+
+func (s *socketTopSource) flows() ([]ctlFlow, error) {
+	var flows []ctlFlow
+	err := control.Call(s.path, "flows", nil, &flows)
+	return flows, err
+}
+
+func (s *socketTopSource) name() string {
+	return s.path
+}
+
+func (s *socketTopSource) stop() {}
+
+// captureTopSource aggregates the packets of an interface or a capture file in its own cache
+type captureTopSource struct {
+	description string
+	cache       *flow.Cache
+	capture     *flow.PacketHandler
+	expired     chan flow.Flow
+}
+
+func newCaptureTopSource(ifaceName string, path string, filter string) (*captureTopSource, error) {
+	logger := log.New()
+	logger.SetLevel(log.ErrorLevel)
+	entry := logger.WithField("app", utils.Name)
+	source := &captureTopSource{expired: make(chan flow.Flow, topMaxFlows)}
+	var err error
+	source.cache, err = flow.NewCache(topMaxFlows, topIdleTimeout, topActiveTimeout, source.expired, entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) > 0 {
+		// The last flows of the file stay on screen once it is read
+		source.cache.UsePacketTime()
+		source.description = path
+		source.capture, err = flow.NewFileHandler(path, true, source.cache.Input, entry)
+	} else {
+		source.description = ifaceName
+		var iface *net.Interface
+		if iface, err = flow.InterfaceByName(ifaceName); err == nil {
+			source.capture, err = flow.NewHandler(iface, source.cache.Input, entry)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(filter) > 0 {
+		if err := source.capture.SetFilter(filter); err != nil {
+			return nil, fmt.Errorf("cannot set BPF filter %s: %s", filter, err)
+		}
+	}
+	go func() {
+		// Nothing is exported
+		for range source.expired {
+		}
+	}()
+	_ = source.cache.Start()
+	_ = source.capture.Start()
+	return source, nil
+}
+
+func (s *captureTopSource) flows() ([]ctlFlow, error) {
+	encoded, err := json.Marshal(s.cache.Query(flow.FlowQuery{}))
+	if err != nil {
+		return nil, err
+	}
+	var flows []ctlFlow
+	err = json.Unmarshal(encoded, &flows)
+	return flows, err
+}
+
+func (s *captureTopSource) name() string {
+	return s.description
+}
+
+func (s *captureTopSource) stop() {
+	_ = s.capture.Stop()
+	_ = s.cache.Stop()
+}
+
+// topCounter is the traffic of a flow, host or port
+type topCounter struct {
+	label   string
+	octets  uint64
+	packets uint64
+	// Rates over the last refresh interval, per second
+	octetRate  float64
+	packetRate float64
+}
+
+func (c *topCounter) add(other topCounter) {
+	c.octets += other.octets
+	c.packets += other.packets
+	c.octetRate += other.octetRate
+	c.packetRate += other.packetRate
+}
+
+type topView struct {
+	source   topSource
+	rows     int
+	packets  bool
+	previous map[string]topCounter
+	lastRead time.Time
+}
+
+func topFlowKey(f ctlFlow) string {
+	// Decapsulated flows of different tenants may share their addresses
+	return fmt.Sprintf("%d %s %d %d %s %s", f.InterfaceIndex, f.TunnelType, f.TunnelID, f.Protocol,
+		ctlEndpoint(f.SourceIP, f.SourcePort), ctlEndpoint(f.DestinationIP, f.DestinationPort))
+}
+
+// topServicePort returns the lower port of a flow, usually the service one
+func topServicePort(f ctlFlow) uint16 {
+	if f.SourcePort != 0 && (f.DestinationPort == 0 || f.SourcePort < f.DestinationPort) {
+		return f.SourcePort
+	}
+	return f.DestinationPort
+}
+
+// counters computes the traffic of each flow, flows seen for the first time are averaged over their duration
+func (v *topView) counters(flows []ctlFlow, now time.Time) map[string]topCounter {
+	current := make(map[string]topCounter, len(flows))
+	for _, f := range flows {
+		counter := topCounter{
+			label:   fmt.Sprintf("%s %s -> %s", ctlInterfaceName(f.InterfaceIndex), ctlEndpoint(f.SourceIP, f.SourcePort), ctlEndpoint(f.DestinationIP, f.DestinationPort)),
+			octets:  f.Octets + f.ReverseOctets,
+			packets: f.Packets + f.ReversePackets,
+		}
+		key := topFlowKey(f)
+		elapsed := now.Sub(v.lastRead).Seconds()
+		previous, found := v.previous[key]
+		if !found || previous.octets > counter.octets {
+			// New flow, or a flow restarted after its active timeout
+			previous, elapsed = topCounter{}, f.End.Sub(f.Start).Seconds()
+		}
+		if elapsed < 1 {
+			elapsed = 1
+		}
+		counter.octetRate = float64(counter.octets-previous.octets) / elapsed
+		counter.packetRate = float64(counter.packets-previous.packets) / elapsed
+		current[key] = counter
+	}
+	return current
+}
+
+func (v *topView) top(counters map[string]topCounter) []topCounter {
+	sorted := make([]topCounter, 0, len(counters))
+	for _, counter := range counters {
+		sorted = append(sorted, counter)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if v.packets {
+			if sorted[i].packetRate != sorted[j].packetRate {
+				return sorted[i].packetRate > sorted[j].packetRate
+			}
+			return sorted[i].packets > sorted[j].packets
+		}
+		if sorted[i].octetRate != sorted[j].octetRate {
+			return sorted[i].octetRate > sorted[j].octetRate
+		}
+		return sorted[i].octets > sorted[j].octets
+	})
+	if len(sorted) > v.rows {
+		sorted = sorted[:v.rows]
+	}
+	return sorted
+}
+
+func topUnits(value float64, base float64, units []string) string {
+	unit := 0
+	for value >= base && unit < len(units)-1 {
+		value /= base
+		unit++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+func topBitRate(octetRate float64) string {
+	return topUnits(8*octetRate, 1000, []string{"b", "Kb", "Mb", "Gb", "Tb"})
+}
+
+func topBytes(octets uint64) string {
+	return topUnits(float64(octets), 1024, []string{"B", "KB", "MB", "GB", "TB"})
+}
+
+func (v *topView) writeTable(writer *tabwriter.Writer, title string, counters []topCounter) {
+	_, _ = fmt.Fprintf(writer, "%s\tRATE\tPKT/S\tTOTAL\tPACKETS\n", title)
+	for _, counter := range counters {
+		_, _ = fmt.Fprintf(writer, "%s\t%s\t%.1f\t%s\t%d\n", counter.label, topBitRate(counter.octetRate),
+			counter.packetRate, topBytes(counter.octets), counter.packets)
+	}
+	_, _ = fmt.Fprintln(writer, "\t\t\t\t")
+}
+
+// refresh reads the active flows and draws the flows, hosts and ports tables
+func (v *topView) refresh() error {
+	flows, err := v.source.flows()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	current := v.counters(flows, now)
+	v.previous, v.lastRead = current, now
+
+	hosts := make(map[string]topCounter)
+	ports := make(map[string]topCounter)
+	var total topCounter
+	for _, f := range flows {
+		counter := current[topFlowKey(f)]
+		total.add(counter)
+		for _, ip := range []net.IP{f.SourceIP, f.DestinationIP} {
+			host := hosts[ip.String()]
+			host.label = ip.String()
+			host.add(counter)
+			hosts[host.label] = host
+		}
+		label := fmt.Sprintf("%s/%d", topProtocolName(f.Protocol), topServicePort(f))
+		port := ports[label]
+		port.label = label
+		port.add(counter)
+		ports[label] = port
+	}
+
+	var screen strings.Builder
+	screen.WriteString(topClearScreen)
+	_, _ = fmt.Fprintf(&screen, "%s top - %s - %s - %d flows - %s %.1f pkt/s\n\n", utils.Name, v.source.name(),
+		now.Format("15:04:05"), len(flows), topBitRate(total.octetRate), total.packetRate)
+	writer := tabwriter.NewWriter(&screen, 0, 8, 2, ' ', 0)
+	v.writeTable(writer, "FLOW", v.top(current))
+	v.writeTable(writer, "HOST", v.top(hosts))
+	v.writeTable(writer, "PORT", v.top(ports))
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	_, err = os.Stdout.WriteString(screen.String())
+	return err
+}
+
+func topProtocolName(protocol uint8) string {
+	switch protocol {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	case syscall.IPPROTO_ICMP:
+		return "icmp"
+	case syscall.IPPROTO_ICMPV6:
+		return "icmp6"
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// runTop shows the heaviest active flows, hosts and ports until interrupted and returns the exit code
+func runTop(args []string) int {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	socket := flags.String("socket", configuration.DefaultControlSocket, "control socket of the daemon")
+	ifaceName := flags.String("interface", "", "capture this interface instead of attaching to the daemon")
+	path := flags.String("file", "", "read this pcap or pcapng file instead of attaching to the daemon")
+	filter := flags.String("filter", "", "BPF filter of the interface or file capture")
+	interval := flags.Duration("interval", 2*time.Second, "refresh interval")
+	rows := flags.Int("n", 10, "rows of each table")
+	sortBy := flags.String("sort", "octets", "sort order: octets or packets")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*sortBy != "octets" && *sortBy != "packets") || *rows < 1 || *interval <= 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	if len(*ifaceName) > 0 && len(*path) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "%s top: -interface and -file are exclusive\n", utils.Name)
+		return 2
+	}
+
+	var source topSource = &socketTopSource{path: *socket}
+	if len(*ifaceName) > 0 || len(*path) > 0 {
+		capture, err := newCaptureTopSource(*ifaceName, *path, *filter)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s top: %s\n", utils.Name, err)
+			return 1
+		}
+		source = capture
+	}
+	defer source.stop()
+
+	view := &topView{source: source, rows: *rows, packets: *sortBy == "packets"}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := view.refresh(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s top: %s\n", utils.Name, err)
+			return 1
+		}
+		select {
+		case <-signals:
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
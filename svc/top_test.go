@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTopSource returns the flows set by the test
+type testTopSource struct {
+	current []ctlFlow
+}
+
+func (s *testTopSource) flows() ([]ctlFlow, error) {
+	return s.current, nil
+}
+
+func (s *testTopSource) name() string {
+	return "test"
+}
+
+func (s *testTopSource) stop() {}
+
+func testTopFlow(source string, sourcePort uint16, destination string, destinationPort uint16, octets uint64, duration time.Duration) ctlFlow {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	return ctlFlow{
+		Start:           start,
+		End:             start.Add(duration),
+		SourceIP:        net.ParseIP(source),
+		DestinationIP:   net.ParseIP(destination),
+		SourcePort:      sourcePort,
+		DestinationPort: destinationPort,
+		Protocol:        6,
+		Octets:          octets,
+		Packets:         octets / 1000,
+	}
+}
+
+func TestTopCounters(t *testing.T) {
+	view := &topView{rows: 10}
+	now := time.Now()
+	web := testTopFlow("192.0.2.1", 40000, "198.51.100.2", 443, 10000, 10*time.Second)
+	short := testTopFlow("192.0.2.1", 40001, "198.51.100.2", 443, 500, 0)
+	// New flows are averaged over their duration, at least a second
+	current := view.counters([]ctlFlow{web, short}, now)
+	if rate := current[topFlowKey(web)].octetRate; rate != 1000 {
+		t.Errorf("new flow rate %.1f B/s, expected 1000", rate)
+	}
+	if rate := current[topFlowKey(short)].octetRate; rate != 500 {
+		t.Errorf("new flow of one packet rate %.1f B/s, expected 500", rate)
+	}
+	view.previous, view.lastRead = current, now
+
+	// Known flows are measured over the refresh interval
+	web.Octets += 4000
+	current = view.counters([]ctlFlow{web}, now.Add(2*time.Second))
+	if rate := current[topFlowKey(web)].octetRate; rate != 2000 {
+		t.Errorf("rate %.1f B/s over the interval, expected 2000", rate)
+	}
+	view.previous, view.lastRead = current, now.Add(2*time.Second)
+
+	// A flow restarted after its active timeout counts less than before
+	web.Octets, web.End = 3000, web.Start.Add(3*time.Second)
+	current = view.counters([]ctlFlow{web}, now.Add(4*time.Second))
+	if rate := current[topFlowKey(web)].octetRate; rate != 1000 {
+		t.Errorf("restarted flow rate %.1f B/s, expected 1000", rate)
+	}
+
+	// Tenants of different tunnels are different flows
+	tenant := web
+	tenant.TunnelType, tenant.TunnelID = "vxlan", 42
+	if topFlowKey(tenant) == topFlowKey(web) {
+		t.Error("flows of different tunnels share their key")
+	}
+}
+
+func TestTopOrder(t *testing.T) {
+	counters := map[string]topCounter{
+		"a": {label: "a", octets: 100, packets: 50, octetRate: 10, packetRate: 5},
+		"b": {label: "b", octets: 900, packets: 1, octetRate: 90, packetRate: 0.1},
+		"c": {label: "c", octets: 500, packets: 60, octetRate: 10, packetRate: 6},
+	}
+	for _, c := range []struct {
+		packets bool
+		rows    int
+		labels  string
+	}{
+		{false, 10, "b c a"},
+		{true, 10, "c a b"},
+		{false, 2, "b c"},
+	} {
+		view := &topView{rows: c.rows, packets: c.packets}
+		var labels []string
+		for _, counter := range view.top(counters) {
+			labels = append(labels, counter.label)
+		}
+		if strings.Join(labels, " ") != c.labels {
+			t.Errorf("sorted by packets %t on %d rows: %v, expected %s", c.packets, c.rows, labels, c.labels)
+		}
+	}
+}
+
+func TestTopFormat(t *testing.T) {
+	for value, expected := range map[string]string{
+		topBitRate(100):      "800.0b",
+		topBitRate(125000):   "1.0Mb",
+		topBitRate(1.25e12):  "10.0Tb",
+		topBytes(1023):       "1023.0B",
+		topBytes(1536):       "1.5KB",
+		topBytes(3 << 30):    "3.0GB",
+		topProtocolName(17):  "udp",
+		topProtocolName(58):  "icmp6",
+		topProtocolName(132): "132",
+	} {
+		if value != expected {
+			t.Errorf("formatted as %s, expected %s", value, expected)
+		}
+	}
+	for _, c := range []struct {
+		source      uint16
+		destination uint16
+		service     uint16
+	}{
+		{40000, 443, 443},
+		{53, 5353, 53},
+		{0, 0, 0},
+		{0, 8, 8},
+	} {
+		f := ctlFlow{SourcePort: c.source, DestinationPort: c.destination}
+		if service := topServicePort(f); service != c.service {
+			t.Errorf("service port of %d -> %d is %d, expected %d", c.source, c.destination, service, c.service)
+		}
+	}
+}
+
+func TestTopRefresh(t *testing.T) {
+	source := &testTopSource{current: []ctlFlow{
+		testTopFlow("192.0.2.1", 40000, "198.51.100.2", 443, 10000, 10*time.Second),
+		testTopFlow("192.0.2.3", 40001, "198.51.100.2", 443, 5000, 10*time.Second),
+	}}
+	view := &topView{source: source, rows: 10}
+	output, err := captureStdout(t, view.refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output, topClearScreen+"ripflow top - test - ") || !strings.Contains(output, " - 2 flows - 12.0Kb 1.5 pkt/s") {
+		t.Errorf("unexpected header in %q", output)
+	}
+	// The destination host and the service port sum both flows
+	for _, line := range []string{`\n198\.51\.100\.2 +12\.0Kb `, `\ntcp/443 +12\.0Kb `, `\n192\.0\.2\.3 +4\.0Kb `} {
+		if !regexp.MustCompile(line).MatchString(output) {
+			t.Errorf("%s not found in\n%s", line, output)
+		}
+	}
+}
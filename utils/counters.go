@@ -0,0 +1,17 @@
+package utils
+
+// InterfaceCounters are the interface statistics reported in sFlow counter samples
+type InterfaceCounters struct {
+	Speed              uint64 // bits per second, 0 if unknown
+	Up                 bool
+	Promiscuous        bool
+	InOctets           uint64
+	InPackets          uint64
+	InMulticastPackets uint64
+	InDiscards         uint64
+	InErrors           uint64
+	OutOctets          uint64
+	OutPackets         uint64
+	OutDiscards        uint64
+	OutErrors          uint64
+}
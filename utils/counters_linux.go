@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	sysClassNet   = "/sys/class/net"
+	promiscFlag   = 0x100 // IFF_PROMISC
+	megabitPerSec = 1000000
+)
+
+func readSysValue(name string, path ...string) (uint64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(append([]string{sysClassNet, name}, path...)...))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 0, 64)
+}
+
+// ReadInterfaceCounters reads the interface statistics from sysfs
+func ReadInterfaceCounters(iface net.Interface) (InterfaceCounters, error) {
+	counters := InterfaceCounters{
+		Up: iface.Flags&net.FlagUp != 0,
+	}
+	statistics := []struct {
+		file  string
+		value *uint64
+	}{
+		{"rx_bytes", &counters.InOctets},
+		{"rx_packets", &counters.InPackets},
+		{"multicast", &counters.InMulticastPackets},
+		{"rx_dropped", &counters.InDiscards},
+		{"rx_errors", &counters.InErrors},
+		{"tx_bytes", &counters.OutOctets},
+		{"tx_packets", &counters.OutPackets},
+		{"tx_dropped", &counters.OutDiscards},
+		{"tx_errors", &counters.OutErrors},
+	}
+	for _, statistic := range statistics {
+		value, err := readSysValue(iface.Name, "statistics", statistic.file)
+		if err != nil {
+			return counters, err
+		}
+		*statistic.value = value
+	}
+	// Virtual interfaces have no speed
+	if speed, err := readSysValue(iface.Name, "speed"); err == nil {
+		counters.Speed = speed * megabitPerSec
+	}
+	if flags, err := readSysValue(iface.Name, "flags"); err == nil {
+		counters.Promiscuous = flags&promiscFlag != 0
+	}
+	return counters, nil
+}
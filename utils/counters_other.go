@@ -0,0 +1,12 @@
+// +build !linux
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+func ReadInterfaceCounters(iface net.Interface) (InterfaceCounters, error) {
+	return InterfaceCounters{}, errors.New("not implemented")
+}
@@ -14,3 +14,8 @@ func NetInterfaceDown(iface net.Interface) error {
 	cmd := exec.Command("ip", "link", "set", iface.Name, "down")
 	return cmd.Run()
 }
+
+// InterfaceHardwareType reads the ARPHRD type of the interface from sysfs
+func InterfaceHardwareType(iface net.Interface) (uint64, error) {
+	return readSysValue(iface.Name, "type")
+}